@@ -0,0 +1,166 @@
+package officeradar
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	DOC_TYPE_ABSENCE_ALERT = "absence_alert"
+)
+
+// A scheduled alert triggered if any of the users hasn't been seen at any of
+// the beacons by a deadline.  It is evaluated when the deadline passes rather
+// than when geofence events arrive.
+// Eg, "Tell me if Traun hasn't arrived at the SF beacon by 10:30 on weekdays"
+type AbsenceAlert struct {
+	BaseAlert
+	Users         []OfficeRadarProfile // users who are expected to arrive
+	Beacons       []Beacon             // arriving at any of these beacons counts
+	Deadline      string               // time of day in 24h format, eg, "10:30"
+	Weekdays      []time.Weekday       // days on which to check, empty means every day
+	TimeZone      string               // eg, "America/Los_Angeles", empty means UTC
+	FirstSeenFunc FirstSeenFunc        `json:"-"` // determine when first seen user at beacon on the day
+	Timers        *TimerScheduler      `json:"-"` // used to schedule the deadlines
+}
+
+func NewAbsenceAlert() *AbsenceAlert {
+	alert := &AbsenceAlert{}
+	alert.Type = DOC_TYPE_ABSENCE_ALERT
+	return alert
+}
+
+// Absence alerts don't react to events, the presence history is consulted
+// when the deadline passes.
+func (a *AbsenceAlert) Process(e GeofenceEvent) (bool, error) {
+	return false, nil
+}
+
+// Fires if any of the users wasn't seen at any of the beacons between the
+// start of the day of the deadline and the deadline.  Also schedules the next
+// deadline.
+func (a *AbsenceAlert) ProcessTimer(timer AlertTimer) (bool, error) {
+
+	if a.FirstSeenFunc == nil {
+		Log.Panic("no FirstSeenFunc defined.")
+	}
+
+	if timer.AlertId != a.Id {
+		return false, fmt.Errorf("Timer %v does not belong to alert %v", timer.Id, a.Id)
+	}
+
+	location, err := a.location()
+	if err != nil {
+		return false, err
+	}
+	deadline := timer.FireAt.In(location)
+	startOfDay := time.Date(deadline.Year(), deadline.Month(), deadline.Day(), 0, 0, 0, 0, location)
+
+	for _, user := range a.Users {
+		if !a.seenBetween(user.Id, startOfDay, deadline) {
+			Log.Debug("Not seen by deadline", LogFields{"alert": a.Id, "profile": user.Id, "deadline": deadline})
+			return true, nil
+		}
+	}
+	return false, nil
+
+}
+
+// Arriving after the deadline doesn't count, even if the timer fires late
+func (a *AbsenceAlert) seenBetween(profileId string, since, deadline time.Time) bool {
+	for _, beacon := range a.Beacons {
+		haveSeen, firstSeenAt := a.FirstSeenFunc(profileId, beacon.Id, since)
+		if haveSeen && !firstSeenAt.After(deadline) {
+			return true
+		}
+	}
+	return false
+}
+
+// Schedule a timer for the first deadline after the given time
+func (a *AbsenceAlert) ScheduleNext(after time.Time) error {
+
+	if a.Timers == nil {
+		Log.Panic("no Timers defined.")
+	}
+
+	deadline, err := a.NextDeadline(after)
+	if err != nil {
+		return err
+	}
+	return a.Timers.Schedule(NewAlertTimer(a.Id, "", "", deadline))
+
+}
+
+// The first deadline strictly after the given time
+func (a *AbsenceAlert) NextDeadline(after time.Time) (time.Time, error) {
+
+	location, err := a.location()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	timeOfDay, err := time.Parse("15:04", a.Deadline)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid deadline %q, expected eg, 10:30: %v", a.Deadline, err)
+	}
+
+	day := after.In(location)
+	for i := 0; i < 8; i++ {
+		deadline := time.Date(day.Year(), day.Month(), day.Day()+i, timeOfDay.Hour(), timeOfDay.Minute(), 0, 0, location)
+		if deadline.After(after) && a.checksOn(deadline.Weekday()) {
+			return deadline, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("No deadline found after %v", after)
+
+}
+
+func (a *AbsenceAlert) checksOn(weekday time.Weekday) bool {
+	if len(a.Weekdays) == 0 {
+		return true
+	}
+	for _, checkedWeekday := range a.Weekdays {
+		if checkedWeekday == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *AbsenceAlert) location() (*time.Location, error) {
+	if a.TimeZone == "" {
+		return time.UTC, nil
+	}
+	location, err := time.LoadLocation(a.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid time zone %q: %v", a.TimeZone, err)
+	}
+	return location, nil
+}
+
+func (a *AbsenceAlert) BeaconIds() []string {
+	return beaconIds(a.Beacons)
+}
+
+func (a *AbsenceAlert) ProfileIds() []string {
+	return profileIds(a.Users)
+}
+
+func (a *AbsenceAlert) RescheduleOrDelete(firedAt time.Time) error {
+
+	// if it's sticky, then update the alert's activeOn time
+	if a.Sticky {
+		a.ActiveOn = firedAt.Add(a.ReactivateAfter)
+		rev, err := a.database.Edit(a)
+		if err == nil {
+			a.Revision = rev
+		}
+		return err
+	}
+
+	// otherwise, delete the alert
+	err := a.database.Delete(a.Id, a.Revision)
+	return err
+
+}
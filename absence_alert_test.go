@@ -0,0 +1,161 @@
+package officeradar
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestAbsenceAlertNextDeadline(t *testing.T) {
+
+	alert := NewAbsenceAlert()
+	alert.Deadline = "10:30"
+	alert.Weekdays = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+	alert.TimeZone = "America/Los_Angeles"
+
+	location, err := time.LoadLocation(alert.TimeZone)
+	assert.True(t, err == nil)
+
+	// friday morning before the deadline
+	friday := time.Date(2014, 9, 5, 8, 0, 0, 0, location)
+	deadline, err := alert.NextDeadline(friday)
+	assert.True(t, err == nil)
+	assert.True(t, deadline.Equal(time.Date(2014, 9, 5, 10, 30, 0, 0, location)))
+
+	// at the deadline, the next one is after the weekend
+	deadline, err = alert.NextDeadline(deadline)
+	assert.True(t, err == nil)
+	assert.True(t, deadline.Equal(time.Date(2014, 9, 8, 10, 30, 0, 0, location)))
+
+	alert.Deadline = "half past ten"
+	_, err = alert.NextDeadline(friday)
+	assert.True(t, err != nil)
+
+}
+
+func TestAbsenceAlertProcessTimer(t *testing.T) {
+
+	timers := NewTimerScheduler(newMemoryTimerStore())
+	presence := NewPresenceHistory(SystemClock)
+
+	alert := NewAbsenceAlert()
+	alert.Id = "absence_alert_1"
+	alert.Deadline = "10:30"
+	alert.FirstSeenFunc = presence.FirstSeenSince
+	alert.Timers = timers
+
+	traun := OfficeRadarProfile{OfficeRadarDoc: OfficeRadarDoc{Id: "traun"}}
+	alert.Users = []OfficeRadarProfile{traun}
+	sf := Beacon{OfficeRadarDoc: OfficeRadarDoc{Id: "sf_beacon"}}
+	alert.Beacons = []Beacon{sf}
+
+	monday := time.Date(2014, 9, 8, 7, 0, 0, 0, time.UTC)
+	assert.True(t, alert.ScheduleNext(monday) == nil)
+	due := timers.Due(monday.Add(4 * time.Hour))
+	assert.Equals(t, len(due), 1)
+	assert.True(t, due[0].FireAt.Equal(time.Date(2014, 9, 8, 10, 30, 0, 0, time.UTC)))
+
+	// seen on friday, but not yet today, so the alert fires
+	presence.Record(GeofenceEvent{
+		Action:    ACTION_ENTRY,
+		BeaconId:  sf.Id,
+		ProfileId: traun.Id,
+		CreatedAt: monday.Add(-72 * time.Hour).Format(time.RFC3339),
+	})
+	fired, err := alert.ProcessTimer(due[0])
+	assert.True(t, err == nil)
+	assert.True(t, fired)
+
+	// arrived at 9:15, so the alert doesn't fire
+	presence.Record(GeofenceEvent{
+		Action:    ACTION_ENTRY,
+		BeaconId:  sf.Id,
+		ProfileId: traun.Id,
+		CreatedAt: monday.Add(135 * time.Minute).Format(time.RFC3339),
+	})
+	fired, err = alert.ProcessTimer(due[0])
+	assert.True(t, err == nil)
+	assert.False(t, fired)
+
+}
+
+func TestAbsenceAlertLateArrivalFires(t *testing.T) {
+
+	timers := NewTimerScheduler(newMemoryTimerStore())
+	presence := NewPresenceHistory(SystemClock)
+
+	alert := NewAbsenceAlert()
+	alert.Id = "absence_alert_1"
+	alert.Deadline = "10:30"
+	alert.FirstSeenFunc = presence.FirstSeenSince
+	alert.Timers = timers
+
+	traun := OfficeRadarProfile{OfficeRadarDoc: OfficeRadarDoc{Id: "traun"}}
+	alert.Users = []OfficeRadarProfile{traun}
+	sf := Beacon{OfficeRadarDoc: OfficeRadarDoc{Id: "sf_beacon"}}
+	alert.Beacons = []Beacon{sf}
+
+	deadline := time.Date(2014, 9, 8, 10, 30, 0, 0, time.UTC)
+	timer := NewAlertTimer(alert.Id, "", "", deadline)
+
+	// arrived at 11:00, and the timer only fired after that
+	presence.Record(GeofenceEvent{
+		Action:    ACTION_ENTRY,
+		BeaconId:  sf.Id,
+		ProfileId: traun.Id,
+		CreatedAt: deadline.Add(30 * time.Minute).Format(time.RFC3339),
+	})
+	fired, err := alert.ProcessTimer(*timer)
+	assert.True(t, err == nil)
+	assert.True(t, fired)
+
+	// but an entry at 9:15 that only showed up later still counts
+	presence.Record(GeofenceEvent{
+		Action:    ACTION_ENTRY,
+		BeaconId:  sf.Id,
+		ProfileId: traun.Id,
+		CreatedAt: deadline.Add(-75 * time.Minute).Format(time.RFC3339),
+	})
+	fired, err = alert.ProcessTimer(*timer)
+	assert.True(t, err == nil)
+	assert.False(t, fired)
+
+}
+
+func TestAbsenceAlertMissedDeadlineStillFires(t *testing.T) {
+
+	api, notifier := newTestAdminAPI()
+	app := api.App
+	now := app.Clock.Now()
+
+	alert := NewAbsenceAlert()
+	alert.Id = "absence_alert"
+	alert.Deadline = "10:30"
+	alert.Sticky = true
+	alert.Users = []OfficeRadarProfile{{OfficeRadarDoc: OfficeRadarDoc{Id: "jensId"}}}
+	alert.Beacons = []Beacon{{OfficeRadarDoc: OfficeRadarDoc{Id: "sfBeaconId"}}}
+	alert.Actions = []AlertAction{{Recipient: "traunsId", Message: "Jens didn't make it in"}}
+	alert.FirstSeenFunc = app.Presence.FirstSeenSince
+	alert.Timers = app.Timers
+	alert.SetClock(app.Clock)
+	app.AlertIndex.Upsert(alert)
+
+	// yesterday's deadline passed while the app server was down
+	missed := time.Date(2014, 9, 1, 10, 30, 0, 0, time.UTC)
+	app.Timers.Restore(NewAlertTimer(alert.Id, "", "", missed))
+	app.scheduleAlerts()
+
+	due := app.Timers.Due(now)
+	assert.Equals(t, len(due), 1)
+	assert.True(t, due[0].FireAt.Equal(missed))
+	app.fireTimer(context.Background(), due[0], "")
+	assert.Equals(t, len(notifier.Notifications()), 1)
+
+	// and then today's deadline is scheduled
+	assert.Equals(t, len(app.Timers.Due(now)), 0)
+	due = app.Timers.Due(time.Date(2014, 9, 2, 10, 30, 0, 0, time.UTC))
+	assert.Equals(t, len(due), 1)
+
+}
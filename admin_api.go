@@ -0,0 +1,480 @@
+package officeradar
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// An HTTP API for managing alerts of every type, so that they don't have to
+// be written into sync gateway by hand.  Every request must have an
+// "Authorization: Bearer <token>" header.
+//
+//	GET    /alerts               list the alerts
+//	POST   /alerts               create an alert
+//	POST   /alerts/preview       how often an alert would have fired, see AlertPreviewRequest
+//	GET    /alerts/{id}          get an alert
+//	PUT    /alerts/{id}          update an alert
+//	DELETE /alerts/{id}          delete an alert, along with its timers and firings
+//	POST   /alerts/{id}/pause    stop the alert from firing until it's resumed
+//	POST   /alerts/{id}/resume
+//	POST   /alerts/{id}/fire     perform the alert's actions now
+//	GET    /alerts/{id}/firings  the times the alert fired, oldest first
+//
+// Alerts are saved to the database and also updated in the app's alert index
+// straight away, rather than waiting for the change to come through the
+// changes feed.
+type AdminAPI struct {
+	App   *OfficeRadarApp
+	Store FixtureStore // where the alert docs are saved
+	Token string       // if empty, every request is refused
+}
+
+func NewAdminAPI(app *OfficeRadarApp, token string) *AdminAPI {
+	return &AdminAPI{
+		App:   app,
+		Store: NewCouchFixtureStore(app.Database),
+		Token: token,
+	}
+}
+
+// An error along with the http status it should be returned with
+type apiError struct {
+	status   int
+	message  string
+	problems []string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func newApiError(status int, format string, args ...interface{}) *apiError {
+	return &apiError{status: status, message: fmt.Sprintf(format, args...)}
+}
+
+func (api *AdminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	Log.Debug("Admin api request", LogFields{"method": r.Method, "path": r.URL.Path})
+
+	if !api.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="officeradar"`)
+		writeApiError(w, newApiError(http.StatusUnauthorized, "Unauthorized"))
+		return
+	}
+
+	status, result, apiErr := api.route(r)
+	if apiErr != nil {
+		writeApiError(w, apiErr)
+		return
+	}
+	writeJson(w, status, result)
+
+}
+
+// Make a request without going through http or its authorization, eg, from
+// the command line.  Returns the status and result that would be sent back.
+func (api *AdminAPI) Call(ctx context.Context, method, path string, body io.Reader) (int, interface{}, error) {
+
+	r, err := http.NewRequestWithContext(ctx, method, path, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	status, result, apiErr := api.route(r)
+	if apiErr != nil {
+		if len(apiErr.problems) > 0 {
+			return apiErr.status, nil, fmt.Errorf("%v:\n  %v", apiErr.message, strings.Join(apiErr.problems, "\n  "))
+		}
+		return apiErr.status, nil, apiErr
+	}
+	return status, result, nil
+
+}
+
+func (api *AdminAPI) authorized(r *http.Request) bool {
+	if api.Token == "" {
+		return false
+	}
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(api.Token)) == 1
+}
+
+func (api *AdminAPI) route(r *http.Request) (int, interface{}, *apiError) {
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "alerts" || len(parts) > 3 {
+		return 0, nil, newApiError(http.StatusNotFound, "Not found: %v", r.URL.Path)
+	}
+
+	var route string
+	switch len(parts) {
+	case 1:
+		route = r.Method + " /alerts"
+	case 2:
+		route = r.Method + " /alerts/{id}"
+		if parts[1] == "preview" {
+			route = r.Method + " /alerts/preview"
+		}
+	case 3:
+		route = r.Method + " /alerts/{id}/" + parts[2]
+	}
+
+	switch route {
+	case "GET /alerts":
+		return api.listAlerts()
+	case "POST /alerts":
+		return api.createAlert(r)
+	case "POST /alerts/preview":
+		return api.previewAlert(r)
+	}
+
+	alertId := parts[1]
+	switch route {
+	case "GET /alerts/{id}":
+		return api.getAlert(alertId)
+	case "PUT /alerts/{id}":
+		return api.updateAlert(alertId, r)
+	case "DELETE /alerts/{id}":
+		return api.deleteAlert(alertId)
+	case "POST /alerts/{id}/pause":
+		return api.setPaused(alertId, true)
+	case "POST /alerts/{id}/resume":
+		return api.setPaused(alertId, false)
+	case "POST /alerts/{id}/fire":
+		return api.fireAlert(r.Context(), alertId)
+	case "GET /alerts/{id}/firings":
+		return api.alertFirings(alertId)
+	}
+
+	return 0, nil, newApiError(http.StatusMethodNotAllowed, "Not allowed: %v %v", r.Method, r.URL.Path)
+
+}
+
+// The alerts in the index, sorted by id
+func (api *AdminAPI) listAlerts() (int, interface{}, *apiError) {
+
+	alerts := api.App.AlertIndex.All()
+	sort.Sort(alertersById(alerts))
+
+	docs := []json.RawMessage{}
+	for _, alert := range alerts {
+		alert.lock()
+		alertJson, err := json.Marshal(alert)
+		alert.unlock()
+		if err != nil {
+			return 0, nil, newApiError(http.StatusInternalServerError, "Unable to encode alert %v: %v", alert.AlertId(), err)
+		}
+		docs = append(docs, alertJson)
+	}
+	return http.StatusOK, map[string]interface{}{"alerts": docs}, nil
+
+}
+
+func (api *AdminAPI) createAlert(r *http.Request) (int, interface{}, *apiError) {
+
+	doc, apiErr := readAlertDoc(r)
+	if apiErr != nil {
+		return 0, nil, apiErr
+	}
+	if doc.Id() == "" {
+		doc["_id"] = newAlertId()
+	}
+	delete(doc, "_rev")
+
+	_, exists, err := api.Store.Get(doc.Id())
+	if err != nil {
+		return 0, nil, newApiError(http.StatusBadGateway, "Unable to get %v: %v", doc.Id(), err)
+	}
+	if exists {
+		return 0, nil, newApiError(http.StatusConflict, "Alert %v already exists", doc.Id())
+	}
+
+	return api.saveAlert(doc, http.StatusCreated)
+
+}
+
+// The body of a preview request.  The alert doesn't need to have been saved.
+type AlertPreviewRequest struct {
+	Alert json.RawMessage `json:"alert"`
+	Since time.Time       `json:"since"`
+	Until time.Time       `json:"until"` // defaults to now
+}
+
+// Dry-run the alert against the stored geofence events, see PreviewAlert
+func (api *AdminAPI) previewAlert(r *http.Request) (int, interface{}, *apiError) {
+
+	request := AlertPreviewRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return 0, nil, newApiError(http.StatusBadRequest, "Invalid json: %v", err)
+	}
+	if request.Until.IsZero() {
+		request.Until = api.App.Clock.Now()
+	}
+	if request.Since.IsZero() || request.Since.After(request.Until) {
+		return 0, nil, newApiError(http.StatusBadRequest, "since is required, and must be before until")
+	}
+
+	doc := FixtureDoc{}
+	if err := json.Unmarshal(request.Alert, &doc); err != nil {
+		return 0, nil, newApiError(http.StatusBadRequest, "Invalid alert: %v", err)
+	}
+	if !isAlertDocType(doc.Type()) {
+		return 0, nil, newApiError(http.StatusUnprocessableEntity, "Unknown alert type: %q", doc.Type())
+	}
+	if apiErr := api.validateAlert(doc); apiErr != nil {
+		return 0, nil, apiErr
+	}
+
+	preview, err := api.App.PreviewAlert(api.Store, request.Alert, request.Since, request.Until)
+	if err != nil {
+		return 0, nil, newApiError(http.StatusBadGateway, "Unable to preview alert: %v", err)
+	}
+	return http.StatusOK, preview, nil
+
+}
+
+func (api *AdminAPI) getAlert(alertId string) (int, interface{}, *apiError) {
+	doc, apiErr := api.loadAlertDoc(alertId)
+	if apiErr != nil {
+		return 0, nil, apiErr
+	}
+	return http.StatusOK, doc, nil
+}
+
+// Replace the alert.  If the new definition has a _rev, it must be the
+// current one, otherwise the update overwrites whatever is there.
+func (api *AdminAPI) updateAlert(alertId string, r *http.Request) (int, interface{}, *apiError) {
+
+	doc, apiErr := readAlertDoc(r)
+	if apiErr != nil {
+		return 0, nil, apiErr
+	}
+	if doc.Id() != "" && doc.Id() != alertId {
+		return 0, nil, newApiError(http.StatusBadRequest, "_id %v does not match %v", doc.Id(), alertId)
+	}
+	doc["_id"] = alertId
+
+	existing, apiErr := api.loadAlertDoc(alertId)
+	if apiErr != nil {
+		return 0, nil, apiErr
+	}
+	if doc.Revision() != "" && doc.Revision() != existing.Revision() {
+		return 0, nil, newApiError(http.StatusConflict, "Alert %v has been changed since revision %v", alertId, doc.Revision())
+	}
+	doc["_rev"] = existing.Revision()
+
+	return api.saveAlert(doc, http.StatusOK)
+
+}
+
+func (api *AdminAPI) deleteAlert(alertId string) (int, interface{}, *apiError) {
+
+	existing, apiErr := api.loadAlertDoc(alertId)
+	if apiErr != nil {
+		return 0, nil, apiErr
+	}
+	if err := api.Store.Delete(alertId, existing.Revision()); err != nil {
+		return 0, nil, newApiError(http.StatusBadGateway, "Unable to delete %v: %v", alertId, err)
+	}
+	api.App.AlertIndex.Remove(alertId)
+
+	// otherwise its timers would still fire, and its history would linger
+	if err := api.App.Timers.CancelAlert(alertId); err != nil {
+		return 0, nil, newApiError(http.StatusBadGateway, "Deleted %v, but unable to cancel its timers: %v", alertId, err)
+	}
+	if api.App.Firings != nil {
+		if err := api.App.Firings.Delete(alertId); err != nil {
+			return 0, nil, newApiError(http.StatusBadGateway, "Deleted %v, but unable to delete its firings: %v", alertId, err)
+		}
+	}
+
+	return http.StatusOK, map[string]interface{}{"deleted": alertId}, nil
+
+}
+
+func (api *AdminAPI) setPaused(alertId string, paused bool) (int, interface{}, *apiError) {
+
+	doc, apiErr := api.loadAlertDoc(alertId)
+	if apiErr != nil {
+		return 0, nil, apiErr
+	}
+	doc["Paused"] = paused
+
+	return api.saveAlert(doc, http.StatusOK)
+
+}
+
+// Fire the alert now, whether or not it's active
+func (api *AdminAPI) fireAlert(ctx context.Context, alertId string) (int, interface{}, *apiError) {
+
+	alert, ok := api.App.AlertIndex.Get(alertId)
+	if !ok {
+		return 0, nil, newApiError(http.StatusNotFound, "Alert %v not found", alertId)
+	}
+
+	alert.lock()
+	defer alert.unlock()
+
+	firing := AlertFiring{FiredAt: api.App.Clock.Now(), Manual: true, CorrelationId: newCorrelationId()}
+	firing = api.App.fireAlert(ctx, alert, firing)
+
+	return http.StatusOK, firing, nil
+
+}
+
+func (api *AdminAPI) alertFirings(alertId string) (int, interface{}, *apiError) {
+
+	firings := []AlertFiring{}
+	if api.App.Firings != nil {
+		var err error
+		firings, err = api.App.Firings.Firings(alertId)
+		if err != nil {
+			return 0, nil, newApiError(http.StatusBadGateway, "Unable to get firings of %v: %v", alertId, err)
+		}
+	}
+	return http.StatusOK, map[string]interface{}{"alert": alertId, "firings": firings}, nil
+
+}
+
+func (api *AdminAPI) loadAlertDoc(alertId string) (FixtureDoc, *apiError) {
+	doc, exists, err := api.Store.Get(alertId)
+	if err != nil {
+		return nil, newApiError(http.StatusBadGateway, "Unable to get %v: %v", alertId, err)
+	}
+	if !exists || !isAlertDocType(doc.Type()) {
+		return nil, newApiError(http.StatusNotFound, "Alert %v not found", alertId)
+	}
+	return doc, nil
+}
+
+// Validate the alert, save it, and then update it in the alert index.
+// Returns the saved doc.
+func (api *AdminAPI) saveAlert(doc FixtureDoc, status int) (int, interface{}, *apiError) {
+
+	if apiErr := api.validateAlert(doc); apiErr != nil {
+		return 0, nil, apiErr
+	}
+
+	if err := api.Store.Put(doc); err != nil {
+		if strings.Contains(err.Error(), "409") {
+			return 0, nil, newApiError(http.StatusConflict, "Alert %v was changed concurrently", doc.Id())
+		}
+		return 0, nil, newApiError(http.StatusBadGateway, "Unable to save %v: %v", doc.Id(), err)
+	}
+
+	saved, exists, err := api.Store.Get(doc.Id())
+	if err != nil || !exists {
+		return 0, nil, newApiError(http.StatusBadGateway, "Unable to get saved %v: %v", doc.Id(), err)
+	}
+	api.indexAlert(saved)
+
+	return status, saved, nil
+
+}
+
+// The alert has to decode into its type without any unknown fields, and it
+// can only refer to beacons and profiles that exist
+func (api *AdminAPI) validateAlert(doc FixtureDoc) *apiError {
+
+	alertJson, err := json.Marshal(doc)
+	if err != nil {
+		return newApiError(http.StatusBadRequest, "Invalid alert: %v", err)
+	}
+
+	problems := []string{}
+	if err := checkAlertFields(alertJson); err != nil {
+		problems = append(problems, err.Error())
+	} else if api.App.Validator != nil {
+		problems = alertProblems(doc, *api.App.Validator)
+	}
+
+	if len(problems) > 0 {
+		apiErr := newApiError(http.StatusUnprocessableEntity, "Invalid alert %v", doc.Id())
+		apiErr.problems = problems
+		return apiErr
+	}
+	return nil
+
+}
+
+// Put the saved alert in the index, replacing the previous definition
+func (api *AdminAPI) indexAlert(doc FixtureDoc) {
+
+	alertJson, err := json.Marshal(doc)
+	if err != nil {
+		Log.Error("Unable to encode alert", LogFields{"doc": doc.Id(), "error": err})
+		return
+	}
+
+	app := api.App
+	alert, err := DecodeAlert(app.Database, alertJson, app.alertServices())
+	if err != nil {
+		Log.Error("Unable to index alert", LogFields{"doc": doc.Id(), "error": err})
+		return
+	}
+	app.reindexAlert(alert)
+
+	if scheduledAlert, ok := alert.(ScheduledAlerter); ok {
+		app.scheduleNext(scheduledAlert, app.Clock.Now())
+	}
+
+}
+
+func readAlertDoc(r *http.Request) (FixtureDoc, *apiError) {
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, newApiError(http.StatusBadRequest, "Unable to read request: %v", err)
+	}
+
+	doc := FixtureDoc{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, newApiError(http.StatusBadRequest, "Invalid json: %v", err)
+	}
+	if !isAlertDocType(doc.Type()) {
+		return nil, newApiError(http.StatusUnprocessableEntity, "Unknown alert type: %q", doc.Type())
+	}
+	return doc, nil
+
+}
+
+func newAlertId() string {
+	random := make([]byte, 8)
+	rand.Read(random)
+	return fmt.Sprintf("alert_%v", hex.EncodeToString(random))
+}
+
+func writeJson(w http.ResponseWriter, status int, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		Log.Error("Unable to write response", LogFields{"error": err})
+	}
+}
+
+func writeApiError(w http.ResponseWriter, apiErr *apiError) {
+	result := map[string]interface{}{"error": apiErr.message}
+	if len(apiErr.problems) > 0 {
+		result["problems"] = apiErr.problems
+	}
+	writeJson(w, apiErr.status, result)
+}
+
+type alertersById []Alerter
+
+func (a alertersById) Len() int           { return len(a) }
+func (a alertersById) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a alertersById) Less(i, j int) bool { return a[i].AlertId() < a[j].AlertId() }
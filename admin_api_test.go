@@ -0,0 +1,221 @@
+package officeradar
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func newTestAdminAPI() (*AdminAPI, *RecordingNotifier) {
+
+	store := newMemoryFixtureStore()
+	store.Put(FixtureDoc{"_id": "sfBeaconId", "type": DOC_TYPE_BEACON})
+	store.Put(FixtureDoc{"_id": "jensId", "type": DOC_TYPE_PROFILE})
+	store.Put(FixtureDoc{"_id": "traunsId", "type": DOC_TYPE_PROFILE})
+
+	clock := NewManualClock(time.Date(2014, 9, 2, 9, 0, 0, 0, time.UTC))
+	app := NewOfficeRadarApp("", "")
+	app.DryRun = true
+	app.SetClock(clock)
+	app.Timers = NewTimerScheduler(discardTimerStore{})
+	app.Firings = NewFiringHistory(store)
+	app.Validator = &GeofenceEventValidator{
+		Clock: clock,
+		DocTypeFunc: func(docId string) (string, error) {
+			doc, _, _ := store.Get(docId)
+			return doc.Type(), nil
+		},
+	}
+	notifier := NewRecordingNotifier(clock)
+	app.Notifier = notifier
+
+	return &AdminAPI{App: app, Store: store, Token: "secret"}, notifier
+
+}
+
+func adminRequest(api *AdminAPI, method, path, body string) (int, map[string]interface{}) {
+	request, _ := http.NewRequest(method, path, strings.NewReader(body))
+	request.Header.Set("Authorization", "Bearer secret")
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, request)
+	result := map[string]interface{}{}
+	json.Unmarshal(recorder.Body.Bytes(), &result)
+	return recorder.Code, result
+}
+
+const testAdminAlert = `{
+  "_id": "sf_alert",
+  "type": "any_users_present_alert",
+  "Beacon": {"_id": "sfBeaconId"},
+  "Users": [{"_id": "jensId"}],
+  "Actions": [{"Recipient": "traunsId", "Message": "Jens is here"}],
+  "Sticky": true
+}`
+
+func TestAdminAPIAuthorization(t *testing.T) {
+
+	api, _ := newTestAdminAPI()
+
+	for _, header := range []string{"", "Bearer wrong", "secret"} {
+		request, _ := http.NewRequest("GET", "/alerts", nil)
+		request.Header.Set("Authorization", header)
+		recorder := httptest.NewRecorder()
+		api.ServeHTTP(recorder, request)
+		assert.Equals(t, recorder.Code, http.StatusUnauthorized)
+	}
+
+	status, _ := adminRequest(api, "GET", "/alerts", "")
+	assert.Equals(t, status, http.StatusOK)
+
+}
+
+func TestAdminAPIAlertLifecycle(t *testing.T) {
+
+	api, notifier := newTestAdminAPI()
+
+	status, created := adminRequest(api, "POST", "/alerts", testAdminAlert)
+	assert.Equals(t, status, http.StatusCreated)
+	assert.Equals(t, created["_id"], "sf_alert")
+	_, indexed := api.App.AlertIndex.Get("sf_alert")
+	assert.True(t, indexed)
+
+	status, _ = adminRequest(api, "POST", "/alerts", testAdminAlert)
+	assert.Equals(t, status, http.StatusConflict)
+
+	status, listed := adminRequest(api, "GET", "/alerts", "")
+	assert.Equals(t, status, http.StatusOK)
+	assert.Equals(t, len(listed["alerts"].([]interface{})), 1)
+
+	// updating from a stale revision is refused
+	update := strings.Replace(testAdminAlert, "Jens is here", "Jens has arrived", 1)
+	withRevision := func(rev string) string {
+		return strings.Replace(update, `"_id": "sf_alert"`, `"_rev": "`+rev+`"`, 1)
+	}
+	status, _ = adminRequest(api, "PUT", "/alerts/sf_alert", withRevision("1-stale"))
+	assert.Equals(t, status, http.StatusConflict)
+	status, _ = adminRequest(api, "PUT", "/alerts/sf_alert", withRevision(created["_rev"].(string)))
+	assert.Equals(t, status, http.StatusOK)
+
+	// a paused alert ignores events, but can still be fired by hand
+	status, paused := adminRequest(api, "POST", "/alerts/sf_alert/pause", "")
+	assert.Equals(t, status, http.StatusOK)
+	assert.Equals(t, paused["Paused"], true)
+
+	event := GeofenceEvent{Action: ACTION_ENTRY, BeaconId: "sfBeaconId", ProfileId: "jensId", CreatedAt: "2014-09-02T09:00:00Z"}
+	api.App.triggerAlerts(context.Background(), event)
+	assert.Equals(t, len(notifier.Notifications()), 0)
+
+	status, fired := adminRequest(api, "POST", "/alerts/sf_alert/fire", "")
+	assert.Equals(t, status, http.StatusOK)
+	assert.Equals(t, fired["manual"], true)
+	assert.Equals(t, len(notifier.Notifications()), 1)
+	assert.Equals(t, notifier.Notifications()[0].Message, "Jens has arrived")
+
+	status, _ = adminRequest(api, "POST", "/alerts/sf_alert/resume", "")
+	assert.Equals(t, status, http.StatusOK)
+	api.App.triggerAlerts(context.Background(), event)
+	assert.Equals(t, len(notifier.Notifications()), 2)
+
+	status, history := adminRequest(api, "GET", "/alerts/sf_alert/firings", "")
+	assert.Equals(t, status, http.StatusOK)
+	firings := history["firings"].([]interface{})
+	assert.Equals(t, len(firings), 2)
+	assert.Equals(t, firings[1].(map[string]interface{})["profile"], "jensId")
+
+	// deleting it cancels its timers and forgets its firings too
+	api.App.Timers.Schedule(NewAlertTimer("sf_alert", "jensId", "sfBeaconId", api.App.Clock.Now().Add(time.Hour)))
+	status, _ = adminRequest(api, "DELETE", "/alerts/sf_alert", "")
+	assert.Equals(t, status, http.StatusOK)
+	_, indexed = api.App.AlertIndex.Get("sf_alert")
+	assert.False(t, indexed)
+	assert.False(t, api.App.Timers.HasTimers("sf_alert"))
+	_, exists, _ := api.Store.Get(alertFiringsId("sf_alert"))
+	assert.False(t, exists)
+	status, _ = adminRequest(api, "GET", "/alerts/sf_alert", "")
+	assert.Equals(t, status, http.StatusNotFound)
+
+}
+
+func TestAdminAPIValidation(t *testing.T) {
+
+	api, _ := newTestAdminAPI()
+
+	invalidAlerts := []struct {
+		alert  string
+		status int
+	}{
+		{`not json`, http.StatusBadRequest},
+		{`{"type": "no_such_alert"}`, http.StatusUnprocessableEntity},
+		{strings.Replace(testAdminAlert, `"Sticky"`, `"Stikcy"`, 1), http.StatusUnprocessableEntity},
+		{strings.Replace(testAdminAlert, `"Sticky": true`, `"Sticky": "yes"`, 1), http.StatusUnprocessableEntity},
+		{strings.Replace(testAdminAlert, "sfBeaconId", "mvBeaconId", 1), http.StatusUnprocessableEntity},
+	}
+	for _, invalid := range invalidAlerts {
+		status, result := adminRequest(api, "POST", "/alerts", invalid.alert)
+		assert.Equals(t, status, invalid.status)
+		assert.True(t, result["error"] != nil)
+	}
+
+	_, result := adminRequest(api, "POST", "/alerts", strings.Replace(testAdminAlert, "sfBeaconId", "mvBeaconId", 1))
+	assert.DeepEquals(t, result["problems"], []interface{}{"beacon mvBeaconId does not exist"})
+	assert.Equals(t, api.App.AlertIndex.Len(), 0)
+
+}
+
+func TestAdminAPICall(t *testing.T) {
+
+	api, _ := newTestAdminAPI()
+	api.Token = "" // calls don't go through the authorization
+
+	ctx := context.Background()
+	status, created, err := api.Call(ctx, "POST", "/alerts", strings.NewReader(testAdminAlert))
+	assert.True(t, err == nil)
+	assert.Equals(t, status, http.StatusCreated)
+	assert.Equals(t, created.(FixtureDoc).Id(), "sf_alert")
+
+	invalid := strings.Replace(testAdminAlert, "jensId", "nobodyId", 1)
+	status, _, err = api.Call(ctx, "PUT", "/alerts/sf_alert", strings.NewReader(invalid))
+	assert.Equals(t, status, http.StatusUnprocessableEntity)
+	assert.True(t, strings.Contains(err.Error(), "nobodyId"))
+
+	status, _, err = api.Call(ctx, "DELETE", "/alerts/sf_alert", nil)
+	assert.True(t, err == nil)
+	status, _, err = api.Call(ctx, "DELETE", "/alerts/sf_alert", nil)
+	assert.Equals(t, status, http.StatusNotFound)
+	assert.True(t, err != nil)
+
+}
+
+func TestAdminAPIPreviewAlert(t *testing.T) {
+
+	api, notifier := newTestAdminAPI()
+	store := api.Store.(*memoryFixtureStore)
+	store.Put(FixtureDoc{"_id": "event1", "type": DOC_TYPE_GEOFENCE_EVENT, "action": ACTION_ENTRY, "beacon": "sfBeaconId", "profile": "jensId", "created_at": "2014-09-01T09:00:00Z"})
+	store.Put(FixtureDoc{"_id": "event2", "type": DOC_TYPE_GEOFENCE_EVENT, "action": ACTION_ENTRY, "beacon": "sfBeaconId", "profile": "traunsId", "created_at": "2014-09-01T10:00:00Z"})
+	store.Put(FixtureDoc{"_id": "event3", "type": DOC_TYPE_GEOFENCE_EVENT, "action": ACTION_EXIT, "beacon": "sfBeaconId", "profile": "jensId", "created_at": "2014-09-01T17:00:00Z"})
+
+	body := `{"alert": ` + testAdminAlert + `, "since": "2014-09-01T00:00:00Z", "until": "2014-09-01T12:00:00Z"}`
+	status, result := adminRequest(api, "POST", "/alerts/preview", body)
+	assert.Equals(t, status, http.StatusOK)
+	assert.Equals(t, result["events_replayed"], float64(2))
+	firings := result["firings"].([]interface{})
+	assert.Equals(t, len(firings), 1)
+	assert.Equals(t, firings[0].(map[string]interface{})["fired_at"], "2014-09-01T09:00:00Z")
+
+	// nothing was saved or sent
+	assert.Equals(t, api.App.AlertIndex.Len(), 0)
+	assert.Equals(t, len(notifier.Notifications()), 0)
+
+	status, _ = adminRequest(api, "POST", "/alerts/preview", `{"alert": `+testAdminAlert+`}`)
+	assert.Equals(t, status, http.StatusBadRequest)
+	invalid := strings.Replace(testAdminAlert, "sfBeaconId", "mvBeaconId", 1)
+	status, _ = adminRequest(api, "POST", "/alerts/preview", `{"alert": `+invalid+`, "since": "2014-09-01T00:00:00Z"}`)
+	assert.Equals(t, status, http.StatusUnprocessableEntity)
+
+}
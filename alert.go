@@ -1,9 +1,8 @@
 package officeradar
 
 import (
+	"sync"
 	"time"
-
-	"github.com/couchbaselabs/logg"
 )
 
 /*
@@ -23,7 +22,9 @@ Alert examples
 */
 
 const (
-	DOC_TYPE_ANY_USERS_PRESENT_ALERT = "any_users_present_alert"
+	DOC_TYPE_ANY_USERS_PRESENT_ALERT   = "any_users_present_alert"
+	DOC_TYPE_SURPRISE_APPEARANCE_ALERT = "surprise_appearance_alert"
+	DOC_TYPE_ALL_USERS_PRESENT_ALERT   = "all_users_present_alert"
 )
 
 // A geofence alert triggered if any of the users enters within range of a specific beacon.
@@ -43,12 +44,9 @@ func NewAnyUsersPresentAlert() *AnyUsersPresentAlert {
 
 func (a *AnyUsersPresentAlert) Process(e GeofenceEvent) (bool, error) {
 
-	logg.LogTo("OFFICERADAR", "AnyUsersPresentAlert.Process() called")
-
 	// does the beacon for this geofence event match the beacon of interest?
 	if e.BeaconId != a.Beacon.Id {
-		logg.LogTo("OFFICERADAR", "beacon id of event does not match alert, ignoring")
-		logg.LogTo("OFFICERADAR", "event: %+v alert: %+v", e, a)
+		e.logger().Debug("Beacon of event does not match alert, ignoring", LogFields{"alert": a.Id, "beacon": e.BeaconId})
 		return false, nil
 	}
 
@@ -58,21 +56,31 @@ func (a *AnyUsersPresentAlert) Process(e GeofenceEvent) (bool, error) {
 			return true, nil // yes
 		}
 	}
-	logg.LogTo("OFFICERADAR", "no users match alert, ignoring")
-	logg.LogTo("OFFICERADAR", "event: %+v alert: %+v", e, a)
+	e.logger().Debug("No users match alert, ignoring", LogFields{"alert": a.Id, "profile": e.ProfileId})
 
 	return false, nil // no
 }
 
+func (a *AnyUsersPresentAlert) BeaconIds() []string {
+	return []string{a.Beacon.Id}
+}
+
+func (a *AnyUsersPresentAlert) ProfileIds() []string {
+	return profileIds(a.Users)
+}
+
 // TODO: code review.  This method duplicated in several
 // places because putting in the basealert was nixing all the
 // non-basealert json fields
-func (a *AnyUsersPresentAlert) RescheduleOrDelete() error {
+func (a *AnyUsersPresentAlert) RescheduleOrDelete(firedAt time.Time) error {
 
 	// if it's sticky, then update the alert's activeOn time
 	if a.Sticky {
-		a.ActiveOn = time.Now().Add(a.ReactivateAfter)
-		_, err := a.database.Edit(a)
+		a.ActiveOn = firedAt.Add(a.ReactivateAfter)
+		rev, err := a.database.Edit(a)
+		if err == nil {
+			a.Revision = rev
+		}
 		return err
 	}
 
@@ -93,19 +101,19 @@ type SurpriseAppearanceAlert struct {
 	Users          []OfficeRadarProfile // users for which this alert can fire
 	Beacons        []Beacon             // beacons for which this alert can fire
 	MinLastSeenAgo time.Duration        // user(s) must not seen at beacon for time duration
-	LastSeenFunc   LastSeenFunc         // determine when last seen user at beacon
+	LastSeenFunc   LastSeenFunc         `json:"-"` // determine when last seen user at beacon
 }
 
 func NewSurpriseAppearanceAlert() *SurpriseAppearanceAlert {
 	alert := &SurpriseAppearanceAlert{}
-	alert.Type = "surprise_appearance_alert"
+	alert.Type = DOC_TYPE_SURPRISE_APPEARANCE_ALERT
 	return alert
 }
 
 func (a *SurpriseAppearanceAlert) Process(e GeofenceEvent) (bool, error) {
 
 	if a.LastSeenFunc == nil {
-		logg.LogPanic("no LastSeenFunc defined.")
+		Log.Panic("no LastSeenFunc defined.")
 	}
 
 	if !hasBeaconOverlap(a.Beacons, e) {
@@ -121,11 +129,13 @@ func (a *SurpriseAppearanceAlert) Process(e GeofenceEvent) (bool, error) {
 
 	// if not, consider that as being "infinite" last seen and fire alert
 	if !haveSeen {
-		logg.LogTo("OFFICERADAR", "!haveSeen")
+		e.logger().Debug("Never seen here before", LogFields{"alert": a.Id, "profile": e.ProfileId, "beacon": e.BeaconId})
 		return true, nil
 	}
 
-	durationSinceLastSeen := time.Since(lastSeenAt)
+	// measure against the time of the event rather than the wall-clock
+	// time, in case the event was delayed or is being replayed
+	durationSinceLastSeen := e.EventTime(a.clock()).Sub(lastSeenAt)
 
 	// the duration since last seen must be GTE MinLastSeenAgo
 	if durationSinceLastSeen >= a.MinLastSeenAgo {
@@ -135,12 +145,23 @@ func (a *SurpriseAppearanceAlert) Process(e GeofenceEvent) (bool, error) {
 	return false, nil
 }
 
-func (a *SurpriseAppearanceAlert) RescheduleOrDelete() error {
+func (a *SurpriseAppearanceAlert) BeaconIds() []string {
+	return beaconIds(a.Beacons)
+}
+
+func (a *SurpriseAppearanceAlert) ProfileIds() []string {
+	return profileIds(a.Users)
+}
+
+func (a *SurpriseAppearanceAlert) RescheduleOrDelete(firedAt time.Time) error {
 
 	// if it's sticky, then update the alert's activeOn time
 	if a.Sticky {
-		a.ActiveOn = time.Now().Add(a.ReactivateAfter)
-		_, err := a.database.Edit(a)
+		a.ActiveOn = firedAt.Add(a.ReactivateAfter)
+		rev, err := a.database.Edit(a)
+		if err == nil {
+			a.Revision = rev
+		}
 		return err
 	}
 
@@ -159,6 +180,22 @@ func hasBeaconOverlap(beacons []Beacon, e GeofenceEvent) bool {
 	return false
 }
 
+func beaconIds(beacons []Beacon) []string {
+	ids := []string{}
+	for _, beacon := range beacons {
+		ids = append(ids, beacon.Id)
+	}
+	return ids
+}
+
+func profileIds(users []OfficeRadarProfile) []string {
+	ids := []string{}
+	for _, user := range users {
+		ids = append(ids, user.Id)
+	}
+	return ids
+}
+
 func hasProfileOverlap(users []OfficeRadarProfile, e GeofenceEvent) bool {
 	for _, user := range users {
 		if user.Id == e.ProfileId {
@@ -168,27 +205,33 @@ func hasProfileOverlap(users []OfficeRadarProfile, e GeofenceEvent) bool {
 	return false
 }
 
-// A geofence alert triggered if all of the users enter within range of one the
-// beacons in the list of beacons, within the specified time window.
+// A geofence alert triggered if all of the users are in range of one of the
+// beacons at the same time, or were there within the specified time window of
+// eachother.  It fires once per gathering at a beacon, and only re-arms for
+// that beacon after the group has dispersed, ie, once someone has been gone
+// from the beacon for longer than the window.
 // Eg, "Send me an alert when Jens and I are in the same office within 1/2 hour of eachother"
 type AllUsersPresentAlert struct {
 	BaseAlert
 	Users        []OfficeRadarProfile // users who must be in range of beacon, within time window
 	Window       time.Duration        // max time window for user appearances of multi-user alerts
 	Beacons      []Beacon             // the beacons of interest
-	LastSeenFunc LastSeenFunc         // determine when last seen user at beacon
+	Disarmed     []string             // beacons where the alert fired and the group is still together
+	LastSeenFunc LastSeenFunc         `json:"-"` // determine when last seen user at beacon
+	PresentFunc  PresentFunc          `json:"-"` // determine whether user is still at beacon
+	rearmed      bool                 // re-armed since it was last saved
 }
 
 func NewAllUsersPresentAlert() *AllUsersPresentAlert {
 	alert := &AllUsersPresentAlert{}
-	alert.Type = "all_users_present_alert"
+	alert.Type = DOC_TYPE_ALL_USERS_PRESENT_ALERT
 	return alert
 }
 
 func (a *AllUsersPresentAlert) Process(e GeofenceEvent) (bool, error) {
 
 	if a.LastSeenFunc == nil {
-		logg.LogPanic("no LastSeenFunc defined.")
+		Log.Panic("no LastSeenFunc defined.")
 	}
 
 	if !hasBeaconOverlap(a.Beacons, e) {
@@ -199,36 +242,122 @@ func (a *AllUsersPresentAlert) Process(e GeofenceEvent) (bool, error) {
 		return false, nil
 	}
 
-	// the beacon of interest is the beacon associated with this geofence
-	// event.  we know one user (eg, the one associated w/ geofence event)
-	// was recently spotted at beacon.  but, have we seen all users
-	// recently at this beacon?
+	eventTime := e.EventTime(a.clock())
+
+	// if the group has dispersed since the alert last fired at this beacon,
+	// it can fire again the next time they get together.  this is checked
+	// against the presence before this event is taken into account.
+	if a.isDisarmed(e.BeaconId) && !a.togetherAt(e.BeaconId, eventTime, nil) {
+		e.logger().Debug("Group dispersed, re-arming", LogFields{"alert": a.Id, "beacon": e.BeaconId})
+		a.setDisarmed(e.BeaconId, false)
+		a.rearmed = true
+	}
+
+	// only an arrival can bring the group together
+	if e.Action != ACTION_ENTRY || a.isDisarmed(e.BeaconId) {
+		return false, nil
+	}
+
+	if !a.togetherAt(e.BeaconId, eventTime, &e) {
+		return false, nil
+	}
+
+	// if we made it this far, alert fires, and won't fire again at this
+	// beacon until the group disperses.  the re-arming is saved along with that.
+	a.setDisarmed(e.BeaconId, true)
+	a.rearmed = false
+	return true, nil
+
+}
+
+// Are all of the users at the beacon at the given time, or were they seen
+// there within the window?  If an event is given, it overrides the presence
+// history for the event's user.
+func (a *AllUsersPresentAlert) togetherAt(beaconId string, at time.Time, e *GeofenceEvent) bool {
+
 	for _, user := range a.Users {
-		haveSeen, lastSeenAt := a.LastSeenFunc(user.Id, e.BeaconId)
-		if !haveSeen {
-			return false, nil
+		if e != nil && user.Id == e.ProfileId {
+			// the user associated w/ geofence event is either here now,
+			// or just left
+			if e.Action != ACTION_ENTRY && a.Window <= 0 {
+				return false
+			}
+			continue
+		}
+		if !seenWithin(a.PresentFunc, a.LastSeenFunc, user.Id, beaconId, at, a.Window) {
+			return false
 		}
+	}
+
+	return true
+
+}
+
+// Is the user in range of the beacon at the given time, or were they last seen
+// there within the window?  Without a PresentFunc, only the window is checked.
+func seenWithin(presentFunc PresentFunc, lastSeenFunc LastSeenFunc, profileId, beaconId string, at time.Time, window time.Duration) bool {
+
+	if presentFunc != nil && presentFunc(profileId, beaconId) {
+		return true
+	}
+
+	haveSeen, lastSeenAt := lastSeenFunc(profileId, beaconId)
+	if !haveSeen || window <= 0 {
+		return false
+	}
+	return at.Sub(lastSeenAt) <= window
+
+}
 
-		// has this user been seen recently enough?
-		durationSinceLastSeen := time.Since(lastSeenAt)
+func (a *AllUsersPresentAlert) isDisarmed(beaconId string) bool {
+	return containsString(a.Disarmed, beaconId)
+}
 
-		if durationSinceLastSeen > a.Window {
-			return false, nil
+func (a *AllUsersPresentAlert) setDisarmed(beaconId string, disarmed bool) {
+	remaining := []string{}
+	for _, id := range a.Disarmed {
+		if id != beaconId {
+			remaining = append(remaining, id)
 		}
+	}
+	if disarmed {
+		remaining = append(remaining, beaconId)
+	}
+	a.Disarmed = remaining
+}
 
+// Save the alert if an event re-armed it w/o it firing
+func (a *AllUsersPresentAlert) SaveRearmed() error {
+	if !a.rearmed {
+		return nil
+	}
+	rev, err := a.database.Edit(a)
+	if err != nil {
+		// try again after the next event
+		return err
 	}
+	a.Revision = rev
+	a.rearmed = false
+	return nil
+}
 
-	// if we made it this far, alert fires
-	return true, nil
+func (a *AllUsersPresentAlert) BeaconIds() []string {
+	return beaconIds(a.Beacons)
+}
 
+func (a *AllUsersPresentAlert) ProfileIds() []string {
+	return profileIds(a.Users)
 }
 
-func (a *AllUsersPresentAlert) RescheduleOrDelete() error {
+func (a *AllUsersPresentAlert) RescheduleOrDelete(firedAt time.Time) error {
 
 	// if it's sticky, then update the alert's activeOn time
 	if a.Sticky {
-		a.ActiveOn = time.Now().Add(a.ReactivateAfter)
-		_, err := a.database.Edit(a)
+		a.ActiveOn = firedAt.Add(a.ReactivateAfter)
+		rev, err := a.database.Edit(a)
+		if err == nil {
+			a.Revision = rev
+		}
 		return err
 	}
 
@@ -245,13 +374,70 @@ type BaseAlert struct {
 	Sticky          bool          // should this alert remain after it fires?
 	ReactivateAfter time.Duration // delay before reaactivating a sticky alert
 	ActiveOn        time.Time     // the time after which this alert becomes active
+	Paused          bool          // a paused alert doesn't fire until it's resumed
+	mutex           sync.Mutex    // held while an alert is being fired
+	clockOverride   Clock         // if nil, the SystemClock is used
+}
+
+func (a *BaseAlert) AlertId() string {
+	return a.Id
+}
+
+// The revision of the alert doc, as of the last time it was loaded or saved
+func (a *BaseAlert) AlertRevision() string {
+	return a.Revision
+}
+
+// The doc type of the alert, eg, "dwell_alert"
+func (a *BaseAlert) AlertType() string {
+	return a.Type
+}
+
+// Is this alert active at the given time?
+func (a *BaseAlert) IsActive(now time.Time) bool {
+	return !a.Paused && !a.ActiveOn.After(now)
+}
+
+// Use the given clock instead of the SystemClock
+func (a *BaseAlert) SetClock(clock Clock) {
+	a.clockOverride = clock
+}
+
+func (a *BaseAlert) clock() Clock {
+	if a.clockOverride == nil {
+		return SystemClock
+	}
+	return a.clockOverride
+}
+
+func (a *BaseAlert) IsSticky() bool {
+	return a.Sticky
+}
+
+// Reactivate a sticky alert in memory only, eg, when previewing it
+func (a *BaseAlert) reactivate(firedAt time.Time) {
+	a.ActiveOn = firedAt.Add(a.ReactivateAfter)
+}
+
+// When the alert becomes active again, or false if it's paused and so
+// won't until it's resumed
+func (a *BaseAlert) reactivatesAt() (time.Time, bool) {
+	return a.ActiveOn, !a.Paused
+}
+
+func (a *BaseAlert) lock() {
+	a.mutex.Lock()
+}
+
+func (a *BaseAlert) unlock() {
+	a.mutex.Unlock()
 }
 
 type ActionFunc func(AlertAction) error
 
 func (a *BaseAlert) PerformActions(actionFunc ActionFunc) error {
 	if len(a.Actions) == 0 {
-		logg.LogTo("OFFICERADAR", "alert %v has no actions", a)
+		Log.Warn("Alert has no actions", LogFields{"alert": a.Id})
 	}
 	for _, action := range a.Actions {
 		err := actionFunc(action)
@@ -264,13 +450,55 @@ func (a *BaseAlert) PerformActions(actionFunc ActionFunc) error {
 
 type Alerter interface {
 
+	// The id of the alert document
+	AlertId() string
+
+	AlertRevision() string
+
+	AlertType() string
+
+	// The beacons and profiles which this alert is restricted to.  An empty
+	// list means the alert isn't restricted, eg, it applies to any beacon.
+	BeaconIds() []string
+	ProfileIds() []string
+
+	IsActive(now time.Time) bool
+
+	IsSticky() bool
+
 	// Given a geofence event, return whether the alert should fire or not.
 	// If there was an error processing the event, return the error.
 	Process(geofenceEvent GeofenceEvent) (bool, error)
 
 	PerformActions(actionFunc ActionFunc) error
 
-	RescheduleOrDelete() error
+	// Called after the alert fires.  Sticky alerts are reactivated relative
+	// to the time the alert fired, other alerts are deleted.
+	RescheduleOrDelete(firedAt time.Time) error
+
+	SetClock(clock Clock)
+
+	reactivate(firedAt time.Time)
+	reactivatesAt() (time.Time, bool)
+	lock()
+	unlock()
+}
+
+// Alerts that keep state between events, which is saved in a doc of its own
+// after the alert processed an event, rather than with the alert
+type StatefulAlerter interface {
+	Alerter
+	SaveState() error
+	LoadState() error
+	keepState(previous Alerter) // when the alert is reloaded after a change
+}
+
+// Alerts that disarm when they fire and are re-armed by a later event.  The
+// re-arming is saved with the alert, the same as the firing, so that it isn't
+// forgotten on restart.
+type RearmingAlerter interface {
+	Alerter
+	SaveRearmed() error
 }
 
 type AlertAction struct {
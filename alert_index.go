@@ -0,0 +1,340 @@
+package officeradar
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/tleyden/go-couch"
+)
+
+// An in-memory index of alerts, keyed by the beacons and profiles they are
+// restricted to, so that a geofence event is only evaluated against the alerts
+// that could possibly fire for it rather than every alert in the database.
+type AlertIndex struct {
+	mutex      sync.RWMutex
+	alerts     map[string]*indexedAlert
+	byBeacon   map[string]map[string]*indexedAlert
+	byProfile  map[string]map[string]*indexedAlert
+	anyBeacon  map[string]*indexedAlert // alerts not restricted to any beacons
+	anyProfile map[string]*indexedAlert // alerts not restricted to any profiles
+}
+
+type indexedAlert struct {
+	alert      Alerter
+	beaconIds  map[string]bool
+	profileIds map[string]bool
+}
+
+func NewAlertIndex() *AlertIndex {
+	return &AlertIndex{
+		alerts:     map[string]*indexedAlert{},
+		byBeacon:   map[string]map[string]*indexedAlert{},
+		byProfile:  map[string]map[string]*indexedAlert{},
+		anyBeacon:  map[string]*indexedAlert{},
+		anyProfile: map[string]*indexedAlert{},
+	}
+}
+
+// Add the alert to the index, replacing any existing alert with the same id
+func (x *AlertIndex) Upsert(alert Alerter) {
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	x.remove(alert.AlertId())
+
+	entry := &indexedAlert{
+		alert:      alert,
+		beaconIds:  stringSet(alert.BeaconIds()),
+		profileIds: stringSet(alert.ProfileIds()),
+	}
+	x.alerts[alert.AlertId()] = entry
+	addToIndex(x.byBeacon, x.anyBeacon, entry.beaconIds, alert.AlertId(), entry)
+	addToIndex(x.byProfile, x.anyProfile, entry.profileIds, alert.AlertId(), entry)
+
+}
+
+// Remove the alert with the given id from the index, if present
+func (x *AlertIndex) Remove(alertId string) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	x.remove(alertId)
+}
+
+// The alerts that could fire for this geofence event, ie, the alerts for which
+// both the beacon and profile of the event match the alert's restrictions.
+func (x *AlertIndex) Candidates(e GeofenceEvent) []Alerter {
+
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+
+	// look up via whichever key has fewer alerts, and filter by the other
+	byBeacon, anyBeacon := x.byBeacon[e.BeaconId], x.anyBeacon
+	byProfile, anyProfile := x.byProfile[e.ProfileId], x.anyProfile
+
+	first, second := byBeacon, anyBeacon
+	if len(byProfile)+len(anyProfile) < len(byBeacon)+len(anyBeacon) {
+		first, second = byProfile, anyProfile
+	}
+
+	candidates := []Alerter{}
+	for _, entries := range []map[string]*indexedAlert{first, second} {
+		for _, entry := range entries {
+			if entry.matches(e) {
+				candidates = append(candidates, entry.alert)
+			}
+		}
+	}
+	return candidates
+
+}
+
+// Look up an alert by id
+func (x *AlertIndex) Get(alertId string) (Alerter, bool) {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	entry, ok := x.alerts[alertId]
+	if !ok {
+		return nil, false
+	}
+	return entry.alert, true
+}
+
+// All of the alerts in the index
+func (x *AlertIndex) All() []Alerter {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	alerts := []Alerter{}
+	for _, entry := range x.alerts {
+		alerts = append(alerts, entry.alert)
+	}
+	return alerts
+}
+
+// The number of alerts in the index
+func (x *AlertIndex) Len() int {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	return len(x.alerts)
+}
+
+func (x *AlertIndex) remove(alertId string) {
+	entry, ok := x.alerts[alertId]
+	if !ok {
+		return
+	}
+	delete(x.alerts, alertId)
+	removeFromIndex(x.byBeacon, x.anyBeacon, entry.beaconIds, alertId)
+	removeFromIndex(x.byProfile, x.anyProfile, entry.profileIds, alertId)
+}
+
+func (entry *indexedAlert) matches(e GeofenceEvent) bool {
+	if len(entry.beaconIds) > 0 && !entry.beaconIds[e.BeaconId] {
+		return false
+	}
+	if len(entry.profileIds) > 0 && !entry.profileIds[e.ProfileId] {
+		return false
+	}
+	return true
+}
+
+func addToIndex(index map[string]map[string]*indexedAlert, wildcard map[string]*indexedAlert, keys map[string]bool, alertId string, entry *indexedAlert) {
+	if len(keys) == 0 {
+		wildcard[alertId] = entry
+		return
+	}
+	for key := range keys {
+		entries, ok := index[key]
+		if !ok {
+			entries = map[string]*indexedAlert{}
+			index[key] = entries
+		}
+		entries[alertId] = entry
+	}
+}
+
+func removeFromIndex(index map[string]map[string]*indexedAlert, wildcard map[string]*indexedAlert, keys map[string]bool, alertId string) {
+	delete(wildcard, alertId)
+	for key := range keys {
+		delete(index[key], alertId)
+		if len(index[key]) == 0 {
+			delete(index, key)
+		}
+	}
+}
+
+func stringSet(items []string) map[string]bool {
+	set := map[string]bool{}
+	for _, item := range items {
+		if item != "" {
+			set[item] = true
+		}
+	}
+	return set
+}
+
+// Is this one of the alert document types?
+func isAlertDocType(docType string) bool {
+	switch docType {
+	case DOC_TYPE_ANY_USERS_PRESENT_ALERT,
+		DOC_TYPE_SURPRISE_APPEARANCE_ALERT,
+		DOC_TYPE_ALL_USERS_PRESENT_ALERT,
+		DOC_TYPE_DWELL_ALERT,
+		DOC_TYPE_ABSENCE_ALERT,
+		DOC_TYPE_CONDITION_ALERT,
+		DOC_TYPE_EXPRESSION_ALERT,
+		DOC_TYPE_PROXIMITY_ALERT:
+		return true
+	}
+	return false
+}
+
+// Alerts whose definition can be checked when they are loaded
+type alertValidator interface {
+	Validate() error
+}
+
+// The services that alerts depend on, which are injected when they are loaded
+type AlertServices struct {
+	LastSeenFunc  LastSeenFunc
+	PresentFunc   PresentFunc
+	FirstSeenFunc FirstSeenFunc
+	Timers        *TimerScheduler
+	Clock         Clock
+}
+
+// Load the alert doc with the given id into the Alerter for its type
+func LoadAlert(db couch.Database, alertId string, services AlertServices) (Alerter, error) {
+
+	retrievedAlert := &BaseAlert{}
+	err := db.Retrieve(alertId, retrievedAlert)
+	if err != nil {
+		return nil, err
+	}
+
+	alert, err := newAlerter(db, retrievedAlert.Type, services)
+	if err != nil {
+		return nil, fmt.Errorf("%v for doc: %v", err, alertId)
+	}
+
+	err = db.Retrieve(alertId, alert)
+	if err != nil {
+		return nil, err
+	}
+	return prepareAlert(alert, services)
+
+}
+
+// Decode an alert definition that hasn't necessarily been saved, eg, to
+// preview it.  The database is only used if the alert is fired for real.
+func DecodeAlert(db couch.Database, alertJson []byte, services AlertServices) (Alerter, error) {
+
+	decodedAlert := &BaseAlert{}
+	if err := json.Unmarshal(alertJson, decodedAlert); err != nil {
+		return nil, err
+	}
+
+	alert, err := newAlerter(db, decodedAlert.Type, services)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(alertJson, alert); err != nil {
+		return nil, err
+	}
+	return prepareAlert(alert, services)
+
+}
+
+// Check that the alert definition only has the fields of its type, eg, to
+// catch misspelled fields in alerts written by hand, which decoding would
+// otherwise silently ignore.
+func checkAlertFields(alertJson []byte) error {
+
+	decodedAlert := &BaseAlert{}
+	if err := json.Unmarshal(alertJson, decodedAlert); err != nil {
+		return err
+	}
+
+	alert, err := newAlerter(couch.Database{}, decodedAlert.Type, AlertServices{})
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(alertJson))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(alert); err != nil {
+		return fmt.Errorf("Invalid %v: %v", decodedAlert.Type, err)
+	}
+	return nil
+
+}
+
+// An empty Alerter for the given doc type, with its services injected
+func newAlerter(db couch.Database, docType string, services AlertServices) (Alerter, error) {
+
+	var alert Alerter
+	switch docType {
+	case DOC_TYPE_ANY_USERS_PRESENT_ALERT:
+		anyUsersAlert := &AnyUsersPresentAlert{}
+		anyUsersAlert.database = db
+		alert = anyUsersAlert
+	case DOC_TYPE_SURPRISE_APPEARANCE_ALERT:
+		surpriseAlert := &SurpriseAppearanceAlert{}
+		surpriseAlert.database = db
+		surpriseAlert.LastSeenFunc = services.LastSeenFunc
+		alert = surpriseAlert
+	case DOC_TYPE_ALL_USERS_PRESENT_ALERT:
+		allUsersAlert := &AllUsersPresentAlert{}
+		allUsersAlert.database = db
+		allUsersAlert.LastSeenFunc = services.LastSeenFunc
+		allUsersAlert.PresentFunc = services.PresentFunc
+		alert = allUsersAlert
+	case DOC_TYPE_DWELL_ALERT:
+		dwellAlert := &DwellAlert{}
+		dwellAlert.database = db
+		dwellAlert.Timers = services.Timers
+		alert = dwellAlert
+	case DOC_TYPE_ABSENCE_ALERT:
+		absenceAlert := &AbsenceAlert{}
+		absenceAlert.database = db
+		absenceAlert.FirstSeenFunc = services.FirstSeenFunc
+		absenceAlert.Timers = services.Timers
+		alert = absenceAlert
+	case DOC_TYPE_CONDITION_ALERT:
+		conditionAlert := &ConditionAlert{}
+		conditionAlert.database = db
+		conditionAlert.LastSeenFunc = services.LastSeenFunc
+		conditionAlert.PresentFunc = services.PresentFunc
+		alert = conditionAlert
+	case DOC_TYPE_EXPRESSION_ALERT:
+		expressionAlert := &ExpressionAlert{}
+		expressionAlert.database = db
+		expressionAlert.LastSeenFunc = services.LastSeenFunc
+		alert = expressionAlert
+	case DOC_TYPE_PROXIMITY_ALERT:
+		proximityAlert := &ProximityAlert{}
+		proximityAlert.database = db
+		proximityAlert.LastSeenFunc = services.LastSeenFunc
+		proximityAlert.PresentFunc = services.PresentFunc
+		alert = proximityAlert
+	default:
+		return nil, fmt.Errorf("Unknown alert type: %v", docType)
+	}
+	return alert, nil
+
+}
+
+func prepareAlert(alert Alerter, services AlertServices) (Alerter, error) {
+	if validator, ok := alert.(alertValidator); ok {
+		if err := validator.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if services.Clock != nil {
+		alert.SetClock(services.Clock)
+	}
+	return alert, nil
+}
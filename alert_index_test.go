@@ -0,0 +1,115 @@
+package officeradar
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func newIndexedAnyUsersAlert(id, beaconId string, profileIds ...string) *AnyUsersPresentAlert {
+	alert := NewAnyUsersPresentAlert()
+	alert.Id = id
+	alert.Beacon = Beacon{OfficeRadarDoc: OfficeRadarDoc{Id: beaconId}}
+	for _, profileId := range profileIds {
+		alert.Users = append(alert.Users, OfficeRadarProfile{OfficeRadarDoc: OfficeRadarDoc{Id: profileId}})
+	}
+	return alert
+}
+
+func candidateIds(index *AlertIndex, e GeofenceEvent) map[string]bool {
+	ids := map[string]bool{}
+	for _, alert := range index.Candidates(e) {
+		ids[alert.AlertId()] = true
+	}
+	return ids
+}
+
+func TestAlertIndexCandidates(t *testing.T) {
+
+	index := NewAlertIndex()
+	index.Upsert(newIndexedAnyUsersAlert("alert1", "beacon1", "foo", "bar"))
+	index.Upsert(newIndexedAnyUsersAlert("alert2", "beacon2", "foo"))
+
+	surpriseAlert := NewSurpriseAppearanceAlert()
+	surpriseAlert.Id = "alert3"
+	surpriseAlert.Users = []OfficeRadarProfile{{OfficeRadarDoc: OfficeRadarDoc{Id: "bar"}}}
+	index.Upsert(surpriseAlert) // not restricted to any beacons
+	assert.Equals(t, index.Len(), 3)
+
+	e := GeofenceEvent{BeaconId: "beacon1", ProfileId: "foo"}
+	assert.DeepEquals(t, candidateIds(index, e), map[string]bool{"alert1": true})
+
+	e = GeofenceEvent{BeaconId: "beacon1", ProfileId: "bar"}
+	assert.DeepEquals(t, candidateIds(index, e), map[string]bool{"alert1": true, "alert3": true})
+
+	e = GeofenceEvent{BeaconId: "beacon2", ProfileId: "bar"}
+	assert.DeepEquals(t, candidateIds(index, e), map[string]bool{"alert3": true})
+
+	e = GeofenceEvent{BeaconId: "beacon3", ProfileId: "baz"}
+	assert.Equals(t, len(index.Candidates(e)), 0)
+
+}
+
+func TestAlertIndexUpsertAndRemove(t *testing.T) {
+
+	index := NewAlertIndex()
+	index.Upsert(newIndexedAnyUsersAlert("alert1", "beacon1", "foo"))
+
+	// move the alert to another beacon, the old beacon shouldn't match anymore
+	index.Upsert(newIndexedAnyUsersAlert("alert1", "beacon2", "foo"))
+	assert.Equals(t, index.Len(), 1)
+	assert.Equals(t, len(index.Candidates(GeofenceEvent{BeaconId: "beacon1", ProfileId: "foo"})), 0)
+	assert.Equals(t, len(index.Candidates(GeofenceEvent{BeaconId: "beacon2", ProfileId: "foo"})), 1)
+
+	index.Remove("alert1")
+	index.Remove("no_such_alert")
+	assert.Equals(t, index.Len(), 0)
+	assert.Equals(t, len(index.Candidates(GeofenceEvent{BeaconId: "beacon2", ProfileId: "foo"})), 0)
+	assert.Equals(t, len(index.byBeacon), 0)
+	assert.Equals(t, len(index.byProfile), 0)
+
+}
+
+func benchmarkAlertIndex(b *testing.B, numAlerts int) {
+
+	index := NewAlertIndex()
+	alerts := []Alerter{}
+	for i := 0; i < numAlerts; i++ {
+		alert := newIndexedAnyUsersAlert(
+			fmt.Sprintf("alert%d", i),
+			fmt.Sprintf("beacon%d", i%100),
+			fmt.Sprintf("profile%d", i%500),
+			fmt.Sprintf("profile%d", (i+1)%500),
+		)
+		index.Upsert(alert)
+		alerts = append(alerts, alert)
+	}
+	e := GeofenceEvent{Action: ACTION_ENTRY, BeaconId: "beacon42", ProfileId: "profile42"}
+
+	b.Run("Indexed", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, alert := range index.Candidates(e) {
+				alert.Process(e)
+			}
+		}
+	})
+
+	// what triggerAlerts used to do: run every alert against the event
+	b.Run("Unindexed", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, alert := range alerts {
+				alert.Process(e)
+			}
+		}
+	})
+
+}
+
+func BenchmarkAlertIndex1000(b *testing.B) {
+	benchmarkAlertIndex(b, 1000)
+}
+
+func BenchmarkAlertIndex10000(b *testing.B) {
+	benchmarkAlertIndex(b, 10000)
+}
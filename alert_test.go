@@ -1,17 +1,15 @@
 package officeradar
 
 import (
+	"os"
 	"testing"
 	"time"
 
 	"github.com/couchbaselabs/go.assert"
-	"github.com/couchbaselabs/logg"
 )
 
 func init() {
-	logg.LogKeys["TEST"] = true
-	logg.LogKeys["OFFICERADAR"] = true
-
+	Log = NewLogger(os.Stderr, LOG_DEBUG, false)
 }
 
 func TestAnyUsersPresentAlert(t *testing.T) {
@@ -165,3 +163,255 @@ func TestAllUsersPresentAlert(t *testing.T) {
 	assert.True(t, fired2)
 
 }
+
+func TestSurpriseAppearanceAlertUsesEventTime(t *testing.T) {
+
+	alert := NewSurpriseAppearanceAlert()
+
+	// the wall clock is a year after the event, which shouldn't matter
+	eventTime := time.Date(2014, 9, 2, 9, 0, 0, 0, time.UTC)
+	alert.SetClock(NewManualClock(eventTime.Add(365 * 24 * time.Hour)))
+
+	foo := OfficeRadarProfile{OfficeRadarDoc: OfficeRadarDoc{Id: "foo"}}
+	alert.Users = []OfficeRadarProfile{foo}
+	beacon := Beacon{OfficeRadarDoc: OfficeRadarDoc{Id: "fake_beacon_id"}}
+	alert.Beacons = []Beacon{beacon}
+	alert.MinLastSeenAgo = (14 * 24 * time.Hour)
+
+	// seen the day before the event
+	alert.LastSeenFunc = func(profileId, beaconId string) (bool, time.Time) {
+		return true, eventTime.Add(-24 * time.Hour)
+	}
+
+	geofenceEvent := GeofenceEvent{
+		Action:    ACTION_ENTRY,
+		BeaconId:  beacon.Id,
+		ProfileId: foo.Id,
+		CreatedAt: eventTime.Format(time.RFC3339),
+	}
+
+	// one day since last seen at the time of the event, so don't fire
+	fired, error := alert.Process(geofenceEvent)
+	assert.True(t, error == nil)
+	assert.False(t, fired)
+
+	// without a timestamp on the event, the alert's clock is used instead
+	geofenceEvent.CreatedAt = ""
+	fired2, error := alert.Process(geofenceEvent)
+	assert.True(t, error == nil)
+	assert.True(t, fired2)
+
+}
+
+func TestAllUsersPresentAlertRearming(t *testing.T) {
+
+	presence := NewPresenceHistory(SystemClock)
+	alert := NewAllUsersPresentAlert()
+	alert.Window = 30 * time.Minute
+	alert.Users = []OfficeRadarProfile{{OfficeRadarDoc: OfficeRadarDoc{Id: "foo"}}, {OfficeRadarDoc: OfficeRadarDoc{Id: "bar"}}}
+	alert.Beacons = []Beacon{{OfficeRadarDoc: OfficeRadarDoc{Id: "b1"}}}
+	alert.LastSeenFunc = presence.LastSeen
+	alert.PresentFunc = presence.IsPresent
+
+	start := time.Date(2014, 9, 2, 9, 0, 0, 0, time.UTC)
+	process := func(profileId, action string, minutes int) bool {
+		geofenceEvent := GeofenceEvent{Action: action, BeaconId: "b1", ProfileId: profileId, CreatedAt: start.Add(time.Duration(minutes) * time.Minute).Format(time.RFC3339)}
+		fired, err := alert.Process(geofenceEvent)
+		assert.True(t, err == nil)
+		presence.Record(geofenceEvent)
+		return fired
+	}
+
+	// firing disarms it, which is saved when it fires
+	process("foo", ACTION_ENTRY, 0)
+	assert.True(t, process("bar", ACTION_ENTRY, 5))
+	assert.DeepEquals(t, alert.Disarmed, []string{"b1"})
+	assert.False(t, alert.rearmed)
+
+	// once the group has dispersed, the next event re-arms it, which has to
+	// be saved on its own
+	process("foo", ACTION_EXIT, 10)
+	process("bar", ACTION_EXIT, 20)
+	assert.False(t, process("foo", ACTION_ENTRY, 120))
+	assert.DeepEquals(t, alert.Disarmed, []string{})
+	assert.True(t, alert.rearmed)
+
+	// unless it fires again right away
+	assert.True(t, process("bar", ACTION_ENTRY, 125))
+	assert.False(t, alert.rearmed)
+
+}
+
+func TestAllUsersPresentAlertCoPresence(t *testing.T) {
+
+	type step struct {
+		profileId string
+		beaconId  string
+		action    string
+		minutes   int // minutes after the start of the test
+		fires     bool
+	}
+
+	tests := []struct {
+		name   string
+		window time.Duration
+		users  []string
+		steps  []step
+	}{
+		{
+			name:   "simultaneously present",
+			window: 0,
+			steps: []step{
+				{"foo", "b1", ACTION_ENTRY, 0, false},
+				{"bar", "b1", ACTION_ENTRY, 5, true},
+			},
+		},
+		{
+			name:   "exited before the other arrived, no window",
+			window: 0,
+			steps: []step{
+				{"foo", "b1", ACTION_ENTRY, 0, false},
+				{"foo", "b1", ACTION_EXIT, 10, false},
+				{"bar", "b1", ACTION_ENTRY, 11, false},
+			},
+		},
+		{
+			name:   "exited within the window",
+			window: 30 * time.Minute,
+			steps: []step{
+				{"foo", "b1", ACTION_ENTRY, 0, false},
+				{"foo", "b1", ACTION_EXIT, 10, false},
+				{"bar", "b1", ACTION_ENTRY, 30, true},
+			},
+		},
+		{
+			name:   "exited outside the window",
+			window: 30 * time.Minute,
+			steps: []step{
+				{"foo", "b1", ACTION_ENTRY, 0, false},
+				{"foo", "b1", ACTION_EXIT, 10, false},
+				{"bar", "b1", ACTION_ENTRY, 60, false},
+			},
+		},
+		{
+			name:   "present for longer than the window",
+			window: 30 * time.Minute,
+			steps: []step{
+				{"foo", "b1", ACTION_ENTRY, 0, false},
+				{"bar", "b1", ACTION_ENTRY, 240, true},
+			},
+		},
+		{
+			name:   "different beacons",
+			window: 30 * time.Minute,
+			steps: []step{
+				{"foo", "b1", ACTION_ENTRY, 0, false},
+				{"bar", "b2", ACTION_ENTRY, 5, false},
+			},
+		},
+		{
+			name:   "exits never fire",
+			window: 30 * time.Minute,
+			steps: []step{
+				{"foo", "b1", ACTION_ENTRY, 0, false},
+				{"bar", "b1", ACTION_EXIT, 5, false},
+			},
+		},
+		{
+			name:   "fires once while the group stays together",
+			window: 30 * time.Minute,
+			steps: []step{
+				{"foo", "b1", ACTION_ENTRY, 0, false},
+				{"bar", "b1", ACTION_ENTRY, 5, true},
+				{"foo", "b1", ACTION_EXIT, 10, false},
+				{"foo", "b1", ACTION_ENTRY, 20, false},
+				{"bar", "b1", ACTION_ENTRY, 25, false},
+			},
+		},
+		{
+			name:   "re-arms after the group disperses",
+			window: 30 * time.Minute,
+			steps: []step{
+				{"foo", "b1", ACTION_ENTRY, 0, false},
+				{"bar", "b1", ACTION_ENTRY, 5, true},
+				{"foo", "b1", ACTION_EXIT, 10, false},
+				{"bar", "b1", ACTION_EXIT, 20, false},
+				{"foo", "b1", ACTION_ENTRY, 120, false},
+				{"bar", "b1", ACTION_ENTRY, 125, true},
+			},
+		},
+		{
+			name:   "re-arms when one user leaves and comes back",
+			window: 30 * time.Minute,
+			steps: []step{
+				{"foo", "b1", ACTION_ENTRY, 0, false},
+				{"bar", "b1", ACTION_ENTRY, 5, true},
+				{"foo", "b1", ACTION_EXIT, 10, false},
+				{"foo", "b1", ACTION_ENTRY, 120, true},
+			},
+		},
+		{
+			name:   "each beacon is armed separately",
+			window: 0,
+			steps: []step{
+				{"foo", "b1", ACTION_ENTRY, 0, false},
+				{"bar", "b1", ACTION_ENTRY, 5, true},
+				{"foo", "b2", ACTION_ENTRY, 10, false},
+				{"bar", "b2", ACTION_ENTRY, 15, true},
+			},
+		},
+		{
+			name:   "three users",
+			window: 0,
+			users:  []string{"foo", "bar", "baz"},
+			steps: []step{
+				{"foo", "b1", ACTION_ENTRY, 0, false},
+				{"bar", "b1", ACTION_ENTRY, 5, false},
+				{"foo", "b1", ACTION_EXIT, 6, false},
+				{"baz", "b1", ACTION_ENTRY, 10, false},
+				{"foo", "b1", ACTION_ENTRY, 15, true},
+			},
+		},
+	}
+
+	startTime := time.Date(2014, 9, 2, 9, 0, 0, 0, time.UTC)
+
+	for _, test := range tests {
+
+		users := test.users
+		if users == nil {
+			users = []string{"foo", "bar"}
+		}
+
+		alert := NewAllUsersPresentAlert()
+		alert.Window = test.window
+		for _, userId := range users {
+			alert.Users = append(alert.Users, OfficeRadarProfile{OfficeRadarDoc: OfficeRadarDoc{Id: userId}})
+		}
+		for _, beaconId := range []string{"b1", "b2"} {
+			alert.Beacons = append(alert.Beacons, Beacon{OfficeRadarDoc: OfficeRadarDoc{Id: beaconId}})
+		}
+
+		// record presence after processing each event, like the app server
+		presence := NewPresenceHistory(SystemClock)
+		alert.LastSeenFunc = presence.LastSeen
+		alert.PresentFunc = presence.IsPresent
+
+		for i, step := range test.steps {
+			geofenceEvent := GeofenceEvent{
+				Action:    step.action,
+				BeaconId:  step.beaconId,
+				ProfileId: step.profileId,
+				CreatedAt: startTime.Add(time.Duration(step.minutes) * time.Minute).Format(time.RFC3339),
+			}
+			fired, err := alert.Process(geofenceEvent)
+			assert.True(t, err == nil)
+			if fired != step.fires {
+				t.Errorf("%v: step %d: expected fired = %v, got %v", test.name, i, step.fires, fired)
+			}
+			presence.Record(geofenceEvent)
+		}
+
+	}
+
+}
@@ -2,6 +2,10 @@ package officeradar
 
 import "github.com/tleyden/go-couch"
 
+const (
+	DOC_TYPE_BEACON = "beacon"
+)
+
 type Beacon struct {
 	OfficeRadarDoc
 	Desc         string `json:"desc"`
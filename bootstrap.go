@@ -0,0 +1,182 @@
+package officeradar
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/ghodss/yaml"
+	"github.com/tleyden/go-couch"
+)
+
+// Alerts that should always exist, declared in a YAML or JSON config file
+// that is loaded at startup.  Each alert is a doc like the ones in a Fixture.
+type BootstrapConfig struct {
+	Alerts []FixtureDoc `json:"alerts"`
+}
+
+// Fields of an alert doc that are changed at runtime, by the alert firing or
+// by the admin api, rather than being part of the alert's definition.  They're
+// carried over from the stored alert, so that a restart doesn't reset them.
+var alertStateFields = []string{"ActiveOn", "Paused", "Disarmed", "Meetings"}
+
+// What bootstrapping did with each of the declared alerts
+type BootstrapResult struct {
+	FixtureImportResult
+	Skipped map[string][]string // the problems with the alerts that were skipped, by alert id
+}
+
+func ReadBootstrapConfig(reader io.Reader) (*BootstrapConfig, error) {
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid bootstrap config: %v", err)
+	}
+
+	config := &BootstrapConfig{}
+	if err := json.Unmarshal(jsonData, config); err != nil {
+		return nil, fmt.Errorf("Invalid bootstrap config: %v", err)
+	}
+	return config, nil
+
+}
+
+// Create or update the alerts declared in the config.  An alert that is
+// invalid or refers to beacons or profiles that don't exist is skipped and
+// reported, rather than stopping the app server from starting.
+func (o *OfficeRadarApp) BootstrapAlerts(config *BootstrapConfig) (*BootstrapResult, error) {
+
+	result, err := bootstrapAlerts(NewCouchFixtureStore(o.Database), *o.Validator, config)
+	if err != nil {
+		return nil, err
+	}
+
+	for alertId, problems := range result.Skipped {
+		Log.Warn("Skipped bootstrap alert", LogFields{"alert": alertId, "problems": problems})
+	}
+	Log.Info("Bootstrap alerts loaded", LogFields{
+		"created":   result.Inserted,
+		"updated":   result.Updated,
+		"unchanged": result.Unchanged,
+	})
+	return result, nil
+
+}
+
+func bootstrapAlerts(store FixtureStore, validator GeofenceEventValidator, config *BootstrapConfig) (*BootstrapResult, error) {
+
+	result := &BootstrapResult{Skipped: map[string][]string{}}
+	valid := []FixtureDoc{}
+
+	for i, doc := range config.Alerts {
+
+		alertId := doc.Id()
+		if alertId == "" {
+			alertId = fmt.Sprintf("alerts[%d]", i)
+		}
+
+		problems := alertProblems(doc, validator)
+		if len(problems) > 0 {
+			result.Skipped[alertId] = problems
+			continue
+		}
+
+		existing, exists, err := store.Get(doc.Id())
+		if err != nil {
+			return result, fmt.Errorf("Unable to get %v: %v", doc.Id(), err)
+		}
+		if exists {
+			doc = withAlertState(doc, existing)
+		}
+		valid = append(valid, doc)
+
+	}
+
+	imported, err := ImportFixture(store, &Fixture{Alerts: valid}, false, false)
+	if imported != nil {
+		result.FixtureImportResult = *imported
+	}
+	return result, err
+
+}
+
+// What's wrong with a declared alert, including references to beacons and
+// profiles that don't exist
+func alertProblems(doc FixtureDoc, validator GeofenceEventValidator) []string {
+
+	if doc.Id() == "" {
+		return []string{"no _id"}
+	}
+
+	alertJson, err := json.Marshal(doc)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	alert, err := DecodeAlert(couch.Database{}, alertJson, AlertServices{})
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	references := []struct {
+		field   string
+		ids     []string
+		docType string
+	}{
+		{"beacon", alert.BeaconIds(), DOC_TYPE_BEACON},
+		{"profile", alert.ProfileIds(), DOC_TYPE_PROFILE},
+		{"recipient", actionRecipients(alert), DOC_TYPE_PROFILE},
+	}
+
+	problems := []string{}
+	for _, reference := range references {
+		for _, docId := range reference.ids {
+			reasons, err := validator.validateReference(reference.field, docId, reference.docType)
+			if err != nil {
+				reasons = []string{err.Error()}
+			}
+			problems = append(problems, reasons...)
+		}
+	}
+	return problems
+
+}
+
+// A copy of the alert, w/o any runtime state
+func withoutAlertState(doc FixtureDoc) FixtureDoc {
+	copied := FixtureDoc{}
+	for key, value := range doc {
+		copied[key] = value
+	}
+	for _, field := range alertStateFields {
+		delete(copied, field)
+	}
+	return copied
+}
+
+// A copy of the declared alert, with the runtime state of the stored one
+func withAlertState(doc, stored FixtureDoc) FixtureDoc {
+	copied := FixtureDoc{}
+	for key, value := range doc {
+		copied[key] = value
+	}
+	for _, field := range alertStateFields {
+		if value, ok := stored[field]; ok {
+			copied[field] = value
+		}
+	}
+	return copied
+}
+
+func actionRecipients(alert Alerter) []string {
+	recipients := []string{}
+	alert.PerformActions(func(action AlertAction) error {
+		recipients = append(recipients, action.Recipient)
+		return nil
+	})
+	return recipients
+}
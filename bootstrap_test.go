@@ -0,0 +1,114 @@
+package officeradar
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestBootstrapAlerts(t *testing.T) {
+
+	store := newMemoryFixtureStore()
+	store.Put(FixtureDoc{"_id": "sfBeaconId", "type": DOC_TYPE_BEACON})
+	store.Put(FixtureDoc{"_id": "jensId", "type": DOC_TYPE_PROFILE})
+	store.Put(FixtureDoc{"_id": "traunsId", "type": DOC_TYPE_PROFILE})
+
+	validator := GeofenceEventValidator{
+		DocTypeFunc: func(docId string) (string, error) {
+			doc, _, _ := store.Get(docId)
+			return doc.Type(), nil
+		},
+	}
+
+	config, err := ReadBootstrapConfig(strings.NewReader(`
+alerts:
+  - _id: good_alert
+    type: any_users_present_alert
+    Beacon: {_id: sfBeaconId}
+    Users: [{_id: jensId}]
+    Actions: [{Recipient: traunsId, Message: Jens is here}]
+  - _id: missing_beacon_alert
+    type: any_users_present_alert
+    Beacon: {_id: mvBeaconId}
+    Users: [{_id: jensId}]
+  - _id: wrong_recipient_alert
+    type: any_users_present_alert
+    Beacon: {_id: sfBeaconId}
+    Users: [{_id: jensId}]
+    Actions: [{Recipient: sfBeaconId, Message: oops}]
+  - _id: invalid_alert
+    type: expression_alert
+    Expression: "event.action =="
+  - type: any_users_present_alert
+`))
+	assert.True(t, err == nil)
+
+	result, err := bootstrapAlerts(store, validator, config)
+	assert.True(t, err == nil)
+	assert.DeepEquals(t, result.Inserted, []string{"good_alert"})
+	assert.Equals(t, len(result.Skipped), 4)
+	assert.DeepEquals(t, result.Skipped["missing_beacon_alert"], []string{"beacon mvBeaconId does not exist"})
+	assert.DeepEquals(t, result.Skipped["wrong_recipient_alert"], []string{"recipient sfBeaconId is a beacon, not a profile"})
+	assert.Equals(t, len(result.Skipped["alerts[4]"]), 1)
+
+	// bootstrapping again leaves the alert alone
+	result, err = bootstrapAlerts(store, validator, config)
+	assert.True(t, err == nil)
+	assert.DeepEquals(t, result.Unchanged, []string{"good_alert"})
+
+}
+
+func TestBootstrapAlertsKeepsRuntimeState(t *testing.T) {
+
+	store := newMemoryFixtureStore()
+	store.Put(FixtureDoc{"_id": "sfBeaconId", "type": DOC_TYPE_BEACON})
+	store.Put(FixtureDoc{"_id": "traunsId", "type": DOC_TYPE_PROFILE})
+	validator := GeofenceEventValidator{
+		DocTypeFunc: func(docId string) (string, error) {
+			doc, _, _ := store.Get(docId)
+			return doc.Type(), nil
+		},
+	}
+	declare := func(message string) *BootstrapConfig {
+		return &BootstrapConfig{Alerts: []FixtureDoc{{
+			"_id":     "sf_alert",
+			"type":    "any_users_present_alert",
+			"Beacon":  map[string]interface{}{"_id": "sfBeaconId"},
+			"Actions": []interface{}{map[string]interface{}{"Recipient": "traunsId", "Message": message}},
+			"Sticky":  true,
+		}}}
+	}
+	_, err := bootstrapAlerts(store, validator, declare("Someone is here"))
+	assert.True(t, err == nil)
+
+	// the alert fires and is paused via the admin api
+	stored, _, _ := store.Get("sf_alert")
+	stored["Paused"] = true
+	stored["ActiveOn"] = "2014-09-02T10:00:00Z"
+	assert.True(t, store.Put(stored) == nil)
+
+	result, err := bootstrapAlerts(store, validator, declare("Someone is here"))
+	assert.True(t, err == nil)
+	assert.DeepEquals(t, result.Unchanged, []string{"sf_alert"})
+
+	// changing the definition updates it, but still leaves the state alone
+	result, err = bootstrapAlerts(store, validator, declare("Someone has arrived"))
+	assert.True(t, err == nil)
+	assert.DeepEquals(t, result.Updated, []string{"sf_alert"})
+	stored, _, _ = store.Get("sf_alert")
+	assert.Equals(t, stored["Paused"], true)
+	assert.Equals(t, stored["ActiveOn"], "2014-09-02T10:00:00Z")
+
+}
+
+func TestBootstrapAlertsExample(t *testing.T) {
+	file, err := os.Open("examples/bootstrap_alerts.yaml")
+	assert.True(t, err == nil)
+	defer file.Close()
+	config, err := ReadBootstrapConfig(file)
+	assert.True(t, err == nil)
+	assert.Equals(t, len(config.Alerts), 1)
+	assert.True(t, (&Fixture{Alerts: config.Alerts}).Validate() == nil)
+}
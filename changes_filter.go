@@ -0,0 +1,58 @@
+package officeradar
+
+import "strings"
+
+const (
+	SYNC_GATEWAY_CHANNEL_FILTER = "sync_gateway/bychannel"
+)
+
+// Restricts which changes the app server follows.  If Channels is set, the
+// changes feed is requested with the sync gateway channel filter so that only
+// documents in those channels are returned.  If DocTypes is set, any change
+// whose document type is not in the list is ignored after being retrieved.
+type ChangesFilter struct {
+	Channels []string // sync gateway channels to follow, eg, ["profiles", "alerts"]
+	DocTypes []string // document types to process, eg, ["profile", "geofence_event"]
+}
+
+// Parse comma separated lists of channels and doc types, as given on the
+// command line, into a ChangesFilter.
+func NewChangesFilter(channels, docTypes string) ChangesFilter {
+	return ChangesFilter{
+		Channels: splitCommaList(channels),
+		DocTypes: splitCommaList(docTypes),
+	}
+}
+
+// Add the filter parameters (if any) to the options passed to the changes feed
+func (f ChangesFilter) addOptions(options map[string]interface{}) {
+	if len(f.Channels) == 0 {
+		return
+	}
+	options["filter"] = SYNC_GATEWAY_CHANNEL_FILTER
+	options["channels"] = strings.Join(f.Channels, ",")
+}
+
+// Should a document of the given type be processed?
+func (f ChangesFilter) acceptsDocType(docType string) bool {
+	if len(f.DocTypes) == 0 {
+		return true
+	}
+	for _, acceptedType := range f.DocTypes {
+		if acceptedType == docType {
+			return true
+		}
+	}
+	return false
+}
+
+func splitCommaList(list string) []string {
+	result := []string{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
@@ -0,0 +1,36 @@
+package officeradar
+
+import (
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestChangesFilterChannels(t *testing.T) {
+
+	filter := NewChangesFilter(" profiles, alerts,,", "")
+	assert.DeepEquals(t, filter.Channels, []string{"profiles", "alerts"})
+
+	options := map[string]interface{}{}
+	filter.addOptions(options)
+	assert.Equals(t, options["filter"], SYNC_GATEWAY_CHANNEL_FILTER)
+	assert.Equals(t, options["channels"], "profiles,alerts")
+
+	// without any channels, the options are left alone
+	options = map[string]interface{}{}
+	NewChangesFilter("", "").addOptions(options)
+	assert.Equals(t, len(options), 0)
+
+}
+
+func TestChangesFilterDocTypes(t *testing.T) {
+
+	filter := NewChangesFilter("", "profile,geofence_event")
+	assert.True(t, filter.acceptsDocType(DOC_TYPE_PROFILE))
+	assert.True(t, filter.acceptsDocType(DOC_TYPE_GEOFENCE_EVENT))
+	assert.False(t, filter.acceptsDocType("beacon"))
+
+	// an empty filter accepts everything
+	assert.True(t, NewChangesFilter("", "").acceptsDocType("beacon"))
+
+}
@@ -0,0 +1,62 @@
+package officeradar
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/tleyden/go-couch"
+)
+
+const (
+	// local docs are not replicated and don't show up on the changes feed,
+	// so saving the checkpoint doesn't generate a change of its own.
+	CHECKPOINT_DOC_ID = "_local/officeradar_checkpoint"
+)
+
+// The last changes feed sequence that was completely processed by the app server
+type Checkpoint struct {
+	Id       string      `json:"_id"`
+	Revision string      `json:"_rev,omitempty"`
+	Since    interface{} `json:"since"`
+}
+
+// Load the saved checkpoint.  Returns an empty checkpoint (with a nil Since)
+// if none has been saved yet.
+func LoadCheckpoint(db couch.Database) (*Checkpoint, error) {
+	checkpoint := &Checkpoint{}
+	err := db.Retrieve(CHECKPOINT_DOC_ID, checkpoint)
+	if err != nil {
+		if isNotFound(err) {
+			return &Checkpoint{Id: CHECKPOINT_DOC_ID}, nil
+		}
+		return nil, err
+	}
+	return checkpoint, nil
+}
+
+// Save the checkpoint with the given since value, unless it is unchanged
+func (c *Checkpoint) Save(db couch.Database, since interface{}) error {
+
+	if since == nil || reflect.DeepEqual(since, c.Since) {
+		return nil
+	}
+	c.Id = CHECKPOINT_DOC_ID
+	c.Since = since
+
+	if c.Revision == "" {
+		_, rev, err := db.Insert(c)
+		if err != nil {
+			return fmt.Errorf("Unable to insert checkpoint: %v", err)
+		}
+		c.Revision = rev
+		return nil
+	}
+
+	rev, err := db.Edit(c)
+	if err != nil {
+		return fmt.Errorf("Unable to update checkpoint: %v", err)
+	}
+	c.Revision = rev
+	return nil
+
+}
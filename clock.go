@@ -0,0 +1,51 @@
+package officeradar
+
+import (
+	"sync"
+	"time"
+)
+
+// The source of the current time.  Everything in this package that needs to
+// know what time it is asks a Clock rather than calling time.Now() directly,
+// so that tests and replays of historical events can control the time.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (c systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// The clock that returns the actual wall-clock time
+var SystemClock Clock = systemClock{}
+
+// A clock that only changes when it is told to.  Useful for tests, and for
+// replaying events where "now" should be the time of the event being replayed.
+type ManualClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *ManualClock) Set(now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = now
+}
+
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
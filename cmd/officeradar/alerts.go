@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/ghodss/yaml"
+	"github.com/tleyden/officeradar-appserver"
+)
+
+// alerts manages the alerts the same way the admin api does, with the same
+// validation, but without needing the admin api to be enabled
+
+var (
+	alertsCommand        = kingpin.Command("alerts", "Manage the alerts")
+	alertsListCommand    = alertsCommand.Command("list", "List the alerts")
+	alertsCreateCommand  = alertsCommand.Command("create", "Create an alert")
+	alertFileDescription = "YAML or JSON file with the alert's definition, - for stdin"
+	alertFile            = alertsCreateCommand.Arg("file", alertFileDescription).Required().String()
+	alertsDeleteCommand  = alertsCommand.Command("delete", "Delete alerts")
+	alertIdsDescription  = "Ids of the alerts to delete"
+	alertIds             = alertsDeleteCommand.Arg("id", alertIdsDescription).Required().Strings()
+	alertsPreviewCommand = alertsCommand.Command("preview", "Show how often an alert would have fired, without saving it")
+	previewFile          = alertsPreviewCommand.Arg("file", alertFileDescription).Required().String()
+	previewSince         = alertsPreviewCommand.Flag("since", "Replay the events from this time (RFC3339)").Required().String()
+	previewUntil         = alertsPreviewCommand.Flag("until", "Replay the events up to this time (RFC3339, default: now)").String()
+)
+
+func listAlerts(config *officeradar.Config) {
+
+	officeRadarApp := newApp(config, true)
+	err := officeRadarApp.LoadAlerts()
+	kingpin.FatalIfError(err, "Error loading alerts")
+
+	adminAPI := officeradar.NewAdminAPI(officeRadarApp, "")
+	_, result, err := adminAPI.Call(context.Background(), "GET", "/alerts", nil)
+	kingpin.FatalIfError(err, "Unable to list alerts")
+	printJson(result)
+
+}
+
+func createAlert(config *officeradar.Config) {
+
+	alertJson := readAlertFile(*alertFile)
+	adminAPI := officeradar.NewAdminAPI(newApp(config, true), "")
+	_, result, err := adminAPI.Call(context.Background(), "POST", "/alerts", bytes.NewReader(alertJson))
+	kingpin.FatalIfError(err, "Unable to create alert")
+	printJson(result)
+
+}
+
+func previewAlert(config *officeradar.Config) {
+
+	since, err := parseTime(*previewSince)
+	if err != nil {
+		kingpin.UsageErrorf("Invalid --since: %v", err)
+		return
+	}
+	until, err := parseTime(*previewUntil)
+	if err != nil {
+		kingpin.UsageErrorf("Invalid --until: %v", err)
+		return
+	}
+
+	request := officeradar.AlertPreviewRequest{
+		Alert: readAlertFile(*previewFile),
+		Since: since,
+		Until: until,
+	}
+	requestJson, err := json.Marshal(request)
+	kingpin.FatalIfError(err, "Invalid alert")
+
+	adminAPI := officeradar.NewAdminAPI(newApp(config, true), "")
+	_, result, err := adminAPI.Call(context.Background(), "POST", "/alerts/preview", bytes.NewReader(requestJson))
+	kingpin.FatalIfError(err, "Unable to preview alert")
+	printJson(result)
+
+}
+
+// Read an alert definition as json, from a YAML or JSON file or - for stdin
+func readAlertFile(path string) []byte {
+
+	var definition []byte
+	var err error
+	if path == "-" {
+		definition, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		definition, err = ioutil.ReadFile(path)
+	}
+	kingpin.FatalIfError(err, "Unable to read alert")
+
+	// json is yaml too
+	alertJson, err := yaml.YAMLToJSON(definition)
+	kingpin.FatalIfError(err, "Invalid alert")
+	return alertJson
+
+}
+
+func deleteAlerts(config *officeradar.Config) {
+	adminAPI := officeradar.NewAdminAPI(newApp(config, true), "")
+	for _, alertId := range *alertIds {
+		_, result, err := adminAPI.Call(context.Background(), "DELETE", "/alerts/"+alertId, nil)
+		kingpin.FatalIfError(err, "Unable to delete alert")
+		printJson(result)
+	}
+}
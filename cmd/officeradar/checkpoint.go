@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/tleyden/officeradar-appserver"
+)
+
+// checkpoint shows or changes the changes feed sequence that serve resumes
+// from, eg, to skip over a backlog or to process changes again.  A running
+// server overwrites it, so it should be set while the server is stopped.
+
+var (
+	checkpointCommand          = kingpin.Command("checkpoint", "Show or change the checkpoint of the changes feed")
+	checkpointGetCommand       = checkpointCommand.Command("get", "Show the checkpoint")
+	checkpointSetCommand       = checkpointCommand.Command("set", "Change the checkpoint, while the server is stopped")
+	checkpointSinceDescription = "The sequence to resume from, eg, 0 to process every change again"
+	checkpointSince            = checkpointSetCommand.Arg("since", checkpointSinceDescription).Required().String()
+)
+
+func getCheckpoint(config *officeradar.Config) {
+
+	checkpoint, err := officeradar.LoadCheckpoint(newApp(config, true).Database)
+	kingpin.FatalIfError(err, "Unable to load checkpoint")
+	if checkpoint.Since == nil {
+		fmt.Println("no checkpoint saved")
+		return
+	}
+	printJson(checkpoint.Since)
+
+}
+
+func setCheckpoint(config *officeradar.Config) {
+
+	db := newApp(config, true).Database
+	checkpoint, err := officeradar.LoadCheckpoint(db)
+	kingpin.FatalIfError(err, "Unable to load checkpoint")
+
+	// sequences are numbers, unless sync gateway is sharded, eg, "12:34"
+	var since interface{} = *checkpointSince
+	if seq, err := strconv.ParseUint(*checkpointSince, 10, 64); err == nil {
+		since = seq
+	}
+	err = checkpoint.Save(db, since)
+	kingpin.FatalIfError(err, "Unable to save checkpoint")
+	fmt.Printf("checkpoint set to %v\n", *checkpointSince)
+
+}
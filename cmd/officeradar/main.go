@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/tleyden/officeradar-appserver"
+)
+
+// The OfficeRadar app server, and the tools for looking after it:
+//
+//	officeradar serve                       follow the changes feed and send the alerts' pushes
+//	officeradar seed                        write fake data, a simulated day or a fixture
+//	officeradar replay                      replay historical geofence events through the alerts
+//	officeradar alerts list|create|delete   manage the alerts, like the admin api does
+//	officeradar alerts preview              how often an alert would have fired
+//	officeradar presence show               where each profile was last seen
+//	officeradar push test <profile>         send a test push
+//	officeradar checkpoint get|set          the changes feed sequence that serve resumes from
+//
+// Every command is configured the same way, with a YAML or JSON config file
+// (see examples/officeradar.yaml), OFFICERADAR_* environment variables and
+// flags, each overriding the one before.
+
+var (
+	configDescription = "YAML or JSON config file"
+	configPath        = kingpin.Flag("config", configDescription).OverrideDefaultFromEnvar("OFFICERADAR_CONFIG").String()
+	printDescription  = "Print the config, with secrets redacted, and exit"
+	printConfig       = kingpin.Flag("print-config", printDescription).Bool()
+	jsonDescription   = "Write the logs as JSON objects, one per line (log.json)"
+	logJson           = kingpin.Flag("log-json", jsonDescription).Bool()
+)
+
+// Flags that override a setting of the config when they're given, by path
+var configFlags = map[string]*string{
+	"database.url":          kingpin.Flag("db-url", "Sync gateway url, with db name and no trailing slash").String(),
+	"database.username":     kingpin.Flag("db-username", "Sync gateway username").String(),
+	"database.password":     kingpin.Flag("db-password", "Sync gateway password").String(),
+	"database.auth":         kingpin.Flag("db-auth", "How to authenticate with sync gateway: basic or session").String(),
+	"database.session_id":   kingpin.Flag("db-session-id", "An existing sync gateway session to use").String(),
+	"database.ca_file":      kingpin.Flag("db-ca-file", "PEM file with the CA certificate for sync gateway's tls certificate").String(),
+	"database.cert_file":    kingpin.Flag("db-cert-file", "PEM file with a client certificate for sync gateway").String(),
+	"database.key_file":     kingpin.Flag("db-key-file", "PEM file with the key of the client certificate").String(),
+	"feed.mode":             kingpin.Flag("feed-mode", "How the changes feed is requested: longpoll or normal").String(),
+	"feed.channels":         kingpin.Flag("channels", "Comma separated list of sync gateway channels to follow (default: all)").String(),
+	"feed.doc_types":        kingpin.Flag("doc-types", "Comma separated list of doc types to process (default: all)").String(),
+	"notifier.backend":      kingpin.Flag("notifier", "Where the alerts' messages go: uniqush or log").String(),
+	"notifier.uniqush.url":  kingpin.Flag("uq-url", "Uniqush gateway url").String(),
+	"workers.count":         kingpin.Flag("workers", "Number of workers processing changes concurrently").String(),
+	"workers.queue_size":    kingpin.Flag("queue-size", "Max number of changes queued up per worker").String(),
+	"timeouts.shutdown":     kingpin.Flag("shutdown-timeout", "How long in-flight changes and pushes get to finish when shutting down").String(),
+	"timeouts.push":         kingpin.Flag("push-timeout", "How long each request to uniqush gets").String(),
+	"events.max_clock_skew": kingpin.Flag("max-clock-skew", "Reject geofence events timestamped further than this in the future").String(),
+	"events.max_event_age":  kingpin.Flag("max-event-age", "Reject geofence events timestamped further than this in the past (0 = no limit)").String(),
+	"events.entry_dwell":    kingpin.Flag("entry-dwell", "How long an entry must last without an exit before it counts").String(),
+	"events.exit_dwell":     kingpin.Flag("exit-dwell", "How long an exit must last without an entry before it counts").String(),
+	"quiet_hours.start":     kingpin.Flag("quiet-hours-start", "Time of day that pushes start being suppressed, eg, 22:00").String(),
+	"quiet_hours.end":       kingpin.Flag("quiet-hours-end", "Time of day that pushes stop being suppressed, eg, 07:00").String(),
+	"quiet_hours.time_zone": kingpin.Flag("quiet-hours-time-zone", "Time zone of the quiet hours, eg, America/Los_Angeles (default: UTC)").String(),
+	"bootstrap_alerts":      kingpin.Flag("bootstrap-alerts", "YAML or JSON file declaring alerts to create or update at startup").String(),
+	"admin.addr":            kingpin.Flag("admin-addr", "Address to serve the admin api on, eg, :8080 (default: disabled)").String(),
+	"admin.token":           kingpin.Flag("admin-token", "Bearer token that admin api requests must have").String(),
+	"status.addr":           kingpin.Flag("status-addr", "Address to serve /healthz, /readyz, /status and /metrics on, eg, :8081 (default: disabled)").String(),
+	"log.level":             kingpin.Flag("log-level", "Minimum level of the logs: debug, info, warn or error").String(),
+}
+
+func main() {
+
+	command := kingpin.Parse()
+
+	config, err := loadConfig()
+	if err != nil {
+		kingpin.Fatalf("%v", err)
+		return
+	}
+
+	if *printConfig {
+		if err := config.Print(os.Stdout); err != nil {
+			kingpin.Fatalf("Unable to print config: %v", err)
+		}
+		return
+	}
+
+	// the commands that don't send pushes don't need uniqush
+	if !sendsPushes(command) {
+		config.Notifier.Backend = officeradar.NOTIFIER_LOG
+	}
+	if problems := config.Validate(); len(problems) > 0 {
+		kingpin.Fatalf("Invalid config:\n  %v", strings.Join(problems, "\n  "))
+		return
+	}
+
+	level, _ := officeradar.ParseLogLevel(config.Log.Level)
+	officeradar.Log = officeradar.NewLogger(os.Stderr, level, config.Log.JSON)
+
+	switch command {
+	case serveCommand.FullCommand():
+		runServer(config)
+	case seedCommand.FullCommand():
+		seed(config)
+	case replayCommand.FullCommand():
+		replay(config)
+	case alertsListCommand.FullCommand():
+		listAlerts(config)
+	case alertsCreateCommand.FullCommand():
+		createAlert(config)
+	case alertsDeleteCommand.FullCommand():
+		deleteAlerts(config)
+	case alertsPreviewCommand.FullCommand():
+		previewAlert(config)
+	case presenceShowCommand.FullCommand():
+		showPresence(config)
+	case pushTestCommand.FullCommand():
+		testPush(config)
+	case checkpointGetCommand.FullCommand():
+		getCheckpoint(config)
+	case checkpointSetCommand.FullCommand():
+		setCheckpoint(config)
+	}
+
+}
+
+func sendsPushes(command string) bool {
+	switch command {
+	case serveCommand.FullCommand(), pushTestCommand.FullCommand():
+		return true
+	case replayCommand.FullCommand():
+		return *replayNotifications == "real"
+	}
+	return false
+}
+
+// The defaults, overridden by the config file, the environment and then the
+// flags (and serve's args) that were given
+func loadConfig() (*officeradar.Config, error) {
+
+	config := officeradar.DefaultConfig()
+
+	if *configPath != "" {
+		file, err := os.Open(*configPath)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open config: %v", err)
+		}
+		defer file.Close()
+		if err := config.Load(file); err != nil {
+			return nil, fmt.Errorf("%v: %v", *configPath, err)
+		}
+	}
+
+	if err := config.ApplyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	for _, flags := range []map[string]*string{configFlags, serveArgs} {
+		for path, value := range flags {
+			if *value == "" {
+				continue
+			}
+			if err := config.Set(path, *value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if *logJson {
+		config.Log.JSON = true
+	}
+
+	return config, nil
+
+}
+
+// Create and initialize the app according to the config.  Apart from serve,
+// the commands use a dry run app, so that they don't schedule any timers or
+// record any firings of their own.
+func newApp(config *officeradar.Config, dryRun bool) *officeradar.OfficeRadarApp {
+
+	officeRadarApp, err := officeradar.NewOfficeRadarAppFromConfig(config)
+	kingpin.FatalIfError(err, "Invalid config")
+	officeRadarApp.DryRun = dryRun
+
+	err = officeRadarApp.InitApp()
+	kingpin.FatalIfError(err, "Error initializing officeradar app")
+	officeRadarApp.Validator.MaxClockSkew = time.Duration(config.Events.MaxClockSkew)
+	officeRadarApp.Validator.MaxEventAge = time.Duration(config.Events.MaxEventAge)
+	return officeRadarApp
+
+}
+
+// Write the result of a command to stdout as indented JSON
+func printJson(result interface{}) {
+	resultJson, err := json.MarshalIndent(result, "", "  ")
+	kingpin.FatalIfError(err, "Unable to encode result")
+	fmt.Println(string(resultJson))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/tleyden/officeradar-appserver"
+)
+
+// presence shows where each profile was last seen, going by the geofence
+// events stored in sync gateway, the same way the app server works it out
+// when it starts up
+
+var (
+	presenceCommand     = kingpin.Command("presence", "Show where the profiles are")
+	presenceShowCommand = presenceCommand.Command("show", "Show where each profile was last seen")
+	profileDescription  = "Only show this profile"
+	presenceProfile     = presenceShowCommand.Flag("profile", profileDescription).String()
+	beaconDescription   = "Only show this beacon"
+	presenceBeacon      = presenceShowCommand.Flag("beacon", beaconDescription).String()
+	allDescription      = "Also show the beacons that the profiles have left since"
+	presenceAll         = presenceShowCommand.Flag("all", allDescription).Bool()
+)
+
+func showPresence(config *officeradar.Config) {
+
+	officeRadarApp := newApp(config, true)
+	events, err := officeradar.LoadGeofenceEvents(officeRadarApp.Database)
+	kingpin.FatalIfError(err, "Error loading geofence events")
+
+	presence := officeradar.NewPresenceHistory(officeradar.SystemClock)
+	for _, geofenceEvent := range events {
+		presence.Record(geofenceEvent)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "PROFILE\tBEACON\tPRESENT\tLAST SEEN")
+	for _, entry := range presence.Entries() {
+		switch {
+		case *presenceProfile != "" && entry.ProfileId != *presenceProfile:
+		case *presenceBeacon != "" && entry.BeaconId != *presenceBeacon:
+		case !entry.Present && !*presenceAll:
+		default:
+			lastSeen := entry.LastSeen.Format(time.RFC3339)
+			fmt.Fprintf(writer, "%v\t%v\t%v\t%v\n", entry.ProfileId, entry.BeaconId, entry.Present, lastSeen)
+		}
+	}
+	writer.Flush()
+
+}
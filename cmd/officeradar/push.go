@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/tleyden/officeradar-appserver"
+)
+
+// push sends a push through the configured notifier, eg, to check that a
+// profile's device token made it into uniqush
+
+const PUSH_TEST_ALERT_ID = "push_test"
+
+var (
+	pushCommand            = kingpin.Command("push", "Send pushes")
+	pushTestCommand        = pushCommand.Command("test", "Send a test push to a profile")
+	pushProfileDescription = "Id of the profile to send the push to"
+	pushProfile            = pushTestCommand.Arg("profile", pushProfileDescription).Required().String()
+	messageDescription     = "The message of the push"
+	pushMessage            = pushTestCommand.Flag("message", messageDescription).Default("Test push from OfficeRadar").String()
+)
+
+func testPush(config *officeradar.Config) {
+
+	officeRadarApp := newApp(config, true)
+
+	store := officeradar.NewCouchFixtureStore(officeRadarApp.Database)
+	doc, exists, err := store.Get(*pushProfile)
+	kingpin.FatalIfError(err, "Unable to get profile")
+	if !exists || doc.Type() != officeradar.DOC_TYPE_PROFILE {
+		kingpin.Fatalf("Profile %v not found", *pushProfile)
+		return
+	}
+
+	ctx := context.Background()
+	if officeRadarApp.PushTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, officeRadarApp.PushTimeout)
+		defer cancel()
+	}
+
+	action := officeradar.AlertAction{Recipient: *pushProfile, Message: *pushMessage}
+	err = officeRadarApp.Notifier.Notify(ctx, PUSH_TEST_ALERT_ID, action)
+	kingpin.FatalIfError(err, "Unable to send push")
+	fmt.Printf("sent %q to %v\n", *pushMessage, *pushProfile)
+
+}
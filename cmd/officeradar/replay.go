@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/tleyden/officeradar-appserver"
+)
+
+// replay replays historical geofence events through the alerts, eg, to find
+// out why an alert did or didn't fire last Tuesday.  The alerts are loaded from
+// sync gateway or a fixture, w/o their current runtime state, and nothing is
+// written back to sync gateway.
+
+var (
+	replayCommand       = kingpin.Command("replay", "Replay historical geofence events through the alerts, without writing anything")
+	fileDescription     = "Read the events from this JSONL file rather than sync gateway"
+	eventsFile          = replayCommand.Flag("file", fileDescription).String()
+	alertsDescription   = "Read the alerts from this YAML or JSON fixture or export rather than sync gateway"
+	alertsFile          = replayCommand.Flag("alerts", alertsDescription).String()
+	sinceSeqDescription = "Replay the events stored after this sequence"
+	sinceSeq            = replayCommand.Flag("since-seq", sinceSeqDescription).Default("0").Int()
+	untilSeqDescription = "Replay the events stored up to this sequence (0 = no limit)"
+	untilSeq            = replayCommand.Flag("until-seq", untilSeqDescription).Default("0").Int()
+	fromDescription     = "Replay the events that happened at or after this time (RFC3339)"
+	from                = replayCommand.Flag("from", fromDescription).String()
+	toDescription       = "Replay the events that happened at or before this time (RFC3339)"
+	to                  = replayCommand.Flag("to", toDescription).String()
+	speedupDescription  = "Speed-up factor, eg, 60 replays an hour per minute (0 = as fast as possible)"
+	speedup             = replayCommand.Flag("speedup", speedupDescription).Default("0").Float64()
+	notifyDescription   = "Where alert messages go: real (the configured notifier), log or record"
+	replayNotifications = replayCommand.Flag("notifications", notifyDescription).Default("log").String()
+)
+
+func replay(config *officeradar.Config) {
+
+	fromTime, err := parseTime(*from)
+	if err != nil {
+		kingpin.UsageErrorf("Invalid --from: %v", err)
+		return
+	}
+	toTime, err := parseTime(*to)
+	if err != nil {
+		kingpin.UsageErrorf("Invalid --to: %v", err)
+		return
+	}
+
+	officeRadarApp := newApp(config, true)
+
+	// the clock follows the events as they are replayed
+	clock := officeradar.NewManualClock(time.Now())
+	officeRadarApp.SetClock(clock)
+
+	var recorder *officeradar.RecordingNotifier
+	switch *replayNotifications {
+	case "real":
+	case "log":
+		officeRadarApp.Notifier = officeradar.LogNotifier{}
+	case "record":
+		recorder = officeradar.NewRecordingNotifier(clock)
+		officeRadarApp.Notifier = recorder
+	default:
+		kingpin.UsageErrorf("Unknown notifications: %v", *replayNotifications)
+		return
+	}
+
+	history, err := officeradar.LoadGeofenceEvents(officeRadarApp.Database)
+	kingpin.FatalIfError(err, "Error loading geofence events")
+
+	events := history
+	switch {
+	case *eventsFile != "":
+		events, err = readEventsFile(*eventsFile)
+	case *sinceSeq > 0 || *untilSeq > 0:
+		events, err = officeradar.LoadGeofenceEventsBetween(
+			officeRadarApp.Database,
+			uint64(*sinceSeq),
+			uint64(*untilSeq),
+		)
+	}
+	kingpin.FatalIfError(err, "Error loading events to replay")
+
+	// alerts are loaded as of the start of the replay, so that scheduled
+	// alerts get their first timer at the right time
+	if startTime, ok := firstEventTime(events, fromTime); ok {
+		clock.Set(startTime)
+	}
+	alerts, err := replayAlerts(officeRadarApp)
+	kingpin.FatalIfError(err, "Error loading alerts")
+	officeRadarApp.LoadReplayAlerts(alerts)
+
+	options := officeradar.ReplayOptions{
+		From:    fromTime,
+		To:      toTime,
+		Speedup: *speedup,
+	}
+
+	// stop replaying on ctrl-c (or SIGTERM), but still print the notifications
+	// of the events that were replayed by then
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	replayed, err := officeRadarApp.ReplayEvents(ctx, history, events, options)
+	if err != nil && ctx.Err() != nil {
+		officeradar.Log.Warn("Replay interrupted", officeradar.LogFields{"events": replayed})
+	} else {
+		kingpin.FatalIfError(err, "Error replaying events")
+		officeradar.Log.Info("Replayed events", officeradar.LogFields{"events": replayed})
+	}
+
+	if recorder != nil {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, notification := range recorder.Notifications() {
+			encoder.Encode(notification)
+		}
+	}
+
+}
+
+// The alert docs from the --alerts fixture, or else from sync gateway
+func replayAlerts(officeRadarApp *officeradar.OfficeRadarApp) ([]officeradar.FixtureDoc, error) {
+
+	if *alertsFile == "" {
+		fixture, err := officeradar.ExportFixture(officeradar.NewCouchFixtureStore(officeRadarApp.Database))
+		if err != nil {
+			return nil, err
+		}
+		return fixture.Alerts, nil
+	}
+
+	file, err := os.Open(*alertsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	fixture, err := officeradar.ReadFixture(file)
+	if err != nil {
+		return nil, err
+	}
+	return fixture.Alerts, nil
+
+}
+
+func readEventsFile(path string) ([]officeradar.GeofenceEvent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return officeradar.ReadGeofenceEvents(file)
+}
+
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// The time of the earliest event that will be replayed
+func firstEventTime(events []officeradar.GeofenceEvent, from time.Time) (time.Time, bool) {
+	var first time.Time
+	for _, geofenceEvent := range events {
+		eventTime, err := geofenceEvent.CreatedAtTime()
+		if err != nil || eventTime.Before(from) {
+			continue
+		}
+		if first.IsZero() || eventTime.Before(first) {
+			first = eventTime
+		}
+	}
+	return first, !first.IsZero()
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/tleyden/go-couch"
+	"github.com/tleyden/officeradar-appserver"
+)
+
+// seed writes data for trying out or testing the app server: a couple of fake
+// docs, a simulated organization and a day of its geofence events, or a
+// fixture.  It can also export the database as a fixture.
+
+var (
+	seedCommand           = kingpin.Command("seed", "Write fake data, a simulated day or a fixture to the database")
+	simDescription        = "Simulate a day of geofence events for an organization"
+	simulate              = seedCommand.Flag("simulate", simDescription).Bool()
+	usersDescription      = "Number of users in the simulated organization"
+	numUsers              = seedCommand.Flag("users", usersDescription).Default("20").Int()
+	beaconsDescription    = "Number of beacons in the simulated organization"
+	numBeacons            = seedCommand.Flag("beacons", beaconsDescription).Default("10").Int()
+	dayDescription        = "Day to simulate, eg, 2014-09-02 (default: yesterday)"
+	day                   = seedCommand.Flag("day", dayDescription).String()
+	simSpeedupDescription = "Write events as they happen, sped up by this factor, eg, 60 writes an hour per minute (0 = all at once)"
+	simSpeedup            = seedCommand.Flag("speedup", simSpeedupDescription).Default("0").Float64()
+	seedDescription       = "Random seed, the same seed always simulates the same day"
+	randomSeed            = seedCommand.Flag("seed", seedDescription).Default("1").Int()
+	flapDescription       = "Chance that an entry or exit flaps"
+	flapProbability       = seedCommand.Flag("flap", flapDescription).Default("0.05").Float64()
+	importDescription     = "Load beacons, profiles, alerts and events from this YAML or JSON fixture"
+	importFile            = seedCommand.Flag("import", importDescription).String()
+	pruneDescription      = "When importing, delete the docs that aren't in the fixture, for the sections the fixture has"
+	prune                 = seedCommand.Flag("prune", pruneDescription).Bool()
+	dryRunDescription     = "When importing, only show what would change"
+	dryRun                = seedCommand.Flag("dry-run", dryRunDescription).Bool()
+	exportDescription     = "Export the database to this fixture file (.json for JSON, otherwise YAML, - for stdout)"
+	exportFile            = seedCommand.Flag("export", exportDescription).String()
+)
+
+func seed(config *officeradar.Config) {
+
+	db := newApp(config, true).Database
+
+	switch {
+	case *importFile != "":
+		importFixture(db, *importFile)
+	case *exportFile != "":
+		exportFixture(db, *exportFile)
+	case *simulate:
+		runSimulation(db)
+	default:
+		createFakeData(db)
+	}
+
+}
+
+func importFixture(db couch.Database, path string) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		kingpin.Fatalf("Could not open fixture: %v", err)
+	}
+	defer file.Close()
+
+	fixture, err := officeradar.ReadFixture(file)
+	if err != nil {
+		kingpin.Fatalf("Could not read fixture: %v", err)
+	}
+
+	store := officeradar.NewCouchFixtureStore(db)
+	result, err := officeradar.ImportFixture(store, fixture, *prune, *dryRun)
+	if err != nil {
+		kingpin.Fatalf("Could not import fixture: %v", err)
+	}
+	fmt.Printf("inserted: %v\n", result.Inserted)
+	fmt.Printf("updated: %v\n", result.Updated)
+	fmt.Printf("unchanged: %d docs\n", len(result.Unchanged))
+	fmt.Printf("pruned: %v\n", result.Pruned)
+
+}
+
+func exportFixture(db couch.Database, path string) {
+
+	fixture, err := officeradar.ExportFixture(officeradar.NewCouchFixtureStore(db))
+	if err != nil {
+		kingpin.Fatalf("Could not export fixture: %v", err)
+	}
+
+	writer := os.Stdout
+	if path != "-" {
+		file, err := os.Create(path)
+		if err != nil {
+			kingpin.Fatalf("Could not create fixture: %v", err)
+		}
+		defer file.Close()
+		writer = file
+	}
+
+	asJson := strings.HasSuffix(path, ".json")
+	if err := fixture.Write(writer, asJson); err != nil {
+		kingpin.Fatalf("Could not write fixture: %v", err)
+	}
+
+}
+
+// A couple of beacons and profiles, and a single event that has no action or
+// timestamp.  Loading it again leaves the existing docs alone.
+const fakeDataFixture = `
+beacons:
+  - {_id: sfBeaconId, desc: sf beacon}
+  - {_id: mvBeaconId, desc: mv beacon}
+profiles:
+  - {_id: jensId}
+  - {_id: traunsId}
+events:
+  - {_id: geofenceId, beacon: sfBeaconId, profile: jensId}
+`
+
+func createFakeData(db couch.Database) {
+
+	fixture, err := officeradar.ReadFixture(strings.NewReader(fakeDataFixture))
+	if err != nil {
+		kingpin.Fatalf("Could not read fake data: %v", err)
+	}
+
+	store := officeradar.NewCouchFixtureStore(db)
+	_, err = officeradar.ImportFixture(store, fixture, false, false)
+	if err != nil {
+		kingpin.Fatalf("Could not insert fake data: %v", err)
+	}
+
+}
+
+// Write a simulated organization and a day of its geofence events.  When
+// sped up, each event is written when it would have happened and is stamped
+// with the time it was written, so that the app server sees it as current.
+// Otherwise the events keep their simulated times, so the day has to be over,
+// or the validator would reject the events that are in the future.
+func runSimulation(db couch.Database) {
+
+	midnight := time.Now().UTC().Truncate(24 * time.Hour).Add(-24 * time.Hour)
+	if *day != "" {
+		parsed, err := time.Parse("2006-01-02", *day)
+		if err != nil {
+			kingpin.UsageErrorf("Invalid day: %v", err)
+			return
+		}
+		midnight = parsed
+	}
+	if *simSpeedup <= 0 && midnight.Add(24*time.Hour).After(time.Now()) {
+		kingpin.UsageErrorf("Day %v isn't over yet, simulate an earlier day or use --speedup", midnight.Format("2006-01-02"))
+		return
+	}
+
+	simulation := officeradar.NewSimulation(officeradar.SimulationConfig{
+		NumUsers:        *numUsers,
+		NumBeacons:      *numBeacons,
+		Seed:            int64(*randomSeed),
+		FlapProbability: *flapProbability,
+	})
+
+	for _, beacon := range simulation.Beacons {
+		insertSimulatedDoc(db, beacon.Id, beacon)
+	}
+	for _, profile := range simulation.Profiles {
+		insertSimulatedDoc(db, profile.Id, profile)
+	}
+
+	events := simulation.Day(midnight)
+	officeradar.Log.Info("Simulating events", officeradar.LogFields{"events": len(events), "day": midnight.Format("2006-01-02")})
+
+	startedAt := time.Now()
+	firstEventAt := midnight
+	if len(events) > 0 {
+		firstEventAt, _ = events[0].CreatedAtTime()
+	}
+	for i, geofenceEvent := range events {
+		if *simSpeedup > 0 {
+			simulatedAt, _ := geofenceEvent.CreatedAtTime()
+			writeAt := startedAt.Add(time.Duration(float64(simulatedAt.Sub(firstEventAt)) / *simSpeedup))
+			time.Sleep(writeAt.Sub(time.Now()))
+			geofenceEvent.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+		}
+		insertSimulatedDoc(db, geofenceEvent.Id, geofenceEvent)
+		if (i+1)%100 == 0 {
+			officeradar.Log.Info("Wrote events", officeradar.LogFields{"written": i + 1, "events": len(events)})
+		}
+	}
+	officeradar.Log.Info("Finished simulating events", officeradar.LogFields{"events": len(events)})
+
+}
+
+// Insert a doc, leaving it alone if it already exists from an earlier run
+func insertSimulatedDoc(db couch.Database, docId string, doc interface{}) {
+	_, _, err := db.Insert(doc)
+	switch {
+	case err == nil:
+	case strings.Contains(err.Error(), "409"):
+		officeradar.Log.Info("Skipping doc that already exists", officeradar.LogFields{"doc": docId})
+	default:
+		kingpin.Fatalf("Could not insert %v: %v", docId, err)
+	}
+}
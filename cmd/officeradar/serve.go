@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/tleyden/officeradar-appserver"
+)
+
+// serve follows the changes feed of the OfficeRadar sync gateway database and:
+//   - When a profile document is changed, it updates Uniqush with the subscribe/device token
+//   - When a geofence event comes in, or an alert's timer is due, it fires the alerts
+//     that it triggers
+
+var (
+	serveCommand     = kingpin.Command("serve", "Follow the changes feed, and send the alerts' pushes")
+	sgUrlDescription = "Sync gateway url, with db name and no trailing slash (database.url)"
+	uqUrlDescription = "Uniqush gateway url (notifier.uniqush.url)"
+	sinceDescription = "Since parameter to changes feed (feed.since)"
+)
+
+// serve's args, which override the config like the flags do, by path
+var serveArgs = map[string]*string{
+	"database.url":         serveCommand.Arg("sg-url", sgUrlDescription).String(),
+	"notifier.uniqush.url": serveCommand.Arg("uq-url", uqUrlDescription).String(),
+	"feed.since":           serveCommand.Arg("since", sinceDescription).String(),
+}
+
+// Once in-flight changes have finished (or been given up on), how long there is
+// left to save the checkpoint before exiting anyway
+var checkpointTimeout = 10 * time.Second
+
+func runServer(config *officeradar.Config) {
+
+	officeRadarApp := newApp(config, false)
+	shutdownTimeout := officeRadarApp.ShutdownTimeout
+
+	// stop on SIGTERM (eg, from docker or systemd) or ctrl-c
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	servers := []*http.Server{}
+
+	// serve the status before loading the alerts, so that it's clear
+	// when the app server is up but not ready yet
+	if config.Status.Addr != "" {
+		statusServer := officeradar.NewStatusServer(officeRadarApp)
+		servers = append(servers, serve("status", config.Status.Addr, statusServer))
+	}
+
+	if config.BootstrapAlerts != "" {
+		loadBootstrapAlerts(officeRadarApp, config.BootstrapAlerts)
+	}
+
+	err := officeRadarApp.LoadAlerts()
+	if err != nil {
+		officeradar.Log.Panic("Error loading alerts", officeradar.LogFields{"error": err})
+	}
+
+	followerDone := make(chan struct{})
+	go func() {
+		defer close(followerDone)
+		officeRadarApp.FollowChangesFeed(ctx, config.Feed.Since)
+	}()
+
+	if config.Admin.Addr != "" {
+		adminAPI := officeradar.NewAdminAPI(officeRadarApp, config.Admin.Token)
+		servers = append(servers, serve("admin api", config.Admin.Addr, adminAPI))
+	}
+
+	<-ctx.Done()
+	stop() // a second signal kills it right away
+
+	officeradar.Log.Info("Shutting down", officeradar.LogFields{"timeout": shutdownTimeout})
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout+checkpointTimeout)
+	defer cancel()
+
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			officeradar.Log.Error("Unable to shut down server", officeradar.LogFields{"addr": server.Addr, "error": err})
+		}
+	}
+
+	select {
+	case <-followerDone:
+		officeradar.Log.Info("Shut down")
+	case <-shutdownCtx.Done():
+		officeradar.Log.Error("Timed out shutting down")
+		os.Exit(1)
+	}
+
+}
+
+// Problems with the declared alerts are logged, but don't stop the server
+func loadBootstrapAlerts(officeRadarApp *officeradar.OfficeRadarApp, path string) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		officeradar.Log.Error("Unable to open bootstrap alerts", officeradar.LogFields{"path": path, "error": err})
+		return
+	}
+	defer file.Close()
+
+	config, err := officeradar.ReadBootstrapConfig(file)
+	if err != nil {
+		officeradar.Log.Error("Unable to read bootstrap alerts", officeradar.LogFields{"path": path, "error": err})
+		return
+	}
+
+	_, err = officeRadarApp.BootstrapAlerts(config)
+	if err != nil {
+		officeradar.Log.Error("Unable to bootstrap alerts", officeradar.LogFields{"error": err})
+	}
+
+}
+
+// Serve the handler in the background, until the returned server is shut down
+func serve(name, addr string, handler http.Handler) *http.Server {
+	server := &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+	go func() {
+		officeradar.Log.Info("Serving "+name, officeradar.LogFields{"addr": addr})
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			officeradar.Log.Panic("Error serving "+name, officeradar.LogFields{"error": err})
+		}
+	}()
+	return server
+}
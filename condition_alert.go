@@ -0,0 +1,176 @@
+package officeradar
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	DOC_TYPE_CONDITION_ALERT = "condition_alert"
+
+	// local docs don't show up on the changes feed, so saving the state
+	// doesn't cause the alert to be reloaded, or race with edits of the alert
+	ALERT_STATE_DOC_PREFIX = "_local/officeradar_alert_state:"
+)
+
+// A geofence alert triggered when its tree of conditions is true for an
+// event.  This lets users build alerts in the app out of simple conditions,
+// rather than being limited to the fixed alert types.
+// Eg, "Tell me when anyone enters the SF office before 8am after not having
+// been there for two weeks"
+type ConditionAlert struct {
+	BaseAlert
+	Condition     *Condition     // the root of the condition tree
+	LastSeenFunc  LastSeenFunc   `json:"-"` // determine when last seen user at beacon
+	PresentFunc   PresentFunc    `json:"-"` // determine whether user is still at beacon
+	Sequences     *SequenceState `json:"-"` // state of the sequence conditions, saved in its own doc
+	stateRevision string
+}
+
+// The doc the state of an alert is saved in, separately from the alert
+type alertStateDoc struct {
+	Id        string         `json:"_id"`
+	Revision  string         `json:"_rev,omitempty"`
+	Sequences *SequenceState `json:"sequences"`
+}
+
+func alertStateDocId(alertId string) string {
+	return ALERT_STATE_DOC_PREFIX + alertId
+}
+
+func NewConditionAlert() *ConditionAlert {
+	alert := &ConditionAlert{}
+	alert.Type = DOC_TYPE_CONDITION_ALERT
+	return alert
+}
+
+func (a *ConditionAlert) Validate() error {
+	if err := a.Condition.Validate(); err != nil {
+		return fmt.Errorf("Invalid condition in alert %v: %v", a.Id, err)
+	}
+	return nil
+}
+
+func (a *ConditionAlert) Process(e GeofenceEvent) (bool, error) {
+
+	if a.LastSeenFunc == nil {
+		Log.Panic("no LastSeenFunc defined.")
+	}
+
+	if a.Condition == nil {
+		return false, fmt.Errorf("Alert %v has no condition", a.Id)
+	}
+
+	if a.Sequences == nil {
+		a.Sequences = NewSequenceState()
+	}
+
+	ctx := ConditionContext{
+		Event:        e,
+		EventTime:    e.EventTime(a.clock()),
+		LastSeenFunc: a.LastSeenFunc,
+		PresentFunc:  a.PresentFunc,
+		Sequences:    a.Sequences,
+		BeaconFunc:   a.fetchBeacon,
+		ProfileFunc:  a.fetchProfile,
+	}
+	return a.Condition.Evaluate(ctx)
+
+}
+
+// Save the state of the sequence conditions if it changed, so that a sequence
+// that's half way through isn't forgotten on restart
+func (a *ConditionAlert) SaveState() error {
+
+	if a.Sequences == nil || !a.Sequences.takeChanged() {
+		return nil
+	}
+
+	stateDoc := &alertStateDoc{Id: alertStateDocId(a.Id), Revision: a.stateRevision, Sequences: a.Sequences}
+	var rev string
+	var err error
+	if stateDoc.Revision == "" {
+		_, rev, err = a.database.Insert(stateDoc)
+	} else {
+		rev, err = a.database.Edit(stateDoc)
+	}
+	if err != nil {
+		// try again after the next event
+		a.Sequences.markChanged()
+		return err
+	}
+	a.stateRevision = rev
+	return nil
+
+}
+
+// Load the state of the sequence conditions, if any was saved
+func (a *ConditionAlert) LoadState() error {
+
+	stateDoc := &alertStateDoc{}
+	err := a.database.Retrieve(alertStateDocId(a.Id), stateDoc)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	a.Sequences = stateDoc.Sequences
+	a.stateRevision = stateDoc.Revision
+	return nil
+
+}
+
+// A changed alert carries on from the state of the previous version
+func (a *ConditionAlert) keepState(previous Alerter) {
+	previousAlert, ok := previous.(*ConditionAlert)
+	if !ok {
+		return
+	}
+	previousAlert.lock()
+	defer previousAlert.unlock()
+	a.Sequences = previousAlert.Sequences
+	a.stateRevision = previousAlert.stateRevision
+}
+
+func (a *ConditionAlert) fetchBeacon(beaconId string) (*Beacon, error) {
+	return FetchBeacon(a.database, beaconId)
+}
+
+func (a *ConditionAlert) fetchProfile(profileId string) (*OfficeRadarProfile, error) {
+	return FetchOfficeRadarProfile(a.database, profileId)
+}
+
+func (a *ConditionAlert) BeaconIds() []string {
+	if a.Condition == nil {
+		return []string{}
+	}
+	beaconIds, _ := a.Condition.indexRestrictions()
+	return beaconIds
+}
+
+func (a *ConditionAlert) ProfileIds() []string {
+	if a.Condition == nil {
+		return []string{}
+	}
+	_, profileIds := a.Condition.indexRestrictions()
+	return profileIds
+}
+
+func (a *ConditionAlert) RescheduleOrDelete(firedAt time.Time) error {
+
+	// if it's sticky, then update the alert's activeOn time
+	if a.Sticky {
+		a.ActiveOn = firedAt.Add(a.ReactivateAfter)
+		rev, err := a.database.Edit(a)
+		if err == nil {
+			a.Revision = rev
+		}
+		return err
+	}
+
+	// otherwise, delete the alert
+	err := a.database.Delete(a.Id, a.Revision)
+	return err
+
+}
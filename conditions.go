@@ -0,0 +1,444 @@
+package officeradar
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Condition operators
+const (
+	CONDITION_AND                  = "and"                  // all Conditions are true
+	CONDITION_OR                   = "or"                   // any of Conditions is true
+	CONDITION_NOT                  = "not"                  // Condition is false
+	CONDITION_SEQUENCE             = "sequence"             // First was true, then Then is true within Duration
+	CONDITION_BEACON_IN            = "beacon_in"            // the event's beacon is in Ids
+	CONDITION_PROFILE_IN           = "profile_in"           // the event's profile is in Ids
+	CONDITION_ACTION_IS            = "action_is"            // the event's action is Action
+	CONDITION_TIME_OF_DAY          = "time_of_day"          // the event happened between After and Before
+	CONDITION_LAST_SEEN_OLDER_THAN = "last_seen_older_than" // profile not seen at beacon for Duration
+	CONDITION_CO_PRESENT           = "co_present"           // all of Ids are in range of the beacon
+	CONDITION_EXPRESSION           = "expression"           // Expression is true, see Expression
+)
+
+// A node in a tree of conditions which is evaluated against a geofence event.
+// The tree is serialized as JSON inside a condition alert doc, eg:
+//
+//	{"op": "and", "conditions": [
+//	  {"op": "beacon_in", "ids": ["sfBeaconId"]},
+//	  {"op": "action_is", "action": "entry"},
+//	  {"op": "last_seen_older_than", "duration": "336h"}
+//	]}
+//
+// Durations are strings in time.ParseDuration format, and times of day are
+// in 24h "15:04" format.
+type Condition struct {
+	Op         string       `json:"op"`
+	Conditions []*Condition `json:"conditions,omitempty"` // and, or
+	Condition  *Condition   `json:"condition,omitempty"`  // not
+	First      *Condition   `json:"first,omitempty"`      // sequence
+	Then       *Condition   `json:"then,omitempty"`       // sequence
+	Ids        []string     `json:"ids,omitempty"`        // beacon_in, profile_in, co_present
+	Action     string       `json:"action,omitempty"`     // action_is
+	After      string       `json:"after,omitempty"`      // time_of_day
+	Before     string       `json:"before,omitempty"`     // time_of_day
+	TimeZone   string       `json:"time_zone,omitempty"`  // time_of_day, empty means UTC
+	Duration   string       `json:"duration,omitempty"`   // sequence, last_seen_older_than, co_present (only without a PresentFunc)
+	Expression string       `json:"expression,omitempty"` // expression
+	compiled   *Expression
+}
+
+// What a condition is evaluated against
+type ConditionContext struct {
+	Event        GeofenceEvent
+	EventTime    time.Time
+	LastSeenFunc LastSeenFunc
+	PresentFunc  PresentFunc // if nil, co_present falls back to LastSeenFunc and its Duration
+	Sequences    *SequenceState
+	BeaconFunc   func(beaconId string) (*Beacon, error)              // for expressions
+	ProfileFunc  func(profileId string) (*OfficeRadarProfile, error) // for expressions
+	path         string                                              // where the condition is in the tree, eg, "/conditions/0/first"
+}
+
+// Remembers when the first half of each sequence condition was last true,
+// keyed by the path of the sequence condition in the tree, so that it can be
+// saved and survive a restart.
+// Sequences are not restricted to a single profile, so that conditions like
+// "Jens arrives, then Traun arrives within an hour" can be expressed.
+type SequenceState struct {
+	mutex     sync.Mutex
+	firstSeen map[string]time.Time
+	changed   bool // since it was last saved
+}
+
+func NewSequenceState() *SequenceState {
+	return &SequenceState{firstSeen: map[string]time.Time{}}
+}
+
+func (s *SequenceState) MarshalJSON() ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return json.Marshal(s.firstSeen)
+}
+
+func (s *SequenceState) UnmarshalJSON(data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.firstSeen = map[string]time.Time{}
+	return json.Unmarshal(data, &s.firstSeen)
+}
+
+// Whether the state changed since the last call, ie, whether it needs saving
+func (s *SequenceState) takeChanged() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	changed := s.changed
+	s.changed = false
+	return changed
+}
+
+func (s *SequenceState) markChanged() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.changed = true
+}
+
+// Check that the condition tree is well formed
+func (c *Condition) Validate() error {
+
+	if c == nil {
+		return fmt.Errorf("Missing condition")
+	}
+
+	switch c.Op {
+	case CONDITION_AND, CONDITION_OR:
+		if len(c.Conditions) == 0 {
+			return fmt.Errorf("%v condition requires conditions", c.Op)
+		}
+		for _, child := range c.Conditions {
+			if err := child.Validate(); err != nil {
+				return err
+			}
+		}
+	case CONDITION_NOT:
+		return c.Condition.Validate()
+	case CONDITION_SEQUENCE:
+		if err := c.First.Validate(); err != nil {
+			return err
+		}
+		if err := c.Then.Validate(); err != nil {
+			return err
+		}
+		_, err := c.duration()
+		return err
+	case CONDITION_BEACON_IN, CONDITION_PROFILE_IN:
+		if len(c.Ids) == 0 {
+			return fmt.Errorf("%v condition requires ids", c.Op)
+		}
+	case CONDITION_ACTION_IS:
+		if c.Action != ACTION_ENTRY && c.Action != ACTION_EXIT {
+			return fmt.Errorf("Invalid action: %q", c.Action)
+		}
+	case CONDITION_TIME_OF_DAY:
+		if _, err := c.location(); err != nil {
+			return err
+		}
+		if _, err := minuteOfDay(c.After); err != nil {
+			return err
+		}
+		if _, err := minuteOfDay(c.Before); err != nil {
+			return err
+		}
+	case CONDITION_LAST_SEEN_OLDER_THAN:
+		_, err := c.duration()
+		return err
+	case CONDITION_CO_PRESENT:
+		if len(c.Ids) == 0 {
+			return fmt.Errorf("%v condition requires ids", c.Op)
+		}
+		if c.Duration != "" {
+			_, err := c.duration()
+			return err
+		}
+	case CONDITION_EXPRESSION:
+		compiled, err := CompileExpression(c.Expression)
+		if err != nil {
+			return err
+		}
+		c.compiled = compiled
+	default:
+		return fmt.Errorf("Unknown condition op: %q", c.Op)
+	}
+	return nil
+
+}
+
+// Evaluate the condition tree for the event in the context.  And/or don't
+// short-circuit, so that every sequence condition in the tree sees every event.
+func (c *Condition) Evaluate(ctx ConditionContext) (bool, error) {
+
+	e := ctx.Event
+
+	switch c.Op {
+	case CONDITION_AND, CONDITION_OR:
+		result := c.Op == CONDITION_AND
+		for i, child := range c.Conditions {
+			childResult, err := child.Evaluate(ctx.child(fmt.Sprintf("conditions/%v", i)))
+			if err != nil {
+				return false, err
+			}
+			if c.Op == CONDITION_AND {
+				result = result && childResult
+			} else {
+				result = result || childResult
+			}
+		}
+		return result, nil
+	case CONDITION_NOT:
+		result, err := c.Condition.Evaluate(ctx.child("condition"))
+		return !result, err
+	case CONDITION_SEQUENCE:
+		return c.evaluateSequence(ctx)
+	case CONDITION_BEACON_IN:
+		return containsString(c.Ids, e.BeaconId), nil
+	case CONDITION_PROFILE_IN:
+		return containsString(c.Ids, e.ProfileId), nil
+	case CONDITION_ACTION_IS:
+		return e.Action == c.Action, nil
+	case CONDITION_TIME_OF_DAY:
+		return c.evaluateTimeOfDay(ctx)
+	case CONDITION_LAST_SEEN_OLDER_THAN:
+		minLastSeenAgo, err := c.duration()
+		if err != nil {
+			return false, err
+		}
+		haveSeen, lastSeenAt := ctx.lastSeen(e.ProfileId, e.BeaconId)
+		if !haveSeen {
+			return true, nil
+		}
+		return ctx.EventTime.Sub(lastSeenAt) >= minLastSeenAgo, nil
+	case CONDITION_CO_PRESENT:
+		return c.evaluateCoPresent(ctx)
+	case CONDITION_EXPRESSION:
+		if c.compiled == nil {
+			if err := c.Validate(); err != nil {
+				return false, err
+			}
+		}
+		env := ExpressionEnv{
+			Event:        e,
+			EventTime:    ctx.EventTime,
+			LastSeenFunc: ctx.LastSeenFunc,
+			BeaconFunc:   ctx.BeaconFunc,
+			ProfileFunc:  ctx.ProfileFunc,
+		}
+		return c.compiled.Evaluate(env)
+	}
+	return false, fmt.Errorf("Unknown condition op: %q", c.Op)
+
+}
+
+// Restrictions on which events could possibly satisfy the condition, for the
+// alert index.  Only restrictions that every matching event must satisfy are
+// returned, and none at all if there are sequences (which need to see events
+// that don't satisfy the rest of the tree).
+func (c *Condition) indexRestrictions() (beaconIds []string, profileIds []string) {
+
+	if c.containsOp(CONDITION_SEQUENCE) {
+		return []string{}, []string{}
+	}
+
+	switch c.Op {
+	case CONDITION_BEACON_IN:
+		return c.Ids, []string{}
+	case CONDITION_PROFILE_IN:
+		return []string{}, c.Ids
+	case CONDITION_AND:
+		// the first restriction of each kind will do, since all must hold
+		beaconIds, profileIds = []string{}, []string{}
+		for _, child := range c.Conditions {
+			childBeaconIds, childProfileIds := child.indexRestrictions()
+			if len(beaconIds) == 0 {
+				beaconIds = childBeaconIds
+			}
+			if len(profileIds) == 0 {
+				profileIds = childProfileIds
+			}
+		}
+		return beaconIds, profileIds
+	}
+	return []string{}, []string{}
+
+}
+
+func (c *Condition) containsOp(op string) bool {
+	if c == nil {
+		return false
+	}
+	if c.Op == op {
+		return true
+	}
+	for _, child := range append([]*Condition{c.Condition, c.First, c.Then}, c.Conditions...) {
+		if child.containsOp(op) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Condition) evaluateSequence(ctx ConditionContext) (bool, error) {
+
+	within, err := c.duration()
+	if err != nil {
+		return false, err
+	}
+	firstResult, err := c.First.Evaluate(ctx.child("first"))
+	if err != nil {
+		return false, err
+	}
+	thenResult, err := c.Then.Evaluate(ctx.child("then"))
+	if err != nil {
+		return false, err
+	}
+
+	state := ctx.Sequences
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	// the first half must have happened on an earlier event
+	firstSeenAt, haveSeenFirst := state.firstSeen[ctx.path]
+	if firstResult {
+		state.firstSeen[ctx.path] = ctx.EventTime
+		state.changed = true
+	}
+
+	if !thenResult || !haveSeenFirst {
+		return false, nil
+	}
+	elapsed := ctx.EventTime.Sub(firstSeenAt)
+	if elapsed < 0 || elapsed > within {
+		return false, nil
+	}
+
+	// start over, so one first half doesn't satisfy many second halves
+	if !firstResult {
+		delete(state.firstSeen, ctx.path)
+		state.changed = true
+	}
+	return true, nil
+
+}
+
+// Everyone else has to be in range of the beacon, ie, entered and not exited
+// since, so someone who just left doesn't count
+func (c *Condition) evaluateCoPresent(ctx ConditionContext) (bool, error) {
+
+	e := ctx.Event
+	var window time.Duration
+	if ctx.PresentFunc == nil {
+		var err error
+		if window, err = c.duration(); err != nil {
+			return false, err
+		}
+	}
+
+	for _, profileId := range c.Ids {
+		if profileId == e.ProfileId {
+			// the user associated w/ geofence event is here now, unless
+			// they just left
+			if e.Action != ACTION_ENTRY {
+				return false, nil
+			}
+			continue
+		}
+		if ctx.PresentFunc != nil {
+			if !ctx.PresentFunc(profileId, e.BeaconId) {
+				return false, nil
+			}
+			continue
+		}
+		haveSeen, lastSeenAt := ctx.lastSeen(profileId, e.BeaconId)
+		if !haveSeen || ctx.EventTime.Sub(lastSeenAt) > window {
+			return false, nil
+		}
+	}
+	return true, nil
+
+}
+
+func (c *Condition) evaluateTimeOfDay(ctx ConditionContext) (bool, error) {
+
+	location, err := c.location()
+	if err != nil {
+		return false, err
+	}
+	after, err := minuteOfDay(c.After)
+	if err != nil {
+		return false, err
+	}
+	before, err := minuteOfDay(c.Before)
+	if err != nil {
+		return false, err
+	}
+
+	eventTime := ctx.EventTime.In(location)
+	minute := eventTime.Hour()*60 + eventTime.Minute()
+
+	if after <= before {
+		return minute >= after && minute < before, nil
+	}
+	// the range wraps around midnight, eg, 22:00 - 06:00
+	return minute >= after || minute < before, nil
+
+}
+
+func (c *Condition) duration() (time.Duration, error) {
+	duration, err := time.ParseDuration(c.Duration)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid duration %q for %v condition: %v", c.Duration, c.Op, err)
+	}
+	return duration, nil
+}
+
+func (c *Condition) location() (*time.Location, error) {
+	if c.TimeZone == "" {
+		return time.UTC, nil
+	}
+	location, err := time.LoadLocation(c.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid time zone %q: %v", c.TimeZone, err)
+	}
+	return location, nil
+}
+
+// The context for evaluating a child of the condition
+func (ctx ConditionContext) child(name string) ConditionContext {
+	ctx.path = ctx.path + "/" + name
+	return ctx
+}
+
+func (ctx ConditionContext) lastSeen(profileId, beaconId string) (bool, time.Time) {
+	if ctx.LastSeenFunc == nil {
+		return false, time.Time{}
+	}
+	return ctx.LastSeenFunc(profileId, beaconId)
+}
+
+// Parse a 24h "15:04" time of day into the number of minutes since midnight
+func minuteOfDay(timeOfDay string) (int, error) {
+	parsed, err := time.Parse("15:04", timeOfDay)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time of day %q, expected eg, 10:30: %v", timeOfDay, err)
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+func containsString(items []string, item string) bool {
+	for _, candidate := range items {
+		if candidate == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,218 @@
+package officeradar
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func parseCondition(t *testing.T, conditionJson string) *Condition {
+	condition := &Condition{}
+	err := json.Unmarshal([]byte(conditionJson), condition)
+	if err != nil {
+		t.Fatalf("Unable to parse %v: %v", conditionJson, err)
+	}
+	if err := condition.Validate(); err != nil {
+		t.Fatalf("Invalid condition %v: %v", conditionJson, err)
+	}
+	return condition
+}
+
+func TestConditionEvaluate(t *testing.T) {
+
+	// 9am on a tuesday
+	eventTime := time.Date(2014, 9, 2, 9, 0, 0, 0, time.UTC)
+
+	lastSeen := map[string]time.Time{
+		"foo": eventTime.Add(-21 * 24 * time.Hour),
+		"bar": eventTime.Add(-10 * time.Minute),
+	}
+	lastSeenFunc := func(profileId, beaconId string) (bool, time.Time) {
+		lastSeenAt, ok := lastSeen[profileId]
+		return ok, lastSeenAt
+	}
+
+	// qux was there a minute ago, but has left since
+	lastSeen["qux"] = eventTime.Add(-time.Minute)
+	present := map[string]bool{"bar": true}
+	presentFunc := func(profileId, beaconId string) bool {
+		return present[profileId]
+	}
+
+	e := GeofenceEvent{Action: ACTION_ENTRY, BeaconId: "sf", ProfileId: "foo"}
+
+	tests := []struct {
+		condition string
+		expected  bool
+	}{
+		{`{"op": "beacon_in", "ids": ["mv", "sf"]}`, true},
+		{`{"op": "beacon_in", "ids": ["mv"]}`, false},
+		{`{"op": "profile_in", "ids": ["foo"]}`, true},
+		{`{"op": "action_is", "action": "exit"}`, false},
+		{`{"op": "time_of_day", "after": "08:00", "before": "10:00"}`, true},
+		{`{"op": "time_of_day", "after": "08:00", "before": "10:00", "time_zone": "America/Los_Angeles"}`, false},
+		{`{"op": "time_of_day", "after": "22:00", "before": "06:00", "time_zone": "America/Los_Angeles"}`, true},
+		{`{"op": "last_seen_older_than", "duration": "336h"}`, true},
+		{`{"op": "last_seen_older_than", "duration": "720h"}`, false},
+		{`{"op": "co_present", "ids": ["foo", "bar"]}`, true},
+		{`{"op": "co_present", "ids": ["foo", "baz"]}`, false},
+		{`{"op": "co_present", "ids": ["foo", "qux"]}`, false},
+		{`{"op": "not", "condition": {"op": "action_is", "action": "exit"}}`, true},
+		{`{"op": "and", "conditions": [
+			{"op": "beacon_in", "ids": ["sf"]},
+			{"op": "action_is", "action": "entry"},
+			{"op": "last_seen_older_than", "duration": "336h"}
+		]}`, true},
+		{`{"op": "and", "conditions": [
+			{"op": "beacon_in", "ids": ["sf"]},
+			{"op": "action_is", "action": "exit"}
+		]}`, false},
+		{`{"op": "or", "conditions": [
+			{"op": "beacon_in", "ids": ["mv"]},
+			{"op": "profile_in", "ids": ["foo"]}
+		]}`, true},
+	}
+
+	for _, test := range tests {
+		condition := parseCondition(t, test.condition)
+		ctx := ConditionContext{
+			Event:        e,
+			EventTime:    eventTime,
+			LastSeenFunc: lastSeenFunc,
+			PresentFunc:  presentFunc,
+			Sequences:    NewSequenceState(),
+		}
+		result, err := condition.Evaluate(ctx)
+		assert.True(t, err == nil)
+		if result != test.expected {
+			t.Errorf("%v: expected %v, got %v", test.condition, test.expected, result)
+		}
+	}
+
+}
+
+func TestConditionSequence(t *testing.T) {
+
+	// jens arrives in sf, then traun arrives in sf within an hour
+	condition := parseCondition(t, `{"op": "sequence", "duration": "1h",
+		"first": {"op": "and", "conditions": [
+			{"op": "profile_in", "ids": ["jens"]}, {"op": "beacon_in", "ids": ["sf"]}]},
+		"then": {"op": "and", "conditions": [
+			{"op": "profile_in", "ids": ["traun"]}, {"op": "beacon_in", "ids": ["sf"]}]}
+	}`)
+
+	start := time.Date(2014, 9, 2, 9, 0, 0, 0, time.UTC)
+	sequences := NewSequenceState()
+	evaluate := func(profileId string, at time.Time) bool {
+		ctx := ConditionContext{
+			Event:     GeofenceEvent{Action: ACTION_ENTRY, BeaconId: "sf", ProfileId: profileId},
+			EventTime: at,
+			Sequences: sequences,
+		}
+		result, err := condition.Evaluate(ctx)
+		assert.True(t, err == nil)
+		return result
+	}
+
+	// wrong order
+	assert.False(t, evaluate("traun", start))
+	assert.False(t, evaluate("jens", start.Add(time.Minute)))
+	assert.True(t, sequences.takeChanged())
+	assert.False(t, sequences.takeChanged())
+
+	// the state is saved w/ the alert, eg, across a restart
+	marshalled, err := json.Marshal(sequences)
+	assert.True(t, err == nil)
+	assert.Equals(t, string(marshalled), `{"":"2014-09-02T09:01:00Z"}`)
+	sequences = &SequenceState{}
+	assert.True(t, json.Unmarshal(marshalled, sequences) == nil)
+
+	// in order, within the window
+	assert.True(t, evaluate("traun", start.Add(30*time.Minute)))
+
+	// the first half was used up
+	assert.False(t, evaluate("traun", start.Add(40*time.Minute)))
+
+	// in order, but too far apart
+	assert.False(t, evaluate("jens", start.Add(2*time.Hour)))
+	assert.False(t, evaluate("traun", start.Add(4*time.Hour)))
+
+	// sequences can't be indexed, since the first half is needed too
+	beaconIds, profileIds := condition.indexRestrictions()
+	assert.Equals(t, len(beaconIds), 0)
+	assert.Equals(t, len(profileIds), 0)
+
+}
+
+func TestConditionValidate(t *testing.T) {
+
+	invalid := []string{
+		`{"op": "bogus"}`,
+		`{"op": "and", "conditions": []}`,
+		`{"op": "not"}`,
+		`{"op": "beacon_in"}`,
+		`{"op": "action_is", "action": "entered"}`,
+		`{"op": "time_of_day", "after": "8am", "before": "10:00"}`,
+		`{"op": "last_seen_older_than", "duration": "two weeks"}`,
+		`{"op": "sequence", "first": {"op": "action_is", "action": "entry"}, "duration": "1h"}`,
+	}
+	for _, conditionJson := range invalid {
+		condition := &Condition{}
+		assert.True(t, json.Unmarshal([]byte(conditionJson), condition) == nil)
+		if condition.Validate() == nil {
+			t.Errorf("Expected %v to be invalid", conditionJson)
+		}
+	}
+
+}
+
+func TestConditionAlertIndexRestrictions(t *testing.T) {
+
+	alert := NewConditionAlert()
+	alert.Condition = parseCondition(t, `{"op": "and", "conditions": [
+		{"op": "beacon_in", "ids": ["sf"]},
+		{"op": "or", "conditions": [
+			{"op": "profile_in", "ids": ["foo"]}, {"op": "action_is", "action": "exit"}]}
+	]}`)
+	assert.DeepEquals(t, alert.BeaconIds(), []string{"sf"})
+	assert.Equals(t, len(alert.ProfileIds()), 0)
+
+	alert.LastSeenFunc = func(profileId, beaconId string) (bool, time.Time) {
+		return false, time.Time{}
+	}
+	fired, err := alert.Process(GeofenceEvent{Action: ACTION_ENTRY, BeaconId: "sf", ProfileId: "foo"})
+	assert.True(t, err == nil)
+	assert.True(t, fired)
+
+}
+
+func TestConditionAlertKeepsStateWhenReindexed(t *testing.T) {
+
+	app := NewOfficeRadarApp("", "")
+	alertDoc := func(revision string) []byte {
+		return []byte(`{"_id": "condition_alert", "_rev": "` + revision + `", "type": "condition_alert",
+			"Condition": {"op": "beacon_in", "ids": ["sfBeaconId"]}}`)
+	}
+
+	app.processChangedAlert("condition_alert", alertDoc("1-a"), Log)
+	indexed, ok := app.AlertIndex.Get("condition_alert")
+	assert.True(t, ok)
+	alert := indexed.(*ConditionAlert)
+	alert.Sequences = NewSequenceState()
+	alert.Sequences.firstSeen["/first"] = time.Date(2014, 9, 2, 9, 0, 0, 0, time.UTC)
+
+	// the app's own edit comes back through the changes feed, and is skipped
+	alert.Revision = "2-b"
+	app.processChangedAlert("condition_alert", alertDoc("2-b"), Log)
+	indexed, _ = app.AlertIndex.Get("condition_alert")
+	assert.True(t, indexed == Alerter(alert))
+
+	// someone else's edit replaces the alert, but keeps its sequence state
+	app.processChangedAlert("condition_alert", alertDoc("3-c"), Log)
+	indexed, _ = app.AlertIndex.Get("condition_alert")
+	assert.False(t, indexed == Alerter(alert))
+	assert.True(t, indexed.(*ConditionAlert).Sequences == alert.Sequences)
+
+}
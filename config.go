@@ -0,0 +1,479 @@
+package officeradar
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+)
+
+const (
+	CONFIG_ENV_PREFIX = "OFFICERADAR_" // eg, OFFICERADAR_DATABASE_URL for database.url
+)
+
+// Notifier backends
+const (
+	NOTIFIER_UNIQUSH = "uniqush" // push notifications via uniqush
+	NOTIFIER_LOG     = "log"     // only log the messages
+)
+
+// The configuration of the app server.  It starts out with the defaults, and
+// then each of a YAML or JSON config file, the environment and the command
+// line flags override what came before.  Every setting has a path, eg,
+// "feed.poll_interval", which is also used for its environment variable, eg,
+// OFFICERADAR_FEED_POLL_INTERVAL.
+type Config struct {
+	Database        DatabaseConfig   `json:"database"`
+	Feed            FeedConfig       `json:"feed"`
+	Notifier        NotifierConfig   `json:"notifier"`
+	Workers         WorkersConfig    `json:"workers"`
+	Timeouts        TimeoutsConfig   `json:"timeouts"`
+	Events          EventsConfig     `json:"events"`
+	QuietHours      QuietHoursConfig `json:"quiet_hours"`
+	Admin           AdminConfig      `json:"admin"`
+	Status          StatusConfig     `json:"status"`
+	Log             LogConfig        `json:"log"`
+	BootstrapAlerts string           `json:"bootstrap_alerts"` // YAML or JSON file declaring alerts, see BootstrapConfig
+}
+
+// The sync gateway database, and how to authenticate with it if it isn't
+// the admin port, see SyncGatewayAuth
+type DatabaseConfig struct {
+	URL       string `json:"url"`  // with db name and no trailing slash
+	Auth      string `json:"auth"` // basic or session, empty means basic if there's a username
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	SessionId string `json:"session_id"`
+	CAFile    string `json:"ca_file"`
+	CertFile  string `json:"cert_file"`
+	KeyFile   string `json:"key_file"`
+}
+
+func (c DatabaseConfig) syncGatewayAuth() *SyncGatewayAuth {
+	auth := SyncGatewayAuth{
+		Mode:      c.Auth,
+		Username:  c.Username,
+		Password:  c.Password,
+		SessionId: c.SessionId,
+		CAFile:    c.CAFile,
+		CertFile:  c.CertFile,
+		KeyFile:   c.KeyFile,
+	}
+	if auth == (SyncGatewayAuth{}) {
+		return nil
+	}
+	return &auth
+}
+
+type FeedConfig struct {
+	Mode         string         `json:"mode"`  // longpoll or normal
+	Since        string         `json:"since"` // where to start, instead of the checkpoint
+	Channels     []string       `json:"channels"`
+	DocTypes     []string       `json:"doc_types"`
+	Timeout      ConfigDuration `json:"timeout"`       // longpoll only
+	PollInterval ConfigDuration `json:"poll_interval"` // normal only
+}
+
+type NotifierConfig struct {
+	Backend string        `json:"backend"` // uniqush or log
+	Uniqush UniqushConfig `json:"uniqush"`
+}
+
+type UniqushConfig struct {
+	URL      string `json:"url"`
+	Username string `json:"username"` // if uniqush is behind a proxy with basic auth
+	Password string `json:"password"`
+}
+
+type WorkersConfig struct {
+	Count     int `json:"count"`      // number of workers processing changes concurrently
+	QueueSize int `json:"queue_size"` // max number of changes queued up per worker
+}
+
+type TimeoutsConfig struct {
+	Shutdown ConfigDuration `json:"shutdown"` // how long in-flight changes and pushes get to finish
+	Push     ConfigDuration `json:"push"`     // each request to uniqush
+}
+
+// How geofence events are validated and debounced
+type EventsConfig struct {
+	MaxClockSkew ConfigDuration `json:"max_clock_skew"`
+	MaxEventAge  ConfigDuration `json:"max_event_age"` // zero means no limit
+	EntryDwell   ConfigDuration `json:"entry_dwell"`
+	ExitDwell    ConfigDuration `json:"exit_dwell"`
+}
+
+// The default quiet hours, if any, eg, 22:00 - 07:00, during which pushes
+// are suppressed
+type QuietHoursConfig struct {
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	TimeZone string `json:"time_zone"`
+}
+
+type AdminConfig struct {
+	Addr  string `json:"addr"` // empty means disabled
+	Token string `json:"token"`
+}
+
+type StatusConfig struct {
+	Addr string `json:"addr"` // empty means disabled
+}
+
+type LogConfig struct {
+	Level string `json:"level"`
+	JSON  bool   `json:"json"`
+}
+
+// A duration, which is written as a string in the config, eg, "30s"
+type ConfigDuration time.Duration
+
+func (d ConfigDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *ConfigDuration) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("Invalid duration %v, expected eg, \"30s\"", string(data))
+	}
+	duration, err := time.ParseDuration(text)
+	if err != nil {
+		return fmt.Errorf("Invalid duration %q, expected eg, \"30s\"", text)
+	}
+	*d = ConfigDuration(duration)
+	return nil
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Feed: FeedConfig{
+			Mode:         FEED_MODE_LONGPOLL,
+			Timeout:      ConfigDuration(DEFAULT_FEED_TIMEOUT),
+			PollInterval: ConfigDuration(DEFAULT_POLL_INTERVAL),
+		},
+		Notifier: NotifierConfig{Backend: NOTIFIER_UNIQUSH},
+		Workers: WorkersConfig{
+			Count:     DEFAULT_NUM_WORKERS,
+			QueueSize: DEFAULT_WORKER_QUEUE_SIZE,
+		},
+		Timeouts: TimeoutsConfig{
+			Shutdown: ConfigDuration(DEFAULT_SHUTDOWN_TIMEOUT),
+			Push:     ConfigDuration(UNIQUSH_TIMEOUT),
+		},
+		Events: EventsConfig{MaxClockSkew: ConfigDuration(DEFAULT_MAX_CLOCK_SKEW)},
+		Log:    LogConfig{Level: "info"},
+	}
+}
+
+// Override the config with the settings in a YAML or JSON config file.
+// Settings that aren't in the file are left alone, and unknown settings are
+// an error, since they're most likely typos.
+func (c *Config) Load(reader io.Reader) error {
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return fmt.Errorf("Invalid config: %v", err)
+	}
+	if string(jsonData) == "null" {
+		return nil // empty file
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("Invalid config: %v", err)
+	}
+	return nil
+
+}
+
+// Override the config with the environment variables that are set, via a
+// func like os.LookupEnv
+func (c *Config) ApplyEnv(lookupEnv func(name string) (string, bool)) error {
+	for _, path := range ConfigPaths() {
+		if value, ok := lookupEnv(ConfigEnvName(path)); ok {
+			if err := c.Set(path, value); err != nil {
+				return fmt.Errorf("%v: %v", ConfigEnvName(path), err)
+			}
+		}
+	}
+	return nil
+}
+
+// The name of the environment variable for the setting
+func ConfigEnvName(path string) string {
+	return CONFIG_ENV_PREFIX + strings.ToUpper(strings.Replace(path, ".", "_", -1))
+}
+
+// The paths of all of the settings, eg, "database.url"
+func ConfigPaths() []string {
+	return configPaths(reflect.TypeOf(Config{}), "")
+}
+
+func configPaths(configType reflect.Type, prefix string) []string {
+	paths := []string{}
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		path := prefix + configFieldName(field)
+		if field.Type.Kind() == reflect.Struct {
+			paths = append(paths, configPaths(field.Type, path+".")...)
+			continue
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func configFieldName(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("json"), ",")[0]
+}
+
+// Override a setting with its string form, eg, from a flag.  Lists are comma
+// separated and durations are in time.ParseDuration format.
+func (c *Config) Set(path, value string) error {
+
+	field := reflect.ValueOf(c).Elem()
+	for _, name := range strings.Split(path, ".") {
+		if field.Kind() != reflect.Struct {
+			return fmt.Errorf("Unknown setting: %v", path)
+		}
+		found := false
+		for i := 0; i < field.NumField(); i++ {
+			if configFieldName(field.Type().Field(i)) == name {
+				field = field.Field(i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("Unknown setting: %v", path)
+		}
+	}
+
+	if err := setConfigField(field, value); err != nil {
+		return fmt.Errorf("Invalid value %q for %v: %v", value, path, err)
+	}
+	return nil
+
+}
+
+func setConfigField(field reflect.Value, value string) error {
+
+	if field.Type() == reflect.TypeOf(ConfigDuration(0)) {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(duration))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(number))
+	case reflect.Bool:
+		flag, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(flag)
+	case reflect.Slice:
+		field.Set(reflect.ValueOf(splitCommaList(value)))
+	default:
+		return fmt.Errorf("%v settings aren't supported", field.Kind())
+	}
+	return nil
+
+}
+
+// Check the config for problems that would stop the app server from working
+// as intended.  Returns a list of problems, which is empty if it's valid.
+func (c *Config) Validate() []string {
+
+	problems := []string{}
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Database.URL == "" {
+		problem("database.url is required")
+	} else if err := checkHttpURL(c.Database.URL); err != nil {
+		problem("database.url: %v", err)
+	}
+	if auth := c.Database.syncGatewayAuth(); auth != nil {
+		if err := auth.Validate(); err != nil {
+			problem("database: %v", err)
+		}
+	}
+
+	switch c.Feed.Mode {
+	case FEED_MODE_LONGPOLL:
+		if c.Feed.Timeout <= 0 {
+			problem("feed.timeout must be positive")
+		}
+	case FEED_MODE_NORMAL:
+		if c.Feed.PollInterval <= 0 {
+			problem("feed.poll_interval must be positive")
+		}
+	default:
+		problem("feed.mode must be %v or %v, not %q", FEED_MODE_LONGPOLL, FEED_MODE_NORMAL, c.Feed.Mode)
+	}
+
+	switch c.Notifier.Backend {
+	case NOTIFIER_UNIQUSH:
+		if c.Notifier.Uniqush.URL == "" {
+			problem("notifier.uniqush.url is required with the %v notifier", NOTIFIER_UNIQUSH)
+		} else if err := checkHttpURL(c.Notifier.Uniqush.URL); err != nil {
+			problem("notifier.uniqush.url: %v", err)
+		}
+	case NOTIFIER_LOG:
+	default:
+		problem("notifier.backend must be %v or %v, not %q", NOTIFIER_UNIQUSH, NOTIFIER_LOG, c.Notifier.Backend)
+	}
+
+	if c.Workers.Count <= 0 {
+		problem("workers.count must be positive")
+	}
+	if c.Workers.QueueSize <= 0 {
+		problem("workers.queue_size must be positive")
+	}
+
+	durations := map[string]ConfigDuration{
+		"timeouts.shutdown":     c.Timeouts.Shutdown,
+		"timeouts.push":         c.Timeouts.Push,
+		"events.max_clock_skew": c.Events.MaxClockSkew,
+		"events.max_event_age":  c.Events.MaxEventAge,
+		"events.entry_dwell":    c.Events.EntryDwell,
+		"events.exit_dwell":     c.Events.ExitDwell,
+	}
+	for _, path := range ConfigPaths() {
+		if duration, ok := durations[path]; ok && duration < 0 {
+			problem("%v can't be negative", path)
+		}
+	}
+
+	if c.QuietHours.Start != "" || c.QuietHours.End != "" {
+		if _, err := c.quietHours(); err != nil {
+			problem("quiet_hours: %v", err)
+		}
+	}
+
+	if c.Admin.Addr != "" && c.Admin.Token == "" {
+		problem("admin.token is required with admin.addr")
+	}
+
+	if _, err := ParseLogLevel(c.Log.Level); err != nil {
+		problem("log.level: %v", err)
+	}
+
+	return problems
+
+}
+
+func checkHttpURL(rawUrl string) error {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return err
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("%q is not an http or https url", rawUrl)
+	}
+	return nil
+}
+
+// The url with the username and password, if any, added to it, so that
+// they're sent with basic auth
+func urlWithCredentials(rawUrl, username, password string) (string, error) {
+	if username == "" {
+		return rawUrl, nil
+	}
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", err
+	}
+	parsed.User = url.UserPassword(username, password)
+	return parsed.String(), nil
+}
+
+func (c *Config) quietHours() (*QuietHours, error) {
+	if c.QuietHours.Start == "" && c.QuietHours.End == "" {
+		return nil, nil
+	}
+	return NewQuietHours(c.QuietHours.Start, c.QuietHours.End, c.QuietHours.TimeZone)
+}
+
+// Write the config as YAML, with the passwords and tokens redacted
+func (c *Config) Print(writer io.Writer) error {
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	yamlData, err := yaml.Marshal(redactValue("", decoded))
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(yamlData)
+	return err
+
+}
+
+// Create an app that's set up according to the (valid) config.  The events
+// settings for the validator need to be applied once InitApp has created it.
+func NewOfficeRadarAppFromConfig(config *Config) (*OfficeRadarApp, error) {
+
+	var err error
+	uniqushURL := ""
+	if config.Notifier.Backend == NOTIFIER_UNIQUSH {
+		uniqush := config.Notifier.Uniqush
+		if uniqushURL, err = urlWithCredentials(uniqush.URL, uniqush.Username, uniqush.Password); err != nil {
+			return nil, fmt.Errorf("Invalid notifier.uniqush.url: %v", err)
+		}
+	}
+
+	quietHours, err := config.quietHours()
+	if err != nil {
+		return nil, err
+	}
+
+	app := NewOfficeRadarApp(config.Database.URL, uniqushURL)
+	app.SyncGatewayAuth = config.Database.syncGatewayAuth()
+	if config.Notifier.Backend == NOTIFIER_LOG {
+		app.Notifier = LogNotifier{}
+	}
+	app.ChangesFilter = ChangesFilter{Channels: config.Feed.Channels, DocTypes: config.Feed.DocTypes}
+	app.FeedMode = config.Feed.Mode
+	app.FeedTimeout = time.Duration(config.Feed.Timeout)
+	app.PollInterval = time.Duration(config.Feed.PollInterval)
+	app.NumWorkers = config.Workers.Count
+	app.QueueSize = config.Workers.QueueSize
+	app.ShutdownTimeout = time.Duration(config.Timeouts.Shutdown)
+	app.PushTimeout = time.Duration(config.Timeouts.Push)
+	app.Debouncer = NewDebouncer(time.Duration(config.Events.EntryDwell), time.Duration(config.Events.ExitDwell))
+	app.QuietHours = quietHours
+	return app, nil
+
+}
@@ -0,0 +1,167 @@
+package officeradar
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	MAX_FILTERED_EVENTS = 100 // how many filtered events to keep for diagnostics
+)
+
+// Suppresses flapping geofence events at the edge of a beacon's range.  Each
+// (profile, beacon) pair has a hysteresis state: an entry only counts once it
+// has persisted for EntryDwell without an exit, and an exit only counts once
+// it has persisted for ExitDwell without an entry.  Events that flap back
+// within the dwell time are filtered out, and never reach the alerts.
+//
+// All times are event times, so the debouncer behaves the same whether events
+// are processed live or replayed.  Pending events are released either by a
+// later event for the same pair, or by calling Release periodically.  Pending
+// events are only held in memory, so the app server holds back the checkpoint
+// until they're released or filtered out (see GeofenceEvent.settled), and
+// they're read from the changes feed again after a restart.
+type Debouncer struct {
+	EntryDwell time.Duration
+	ExitDwell  time.Duration
+	mutex      sync.Mutex
+	states     map[presenceKey]*debounceState
+	filtered   []FilteredEvent
+}
+
+type debounceState struct {
+	confirmedAction string         // the last action that counted, eg, ACTION_ENTRY
+	pending         *GeofenceEvent // waiting for its dwell time to pass
+	pendingAt       time.Time      // the time of the pending event
+	pendingUntil    time.Time
+}
+
+// A geofence event that was filtered out by the debouncer, and why
+type FilteredEvent struct {
+	Event  GeofenceEvent `json:"event"`
+	Reason string        `json:"reason"`
+}
+
+func NewDebouncer(entryDwell, exitDwell time.Duration) *Debouncer {
+	return &Debouncer{
+		EntryDwell: entryDwell,
+		ExitDwell:  exitDwell,
+		states:     map[presenceKey]*debounceState{},
+	}
+}
+
+// Add an event that happened at eventTime.  Returns the events (if any) for
+// the same profile and beacon which are now confirmed, in order.
+func (d *Debouncer) Add(e GeofenceEvent, eventTime time.Time) []GeofenceEvent {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	key := presenceKey{profileId: e.ProfileId, beaconId: e.BeaconId}
+	state, ok := d.states[key]
+	if !ok {
+		state = &debounceState{confirmedAction: ACTION_EXIT}
+		d.states[key] = state
+	}
+
+	// if the pending event has been around long enough by the time of this
+	// event, it counts regardless of what this event is
+	released := state.release(eventTime)
+
+	if state.pending != nil {
+		if state.pending.Action == e.Action {
+			d.filter(e, "duplicate of pending event")
+			return released
+		}
+		// flapped back before the pending event's dwell time passed
+		d.filter(*state.pending, "reversed by a later event within dwell time")
+		state.pending = nil
+		if e.Action == state.confirmedAction {
+			d.filter(e, "reverses an event that never counted")
+			return released
+		}
+	}
+
+	state.pending = &e
+	state.pendingAt = eventTime
+	state.pendingUntil = eventTime.Add(d.dwell(e.Action))
+
+	return append(released, state.release(eventTime)...)
+
+}
+
+// Release all pending events whose dwell time has passed as of now, in the
+// order they happened
+func (d *Debouncer) Release(now time.Time) []GeofenceEvent {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	due := []*debounceState{}
+	for _, state := range d.states {
+		if state.pending != nil && !now.Before(state.pendingUntil) {
+			due = append(due, state)
+		}
+	}
+	sort.Stable(statesByPendingAt(due))
+
+	released := []GeofenceEvent{}
+	for _, state := range due {
+		released = append(released, state.release(now)...)
+	}
+	return released
+
+}
+
+// The most recently filtered events, oldest first
+func (d *Debouncer) RecentlyFiltered() []FilteredEvent {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]FilteredEvent{}, d.filtered...)
+}
+
+// The number of events waiting for their dwell time to pass
+func (d *Debouncer) NumPending() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	numPending := 0
+	for _, state := range d.states {
+		if state.pending != nil {
+			numPending += 1
+		}
+	}
+	return numPending
+}
+
+func (d *Debouncer) dwell(action string) time.Duration {
+	if action == ACTION_EXIT {
+		return d.ExitDwell
+	}
+	return d.EntryDwell
+}
+
+func (d *Debouncer) filter(e GeofenceEvent, reason string) {
+	e.logger().Debug("Debouncer filtered event", LogFields{"event": e.Id, "action": e.Action, "created_at": e.CreatedAt, "reason": reason})
+	e.settled()
+	d.filtered = append(d.filtered, FilteredEvent{Event: e, Reason: reason})
+	if len(d.filtered) > MAX_FILTERED_EVENTS {
+		d.filtered = d.filtered[len(d.filtered)-MAX_FILTERED_EVENTS:]
+	}
+}
+
+func (s *debounceState) release(now time.Time) []GeofenceEvent {
+	if s.pending == nil || now.Before(s.pendingUntil) {
+		return []GeofenceEvent{}
+	}
+	released := *s.pending
+	s.confirmedAction = released.Action
+	s.pending = nil
+	return []GeofenceEvent{released}
+}
+
+type statesByPendingAt []*debounceState
+
+func (s statesByPendingAt) Len() int           { return len(s) }
+func (s statesByPendingAt) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s statesByPendingAt) Less(i, j int) bool { return s[i].pendingAt.Before(s[j].pendingAt) }
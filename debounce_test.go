@@ -0,0 +1,116 @@
+package officeradar
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func debounceEvent(id, action string) GeofenceEvent {
+	e := GeofenceEvent{Action: action, BeaconId: "beacon1", ProfileId: "foo"}
+	e.Id = id
+	return e
+}
+
+func eventIds(events []GeofenceEvent) []string {
+	ids := []string{}
+	for _, e := range events {
+		ids = append(ids, e.Id)
+	}
+	return ids
+}
+
+func TestDebouncerFiltersFlapping(t *testing.T) {
+
+	start := time.Date(2014, 9, 2, 9, 0, 0, 0, time.UTC)
+	debouncer := NewDebouncer(30*time.Second, 60*time.Second)
+
+	// entry, then exit and entry again in quick succession at the edge of range
+	released := debouncer.Add(debounceEvent("entry1", ACTION_ENTRY), start)
+	assert.Equals(t, len(released), 0)
+	released = debouncer.Add(debounceEvent("exit1", ACTION_EXIT), start.Add(5*time.Second))
+	assert.Equals(t, len(released), 0)
+	released = debouncer.Add(debounceEvent("entry2", ACTION_ENTRY), start.Add(10*time.Second))
+	assert.Equals(t, len(released), 0)
+	assert.Equals(t, debouncer.NumPending(), 1)
+
+	// nothing counts until entry2 has lasted for the entry dwell time
+	assert.Equals(t, len(debouncer.Release(start.Add(39*time.Second))), 0)
+	released = debouncer.Release(start.Add(40 * time.Second))
+	assert.DeepEquals(t, eventIds(released), []string{"entry2"})
+
+	filtered := debouncer.RecentlyFiltered()
+	assert.Equals(t, len(filtered), 2)
+	assert.Equals(t, filtered[0].Event.Id, "entry1")
+	assert.Equals(t, filtered[1].Event.Id, "exit1")
+
+	// now inside: a brief exit is filtered along with the entry that reverses it
+	debouncer.Add(debounceEvent("exit2", ACTION_EXIT), start.Add(100*time.Second))
+	debouncer.Add(debounceEvent("entry3", ACTION_ENTRY), start.Add(130*time.Second))
+	assert.Equals(t, debouncer.NumPending(), 0)
+	assert.Equals(t, len(debouncer.Release(start.Add(time.Hour))), 0)
+
+	// an exit that lasts is released by the next event, ahead of that event
+	debouncer.Add(debounceEvent("exit3", ACTION_EXIT), start.Add(200*time.Second))
+	released = debouncer.Add(debounceEvent("entry4", ACTION_ENTRY), start.Add(300*time.Second))
+	assert.DeepEquals(t, eventIds(released), []string{"exit3"})
+	assert.Equals(t, debouncer.NumPending(), 1)
+
+}
+
+func TestDebouncerWithoutDwellPassesThrough(t *testing.T) {
+
+	now := time.Now()
+	debouncer := NewDebouncer(0, 0)
+
+	released := debouncer.Add(debounceEvent("entry1", ACTION_ENTRY), now)
+	assert.DeepEquals(t, eventIds(released), []string{"entry1"})
+	released = debouncer.Add(debounceEvent("exit1", ACTION_EXIT), now)
+	assert.DeepEquals(t, eventIds(released), []string{"exit1"})
+	assert.Equals(t, len(debouncer.RecentlyFiltered()), 0)
+
+}
+
+func TestDebouncerSettlesEvents(t *testing.T) {
+
+	start := time.Date(2014, 9, 2, 9, 0, 0, 0, time.UTC)
+	debouncer := NewDebouncer(30*time.Second, 60*time.Second)
+
+	settled := []string{}
+	settling := func(e GeofenceEvent) GeofenceEvent {
+		e.settle = func() { settled = append(settled, e.Id) }
+		return e
+	}
+
+	// pending events stay unsettled, filtered ones are settled straight away
+	debouncer.Add(settling(debounceEvent("entry1", ACTION_ENTRY)), start)
+	debouncer.Add(settling(debounceEvent("entry2", ACTION_ENTRY)), start.Add(time.Second))
+	assert.DeepEquals(t, settled, []string{"entry2"})
+
+	// released events are settled once they've been processed
+	released := debouncer.Release(start.Add(time.Minute))
+	assert.DeepEquals(t, eventIds(released), []string{"entry1"})
+	assert.DeepEquals(t, settled, []string{"entry2"})
+	released[0].settled()
+	assert.DeepEquals(t, settled, []string{"entry2", "entry1"})
+
+}
+
+func TestDebouncerReleasesInOrder(t *testing.T) {
+
+	start := time.Date(2014, 9, 2, 9, 0, 0, 0, time.UTC)
+	debouncer := NewDebouncer(time.Minute, time.Minute)
+
+	expected := []string{}
+	for i := 0; i < 10; i++ {
+		e := debounceEvent(fmt.Sprintf("entry%d", i), ACTION_ENTRY)
+		e.BeaconId = fmt.Sprintf("beacon%d", i)
+		debouncer.Add(e, start.Add(time.Duration(i)*time.Second))
+		expected = append(expected, e.Id)
+	}
+
+	assert.DeepEquals(t, eventIds(debouncer.Release(start.Add(time.Hour))), expected)
+
+}
@@ -0,0 +1,98 @@
+package officeradar
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	DOC_TYPE_DWELL_ALERT = "dwell_alert"
+)
+
+// A geofence alert triggered if any of the users stays within range of any of
+// the beacons continuously for at least the given duration.  It fires even if
+// no further events arrive, since a timer is started on entry and cancelled
+// on exit.
+// Eg, "Remind me to stand up after 2 hours at my desk beacon"
+type DwellAlert struct {
+	BaseAlert
+	Users    []OfficeRadarProfile // users for which this alert can fire
+	Beacons  []Beacon             // beacons for which this alert can fire
+	Duration time.Duration        // how long a user must stay in range of the beacon
+	Timers   *TimerScheduler      `json:"-"` // used to schedule the dwell timers
+}
+
+func NewDwellAlert() *DwellAlert {
+	alert := &DwellAlert{}
+	alert.Type = DOC_TYPE_DWELL_ALERT
+	return alert
+}
+
+// Starts a timer when a user enters a beacon, and cancels it when they exit.
+// The alert never fires directly from an event, only from ProcessTimer.
+func (a *DwellAlert) Process(e GeofenceEvent) (bool, error) {
+
+	if a.Timers == nil {
+		Log.Panic("no Timers defined.")
+	}
+
+	if !hasBeaconOverlap(a.Beacons, e) {
+		return false, nil
+	}
+
+	if !hasProfileOverlap(a.Users, e) {
+		return false, nil
+	}
+
+	switch e.Action {
+	case ACTION_ENTRY:
+		fireAt := e.EventTime(a.clock()).Add(a.Duration)
+		timer := NewAlertTimer(a.Id, e.ProfileId, e.BeaconId, fireAt)
+		if err := a.Timers.Schedule(timer); err != nil {
+			return false, fmt.Errorf("Unable to schedule dwell timer: %v", err)
+		}
+	case ACTION_EXIT:
+		timerId := alertTimerId(a.Id, e.ProfileId, e.BeaconId)
+		if err := a.Timers.Cancel(timerId); err != nil {
+			return false, fmt.Errorf("Unable to cancel dwell timer: %v", err)
+		}
+	}
+
+	return false, nil
+
+}
+
+// The timer only exists while the user is still in range, so if it comes
+// due they've been there for the whole duration.
+func (a *DwellAlert) ProcessTimer(timer AlertTimer) (bool, error) {
+	if timer.AlertId != a.Id {
+		return false, fmt.Errorf("Timer %v does not belong to alert %v", timer.Id, a.Id)
+	}
+	return true, nil
+}
+
+func (a *DwellAlert) BeaconIds() []string {
+	return beaconIds(a.Beacons)
+}
+
+func (a *DwellAlert) ProfileIds() []string {
+	return profileIds(a.Users)
+}
+
+func (a *DwellAlert) RescheduleOrDelete(firedAt time.Time) error {
+
+	// if it's sticky, then update the alert's activeOn time
+	if a.Sticky {
+		a.ActiveOn = firedAt.Add(a.ReactivateAfter)
+		rev, err := a.database.Edit(a)
+		if err == nil {
+			a.Revision = rev
+		}
+		return err
+	}
+
+	// otherwise, delete the alert
+	err := a.database.Delete(a.Id, a.Revision)
+	return err
+
+}
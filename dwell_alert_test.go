@@ -0,0 +1,157 @@
+package officeradar
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+// Keeps timers in memory instead of saving them as docs
+type memoryTimerStore struct {
+	saved map[string]AlertTimer
+}
+
+func newMemoryTimerStore() *memoryTimerStore {
+	return &memoryTimerStore{saved: map[string]AlertTimer{}}
+}
+
+func (s *memoryTimerStore) SaveTimer(timer *AlertTimer) error {
+	s.saved[timer.Id] = *timer
+	return nil
+}
+
+func (s *memoryTimerStore) DeleteTimer(timer *AlertTimer) error {
+	delete(s.saved, timer.Id)
+	return nil
+}
+
+func TestDwellAlert(t *testing.T) {
+
+	store := newMemoryTimerStore()
+	timers := NewTimerScheduler(store)
+
+	alert := NewDwellAlert()
+	alert.Id = "dwell_alert_1"
+	alert.Timers = timers
+	alert.Duration = 2 * time.Hour
+
+	foo := OfficeRadarProfile{OfficeRadarDoc: OfficeRadarDoc{Id: "foo"}}
+	alert.Users = []OfficeRadarProfile{foo}
+	desk := Beacon{OfficeRadarDoc: OfficeRadarDoc{Id: "desk_beacon"}}
+	alert.Beacons = []Beacon{desk}
+
+	arrival := time.Date(2014, 9, 2, 9, 0, 0, 0, time.UTC)
+	entry := GeofenceEvent{
+		Action:    ACTION_ENTRY,
+		BeaconId:  desk.Id,
+		ProfileId: foo.Id,
+		CreatedAt: arrival.Format(time.RFC3339),
+	}
+
+	// an entry never fires directly, but starts a timer which is saved
+	fired, err := alert.Process(entry)
+	assert.True(t, err == nil)
+	assert.False(t, fired)
+	assert.Equals(t, timers.Len(), 1)
+	assert.Equals(t, len(store.saved), 1)
+
+	// leaving cancels the timer
+	exit := entry
+	exit.Action = ACTION_EXIT
+	exit.CreatedAt = arrival.Add(time.Hour).Format(time.RFC3339)
+	fired, err = alert.Process(exit)
+	assert.True(t, err == nil)
+	assert.False(t, fired)
+	assert.Equals(t, timers.Len(), 0)
+	assert.Equals(t, len(store.saved), 0)
+	assert.Equals(t, len(timers.Due(arrival.Add(24*time.Hour))), 0)
+
+	// come back and stay
+	fired, err = alert.Process(entry)
+	assert.True(t, err == nil)
+	assert.Equals(t, len(timers.Due(arrival.Add(119*time.Minute))), 0)
+
+	due := timers.Due(arrival.Add(2 * time.Hour))
+	assert.Equals(t, len(due), 1)
+	assert.Equals(t, due[0].ProfileId, foo.Id)
+	assert.Equals(t, due[0].BeaconId, desk.Id)
+
+	// a due timer is only handed out once
+	assert.Equals(t, len(timers.Due(arrival.Add(3*time.Hour))), 0)
+
+	assert.True(t, timers.Take(due[0]))
+	fired, err = alert.ProcessTimer(due[0])
+	assert.True(t, err == nil)
+	assert.True(t, fired)
+	assert.Equals(t, len(store.saved), 0)
+
+}
+
+func TestTimerSchedulerTakeAfterCancel(t *testing.T) {
+
+	timers := NewTimerScheduler(newMemoryTimerStore())
+	now := time.Now()
+
+	timer := NewAlertTimer("alert", "foo", "beacon", now)
+	assert.True(t, timers.Schedule(timer) == nil)
+	due := timers.Due(now)
+	assert.Equals(t, len(due), 1)
+
+	// cancelled (eg, by an exit) after coming due but before firing
+	assert.True(t, timers.Cancel(timer.Id) == nil)
+	assert.False(t, timers.Take(due[0]))
+
+	// rescheduled after coming due: the stale due timer must not fire
+	assert.True(t, timers.Schedule(NewAlertTimer("alert", "foo", "beacon", now)) == nil)
+	due = timers.Due(now)
+	assert.True(t, timers.Schedule(NewAlertTimer("alert", "foo", "beacon", now.Add(time.Hour))) == nil)
+	assert.False(t, timers.Take(due[0]))
+	assert.Equals(t, timers.Len(), 1)
+
+}
+
+func TestDwellAlertKeepsTimersWhileInactive(t *testing.T) {
+
+	api, notifier := newTestAdminAPI()
+	app := api.App
+	start := app.Clock.Now()
+
+	// sticky, and still waiting to reactivate after firing
+	alert := NewDwellAlert()
+	alert.Id = "dwell_alert"
+	alert.Duration = 10 * time.Minute
+	alert.Sticky = true
+	alert.ActiveOn = start.Add(30 * time.Minute)
+	alert.Actions = []AlertAction{{Recipient: "traunsId", Message: "Jens is still here"}}
+	alert.Users = []OfficeRadarProfile{{OfficeRadarDoc: OfficeRadarDoc{Id: "jensId"}}}
+	alert.Beacons = []Beacon{{OfficeRadarDoc: OfficeRadarDoc{Id: "sfBeaconId"}}}
+	alert.Timers = app.Timers
+	alert.SetClock(app.Clock)
+	app.AlertIndex.Upsert(alert)
+
+	event := func(action string, at time.Duration) GeofenceEvent {
+		return GeofenceEvent{Action: action, BeaconId: "sfBeaconId", ProfileId: "jensId", CreatedAt: start.Add(at).Format(time.RFC3339)}
+	}
+	ctx := context.Background()
+
+	// an exit while inactive still cancels the timer
+	app.triggerAlerts(ctx, event(ACTION_ENTRY, 0))
+	assert.Equals(t, app.Timers.Len(), 1)
+	app.triggerAlerts(ctx, event(ACTION_EXIT, 5*time.Minute))
+	assert.Equals(t, app.Timers.Len(), 0)
+
+	// a timer that comes due while inactive fires once the alert is active
+	app.triggerAlerts(ctx, event(ACTION_ENTRY, 6*time.Minute))
+	due := app.Timers.Due(start.Add(16 * time.Minute))
+	assert.Equals(t, len(due), 1)
+	app.fireTimer(ctx, due[0], "")
+	assert.Equals(t, len(notifier.Notifications()), 0)
+
+	due = app.Timers.Due(start.Add(30 * time.Minute))
+	assert.Equals(t, len(due), 1)
+	app.fireTimer(ctx, due[0], "")
+	assert.Equals(t, len(notifier.Notifications()), 1)
+
+}
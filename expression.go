@@ -0,0 +1,728 @@
+package officeradar
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// An alert rule written as a short expression, for power users, eg:
+//
+//	event.action == "entry" && beacon.location == "SF" && lastSeen(profile, beacon) > 14d
+//
+// Expressions can refer to the geofence event being processed, and the beacon
+// and profile it references:
+//
+//	event:   id, action, beacon, profile (strings), created_at (time)
+//	beacon:  id, desc, location, uuid, organization (strings), major, minor (numbers)
+//	profile: id, name, auth_system (strings)
+//
+// Literals are strings ("SF"), numbers (3), booleans and durations (14d,
+// 2h30m).  The operators are || && ! == != < <= > >= + - and the functions are:
+//
+//	lastSeen(profile, beacon) duration   how long before the event the profile was last
+//	                                     seen at the beacon (ids work too), longer than any
+//	                                     other duration if never
+//	hour(time, timeZone) number          the hour of the day (0-23), eg, hour(event.created_at, "UTC")
+//	weekday(time, timeZone) string       the day of the week, eg, "Monday"
+//	contains(string, string) bool        whether the first string contains the second
+//	lower(string) string                 the string in lower case
+//	oneOf(string, string, ...) bool      whether the first string equals any of the others
+//
+// Expressions are sandboxed: they can't loop, have side effects or call
+// anything other than the functions above, and their size is limited.  They
+// are type checked when compiled, and must evaluate to a boolean.
+type Expression struct {
+	Source string
+	root   exprNode
+}
+
+// What an expression is evaluated against
+type ExpressionEnv struct {
+	Event        GeofenceEvent
+	EventTime    time.Time
+	LastSeenFunc LastSeenFunc
+	BeaconFunc   func(beaconId string) (*Beacon, error)
+	ProfileFunc  func(profileId string) (*OfficeRadarProfile, error)
+}
+
+type exprType string
+
+const (
+	typeString   exprType = "string"
+	typeNumber   exprType = "number"
+	typeBool     exprType = "bool"
+	typeDuration exprType = "duration"
+	typeTime     exprType = "time"
+	typeEvent    exprType = "event"
+	typeBeacon   exprType = "beacon"
+	typeProfile  exprType = "profile"
+)
+
+// Returned by lastSeen() if the profile has never been seen at the beacon.
+// It's a duration that's longer than any other, and stays that way when
+// durations are added to or subtracted from it.
+type neverSeen struct{}
+
+var exprGlobals = map[string]exprType{
+	"event":   typeEvent,
+	"beacon":  typeBeacon,
+	"profile": typeProfile,
+}
+
+var exprFields = map[exprType]map[string]exprType{
+	typeEvent: {
+		"id":         typeString,
+		"action":     typeString,
+		"beacon":     typeString,
+		"profile":    typeString,
+		"created_at": typeTime,
+	},
+	typeBeacon: {
+		"id":           typeString,
+		"desc":         typeString,
+		"location":     typeString,
+		"uuid":         typeString,
+		"organization": typeString,
+		"major":        typeNumber,
+		"minor":        typeNumber,
+	},
+	typeProfile: {
+		"id":          typeString,
+		"name":        typeString,
+		"auth_system": typeString,
+	},
+}
+
+type exprFunc struct {
+	check func(args []exprType) (exprType, error)
+	call  func(env *exprEnv, args []interface{}) (interface{}, error)
+}
+
+var exprFuncs = map[string]exprFunc{
+	"lastSeen": {
+		check: func(args []exprType) (exprType, error) {
+			if len(args) != 2 ||
+				(args[0] != typeProfile && args[0] != typeString) ||
+				(args[1] != typeBeacon && args[1] != typeString) {
+				return "", fmt.Errorf("lastSeen expects (profile, beacon)")
+			}
+			return typeDuration, nil
+		},
+		call: func(env *exprEnv, args []interface{}) (interface{}, error) {
+			if env.LastSeenFunc == nil {
+				return nil, fmt.Errorf("lastSeen is not available")
+			}
+			haveSeen, lastSeenAt := env.LastSeenFunc(docId(args[0]), docId(args[1]))
+			if !haveSeen {
+				return neverSeen{}, nil
+			}
+			return env.EventTime.Sub(lastSeenAt), nil
+		},
+	},
+	"hour": {
+		check: timeFuncCheck("hour", typeNumber),
+		call: func(env *exprEnv, args []interface{}) (interface{}, error) {
+			t, err := timeIn(args[0].(time.Time), args[1].(string))
+			if err != nil {
+				return nil, err
+			}
+			return float64(t.Hour()), nil
+		},
+	},
+	"weekday": {
+		check: timeFuncCheck("weekday", typeString),
+		call: func(env *exprEnv, args []interface{}) (interface{}, error) {
+			t, err := timeIn(args[0].(time.Time), args[1].(string))
+			if err != nil {
+				return nil, err
+			}
+			return t.Weekday().String(), nil
+		},
+	},
+	"contains": {
+		check: func(args []exprType) (exprType, error) {
+			if len(args) != 2 || args[0] != typeString || args[1] != typeString {
+				return "", fmt.Errorf("contains expects (string, string)")
+			}
+			return typeBool, nil
+		},
+		call: func(env *exprEnv, args []interface{}) (interface{}, error) {
+			return strings.Contains(args[0].(string), args[1].(string)), nil
+		},
+	},
+	"lower": {
+		check: func(args []exprType) (exprType, error) {
+			if len(args) != 1 || args[0] != typeString {
+				return "", fmt.Errorf("lower expects (string)")
+			}
+			return typeString, nil
+		},
+		call: func(env *exprEnv, args []interface{}) (interface{}, error) {
+			return strings.ToLower(args[0].(string)), nil
+		},
+	},
+	"oneOf": {
+		check: func(args []exprType) (exprType, error) {
+			if len(args) < 2 {
+				return "", fmt.Errorf("oneOf expects (string, string, ...)")
+			}
+			for _, arg := range args {
+				if arg != typeString {
+					return "", fmt.Errorf("oneOf expects (string, string, ...)")
+				}
+			}
+			return typeBool, nil
+		},
+		call: func(env *exprEnv, args []interface{}) (interface{}, error) {
+			for _, arg := range args[1:] {
+				if arg.(string) == args[0].(string) {
+					return true, nil
+				}
+			}
+			return false, nil
+		},
+	},
+}
+
+// Parse and type check an expression, which must evaluate to a boolean
+func CompileExpression(source string) (*Expression, error) {
+
+	root, err := parseExpression(source)
+	if err != nil {
+		return nil, err
+	}
+
+	expression := &Expression{Source: source, root: root}
+	resultType, err := expression.check(root)
+	if err != nil {
+		return nil, err
+	}
+	if resultType != typeBool {
+		return nil, fmt.Errorf("Expression must be a bool, not a %v", resultType)
+	}
+	return expression, nil
+
+}
+
+func (x *Expression) Evaluate(env ExpressionEnv) (bool, error) {
+	result, err := x.eval(x.root, &exprEnv{ExpressionEnv: env})
+	if err != nil {
+		return false, fmt.Errorf("Error evaluating %q: %v", x.Source, err)
+	}
+	return result.(bool), nil
+}
+
+// The ids that the event's "beacon" or "profile" must have for the expression
+// to be true, as far as literal comparisons in its && chains tell, eg,
+// `event.beacon == "sfBeaconId" && ...`.  Empty if it could be any.
+func (x *Expression) RequiredIds(field string) []string {
+	ids := requiredIds(x.root, field)
+	if ids == nil {
+		return []string{}
+	}
+	return ids
+}
+
+func requiredIds(node exprNode, field string) []string {
+
+	n, ok := node.(*binaryNode)
+	if !ok {
+		return nil
+	}
+
+	switch n.op {
+	case "&&":
+		// either side is enough to restrict it
+		if ids := requiredIds(n.left, field); ids != nil {
+			return ids
+		}
+		return requiredIds(n.right, field)
+	case "||":
+		// but here both sides have to
+		left, right := requiredIds(n.left, field), requiredIds(n.right, field)
+		if left == nil || right == nil {
+			return nil
+		}
+		return append(left, right...)
+	case "==":
+		if id, ok := literalString(n.right); ok && isEventDocId(n.left, field) {
+			return []string{id}
+		}
+		if id, ok := literalString(n.left); ok && isEventDocId(n.right, field) {
+			return []string{id}
+		}
+	}
+	return nil
+
+}
+
+// Is the node event.beacon or beacon.id (or the same for profile)?
+func isEventDocId(node exprNode, field string) bool {
+	n, ok := node.(*fieldNode)
+	if !ok {
+		return false
+	}
+	object, ok := n.object.(*identNode)
+	if !ok {
+		return false
+	}
+	return (object.name == "event" && n.name == field) || (object.name == field && n.name == "id")
+}
+
+func literalString(node exprNode) (string, bool) {
+	n, ok := node.(*literalNode)
+	if !ok {
+		return "", false
+	}
+	value, ok := n.value.(string)
+	return value, ok
+}
+
+func (x *Expression) check(node exprNode) (exprType, error) {
+	t, err := x.checkNode(node)
+	if err != nil {
+		return "", err
+	}
+	node.setExprType(t)
+	return t, nil
+}
+
+func (x *Expression) checkNode(node exprNode) (exprType, error) {
+
+	switch n := node.(type) {
+	case *literalNode:
+		switch n.value.(type) {
+		case string:
+			return typeString, nil
+		case float64:
+			return typeNumber, nil
+		case bool:
+			return typeBool, nil
+		case time.Duration:
+			return typeDuration, nil
+		}
+	case *identNode:
+		t, ok := exprGlobals[n.name]
+		if !ok {
+			return "", fmt.Errorf("Unknown name %q at position %d", n.name, n.pos)
+		}
+		return t, nil
+	case *fieldNode:
+		objectType, err := x.check(n.object)
+		if err != nil {
+			return "", err
+		}
+		fields, ok := exprFields[objectType]
+		if !ok {
+			return "", fmt.Errorf("A %v has no fields, at position %d", objectType, n.pos)
+		}
+		t, ok := fields[n.name]
+		if !ok {
+			return "", fmt.Errorf("A %v has no field %q, at position %d", objectType, n.name, n.pos)
+		}
+		return t, nil
+	case *callNode:
+		function, ok := exprFuncs[n.name]
+		if !ok {
+			return "", fmt.Errorf("Unknown function %q at position %d", n.name, n.pos)
+		}
+		argTypes := []exprType{}
+		for _, arg := range n.args {
+			t, err := x.check(arg)
+			if err != nil {
+				return "", err
+			}
+			argTypes = append(argTypes, t)
+		}
+		t, err := function.check(argTypes)
+		if err != nil {
+			return "", fmt.Errorf("%v, at position %d", err, n.pos)
+		}
+		return t, nil
+	case *unaryNode:
+		t, err := x.check(n.operand)
+		if err != nil {
+			return "", err
+		}
+		if t != typeBool {
+			return "", fmt.Errorf("! expects a bool, not a %v, at position %d", t, n.pos)
+		}
+		return typeBool, nil
+	case *binaryNode:
+		return x.checkBinary(n)
+	}
+	return "", fmt.Errorf("Invalid expression at position %d", node.position())
+
+}
+
+func (x *Expression) checkBinary(n *binaryNode) (exprType, error) {
+
+	left, err := x.check(n.left)
+	if err != nil {
+		return "", err
+	}
+	right, err := x.check(n.right)
+	if err != nil {
+		return "", err
+	}
+	mismatch := fmt.Errorf("Can't apply %v to a %v and a %v, at position %d", n.op, left, right, n.pos)
+
+	switch n.op {
+	case "&&", "||":
+		if left == typeBool && right == typeBool {
+			return typeBool, nil
+		}
+	case "==", "!=":
+		if left == right && isScalarType(left) {
+			return typeBool, nil
+		}
+	case "<", "<=", ">", ">=":
+		if left == right && left != typeBool && isScalarType(left) {
+			return typeBool, nil
+		}
+	case "+":
+		switch {
+		case left == right && (left == typeNumber || left == typeDuration):
+			return left, nil
+		case left == typeTime && right == typeDuration:
+			return typeTime, nil
+		}
+	case "-":
+		switch {
+		case left == right && (left == typeNumber || left == typeDuration):
+			return left, nil
+		case left == typeTime && right == typeTime:
+			return typeDuration, nil
+		case left == typeTime && right == typeDuration:
+			return typeTime, nil
+		}
+	}
+	return "", mismatch
+
+}
+
+func isScalarType(t exprType) bool {
+	switch t {
+	case typeString, typeNumber, typeBool, typeDuration, typeTime:
+		return true
+	}
+	return false
+}
+
+// Evaluation state, which caches the beacon and profile docs
+type exprEnv struct {
+	ExpressionEnv
+	beacon  *Beacon
+	profile *OfficeRadarProfile
+}
+
+func (env *exprEnv) lookupBeacon() (*Beacon, error) {
+	if env.beacon == nil {
+		if env.BeaconFunc == nil {
+			return nil, fmt.Errorf("beacon is not available")
+		}
+		beacon, err := env.BeaconFunc(env.Event.BeaconId)
+		if err != nil {
+			return nil, err
+		}
+		env.beacon = beacon
+	}
+	return env.beacon, nil
+}
+
+func (env *exprEnv) lookupProfile() (*OfficeRadarProfile, error) {
+	if env.profile == nil {
+		if env.ProfileFunc == nil {
+			return nil, fmt.Errorf("profile is not available")
+		}
+		profile, err := env.ProfileFunc(env.Event.ProfileId)
+		if err != nil {
+			return nil, err
+		}
+		env.profile = profile
+	}
+	return env.profile, nil
+}
+
+func (env *exprEnv) eventDocId(name string) string {
+	if name == "beacon" {
+		return env.Event.BeaconId
+	}
+	return env.Event.ProfileId
+}
+
+func (x *Expression) eval(node exprNode, env *exprEnv) (interface{}, error) {
+
+	switch n := node.(type) {
+	case *literalNode:
+		return n.value, nil
+	case *identNode:
+		switch n.name {
+		case "event":
+			return env.Event, nil
+		case "beacon":
+			return env.lookupBeacon()
+		case "profile":
+			return env.lookupProfile()
+		}
+	case *fieldNode:
+		object, err := x.eval(n.object, env)
+		if err != nil {
+			return nil, err
+		}
+		return fieldValue(object, n.name, env)
+	case *callNode:
+		args := []interface{}{}
+		for _, argNode := range n.args {
+			// only the id of the event's beacon or profile is needed when
+			// they are passed to a function, so don't look up the docs
+			if ident, ok := argNode.(*identNode); ok && ident.name != "event" {
+				args = append(args, env.eventDocId(ident.name))
+				continue
+			}
+			arg, err := x.eval(argNode, env)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+		}
+		return exprFuncs[n.name].call(env, args)
+	case *unaryNode:
+		operand, err := x.eval(n.operand, env)
+		if err != nil {
+			return nil, err
+		}
+		return !operand.(bool), nil
+	case *binaryNode:
+		return x.evalBinary(n, env)
+	}
+	return nil, fmt.Errorf("Invalid expression at position %d", node.position())
+
+}
+
+func (x *Expression) evalBinary(n *binaryNode, env *exprEnv) (interface{}, error) {
+
+	left, err := x.eval(n.left, env)
+	if err != nil {
+		return nil, err
+	}
+
+	// short-circuit, so eg, the profile isn't looked up if it's not needed
+	switch n.op {
+	case "&&":
+		if !left.(bool) {
+			return false, nil
+		}
+		return x.eval(n.right, env)
+	case "||":
+		if left.(bool) {
+			return true, nil
+		}
+		return x.eval(n.right, env)
+	}
+
+	right, err := x.eval(n.right, env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return scalarEquals(left, right), nil
+	case "!=":
+		return !scalarEquals(left, right), nil
+	case "<", "<=", ">", ">=":
+		return compareScalars(n.op, left, right), nil
+	case "+", "-":
+		result, err := arithmetic(n.op, left, right)
+		if err != nil {
+			return nil, fmt.Errorf("%v, at position %d", err, n.pos)
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("Unknown operator %v at position %d", n.op, n.pos)
+
+}
+
+func fieldValue(object interface{}, name string, env *exprEnv) (interface{}, error) {
+
+	switch o := object.(type) {
+	case GeofenceEvent:
+		switch name {
+		case "id":
+			return o.Id, nil
+		case "action":
+			return o.Action, nil
+		case "beacon":
+			return o.BeaconId, nil
+		case "profile":
+			return o.ProfileId, nil
+		case "created_at":
+			return env.EventTime, nil
+		}
+	case *Beacon:
+		switch name {
+		case "id":
+			return o.Id, nil
+		case "desc":
+			return o.Desc, nil
+		case "location":
+			return o.Location, nil
+		case "uuid":
+			return o.Uuid, nil
+		case "organization":
+			return o.Organization, nil
+		case "major":
+			return float64(o.Major), nil
+		case "minor":
+			return float64(o.Minor), nil
+		}
+	case *OfficeRadarProfile:
+		switch name {
+		case "id":
+			return o.Id, nil
+		case "name":
+			return o.Name, nil
+		case "auth_system":
+			return o.AuthSystem, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown field %q", name)
+
+}
+
+func scalarEquals(left, right interface{}) bool {
+	if leftTime, ok := left.(time.Time); ok {
+		return leftTime.Equal(right.(time.Time))
+	}
+	return left == right
+}
+
+func compareScalars(op string, left, right interface{}) bool {
+
+	// -1, 0 or 1 depending on whether left is less, equal or greater
+	comparison := 0
+	switch l := left.(type) {
+	case string:
+		comparison = strings.Compare(l, right.(string))
+	case float64:
+		comparison = compareFloats(l, right.(float64))
+	case time.Duration, neverSeen:
+		comparison = compareDurations(l, right)
+	case time.Time:
+		r := right.(time.Time)
+		switch {
+		case l.Before(r):
+			comparison = -1
+		case l.After(r):
+			comparison = 1
+		}
+	}
+
+	switch op {
+	case "<":
+		return comparison < 0
+	case "<=":
+		return comparison <= 0
+	case ">":
+		return comparison > 0
+	}
+	return comparison >= 0
+
+}
+
+func compareFloats(left, right float64) int {
+	switch {
+	case left < right:
+		return -1
+	case left > right:
+		return 1
+	}
+	return 0
+}
+
+// Like compareFloats, for durations, either of which may be neverSeen
+func compareDurations(left, right interface{}) int {
+	_, leftNever := left.(neverSeen)
+	_, rightNever := right.(neverSeen)
+	switch {
+	case leftNever && rightNever:
+		return 0
+	case leftNever:
+		return 1
+	case rightNever:
+		return -1
+	}
+	return compareFloats(float64(left.(time.Duration)), float64(right.(time.Duration)))
+}
+
+func arithmetic(op string, left, right interface{}) (interface{}, error) {
+
+	sign := 1
+	if op == "-" {
+		sign = -1
+	}
+
+	// never plus or minus a duration is still never, but there's no sensible
+	// answer for anything else involving never
+	_, leftNever := left.(neverSeen)
+	_, rightNever := right.(neverSeen)
+	switch {
+	case leftNever && !rightNever:
+		return neverSeen{}, nil
+	case rightNever && op == "+" && !isTime(left):
+		return neverSeen{}, nil
+	case rightNever:
+		return nil, fmt.Errorf("Can't apply %v to a duration of never seen", op)
+	}
+
+	switch l := left.(type) {
+	case float64:
+		return l + float64(sign)*right.(float64), nil
+	case time.Duration:
+		return l + time.Duration(sign)*right.(time.Duration), nil
+	case time.Time:
+		if r, ok := right.(time.Time); ok {
+			return l.Sub(r), nil
+		}
+		return l.Add(time.Duration(sign) * right.(time.Duration)), nil
+	}
+	return nil, fmt.Errorf("Can't apply %v", op)
+
+}
+
+func isTime(value interface{}) bool {
+	_, ok := value.(time.Time)
+	return ok
+}
+
+func timeFuncCheck(name string, resultType exprType) func(args []exprType) (exprType, error) {
+	return func(args []exprType) (exprType, error) {
+		if len(args) != 2 || args[0] != typeTime || args[1] != typeString {
+			return "", fmt.Errorf("%v expects (time, timeZone)", name)
+		}
+		return resultType, nil
+	}
+}
+
+func timeIn(t time.Time, timeZone string) (time.Time, error) {
+	location, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid time zone %q: %v", timeZone, err)
+	}
+	return t.In(location), nil
+}
+
+// The id of a beacon or profile, which may be given as the doc or its id
+func docId(value interface{}) string {
+	switch v := value.(type) {
+	case *Beacon:
+		return v.Id
+	case *OfficeRadarProfile:
+		return v.Id
+	case string:
+		return v
+	}
+	return ""
+}
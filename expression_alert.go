@@ -0,0 +1,97 @@
+package officeradar
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	DOC_TYPE_EXPRESSION_ALERT = "expression_alert"
+)
+
+// A geofence alert triggered when its expression is true for an event.  See
+// Expression for the syntax.
+// Eg, `event.action == "entry" && beacon.location == "SF" && lastSeen(profile, beacon) > 14d`
+type ExpressionAlert struct {
+	BaseAlert
+	Expression   string       // the source of the expression
+	LastSeenFunc LastSeenFunc `json:"-"` // determine when last seen user at beacon
+	compiled     *Expression
+}
+
+func NewExpressionAlert() *ExpressionAlert {
+	alert := &ExpressionAlert{}
+	alert.Type = DOC_TYPE_EXPRESSION_ALERT
+	return alert
+}
+
+// Compile the expression, which also checks that it's valid
+func (a *ExpressionAlert) Validate() error {
+	compiled, err := CompileExpression(a.Expression)
+	if err != nil {
+		return fmt.Errorf("Invalid expression in alert %v: %v", a.Id, err)
+	}
+	a.compiled = compiled
+	return nil
+}
+
+func (a *ExpressionAlert) Process(e GeofenceEvent) (bool, error) {
+
+	if a.LastSeenFunc == nil {
+		Log.Panic("no LastSeenFunc defined.")
+	}
+
+	if a.compiled == nil {
+		if err := a.Validate(); err != nil {
+			return false, err
+		}
+	}
+
+	env := ExpressionEnv{
+		Event:        e,
+		EventTime:    e.EventTime(a.clock()),
+		LastSeenFunc: a.LastSeenFunc,
+		BeaconFunc: func(beaconId string) (*Beacon, error) {
+			return e.docs.fetchBeacon(a.database, beaconId)
+		},
+		ProfileFunc: func(profileId string) (*OfficeRadarProfile, error) {
+			return e.docs.fetchProfile(a.database, profileId)
+		},
+	}
+	return a.compiled.Evaluate(env)
+
+}
+
+// Indexed by the beacons and profiles the expression compares the event's
+// with ==, otherwise it's evaluated against every event
+func (a *ExpressionAlert) BeaconIds() []string {
+	if a.compiled == nil {
+		return []string{}
+	}
+	return a.compiled.RequiredIds("beacon")
+}
+
+func (a *ExpressionAlert) ProfileIds() []string {
+	if a.compiled == nil {
+		return []string{}
+	}
+	return a.compiled.RequiredIds("profile")
+}
+
+func (a *ExpressionAlert) RescheduleOrDelete(firedAt time.Time) error {
+
+	// if it's sticky, then update the alert's activeOn time
+	if a.Sticky {
+		a.ActiveOn = firedAt.Add(a.ReactivateAfter)
+		rev, err := a.database.Edit(a)
+		if err == nil {
+			a.Revision = rev
+		}
+		return err
+	}
+
+	// otherwise, delete the alert
+	err := a.database.Delete(a.Id, a.Revision)
+	return err
+
+}
@@ -0,0 +1,422 @@
+package officeradar
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	MAX_EXPRESSION_LENGTH = 2000 // keep expressions small, they're evaluated on every event
+	MAX_EXPRESSION_DEPTH  = 32
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenDuration
+	tokenOperator
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	pos   int
+	value interface{} // parsed value of string, number and duration literals
+}
+
+// The nodes of an expression's syntax tree.  The type of each node is filled
+// in by the type checker.
+type exprNode interface {
+	position() int
+	exprType() exprType
+	setExprType(t exprType)
+}
+
+type exprBase struct {
+	pos int
+	typ exprType
+}
+
+func (n *exprBase) position() int          { return n.pos }
+func (n *exprBase) exprType() exprType     { return n.typ }
+func (n *exprBase) setExprType(t exprType) { n.typ = t }
+
+type literalNode struct {
+	exprBase
+	value interface{}
+}
+
+type identNode struct {
+	exprBase
+	name string
+}
+
+type fieldNode struct {
+	exprBase
+	object exprNode
+	name   string
+}
+
+type callNode struct {
+	exprBase
+	name string
+	args []exprNode
+}
+
+type unaryNode struct {
+	exprBase
+	op      string
+	operand exprNode
+}
+
+type binaryNode struct {
+	exprBase
+	op    string
+	left  exprNode
+	right exprNode
+}
+
+// Binary operators by precedence, lowest first
+var binaryPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+}
+
+type exprParser struct {
+	tokens []token
+	next   int
+	depth  int
+}
+
+func parseExpression(source string) (exprNode, error) {
+
+	if len(source) > MAX_EXPRESSION_LENGTH {
+		return nil, fmt.Errorf("Expression is longer than %d characters", MAX_EXPRESSION_LENGTH)
+	}
+
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &exprParser{tokens: tokens}
+	node, err := parser.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if tok := parser.peek(); tok.kind != tokenEOF {
+		return nil, fmt.Errorf("Unexpected %q at position %d", tok.text, tok.pos)
+	}
+	return node, nil
+
+}
+
+func (p *exprParser) peek() token {
+	return p.tokens[p.next]
+}
+
+func (p *exprParser) advance() token {
+	tok := p.tokens[p.next]
+	if tok.kind != tokenEOF {
+		p.next += 1
+	}
+	return tok
+}
+
+func (p *exprParser) isOperator(text string) bool {
+	tok := p.peek()
+	return tok.kind == tokenOperator && tok.text == text
+}
+
+func (p *exprParser) expect(text string) error {
+	tok := p.advance()
+	if tok.kind != tokenOperator || tok.text != text {
+		return fmt.Errorf("Expected %q at position %d, found %q", text, tok.pos, tok.text)
+	}
+	return nil
+}
+
+// Only parens, function calls and ! count towards the depth, since they're
+// what can be nested
+func (p *exprParser) enter() error {
+	p.depth += 1
+	if p.depth > MAX_EXPRESSION_DEPTH {
+		return fmt.Errorf("Expression is nested more than %d levels deep", MAX_EXPRESSION_DEPTH)
+	}
+	return nil
+}
+
+func (p *exprParser) leave() {
+	p.depth -= 1
+}
+
+func (p *exprParser) parseBinary(level int) (exprNode, error) {
+
+	if level == len(binaryPrecedence) {
+		return p.parseUnary()
+	}
+
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		tok := p.peek()
+		if tok.kind != tokenOperator || !containsString(binaryPrecedence[level], tok.text) {
+			return left, nil
+		}
+		p.advance()
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{exprBase: exprBase{pos: tok.pos}, op: tok.text, left: left, right: right}
+	}
+
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+
+	if p.isOperator("!") {
+		tok := p.advance()
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{exprBase: exprBase{pos: tok.pos}, op: "!", operand: operand}, nil
+	}
+	return p.parsePostfix()
+
+}
+
+func (p *exprParser) parsePostfix() (exprNode, error) {
+
+	node, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isOperator(".") {
+		p.advance()
+		tok := p.advance()
+		if tok.kind != tokenIdent {
+			return nil, fmt.Errorf("Expected field name at position %d, found %q", tok.pos, tok.text)
+		}
+		node = &fieldNode{exprBase: exprBase{pos: tok.pos}, object: node, name: tok.text}
+	}
+	return node, nil
+
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+
+	tok := p.advance()
+
+	switch tok.kind {
+	case tokenString, tokenNumber, tokenDuration:
+		return &literalNode{exprBase: exprBase{pos: tok.pos}, value: tok.value}, nil
+	case tokenIdent:
+		switch tok.text {
+		case "true":
+			return &literalNode{exprBase: exprBase{pos: tok.pos}, value: true}, nil
+		case "false":
+			return &literalNode{exprBase: exprBase{pos: tok.pos}, value: false}, nil
+		}
+		if p.isOperator("(") {
+			return p.parseCall(tok)
+		}
+		return &identNode{exprBase: exprBase{pos: tok.pos}, name: tok.text}, nil
+	case tokenOperator:
+		if tok.text == "(" {
+			if err := p.enter(); err != nil {
+				return nil, err
+			}
+			defer p.leave()
+			node, err := p.parseBinary(0)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return node, nil
+		}
+	case tokenEOF:
+		return nil, fmt.Errorf("Unexpected end of expression")
+	}
+	return nil, fmt.Errorf("Unexpected %q at position %d", tok.text, tok.pos)
+
+}
+
+func (p *exprParser) parseCall(name token) (exprNode, error) {
+
+	p.advance() // the (
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+
+	call := &callNode{exprBase: exprBase{pos: name.pos}, name: name.text}
+	if p.isOperator(")") {
+		p.advance()
+		return call, nil
+	}
+	for {
+		arg, err := p.parseBinary(0)
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+		if p.isOperator(")") {
+			p.advance()
+			return call, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+
+}
+
+var twoCharOperators = []string{"==", "!=", "<=", ">=", "&&", "||"}
+
+func tokenize(source string) ([]token, error) {
+
+	tokens := []token{}
+	runes := []rune(source)
+	i := 0
+
+	for i < len(runes) {
+		r := runes[i]
+		start := i
+
+		switch {
+		case unicode.IsSpace(r):
+			i += 1
+			continue
+		case unicode.IsLetter(r) || r == '_':
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i += 1
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: string(runes[start:i]), pos: start})
+			continue
+		case unicode.IsDigit(r):
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || unicode.IsLetter(runes[i]) || runes[i] == '.') {
+				i += 1
+			}
+			tok, err := numberToken(string(runes[start:i]), start)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, tok)
+			continue
+		case r == '"':
+			value, end, err := stringLiteral(runes, start)
+			if err != nil {
+				return nil, err
+			}
+			i = end
+			tokens = append(tokens, token{kind: tokenString, text: string(runes[start:i]), pos: start, value: value})
+			continue
+		}
+
+		if i+1 < len(runes) && containsString(twoCharOperators, string(runes[i:i+2])) {
+			tokens = append(tokens, token{kind: tokenOperator, text: string(runes[i : i+2]), pos: start})
+			i += 2
+			continue
+		}
+		if strings.ContainsRune("()<>!.,+-", r) {
+			tokens = append(tokens, token{kind: tokenOperator, text: string(r), pos: start})
+			i += 1
+			continue
+		}
+		return nil, fmt.Errorf("Unexpected character %q at position %d", r, start)
+	}
+
+	tokens = append(tokens, token{kind: tokenEOF, pos: len(runes)})
+	return tokens, nil
+
+}
+
+// Numbers with a unit suffix are durations, eg, 14d, 2h30m, 90s
+func numberToken(text string, pos int) (token, error) {
+
+	if number, err := strconv.ParseFloat(text, 64); err == nil {
+		return token{kind: tokenNumber, text: text, pos: pos, value: number}, nil
+	}
+
+	duration, err := parseDurationLiteral(text)
+	if err != nil {
+		return token{}, fmt.Errorf("Invalid number or duration %q at position %d", text, pos)
+	}
+	return token{kind: tokenDuration, text: text, pos: pos, value: duration}, nil
+
+}
+
+// Like time.ParseDuration, but also accepts days, eg, 14d or 1d12h
+func parseDurationLiteral(text string) (time.Duration, error) {
+
+	days := time.Duration(0)
+	if index := strings.Index(text, "d"); index >= 0 {
+		numDays, err := strconv.Atoi(text[:index])
+		if err != nil {
+			return 0, err
+		}
+		days = time.Duration(numDays) * 24 * time.Hour
+		text = text[index+1:]
+		if text == "" {
+			return days, nil
+		}
+	}
+	duration, err := time.ParseDuration(text)
+	if err != nil {
+		return 0, err
+	}
+	return days + duration, nil
+
+}
+
+func stringLiteral(runes []rune, start int) (string, int, error) {
+
+	value := []rune{}
+	i := start + 1
+	for i < len(runes) {
+		switch runes[i] {
+		case '"':
+			return string(value), i + 1, nil
+		case '\\':
+			if i+1 >= len(runes) {
+				break
+			}
+			i += 1
+			switch runes[i] {
+			case 'n':
+				value = append(value, '\n')
+			case 't':
+				value = append(value, '\t')
+			default:
+				value = append(value, runes[i])
+			}
+		default:
+			value = append(value, runes[i])
+		}
+		i += 1
+	}
+	return "", 0, fmt.Errorf("Unterminated string starting at position %d", start)
+
+}
@@ -0,0 +1,236 @@
+package officeradar
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func newTestExpressionEnv(lastSeenAgo time.Duration) ExpressionEnv {
+
+	// 9am on a tuesday
+	eventTime := time.Date(2014, 9, 2, 9, 0, 0, 0, time.UTC)
+
+	e := GeofenceEvent{
+		Action:    ACTION_ENTRY,
+		BeaconId:  "sfBeaconId",
+		ProfileId: "traunsId",
+		CreatedAt: eventTime.Format(time.RFC3339),
+	}
+	e.Id = "event1"
+
+	return ExpressionEnv{
+		Event:     e,
+		EventTime: eventTime,
+		LastSeenFunc: func(profileId, beaconId string) (bool, time.Time) {
+			if lastSeenAgo == 0 {
+				return false, time.Time{}
+			}
+			return true, eventTime.Add(-lastSeenAgo)
+		},
+		BeaconFunc: func(beaconId string) (*Beacon, error) {
+			beacon := &Beacon{Location: "SF", Major: 3, Organization: "Couchbase"}
+			beacon.Id = beaconId
+			return beacon, nil
+		},
+		ProfileFunc: func(profileId string) (*OfficeRadarProfile, error) {
+			profile := &OfficeRadarProfile{Name: "Traun"}
+			profile.Id = profileId
+			return profile, nil
+		},
+	}
+
+}
+
+func TestExpressionEvaluate(t *testing.T) {
+
+	env := newTestExpressionEnv(21 * 24 * time.Hour)
+
+	tests := []struct {
+		source   string
+		expected bool
+	}{
+		{`event.action == "entry" && beacon.location == "SF" && lastSeen(profile, beacon) > 14d`, true},
+		{`event.action == "entry" && beacon.location == "SF" && lastSeen(profile, beacon) > 30d`, false},
+		{`lastSeen(event.profile, "sfBeaconId") >= 1d12h`, true},
+		{`event.action == "exit" || profile.name == "Traun"`, true},
+		{`!(event.action == "entry")`, false},
+		{`beacon.major + 1 == 4 && beacon.minor < 1`, true},
+		{`hour(event.created_at, "UTC") >= 8 && hour(event.created_at, "America/Los_Angeles") < 8`, true},
+		{`weekday(event.created_at, "UTC") == "Tuesday"`, true},
+		{`contains(lower(beacon.organization), "couch")`, true},
+		{`oneOf(beacon.location, "MV", "SF")`, true},
+		{`event.created_at - 1h < event.created_at`, true},
+		{`"a" < "b" && 2h30m == 150m && true != false`, true},
+	}
+
+	for _, test := range tests {
+		expression, err := CompileExpression(test.source)
+		if err != nil {
+			t.Errorf("Unable to compile %v: %v", test.source, err)
+			continue
+		}
+		result, err := expression.Evaluate(env)
+		assert.True(t, err == nil)
+		if result != test.expected {
+			t.Errorf("%v: expected %v, got %v", test.source, test.expected, result)
+		}
+	}
+
+	// never seen counts as longer ago than anything, even after arithmetic
+	neverTests := []struct {
+		source   string
+		expected bool
+	}{
+		{`lastSeen(profile, beacon) > 1000d`, true},
+		{`lastSeen(profile, beacon) + 1d > 1000d`, true},
+		{`1d + lastSeen(profile, beacon) > 1000d`, true},
+		{`lastSeen(profile, beacon) - 1000d >= 1000d`, true},
+		{`lastSeen(profile, beacon) == lastSeen("jensId", beacon)`, true},
+		{`lastSeen(profile, beacon) < 1000d`, false},
+	}
+	for _, test := range neverTests {
+		expression, err := CompileExpression(test.source)
+		assert.True(t, err == nil)
+		result, err := expression.Evaluate(newTestExpressionEnv(0))
+		assert.True(t, err == nil)
+		if result != test.expected {
+			t.Errorf("%v: expected %v, got %v", test.source, test.expected, result)
+		}
+	}
+
+	// there's no time that's never seen before the event
+	expression, err := CompileExpression(`event.created_at - lastSeen(profile, beacon) > event.created_at`)
+	assert.True(t, err == nil)
+	_, err = expression.Evaluate(newTestExpressionEnv(0))
+	assert.True(t, err != nil)
+
+}
+
+func TestExpressionCompileErrors(t *testing.T) {
+
+	tests := []struct {
+		source string
+		err    string
+	}{
+		{`event.action`, "must be a bool"},
+		{`event.action == 3`, "Can't apply =="},
+		{`beacon.location > 14d`, "Can't apply >"},
+		{`event.colour == "red"`, `no field "colour"`},
+		{`office.location == "SF"`, `Unknown name "office"`},
+		{`exec("rm -rf /")`, `Unknown function "exec"`},
+		{`lastSeen(beacon, profile) > 1d`, "lastSeen expects"},
+		{`!event.action`, "! expects a bool"},
+		{`event.action == "entry`, "Unterminated string"},
+		{`event.action == "entry" &&`, "Unexpected end"},
+		{`(event.action == "entry"`, `Expected ")"`},
+		{`event.action = "entry"`, "Unexpected character"},
+		{`14x > 1d`, "Invalid number or duration"},
+		{strings.Repeat("!", 100) + `true`, "nested more than"},
+		{strings.Repeat(`true || `, 500) + `true`, "longer than"},
+	}
+
+	for _, test := range tests {
+		_, err := CompileExpression(test.source)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: expected error containing %q, got %v", test.source, test.err, err)
+		}
+	}
+
+}
+
+func TestExpressionNestedParens(t *testing.T) {
+
+	env := newTestExpressionEnv(time.Hour)
+	for depth := 5; depth <= 10; depth++ {
+		source := strings.Repeat("(", depth) + `event.action == "entry"` + strings.Repeat(")", depth)
+		expression, err := CompileExpression(source)
+		if err != nil {
+			t.Fatalf("%v: %v", source, err)
+		}
+		result, err := expression.Evaluate(env)
+		assert.True(t, err == nil)
+		assert.True(t, result)
+	}
+
+}
+
+func TestExpressionRequiredIds(t *testing.T) {
+
+	tests := []struct {
+		source   string
+		beacons  []string
+		profiles []string
+	}{
+		{`event.beacon == "sfBeaconId" && event.action == "entry"`, []string{"sfBeaconId"}, []string{}},
+		{`event.action == "entry" && ("traunsId" == profile.id && beacon.id == "sfBeaconId")`, []string{"sfBeaconId"}, []string{"traunsId"}},
+		{`event.beacon == "sfBeaconId" || event.beacon == "mvBeaconId"`, []string{"sfBeaconId", "mvBeaconId"}, []string{}},
+		{`event.beacon == "sfBeaconId" || event.action == "exit"`, []string{}, []string{}},
+		{`event.beacon != "sfBeaconId"`, []string{}, []string{}},
+		{`!(event.beacon == "sfBeaconId")`, []string{}, []string{}},
+	}
+
+	for _, test := range tests {
+		expression, err := CompileExpression(test.source)
+		assert.True(t, err == nil)
+		assert.DeepEquals(t, expression.RequiredIds("beacon"), test.beacons)
+		assert.DeepEquals(t, expression.RequiredIds("profile"), test.profiles)
+	}
+
+	alert := NewExpressionAlert()
+	alert.Id = "expression_alert"
+	alert.Expression = `event.profile == "traunsId" && event.action == "entry"`
+	assert.True(t, alert.Validate() == nil)
+	index := NewAlertIndex()
+	index.Upsert(alert)
+	assert.Equals(t, len(index.Candidates(GeofenceEvent{BeaconId: "sfBeaconId", ProfileId: "traunsId"})), 1)
+	assert.Equals(t, len(index.Candidates(GeofenceEvent{BeaconId: "sfBeaconId", ProfileId: "jensId"})), 0)
+
+}
+
+func TestExpressionLookupErrors(t *testing.T) {
+
+	env := newTestExpressionEnv(time.Hour)
+	env.BeaconFunc = func(beaconId string) (*Beacon, error) {
+		return nil, fmt.Errorf("404 Not Found")
+	}
+
+	expression, err := CompileExpression(`beacon.location == "SF"`)
+	assert.True(t, err == nil)
+	_, err = expression.Evaluate(env)
+	assert.True(t, err != nil)
+
+	// the beacon isn't looked up if the expression doesn't need it
+	expression, err = CompileExpression(`event.action == "exit" && beacon.location == "SF"`)
+	assert.True(t, err == nil)
+	result, err := expression.Evaluate(env)
+	assert.True(t, err == nil)
+	assert.False(t, result)
+
+}
+
+func TestConditionExpression(t *testing.T) {
+
+	condition := parseCondition(t, `{"op": "and", "conditions": [
+		{"op": "beacon_in", "ids": ["sfBeaconId"]},
+		{"op": "expression", "expression": "profile.name == \"Traun\""}
+	]}`)
+
+	env := newTestExpressionEnv(time.Hour)
+	ctx := ConditionContext{
+		Event:       env.Event,
+		EventTime:   env.EventTime,
+		Sequences:   NewSequenceState(),
+		ProfileFunc: env.ProfileFunc,
+	}
+	result, err := condition.Evaluate(ctx)
+	assert.True(t, err == nil)
+	assert.True(t, result)
+
+	invalid := &Condition{Op: CONDITION_EXPRESSION, Expression: "profile.name"}
+	assert.True(t, invalid.Validate() != nil)
+
+}
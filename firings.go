@@ -0,0 +1,117 @@
+package officeradar
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DOC_TYPE_ALERT_FIRINGS = "alert_firings"
+	MAX_ALERT_FIRINGS      = 100 // older firings are dropped from the history
+)
+
+// A time an alert fired, what fired it, and the notifications it sent
+type AlertFiring struct {
+	FiredAt       time.Time     `json:"fired_at"`
+	EventId       string        `json:"event,omitempty"`          // the geofence event that fired the alert, if any
+	TimerId       string        `json:"timer,omitempty"`          // or the timer that fired it
+	ProfileId     string        `json:"profile,omitempty"`        // the profile the event or timer concerns, if any
+	BeaconId      string        `json:"beacon,omitempty"`         // the beacon the event or timer concerns, if any
+	Manual        bool          `json:"manual,omitempty"`         // fired by hand via the admin api
+	CorrelationId string        `json:"correlation_id,omitempty"` // to find the logs about the firing
+	Actions       []AlertAction `json:"actions"`
+}
+
+// Keeps the most recent firings of each alert in a doc per alert, so that
+// the history survives the alert being rescheduled or restarts of the app
+// server.
+type FiringHistory struct {
+	mutex sync.Mutex
+	store FixtureStore
+}
+
+func NewFiringHistory(store FixtureStore) *FiringHistory {
+	return &FiringHistory{store: store}
+}
+
+func alertFiringsId(alertId string) string {
+	return fmt.Sprintf("%v:%v", DOC_TYPE_ALERT_FIRINGS, alertId)
+}
+
+// Add a firing to the alert's history, dropping the oldest one if the
+// history is full
+func (h *FiringHistory) Record(alertId string, firing AlertFiring) error {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	doc, exists, err := h.store.Get(alertFiringsId(alertId))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		doc = FixtureDoc{
+			"_id":   alertFiringsId(alertId),
+			"type":  DOC_TYPE_ALERT_FIRINGS,
+			"alert": alertId,
+		}
+	}
+
+	firings, err := decodeFirings(doc)
+	if err != nil {
+		return err
+	}
+	firings = append(firings, firing)
+	if len(firings) > MAX_ALERT_FIRINGS {
+		firings = firings[len(firings)-MAX_ALERT_FIRINGS:]
+	}
+	doc["firings"] = firings
+
+	return h.store.Put(doc)
+
+}
+
+// The alert's firings, oldest first
+func (h *FiringHistory) Firings(alertId string) ([]AlertFiring, error) {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	doc, exists, err := h.store.Get(alertFiringsId(alertId))
+	if err != nil || !exists {
+		return []AlertFiring{}, err
+	}
+	return decodeFirings(doc)
+
+}
+
+// Forget the alert's firings, eg, when it's deleted
+func (h *FiringHistory) Delete(alertId string) error {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	doc, exists, err := h.store.Get(alertFiringsId(alertId))
+	if err != nil || !exists {
+		return err
+	}
+	return h.store.Delete(doc.Id(), doc.Revision())
+
+}
+
+func decodeFirings(doc FixtureDoc) ([]AlertFiring, error) {
+	firings := []AlertFiring{}
+	if doc["firings"] == nil {
+		return firings, nil
+	}
+	data, err := json.Marshal(doc["firings"])
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &firings); err != nil {
+		return nil, fmt.Errorf("Invalid firing history: %v", err)
+	}
+	return firings, nil
+}
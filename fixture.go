@@ -0,0 +1,370 @@
+package officeradar
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/tleyden/go-couch"
+)
+
+// Seed data for the database, which can be written as YAML or JSON.  Each doc
+// is kept as-is, so any fields the app server doesn't know about survive an
+// export followed by an import.
+type Fixture struct {
+	Beacons  []FixtureDoc `json:"beacons,omitempty"`
+	Profiles []FixtureDoc `json:"profiles,omitempty"`
+	Alerts   []FixtureDoc `json:"alerts,omitempty"`
+	Events   []FixtureDoc `json:"events,omitempty"`
+}
+
+type FixtureDoc map[string]interface{}
+
+func (d FixtureDoc) Id() string {
+	id, _ := d["_id"].(string)
+	return id
+}
+
+func (d FixtureDoc) Revision() string {
+	rev, _ := d["_rev"].(string)
+	return rev
+}
+
+func (d FixtureDoc) Type() string {
+	docType, _ := d["type"].(string)
+	return docType
+}
+
+// What an import did, or would have done
+type FixtureImportResult struct {
+	Inserted  []string
+	Updated   []string
+	Unchanged []string
+	Pruned    []string
+}
+
+// The database operations used by fixtures
+type FixtureStore interface {
+	AllDocs() ([]FixtureDoc, error)
+	Get(docId string) (FixtureDoc, bool, error)
+	Put(doc FixtureDoc) error // inserts the doc, or updates it if it has a _rev
+	Delete(docId, rev string) error
+}
+
+// Parse a fixture, which may be YAML or JSON
+func ReadFixture(reader io.Reader) (*Fixture, error) {
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid fixture: %v", err)
+	}
+
+	fixture := &Fixture{}
+	if err := json.Unmarshal(jsonData, fixture); err != nil {
+		return nil, fmt.Errorf("Invalid fixture: %v", err)
+	}
+	return fixture, nil
+
+}
+
+// Write the fixture as YAML, or as JSON if asJson is true
+func (f *Fixture) Write(writer io.Writer, asJson bool) error {
+
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	if !asJson {
+		if data, err = yaml.JSONToYAML(data); err != nil {
+			return err
+		}
+	}
+	_, err = writer.Write(data)
+	return err
+
+}
+
+// Check that every doc has an id and the right type for its section, filling
+// in the type where it's missing, and that the alerts are valid.
+func (f *Fixture) Validate() error {
+
+	sections := []struct {
+		name    string
+		docs    []FixtureDoc
+		docType string
+	}{
+		{"beacons", f.Beacons, DOC_TYPE_BEACON},
+		{"profiles", f.Profiles, DOC_TYPE_PROFILE},
+		{"alerts", f.Alerts, ""},
+		{"events", f.Events, DOC_TYPE_GEOFENCE_EVENT},
+	}
+
+	seen := map[string]bool{}
+	for _, section := range sections {
+		for i, doc := range section.docs {
+			if doc.Id() == "" {
+				return fmt.Errorf("%v[%d] has no _id", section.name, i)
+			}
+			if seen[doc.Id()] {
+				return fmt.Errorf("%v[%d]: duplicate _id %v", section.name, i, doc.Id())
+			}
+			seen[doc.Id()] = true
+
+			if section.docType != "" && doc.Type() == "" {
+				doc["type"] = section.docType
+			}
+			if section.docType != "" && doc.Type() != section.docType {
+				return fmt.Errorf("%v[%d]: %v has type %v, expected %v", section.name, i, doc.Id(), doc.Type(), section.docType)
+			}
+		}
+	}
+
+	for i, doc := range f.Alerts {
+		alertJson, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		if _, err := DecodeAlert(couch.Database{}, alertJson, AlertServices{}); err != nil {
+			return fmt.Errorf("alerts[%d]: %v", i, err)
+		}
+	}
+
+	return nil
+
+}
+
+// All of the docs in the fixture, in the order they should be imported, so
+// that alerts and events only refer to beacons and profiles that exist.
+func (f *Fixture) docs() []FixtureDoc {
+	docs := []FixtureDoc{}
+	for _, section := range [][]FixtureDoc{f.Beacons, f.Profiles, f.Alerts, f.Events} {
+		docs = append(docs, section...)
+	}
+	return docs
+}
+
+// Upsert the fixture's docs into the store by id, so that importing the same
+// fixture again changes nothing.  If prune is set, docs that aren't in the
+// fixture are deleted, but only for the sections the fixture declares, eg, a
+// fixture of just beacons doesn't prune the events.  If dryRun is set,
+// nothing is written, but the result shows what would have been.
+func ImportFixture(store FixtureStore, fixture *Fixture, prune, dryRun bool) (*FixtureImportResult, error) {
+
+	if err := fixture.Validate(); err != nil {
+		return nil, err
+	}
+
+	result := &FixtureImportResult{}
+	inFixture := map[string]bool{}
+
+	for _, doc := range fixture.docs() {
+
+		inFixture[doc.Id()] = true
+
+		existing, exists, err := store.Get(doc.Id())
+		if err != nil {
+			return result, fmt.Errorf("Unable to get %v: %v", doc.Id(), err)
+		}
+
+		doc = withoutRevision(doc)
+		switch {
+		case exists && sameDoc(doc, existing):
+			result.Unchanged = append(result.Unchanged, doc.Id())
+			continue
+		case exists:
+			doc["_rev"] = existing.Revision()
+			result.Updated = append(result.Updated, doc.Id())
+		default:
+			result.Inserted = append(result.Inserted, doc.Id())
+		}
+
+		if dryRun {
+			continue
+		}
+		if err := store.Put(doc); err != nil {
+			return result, fmt.Errorf("Unable to save %v: %v", doc.Id(), err)
+		}
+
+	}
+
+	if !prune {
+		return result, nil
+	}
+
+	allDocs, err := store.AllDocs()
+	if err != nil {
+		return result, fmt.Errorf("Unable to list docs to prune: %v", err)
+	}
+	for _, doc := range allDocs {
+		if inFixture[doc.Id()] || !fixture.declares(doc.Type()) {
+			continue
+		}
+		result.Pruned = append(result.Pruned, doc.Id())
+		if dryRun {
+			continue
+		}
+		if err := store.Delete(doc.Id(), doc.Revision()); err != nil {
+			return result, fmt.Errorf("Unable to prune %v: %v", doc.Id(), err)
+		}
+	}
+
+	return result, nil
+
+}
+
+// Export the beacons, profiles, alerts and events in the store, sorted by id
+// and without revisions, so that the export can be imported elsewhere.
+func ExportFixture(store FixtureStore) (*Fixture, error) {
+
+	allDocs, err := store.AllDocs()
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(fixtureDocsById(allDocs))
+
+	fixture := &Fixture{}
+	for _, doc := range allDocs {
+		doc = withoutRevision(doc)
+		switch docType := doc.Type(); {
+		case docType == DOC_TYPE_BEACON:
+			fixture.Beacons = append(fixture.Beacons, doc)
+		case docType == DOC_TYPE_PROFILE:
+			fixture.Profiles = append(fixture.Profiles, doc)
+		case isAlertDocType(docType):
+			fixture.Alerts = append(fixture.Alerts, doc)
+		case docType == DOC_TYPE_GEOFENCE_EVENT:
+			fixture.Events = append(fixture.Events, doc)
+		}
+	}
+	return fixture, nil
+
+}
+
+// Does the fixture have a section for this kind of doc, even an empty one?
+// Only those kinds are pruned.
+func (f *Fixture) declares(docType string) bool {
+	switch {
+	case docType == DOC_TYPE_BEACON:
+		return f.Beacons != nil
+	case docType == DOC_TYPE_PROFILE:
+		return f.Profiles != nil
+	case isAlertDocType(docType):
+		return f.Alerts != nil
+	case docType == DOC_TYPE_GEOFENCE_EVENT:
+		return f.Events != nil
+	}
+	return false
+}
+
+func withoutRevision(doc FixtureDoc) FixtureDoc {
+	copied := FixtureDoc{}
+	for key, value := range doc {
+		if key != "_rev" {
+			copied[key] = value
+		}
+	}
+	return copied
+}
+
+// Are the docs the same, apart from their revisions?  They're compared as
+// JSON so that, eg, YAML integers match JSON numbers.
+func sameDoc(doc, other FixtureDoc) bool {
+	normalize := func(doc FixtureDoc) interface{} {
+		data, _ := json.Marshal(withoutRevision(doc))
+		var normalized interface{}
+		json.Unmarshal(data, &normalized)
+		return normalized
+	}
+	return reflect.DeepEqual(normalize(doc), normalize(other))
+}
+
+type fixtureDocsById []FixtureDoc
+
+func (d fixtureDocsById) Len() int           { return len(d) }
+func (d fixtureDocsById) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d fixtureDocsById) Less(i, j int) bool { return d[i].Id() < d[j].Id() }
+
+// Stores fixture docs in the database
+type couchFixtureStore struct {
+	db couch.Database
+}
+
+func NewCouchFixtureStore(db couch.Database) FixtureStore {
+	return couchFixtureStore{db: db}
+}
+
+// All of the docs, by reading the changes feed from the beginning.  Fails if
+// any of them can't be retrieved, rather than leaving it out, so that an
+// export or prune is never based on a partial list.
+func (s couchFixtureStore) AllDocs() ([]FixtureDoc, error) {
+
+	docs := []FixtureDoc{}
+	var loadErr error
+
+	handleChanges := func(reader io.Reader) interface{} {
+		changes, err := decodeChanges(reader)
+		if err != nil {
+			loadErr = err
+			return nil // stop
+		}
+		for _, change := range changes.Results {
+			if change.Deleted || strings.HasPrefix(change.Id, "_") {
+				continue
+			}
+			doc := FixtureDoc{}
+			err := s.db.Retrieve(change.Id, &doc)
+			if isNotFound(err) {
+				continue // deleted since the feed was read
+			}
+			if err != nil {
+				loadErr = fmt.Errorf("Unable to retrieve %v: %v", change.Id, err)
+				return nil // stop
+			}
+			docs = append(docs, doc)
+		}
+		return nil // a normal (non-continuous) feed only needs one callback
+	}
+
+	options := map[string]interface{}{
+		"since": 0,
+		"feed":  "normal",
+	}
+	s.db.Changes(handleChanges, options)
+
+	return docs, loadErr
+
+}
+
+func (s couchFixtureStore) Get(docId string) (FixtureDoc, bool, error) {
+	doc := FixtureDoc{}
+	err := s.db.Retrieve(docId, &doc)
+	if isNotFound(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return doc, true, nil
+}
+
+func (s couchFixtureStore) Put(doc FixtureDoc) error {
+	if doc.Revision() == "" {
+		_, _, err := s.db.InsertWith(doc, doc.Id())
+		return err
+	}
+	_, err := s.db.EditWith(doc, doc.Id(), doc.Revision())
+	return err
+}
+
+func (s couchFixtureStore) Delete(docId, rev string) error {
+	return s.db.Delete(docId, rev)
+}
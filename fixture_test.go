@@ -0,0 +1,171 @@
+package officeradar
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+type memoryFixtureStore struct {
+	docs      map[string]FixtureDoc
+	revisions int
+}
+
+func newMemoryFixtureStore() *memoryFixtureStore {
+	return &memoryFixtureStore{docs: map[string]FixtureDoc{}}
+}
+
+func (s *memoryFixtureStore) AllDocs() ([]FixtureDoc, error) {
+	docs := []FixtureDoc{}
+	for _, doc := range s.docs {
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+func (s *memoryFixtureStore) Get(docId string) (FixtureDoc, bool, error) {
+	doc, ok := s.docs[docId]
+	return doc, ok, nil
+}
+
+func (s *memoryFixtureStore) Put(doc FixtureDoc) error {
+	existing, exists := s.docs[doc.Id()]
+	if exists && existing.Revision() != doc.Revision() {
+		return fmt.Errorf("409 Conflict")
+	}
+	s.revisions += 1
+	saved := withoutRevision(doc)
+	saved["_rev"] = fmt.Sprintf("%d-abc", s.revisions)
+	s.docs[doc.Id()] = saved
+	return nil
+}
+
+func (s *memoryFixtureStore) Delete(docId, rev string) error {
+	delete(s.docs, docId)
+	return nil
+}
+
+const testFixture = `
+beacons:
+  - _id: sfBeaconId
+    desc: sf beacon
+    location: SF
+    major: 1
+profiles:
+  - _id: jensId
+    name: Jens
+    type: profile
+alerts:
+  - _id: alert1
+    type: any_users_present_alert
+    Beacon: {_id: sfBeaconId}
+    Users: [{_id: jensId}]
+    Actions:
+      - Recipient: jensId
+        Message: Welcome to SF
+events:
+  - _id: event1
+    action: entry
+    beacon: sfBeaconId
+    profile: jensId
+    created_at: "2014-09-02T09:00:00Z"
+`
+
+func TestImportFixture(t *testing.T) {
+
+	fixture, err := ReadFixture(strings.NewReader(testFixture))
+	assert.True(t, err == nil)
+
+	store := newMemoryFixtureStore()
+	store.Put(FixtureDoc{"_id": "oldBeaconId", "type": DOC_TYPE_BEACON})
+	store.Put(FixtureDoc{"_id": "_local/officeradar_checkpoint", "since": "12"})
+
+	result, err := ImportFixture(store, fixture, false, false)
+	assert.True(t, err == nil)
+	assert.Equals(t, len(result.Inserted), 4)
+	assert.Equals(t, store.docs["sfBeaconId"].Type(), DOC_TYPE_BEACON)
+	assert.Equals(t, store.docs["event1"].Type(), DOC_TYPE_GEOFENCE_EVENT)
+
+	// importing again changes nothing
+	fixture, _ = ReadFixture(strings.NewReader(testFixture))
+	result, err = ImportFixture(store, fixture, false, false)
+	assert.True(t, err == nil)
+	assert.Equals(t, len(result.Inserted), 0)
+	assert.Equals(t, len(result.Updated), 0)
+	assert.Equals(t, len(result.Unchanged), 4)
+
+	// a changed doc is updated using the current revision
+	fixture, _ = ReadFixture(strings.NewReader(strings.Replace(testFixture, "name: Jens", "name: Jens A", 1)))
+	result, err = ImportFixture(store, fixture, true, true)
+	assert.True(t, err == nil)
+	assert.DeepEquals(t, result.Updated, []string{"jensId"})
+	assert.DeepEquals(t, result.Pruned, []string{"oldBeaconId"})
+	assert.Equals(t, store.docs["jensId"]["name"], "Jens") // dry run
+
+	result, err = ImportFixture(store, fixture, true, false)
+	assert.True(t, err == nil)
+	assert.Equals(t, store.docs["jensId"]["name"], "Jens A")
+	_, stillThere := store.docs["oldBeaconId"]
+	assert.False(t, stillThere)
+	_, stillThere = store.docs["_local/officeradar_checkpoint"]
+	assert.True(t, stillThere)
+
+	// only the sections in the fixture are pruned, an empty one prunes everything
+	fixture, _ = ReadFixture(strings.NewReader("beacons: []"))
+	result, err = ImportFixture(store, fixture, true, false)
+	assert.True(t, err == nil)
+	assert.DeepEquals(t, result.Pruned, []string{"sfBeaconId"})
+	assert.Equals(t, len(store.docs), 4)
+
+}
+
+func TestFixtureValidate(t *testing.T) {
+
+	invalid := []string{
+		"beacons: [{desc: no id}]",
+		"beacons: [{_id: b1, type: profile}]",
+		"profiles: [{_id: p1}]\nevents: [{_id: p1}]",
+		"alerts: [{_id: a1, type: bogus_alert}]",
+		"alerts: [{_id: a1, type: expression_alert, Expression: 'event.action'}]",
+	}
+	for _, source := range invalid {
+		fixture, err := ReadFixture(strings.NewReader(source))
+		assert.True(t, err == nil)
+		if fixture.Validate() == nil {
+			t.Errorf("Expected fixture to be invalid: %v", source)
+		}
+	}
+
+	_, err := ReadFixture(strings.NewReader("beacons: [unterminated"))
+	assert.True(t, err != nil)
+
+}
+
+func TestExportFixture(t *testing.T) {
+
+	store := newMemoryFixtureStore()
+	fixture, _ := ReadFixture(strings.NewReader(testFixture))
+	ImportFixture(store, fixture, false, false)
+	store.Put(FixtureDoc{"_id": "alert_timer:alert1:jensId:sfBeaconId", "type": DOC_TYPE_ALERT_TIMER})
+
+	exported, err := ExportFixture(store)
+	assert.True(t, err == nil)
+	assert.Equals(t, len(exported.Beacons), 1)
+	assert.Equals(t, len(exported.Alerts), 1)
+	assert.Equals(t, exported.Beacons[0].Revision(), "")
+
+	// round trips through both formats into an equivalent database
+	for _, asJson := range []bool{false, true} {
+		buffer := &bytes.Buffer{}
+		assert.True(t, exported.Write(buffer, asJson) == nil)
+		reread, err := ReadFixture(buffer)
+		assert.True(t, err == nil)
+		result, err := ImportFixture(store, reread, false, false)
+		assert.True(t, err == nil)
+		assert.Equals(t, len(result.Unchanged), 4)
+	}
+
+}
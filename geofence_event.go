@@ -1,6 +1,22 @@
 package officeradar
 
-import "time"
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tleyden/go-couch"
+)
+
+const (
+	DOC_TYPE_GEOFENCE_EVENT = "geofence_event"
+)
 
 const (
 	ACTION_ENTRY = "entry"
@@ -13,6 +29,78 @@ type GeofenceEvent struct {
 	BeaconId  string `json:"beacon"`
 	CreatedAt string `json:"created_at"` // eg, "2014-08-29T01:19:15.388Z" - RFC3339
 	ProfileId string `json:"profile"`
+
+	correlationId string     // follows the event through the logs, from the change that delivered it
+	settle        func()     // if set, called once the event has been processed or filtered out
+	docs          *eventDocs // if set, shared by the alerts the event is evaluated against
+}
+
+// The beacon and profile docs of an event, so they're only fetched once no
+// matter how many alerts look at them
+type eventDocs struct {
+	mutex   sync.Mutex
+	beacon  *Beacon
+	profile *OfficeRadarProfile
+}
+
+func newEventDocs() *eventDocs {
+	return &eventDocs{}
+}
+
+// Fetch the event's beacon the first time it's needed.  W/o anywhere to keep
+// it (eg, in a preview), it's fetched every time.
+func (d *eventDocs) fetchBeacon(db couch.Database, beaconId string) (*Beacon, error) {
+	if d == nil {
+		return FetchBeacon(db, beaconId)
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.beacon == nil {
+		beacon, err := FetchBeacon(db, beaconId)
+		if err != nil {
+			return nil, err
+		}
+		d.beacon = beacon
+	}
+	return d.beacon, nil
+}
+
+func (d *eventDocs) fetchProfile(db couch.Database, profileId string) (*OfficeRadarProfile, error) {
+	if d == nil {
+		return FetchOfficeRadarProfile(db, profileId)
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.profile == nil {
+		profile, err := FetchOfficeRadarProfile(db, profileId)
+		if err != nil {
+			return nil, err
+		}
+		d.profile = profile
+	}
+	return d.profile, nil
+}
+
+// Logs with the event's correlation id
+func (e GeofenceEvent) logger() *Logger {
+	return Log.WithCorrelationId(e.correlationId)
+}
+
+// Let go of the event's change, eg, so that the checkpoint can move past it
+func (e GeofenceEvent) settled() {
+	if e.settle != nil {
+		e.settle()
+	}
+}
+
+// Deferred while processing the event.  The worker recovers from a panic and
+// completes the change, so the event has to let go of it too, or the
+// checkpoint would be stuck behind it.
+func (e GeofenceEvent) settleOnPanic() {
+	if r := recover(); r != nil {
+		e.settled()
+		panic(r)
+	}
 }
 
 func (e GeofenceEvent) ActionPastTense() string {
@@ -31,3 +119,105 @@ func (e GeofenceEvent) CreatedAtTime() (time.Time, error) {
 	return time.Parse(time.RFC3339, e.CreatedAt)
 
 }
+
+// The time at which the event happened, which is what alerts should be
+// evaluated against.  If the event has no valid timestamp, the current
+// time according to the clock is used instead.
+func (e GeofenceEvent) EventTime(clock Clock) time.Time {
+
+	createdAt, err := e.CreatedAtTime()
+	if err != nil {
+		return clock.Now()
+	}
+	return createdAt
+
+}
+
+// Load all of the stored geofence events, by reading the changes feed from
+// the beginning.  They are returned in the order they were stored, which
+// isn't necessarily the order in which they happened.
+func LoadGeofenceEvents(db couch.Database) ([]GeofenceEvent, error) {
+	return LoadGeofenceEventsBetween(db, 0, 0)
+}
+
+// Load the geofence events stored after the sinceSeq sequence of the changes
+// feed, up to and including the untilSeq sequence (0 means no limit).
+func LoadGeofenceEventsBetween(db couch.Database, sinceSeq, untilSeq uint64) ([]GeofenceEvent, error) {
+
+	events := []GeofenceEvent{}
+	var loadErr error
+
+	handleChanges := func(reader io.Reader) interface{} {
+		changes, err := decodeChanges(reader)
+		if err != nil {
+			loadErr = err
+			return nil // stop
+		}
+		for _, change := range changes.Results {
+			if untilSeq > 0 {
+				seq, ok := sequenceNumber(change.Sequence)
+				if ok && seq > untilSeq {
+					break
+				}
+			}
+			if change.Deleted {
+				continue
+			}
+			geofenceEvent := GeofenceEvent{}
+			if err := db.Retrieve(change.Id, &geofenceEvent); err != nil {
+				Log.Error("Didn't retrieve doc", LogFields{"doc": change.Id, "error": err})
+				continue
+			}
+			if geofenceEvent.Type == DOC_TYPE_GEOFENCE_EVENT {
+				events = append(events, geofenceEvent)
+			}
+		}
+		return nil // a normal (non-continuous) feed only needs one callback
+	}
+
+	options := map[string]interface{}{
+		"since": sinceSeq,
+		"feed":  "normal",
+	}
+	db.Changes(handleChanges, options)
+
+	return events, loadErr
+
+}
+
+// Read geofence events from JSON lines, eg, an export of the event docs.
+// Blank lines are skipped.
+func ReadGeofenceEvents(reader io.Reader) ([]GeofenceEvent, error) {
+
+	events := []GeofenceEvent{}
+	scanner := bufio.NewScanner(reader)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber += 1
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		geofenceEvent := GeofenceEvent{}
+		if err := json.Unmarshal(line, &geofenceEvent); err != nil {
+			return nil, fmt.Errorf("Invalid geofence event on line %d: %v", lineNumber, err)
+		}
+		events = append(events, geofenceEvent)
+	}
+	return events, scanner.Err()
+
+}
+
+// The numeric part of a changes feed sequence, which sync gateway may return
+// as a number or as a string such as "12" or "11:12"
+func sequenceNumber(seq interface{}) (uint64, bool) {
+	switch seq := seq.(type) {
+	case float64:
+		return uint64(seq), true
+	case string:
+		parts := strings.Split(seq, ":")
+		number, err := strconv.ParseUint(parts[len(parts)-1], 10, 64)
+		return number, err == nil
+	}
+	return 0, false
+}
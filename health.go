@@ -0,0 +1,300 @@
+package officeradar
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Keeps track of whether the alerts have been loaded and what the changes
+// feed follower is up to, so that the status server can report on it.
+type Health struct {
+	mutex        sync.Mutex
+	alertsLoaded bool
+	feed         FeedStatus
+	deadLetters  DeadLetterStatus
+}
+
+const MAX_RECENT_DEAD_LETTERS = 20
+
+// A change that was given up on, since its doc couldn't be retrieved
+type DeadLetter struct {
+	DocId    string      `json:"doc_id"`
+	Sequence interface{} `json:"sequence"`
+	Error    string      `json:"error"`
+	At       time.Time   `json:"at"`
+}
+
+type DeadLetterStatus struct {
+	Count  int          `json:"count"`
+	Recent []DeadLetter `json:"recent"` // oldest first
+}
+
+// The state of the changes feed follower
+type FeedStatus struct {
+	Running       bool        `json:"running"`
+	Exited        bool        `json:"exited"` // the follower stopped, and won't see any more changes
+	Since         interface{} `json:"since"`
+	LastSequence  interface{} `json:"last_sequence,omitempty"`
+	Lag           *uint64     `json:"lag,omitempty"` // how many sequences since is behind the last sequence, if known
+	LastError     string      `json:"last_error,omitempty"`
+	LastErrorAt   time.Time   `json:"last_error_at"`
+	Reconnects    int         `json:"reconnects"` // how many times the feed had to be requested again after an error
+	LastChangesAt time.Time   `json:"last_changes_at"`
+}
+
+func NewHealth() *Health {
+	return &Health{}
+}
+
+func (h *Health) setAlertsLoaded() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.alertsLoaded = true
+}
+
+func (h *Health) feedStarted(since interface{}) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.feed.Running = true
+	h.feed.Since = since
+}
+
+func (h *Health) feedReceived(since interface{}, at time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.feed.Since = since
+	h.feed.LastChangesAt = at
+}
+
+func (h *Health) feedFailed(err error, at time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.feed.LastError = err.Error()
+	h.feed.LastErrorAt = at
+	h.feed.Reconnects += 1
+}
+
+func (h *Health) feedExited() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.feed.Running = false
+	h.feed.Exited = true
+}
+
+func (h *Health) deadLettered(deadLetter DeadLetter) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.deadLetters.Count += 1
+	h.deadLetters.Recent = append(h.deadLetters.Recent, deadLetter)
+	if len(h.deadLetters.Recent) > MAX_RECENT_DEAD_LETTERS {
+		h.deadLetters.Recent = h.deadLetters.Recent[1:]
+	}
+}
+
+func (h *Health) AlertsLoaded() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.alertsLoaded
+}
+
+func (h *Health) Feed() FeedStatus {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.feed
+}
+
+func (h *Health) DeadLetters() DeadLetterStatus {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	status := h.deadLetters
+	status.Recent = append([]DeadLetter{}, h.deadLetters.Recent...)
+	return status
+}
+
+// Everything the status server knows about the app server
+type AppStatus struct {
+	Healthy     bool             `json:"healthy"`
+	Ready       bool             `json:"ready"`
+	Problems    []string         `json:"problems,omitempty"` // why it isn't healthy or ready
+	Feed        FeedStatus       `json:"feed"`
+	Push        PushStatus       `json:"push"`
+	Alerts      AlertCounts      `json:"alerts"`
+	Timers      int              `json:"timers"` // pending alert timers
+	Debouncer   DebouncerStatus  `json:"debouncer"`
+	DeadLetters DeadLetterStatus `json:"dead_letters"` // changes given up on
+}
+
+type PushStatus struct {
+	Checked   bool   `json:"checked"` // only some notifiers can be checked
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+}
+
+type DebouncerStatus struct {
+	Pending  int             `json:"pending"`  // events waiting for their dwell time to pass
+	Filtered []FilteredEvent `json:"filtered"` // the most recently filtered events, oldest first
+}
+
+type AlertCounts struct {
+	Total  int            `json:"total"`
+	Active int            `json:"active"`
+	ByType map[string]int `json:"by_type"`
+}
+
+// Notifiers that send to a backend which can be checked
+type reachabilityChecker interface {
+	CheckReachable() error
+}
+
+// Serves the health, readiness and status of the app server:
+//
+//	GET /healthz  200 unless the changes feed follower has exited
+//	GET /readyz   200 once the alerts are loaded and the changes feed is being followed
+//	GET /status   the state of the changes feed, the push backend, the alerts, the debouncer and the dead letters
+//	GET /metrics  the app's metrics, in the prometheus text format
+type StatusServer struct {
+	App              *OfficeRadarApp
+	LastSequenceFunc func() (interface{}, error) // the sequence of the most recent change in the database
+	PushCheckFunc    func() error                // checks the push backend can be reached, if possible
+}
+
+func NewStatusServer(app *OfficeRadarApp) *StatusServer {
+	server := &StatusServer{
+		App:              app,
+		LastSequenceFunc: app.Database.LastSequence,
+	}
+	if checker, ok := app.Notifier.(reachabilityChecker); ok {
+		server.PushCheckFunc = checker.CheckReachable
+	}
+	return server
+}
+
+func (s *StatusServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		writeJson(w, http.StatusMethodNotAllowed, map[string]interface{}{"error": "Not allowed"})
+		return
+	}
+
+	switch r.URL.Path {
+	case "/healthz":
+		problems := s.healthProblems()
+		writeJson(w, statusCode(problems), map[string]interface{}{"healthy": len(problems) == 0, "problems": problems})
+	case "/readyz":
+		problems := append(s.healthProblems(), s.readinessProblems()...)
+		writeJson(w, statusCode(problems), map[string]interface{}{"ready": len(problems) == 0, "problems": problems})
+	case "/status":
+		writeJson(w, http.StatusOK, s.Status())
+	case "/metrics":
+		if _, lag := s.feedLag(s.App.Health.Feed()); lag != nil {
+			s.App.Metrics.FeedLag.Set(float64(*lag))
+		}
+		s.App.Metrics.Registry.ServeHTTP(w, r)
+	default:
+		writeJson(w, http.StatusNotFound, map[string]interface{}{"error": fmt.Sprintf("Not found: %v", r.URL.Path)})
+	}
+
+}
+
+func (s *StatusServer) healthProblems() []string {
+	problems := []string{}
+	feed := s.App.Health.Feed()
+	if feed.Exited {
+		problems = append(problems, fmt.Sprintf("changes feed follower exited, last error: %q", feed.LastError))
+	}
+	return problems
+}
+
+func (s *StatusServer) readinessProblems() []string {
+	problems := []string{}
+	if !s.App.Health.AlertsLoaded() {
+		problems = append(problems, "alerts not loaded yet")
+	}
+	feed := s.App.Health.Feed()
+	if !feed.Running && !feed.Exited {
+		problems = append(problems, "changes feed not followed yet")
+	}
+	return problems
+}
+
+// Gather the status, which involves asking the database for its last
+// sequence and checking the push backend
+func (s *StatusServer) Status() AppStatus {
+
+	status := AppStatus{
+		Feed:   s.App.Health.Feed(),
+		Alerts: s.alertCounts(),
+		Timers: s.App.Timers.Len(),
+		Debouncer: DebouncerStatus{
+			Pending:  s.App.Debouncer.NumPending(),
+			Filtered: s.App.Debouncer.RecentlyFiltered(),
+		},
+		DeadLetters: s.App.Health.DeadLetters(),
+	}
+
+	status.Problems = s.healthProblems()
+	status.Healthy = len(status.Problems) == 0
+	status.Problems = append(status.Problems, s.readinessProblems()...)
+	status.Ready = len(status.Problems) == 0
+
+	status.Feed.LastSequence, status.Feed.Lag = s.feedLag(status.Feed)
+
+	if s.PushCheckFunc != nil {
+		status.Push.Checked = true
+		if err := s.PushCheckFunc(); err != nil {
+			status.Push.Error = err.Error()
+		} else {
+			status.Push.Reachable = true
+		}
+	}
+
+	return status
+
+}
+
+// The sequence of the most recent change in the database, and how far behind
+// it the feed is, if known
+func (s *StatusServer) feedLag(feed FeedStatus) (interface{}, *uint64) {
+
+	if s.LastSequenceFunc == nil {
+		return nil, nil
+	}
+	lastSequence, err := s.LastSequenceFunc()
+	if err != nil {
+		Log.Error("Unable to get last sequence", LogFields{"error": err})
+		return nil, nil
+	}
+
+	since, ok := sequenceNumber(feed.Since)
+	last, lastOk := sequenceNumber(lastSequence)
+	if !ok || !lastOk || last < since {
+		return lastSequence, nil
+	}
+	lag := last - since
+	return lastSequence, &lag
+
+}
+
+func (s *StatusServer) alertCounts() AlertCounts {
+	counts := AlertCounts{ByType: map[string]int{}}
+	now := s.App.Clock.Now()
+	for _, alert := range s.App.AlertIndex.All() {
+		counts.Total += 1
+		counts.ByType[alert.AlertType()] += 1
+		alert.lock()
+		if alert.IsActive(now) {
+			counts.Active += 1
+		}
+		alert.unlock()
+	}
+	return counts
+}
+
+func statusCode(problems []string) int {
+	if len(problems) > 0 {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusOK
+}
@@ -0,0 +1,96 @@
+package officeradar
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func statusRequest(server *StatusServer, path string) int {
+	request, _ := http.NewRequest("GET", path, nil)
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	return recorder.Code
+}
+
+func TestStatusServerProbes(t *testing.T) {
+
+	app := NewOfficeRadarApp("", "")
+	app.Timers = NewTimerScheduler(discardTimerStore{})
+	server := &StatusServer{App: app}
+
+	// alive while starting up, but not ready
+	assert.Equals(t, statusRequest(server, "/healthz"), http.StatusOK)
+	assert.Equals(t, statusRequest(server, "/readyz"), http.StatusServiceUnavailable)
+
+	app.Health.setAlertsLoaded()
+	app.Health.feedStarted("10")
+	assert.Equals(t, statusRequest(server, "/readyz"), http.StatusOK)
+
+	// errors while following the feed are retried, and don't count against it
+	app.Health.feedFailed(errors.New("timeout"), time.Now())
+	assert.Equals(t, statusRequest(server, "/readyz"), http.StatusOK)
+
+	// but nothing notices changes once the follower exits
+	app.Health.feedExited()
+	assert.Equals(t, statusRequest(server, "/healthz"), http.StatusServiceUnavailable)
+	assert.Equals(t, statusRequest(server, "/readyz"), http.StatusServiceUnavailable)
+
+	assert.Equals(t, statusRequest(server, "/nope"), http.StatusNotFound)
+
+}
+
+func TestStatusServerStatus(t *testing.T) {
+
+	app := NewOfficeRadarApp("", "")
+	clock := NewManualClock(time.Date(2014, 9, 2, 9, 0, 0, 0, time.UTC))
+	app.SetClock(clock)
+	app.Timers = NewTimerScheduler(discardTimerStore{})
+
+	activeAlert := NewAnyUsersPresentAlert()
+	activeAlert.Id = "active_alert"
+	app.AlertIndex.Upsert(activeAlert)
+	pausedAlert := NewDwellAlert()
+	pausedAlert.Id = "paused_alert"
+	pausedAlert.Paused = true
+	app.AlertIndex.Upsert(pausedAlert)
+
+	app.Debouncer = NewDebouncer(time.Minute, time.Minute)
+	app.Debouncer.Add(debounceEvent("entry1", ACTION_ENTRY), clock.Now())
+	app.Debouncer.Add(debounceEvent("entry2", ACTION_ENTRY), clock.Now())
+
+	app.Health.setAlertsLoaded()
+	app.Health.feedStarted("9:40")
+	app.Health.feedFailed(errors.New("connection reset"), clock.Now())
+	app.Health.feedReceived("9:42", clock.Now())
+	app.Health.deadLettered(DeadLetter{DocId: "event1", Sequence: "9:41", Error: "503", At: clock.Now()})
+
+	server := &StatusServer{
+		App:              app,
+		LastSequenceFunc: func() (interface{}, error) { return float64(50), nil },
+		PushCheckFunc:    func() error { return errors.New("connection refused") },
+	}
+
+	status := server.Status()
+	assert.True(t, status.Healthy)
+	assert.True(t, status.Ready)
+	assert.Equals(t, status.Feed.Since, "9:42")
+	assert.Equals(t, *status.Feed.Lag, uint64(8))
+	assert.Equals(t, status.Feed.Reconnects, 1)
+	assert.Equals(t, status.Feed.LastError, "connection reset")
+	assert.True(t, status.Push.Checked)
+	assert.False(t, status.Push.Reachable)
+	assert.Equals(t, status.Alerts.Total, 2)
+	assert.Equals(t, status.Alerts.Active, 1)
+	assert.Equals(t, status.Alerts.ByType[DOC_TYPE_DWELL_ALERT], 1)
+	assert.Equals(t, status.Debouncer.Pending, 1)
+	assert.Equals(t, len(status.Debouncer.Filtered), 1)
+	assert.Equals(t, status.Debouncer.Filtered[0].Event.Id, "entry2")
+	assert.Equals(t, status.DeadLetters.Count, 1)
+	assert.Equals(t, status.DeadLetters.Recent[0].DocId, "event1")
+
+}
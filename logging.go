@@ -0,0 +1,312 @@
+package officeradar
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LogLevel int
+
+const (
+	LOG_DEBUG LogLevel = iota
+	LOG_INFO
+	LOG_WARN
+	LOG_ERROR
+)
+
+const (
+	REDACTED = "[REDACTED]"
+)
+
+// Fields whose values are never logged, compared case-insensitively and
+// ignoring underscores and dashes, eg, "deviceTokens" or "device_tokens"
+var redactedFields = map[string]bool{
+	"devicetokens":  true,
+	"devicetoken":   true,
+	"devtoken":      true,
+	"token":         true,
+	"admintoken":    true,
+	"authorization": true,
+	"password":      true,
+	"cookie":        true,
+	"setcookie":     true,
+	"session":       true,
+	"sessionid":     true,
+}
+
+// The logger used by the app server.  Replace it before starting anything
+// to change the level or format of the logs.
+var Log = NewLogger(os.Stderr, LOG_INFO, false)
+
+// Fields attached to a log entry
+type LogFields map[string]interface{}
+
+// A leveled logger which writes each entry as a line of text or a JSON
+// object, along with its fields.  Sensitive fields are redacted, including
+// inside of structs, which are logged as their JSON.
+type Logger struct {
+	output *logOutput
+	fields LogFields // included in every entry, eg, the correlation id
+}
+
+// Shared by a logger and the loggers derived from it with With
+type logOutput struct {
+	mutex  sync.Mutex
+	writer io.Writer
+	level  LogLevel
+	asJson bool
+	now    func() time.Time
+}
+
+func NewLogger(writer io.Writer, level LogLevel, asJson bool) *Logger {
+	return &Logger{
+		output: &logOutput{writer: writer, level: level, asJson: asJson, now: time.Now},
+		fields: LogFields{},
+	}
+}
+
+func ParseLogLevel(level string) (LogLevel, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return LOG_DEBUG, nil
+	case "info":
+		return LOG_INFO, nil
+	case "warn", "warning":
+		return LOG_WARN, nil
+	case "error":
+		return LOG_ERROR, nil
+	}
+	return LOG_INFO, fmt.Errorf("Unknown log level: %q, expected debug, info, warn or error", level)
+}
+
+func (level LogLevel) String() string {
+	switch level {
+	case LOG_DEBUG:
+		return "DEBUG"
+	case LOG_INFO:
+		return "INFO"
+	case LOG_WARN:
+		return "WARN"
+	}
+	return "ERROR"
+}
+
+// A logger that adds the given fields to every entry
+func (l *Logger) With(fields LogFields) *Logger {
+	merged := LogFields{}
+	for key, value := range l.fields {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	return &Logger{output: l.output, fields: merged}
+}
+
+// A logger for everything that happens because of one change or timer, so
+// that it can be followed through the logs
+func (l *Logger) WithCorrelationId(correlationId string) *Logger {
+	if correlationId == "" {
+		return l
+	}
+	return l.With(LogFields{"correlation_id": correlationId})
+}
+
+func newCorrelationId() string {
+	random := make([]byte, 6)
+	rand.Read(random)
+	return hex.EncodeToString(random)
+}
+
+func (l *Logger) Enabled(level LogLevel) bool {
+	return level >= l.output.level
+}
+
+func (l *Logger) Debug(msg string, fields ...LogFields) {
+	l.log(LOG_DEBUG, msg, fields)
+}
+
+func (l *Logger) Info(msg string, fields ...LogFields) {
+	l.log(LOG_INFO, msg, fields)
+}
+
+func (l *Logger) Warn(msg string, fields ...LogFields) {
+	l.log(LOG_WARN, msg, fields)
+}
+
+func (l *Logger) Error(msg string, fields ...LogFields) {
+	l.log(LOG_ERROR, msg, fields)
+}
+
+// Log an error and then panic, for things that should never happen
+func (l *Logger) Panic(msg string, fields ...LogFields) {
+	l.log(LOG_ERROR, msg, fields)
+	panic(msg)
+}
+
+func (l *Logger) log(level LogLevel, msg string, fields []LogFields) {
+
+	if !l.Enabled(level) {
+		return
+	}
+
+	entry := map[string]interface{}{}
+	for key, value := range l.fields {
+		entry[key] = redactValue(key, logValue(value))
+	}
+	for _, extra := range fields {
+		for key, value := range extra {
+			entry[key] = redactValue(key, logValue(value))
+		}
+	}
+
+	output := l.output
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+
+	var line string
+	if output.asJson {
+		line = formatJsonLogEntry(output.now(), level, msg, entry)
+	} else {
+		line = formatTextLogEntry(output.now(), level, msg, entry)
+	}
+	io.WriteString(output.writer, line+"\n")
+
+}
+
+func formatJsonLogEntry(at time.Time, level LogLevel, msg string, entry map[string]interface{}) string {
+	entry["time"] = at.UTC().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = msg
+	data, err := json.Marshal(entry)
+	if err != nil {
+		data, _ = json.Marshal(map[string]interface{}{"level": level.String(), "msg": msg, "log_error": err.Error()})
+	}
+	return string(data)
+}
+
+// eg, 2014-09-02T09:00:00.000Z INFO alert fired correlation_id=1f2e alert=sf_alert
+func formatTextLogEntry(at time.Time, level LogLevel, msg string, entry map[string]interface{}) string {
+
+	keys := []string{}
+	for key := range entry {
+		if key != "correlation_id" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	// the correlation id goes first, to make it easy to scan for
+	if _, ok := entry["correlation_id"]; ok {
+		keys = append([]string{"correlation_id"}, keys...)
+	}
+
+	parts := []string{at.UTC().Format("2006-01-02T15:04:05.000Z07:00"), level.String(), msg}
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%v=%v", key, formatTextLogValue(entry[key])))
+	}
+	return strings.Join(parts, " ")
+
+}
+
+func formatTextLogValue(value interface{}) string {
+	if s, ok := value.(string); ok {
+		if s == "" || strings.ContainsAny(s, " =\"\n\t") {
+			return strconv.Quote(s)
+		}
+		return s
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return strconv.Quote(fmt.Sprintf("%v", value))
+	}
+	return string(data)
+}
+
+// Convert a field value into something that can be redacted and encoded.
+// Structs are converted via their JSON, so they're logged with the same
+// field names as the docs.
+func logValue(value interface{}) interface{} {
+
+	switch v := value.(type) {
+	case nil, bool, string, int, int64, uint64, float64:
+		return v
+	case error:
+		return v.Error()
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return string(data)
+	}
+	return decoded
+
+}
+
+func redactValue(key string, value interface{}) interface{} {
+
+	// an empty password is logged as such, so it's clear that it's missing
+	if isRedactedField(key) && value != nil && value != "" {
+		return REDACTED
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		redacted := map[string]interface{}{}
+		for nestedKey, nestedValue := range v {
+			redacted[nestedKey] = redactValue(nestedKey, nestedValue)
+		}
+		return redacted
+	case []interface{}:
+		redacted := []interface{}{}
+		for _, item := range v {
+			redacted = append(redacted, redactValue("", item))
+		}
+		return redacted
+	case string:
+		return redactURL(v)
+	}
+	return value
+
+}
+
+func isRedactedField(key string) bool {
+	normalized := strings.NewReplacer("_", "", "-", "").Replace(strings.ToLower(key))
+	return redactedFields[normalized]
+}
+
+// Hide the password of a url with credentials, eg, a sync gateway url
+func redactURL(value string) string {
+	if !strings.Contains(value, "@") || !strings.Contains(value, "://") {
+		return value
+	}
+	parsed, err := url.Parse(value)
+	if err != nil || parsed.User == nil {
+		return value
+	}
+	if _, hasPassword := parsed.User.Password(); !hasPassword {
+		return value
+	}
+	parsed.User = url.UserPassword(parsed.User.Username(), "REDACTED")
+	return parsed.String()
+}
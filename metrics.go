@@ -0,0 +1,295 @@
+package officeradar
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The label value for rejected geofence events, in place of their beacon and action
+const METRIC_LABEL_INVALID = "invalid"
+
+// Buckets for latencies in seconds, from 1ms to 10s
+var LATENCY_BUCKETS = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// A minimal registry of counters, gauges and histograms, which are exposed
+// in the prometheus text format.  It's just enough for the app server's
+// metrics, without pulling in the prometheus client and its dependencies.
+type MetricsRegistry struct {
+	mutex    sync.Mutex
+	families map[string]*metricFamily
+}
+
+type metricFamily struct {
+	name       string
+	help       string
+	kind       string // counter, gauge or histogram
+	labelNames []string
+	buckets    []float64 // upper bounds, histograms only
+	series     map[string]*metricSeries
+}
+
+// The values of a metric for one combination of label values
+type metricSeries struct {
+	labelValues  []string
+	value        float64  // counters and gauges
+	bucketCounts []uint64 // histograms, not cumulative
+	sum          float64
+	count        uint64
+}
+
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{families: map[string]*metricFamily{}}
+}
+
+type Counter struct {
+	registry *MetricsRegistry
+	family   *metricFamily
+}
+
+type Gauge struct {
+	registry *MetricsRegistry
+	family   *metricFamily
+}
+
+type Histogram struct {
+	registry *MetricsRegistry
+	family   *metricFamily
+}
+
+func (r *MetricsRegistry) NewCounter(name, help string, labelNames ...string) *Counter {
+	return &Counter{registry: r, family: r.register(name, help, "counter", labelNames, nil)}
+}
+
+func (r *MetricsRegistry) NewGauge(name, help string, labelNames ...string) *Gauge {
+	return &Gauge{registry: r, family: r.register(name, help, "gauge", labelNames, nil)}
+}
+
+func (r *MetricsRegistry) NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+	return &Histogram{registry: r, family: r.register(name, help, "histogram", labelNames, sorted)}
+}
+
+func (r *MetricsRegistry) register(name, help, kind string, labelNames []string, buckets []float64) *metricFamily {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, exists := r.families[name]; exists {
+		panic(fmt.Sprintf("metric %v registered twice", name))
+	}
+	family := &metricFamily{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     map[string]*metricSeries{},
+	}
+	r.families[name] = family
+	return family
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	c.registry.update(c.family, labelValues, func(series *metricSeries) {
+		series.value += delta
+	})
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.registry.update(g.family, labelValues, func(series *metricSeries) {
+		series.value = value
+	})
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.registry.update(h.family, labelValues, func(series *metricSeries) {
+		if series.bucketCounts == nil {
+			series.bucketCounts = make([]uint64, len(h.family.buckets))
+		}
+		for i, upperBound := range h.family.buckets {
+			if value <= upperBound {
+				series.bucketCounts[i] += 1
+				break
+			}
+		}
+		series.sum += value
+		series.count += 1
+	})
+}
+
+// Observe how long it's been since the start, in seconds
+func (h *Histogram) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (r *MetricsRegistry) update(family *metricFamily, labelValues []string, updateFunc func(*metricSeries)) {
+
+	if len(labelValues) != len(family.labelNames) {
+		panic(fmt.Sprintf("metric %v needs labels %v, got %v", family.name, family.labelNames, labelValues))
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	series, ok := family.series[key]
+	if !ok {
+		series = &metricSeries{labelValues: append([]string{}, labelValues...)}
+		family.series[key] = series
+	}
+	updateFunc(series)
+
+}
+
+// Write all of the metrics in the prometheus text format, sorted by name
+// and then by label values
+func (r *MetricsRegistry) Write(writer io.Writer) error {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	names := []string{}
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		family := r.families[name]
+		lines := []string{
+			fmt.Sprintf("# HELP %v %v", name, escapeMetricHelp(family.help)),
+			fmt.Sprintf("# TYPE %v %v", name, family.kind),
+		}
+
+		keys := []string{}
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			series := family.series[key]
+			labels := metricLabels(family.labelNames, series.labelValues)
+			if family.kind != "histogram" {
+				lines = append(lines, fmt.Sprintf("%v%v %v", name, labels.format(), formatMetricValue(series.value)))
+				continue
+			}
+			cumulative := uint64(0)
+			for i, upperBound := range family.buckets {
+				cumulative += series.bucketCounts[i]
+				bucketLabels := append(labels, metricLabel{"le", formatMetricValue(upperBound)})
+				lines = append(lines, fmt.Sprintf("%v_bucket%v %v", name, bucketLabels.format(), cumulative))
+			}
+			infLabels := append(labels, metricLabel{"le", "+Inf"})
+			lines = append(
+				lines,
+				fmt.Sprintf("%v_bucket%v %v", name, infLabels.format(), series.count),
+				fmt.Sprintf("%v_sum%v %v", name, labels.format(), formatMetricValue(series.sum)),
+				fmt.Sprintf("%v_count%v %v", name, labels.format(), series.count),
+			)
+		}
+
+		if _, err := io.WriteString(writer, strings.Join(lines, "\n")+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+
+}
+
+func (r *MetricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.Write(w)
+}
+
+type metricLabel struct {
+	name  string
+	value string
+}
+
+type metricLabelList []metricLabel
+
+func metricLabels(names, values []string) metricLabelList {
+	labels := metricLabelList{}
+	for i, name := range names {
+		labels = append(labels, metricLabel{name, values[i]})
+	}
+	return labels
+}
+
+func (l metricLabelList) format() string {
+	if len(l) == 0 {
+		return ""
+	}
+	formatted := []string{}
+	for _, label := range l {
+		formatted = append(formatted, fmt.Sprintf("%v=\"%v\"", label.name, escapeMetricLabel(label.value)))
+	}
+	return "{" + strings.Join(formatted, ",") + "}"
+}
+
+func formatMetricValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func escapeMetricLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func escapeMetricHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+// The metrics collected by the app server as changes go through the pipeline
+type AppMetrics struct {
+	Registry           *MetricsRegistry
+	ChangesProcessed   *Counter   // by doc type
+	GeofenceEvents     *Counter   // by beacon and action, or "invalid" for rejected events
+	AlertEvaluations   *Counter   // by alert type and result
+	AlertFirings       *Counter   // by alert type
+	ProcessLatency     *Histogram // by alert type
+	PushSends          *Counter   // by outcome
+	PushLatency        *Histogram // by outcome
+	TokenRegistrations *Counter   // by outcome
+	FeedLag            *Gauge     // updated when the metrics are scraped
+}
+
+func NewAppMetrics() *AppMetrics {
+	r := NewMetricsRegistry()
+	return &AppMetrics{
+		Registry:           r,
+		ChangesProcessed:   r.NewCounter("officeradar_changes_processed_total", "Changes from the changes feed that were processed.", "doc_type"),
+		GeofenceEvents:     r.NewCounter("officeradar_geofence_events_total", "Geofence events received.", "beacon", "action"),
+		AlertEvaluations:   r.NewCounter("officeradar_alert_evaluations_total", "Times an alert was evaluated against an event or timer.", "alert_type", "result"),
+		AlertFirings:       r.NewCounter("officeradar_alert_firings_total", "Times an alert fired.", "alert_type"),
+		ProcessLatency:     r.NewHistogram("officeradar_alert_process_seconds", "How long alerts took to evaluate an event or timer.", LATENCY_BUCKETS, "alert_type"),
+		PushSends:          r.NewCounter("officeradar_push_sends_total", "Notifications sent.", "outcome"),
+		PushLatency:        r.NewHistogram("officeradar_push_send_seconds", "How long notifications took to send.", LATENCY_BUCKETS, "outcome"),
+		TokenRegistrations: r.NewCounter("officeradar_token_registrations_total", "Device tokens registered with uniqush.", "outcome"),
+		FeedLag:            r.NewGauge("officeradar_changes_feed_lag", "How many sequences the changes feed follower is behind the database."),
+	}
+}
+
+// The outcome label for an operation that returned the given error
+func outcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
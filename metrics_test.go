@@ -0,0 +1,99 @@
+package officeradar
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestMetricsRegistryFormat(t *testing.T) {
+
+	registry := NewMetricsRegistry()
+	counter := registry.NewCounter("test_events_total", "Events seen.", "beacon")
+	gauge := registry.NewGauge("test_lag", "Lag.")
+	histogram := registry.NewHistogram("test_seconds", "Latency.", []float64{1, 0.1}, "type")
+
+	counter.Inc("b")
+	counter.Add(2, `a "quoted"`)
+	gauge.Set(7)
+	histogram.Observe(0.05, "x")
+	histogram.Observe(0.5, "x")
+	histogram.Observe(5, "x")
+
+	buffer := &bytes.Buffer{}
+	assert.True(t, registry.Write(buffer) == nil)
+	assert.Equals(t, buffer.String(), strings.Join([]string{
+		`# HELP test_events_total Events seen.`,
+		`# TYPE test_events_total counter`,
+		`test_events_total{beacon="a \"quoted\""} 2`,
+		`test_events_total{beacon="b"} 1`,
+		`# HELP test_lag Lag.`,
+		`# TYPE test_lag gauge`,
+		`test_lag 7`,
+		`# HELP test_seconds Latency.`,
+		`# TYPE test_seconds histogram`,
+		`test_seconds_bucket{type="x",le="0.1"} 1`,
+		`test_seconds_bucket{type="x",le="1"} 2`,
+		`test_seconds_bucket{type="x",le="+Inf"} 3`,
+		`test_seconds_sum{type="x"} 5.55`,
+		`test_seconds_count{type="x"} 3`,
+		``,
+	}, "\n"))
+
+}
+
+func TestAppMetrics(t *testing.T) {
+
+	api, _ := newTestAdminAPI()
+	app := api.App
+	adminRequest(api, "POST", "/alerts", testAdminAlert)
+
+	event := GeofenceEvent{Action: ACTION_ENTRY, BeaconId: "sfBeaconId", ProfileId: "jensId", CreatedAt: "2014-09-02T09:00:00Z"}
+	app.processGeofenceEvent(context.Background(), event)
+	event.Action = ACTION_EXIT
+	event.ProfileId = "traunsId"
+	app.processGeofenceEvent(context.Background(), event)
+	event.BeaconId = "bogusBeaconId"
+	app.processGeofenceEvent(context.Background(), event)
+
+	app.Health.feedStarted(float64(40))
+	server := &StatusServer{
+		App:              app,
+		LastSequenceFunc: func() (interface{}, error) { return float64(45), nil },
+	}
+	request, _ := http.NewRequest("GET", "/metrics", nil)
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	assert.Equals(t, recorder.Code, http.StatusOK)
+
+	metrics := recorder.Body.String()
+	for _, expected := range []string{
+		`officeradar_geofence_events_total{beacon="sfBeaconId",action="entry"} 1`,
+		`officeradar_geofence_events_total{beacon="sfBeaconId",action="exit"} 1`,
+		`officeradar_geofence_events_total{beacon="invalid",action="invalid"} 1`,
+		`officeradar_alert_evaluations_total{alert_type="any_users_present_alert",result="fire"} 1`,
+		`officeradar_alert_firings_total{alert_type="any_users_present_alert"} 1`,
+		`officeradar_alert_process_seconds_count{alert_type="any_users_present_alert"} 1`,
+		`officeradar_push_sends_total{outcome="success"} 1`,
+		`officeradar_changes_feed_lag 5`,
+	} {
+		assert.True(t, strings.Contains(metrics, expected))
+	}
+
+}
+
+func TestHistogramObserveSince(t *testing.T) {
+	registry := NewMetricsRegistry()
+	histogram := registry.NewHistogram("test_seconds", "Latency.", LATENCY_BUCKETS)
+	histogram.ObserveSince(time.Now().Add(-time.Minute))
+	buffer := &bytes.Buffer{}
+	registry.Write(buffer)
+	assert.True(t, strings.Contains(buffer.String(), `test_seconds_bucket{le="10"} 0`))
+	assert.True(t, strings.Contains(buffer.String(), `test_seconds_bucket{le="+Inf"} 1`))
+}
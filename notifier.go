@@ -0,0 +1,137 @@
+package officeradar
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	UNIQUSH_TIMEOUT = 10 * time.Second // for requests to uniqush with no deadline of their own
+)
+
+var uniqushClient = &http.Client{}
+
+// Delivers the messages of the alerts that fire.  Notify should give up
+// when the context is done.
+type Notifier interface {
+	Notify(ctx context.Context, alertId string, action AlertAction) error
+}
+
+// Sends the messages as push notifications via uniqush
+type UniqushNotifier struct {
+	UniqushURL string
+}
+
+func (n UniqushNotifier) Notify(ctx context.Context, alertId string, action AlertAction) error {
+
+	endpointUrl := fmt.Sprintf("%s/push", n.UniqushURL)
+	formValues := url.Values{
+		"service":    {UNIQUSH_OFFICERADAR_SERVICE},
+		"subscriber": {action.Recipient},
+		"msg":        {action.Message},
+	}
+	Log.Debug("Sending push", LogFields{"url": endpointUrl, "form": formValues})
+
+	body, err := postUniqush(ctx, endpointUrl, formValues)
+	if err != nil {
+		return fmt.Errorf("Failed to send push to: %v - %v", action.Recipient, err)
+	}
+	Log.Debug("Uniqush responded", LogFields{"recipient": action.Recipient, "response": string(body)})
+	return nil
+
+}
+
+// Post the form to uniqush and return the body of the response.  Any
+// credentials in the url are sent with basic auth.
+func postUniqush(ctx context.Context, endpointUrl string, formValues url.Values) ([]byte, error) {
+
+	// so that none of them can hang forever
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, UNIQUSH_TIMEOUT)
+		defer cancel()
+	}
+
+	req, err := http.NewRequest("POST", endpointUrl, strings.NewReader(formValues.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := uniqushClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read body: %v", err)
+	}
+	return body, nil
+
+}
+
+// Any response from uniqush, even an error status, means it can be reached
+func (n UniqushNotifier) CheckReachable() error {
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(n.UniqushURL)
+	if err != nil {
+		return fmt.Errorf("Unable to reach uniqush: %v", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Only logs the messages, eg, when replaying events
+type LogNotifier struct{}
+
+func (n LogNotifier) Notify(ctx context.Context, alertId string, action AlertAction) error {
+	Log.Info("Alert would notify", LogFields{"alert": alertId, "recipient": action.Recipient, "message": action.Message})
+	return nil
+}
+
+// A message that was sent by an alert
+type Notification struct {
+	AlertId   string    `json:"alert"`
+	Recipient string    `json:"recipient"`
+	Message   string    `json:"message"`
+	SentAt    time.Time `json:"sent_at"`
+}
+
+// Keeps the messages in memory rather than sending them, so that they can be
+// inspected afterwards
+type RecordingNotifier struct {
+	Clock         Clock
+	mutex         sync.Mutex
+	notifications []Notification
+}
+
+func NewRecordingNotifier(clock Clock) *RecordingNotifier {
+	return &RecordingNotifier{Clock: clock}
+}
+
+func (n *RecordingNotifier) Notify(ctx context.Context, alertId string, action AlertAction) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	notification := Notification{
+		AlertId:   alertId,
+		Recipient: action.Recipient,
+		Message:   action.Message,
+		SentAt:    n.Clock.Now(),
+	}
+	n.notifications = append(n.notifications, notification)
+	return nil
+}
+
+// The messages recorded so far, in the order they were sent
+func (n *RecordingNotifier) Notifications() []Notification {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return append([]Notification{}, n.notifications...)
+}
@@ -0,0 +1,49 @@
+package officeradar
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestUniqushNotifierSendsPush(t *testing.T) {
+
+	var form map[string][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equals(t, r.URL.Path, "/push")
+		r.ParseForm()
+		form = r.PostForm
+	}))
+	defer server.Close()
+
+	notifier := UniqushNotifier{UniqushURL: server.URL}
+	action := AlertAction{Recipient: "jensId", Message: "Traun is in the office"}
+	assert.True(t, notifier.Notify(context.Background(), "sf_alert", action) == nil)
+	assert.Equals(t, form["subscriber"][0], "jensId")
+	assert.Equals(t, form["msg"][0], "Traun is in the office")
+
+}
+
+func TestUniqushNotifierGivesUpWhenCancelled(t *testing.T) {
+
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	notifier := UniqushNotifier{UniqushURL: server.URL}
+	err := notifier.Notify(ctx, "sf_alert", AlertAction{Recipient: "jensId"})
+	assert.True(t, err != nil)
+	assert.True(t, time.Since(start) < UNIQUSH_TIMEOUT)
+
+}
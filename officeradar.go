@@ -1,22 +1,43 @@
 package officeradar
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/couchbaselabs/logg"
 	"github.com/tleyden/go-couch"
 )
 
 type OfficeRadarApp struct {
-	DatabaseURL string
-	UniqushURL  string
-	Database    couch.Database
+	DatabaseURL     string
+	SyncGatewayAuth *SyncGatewayAuth // if nil, sync gateway is used as is, eg, via the admin port
+	UniqushURL      string
+	Database        couch.Database
+	ChangesFilter   ChangesFilter // restricts which changes are followed/processed
+	NumWorkers      int           // number of workers processing changes concurrently
+	QueueSize       int           // max number of changes queued up per worker
+	AlertIndex      *AlertIndex
+	Presence        *PresenceHistory
+	Clock           Clock // source of the current time, for events without one
+	Validator       *GeofenceEventValidator
+	Debouncer       *Debouncer // filters out flapping entry/exit events
+	Timers          *TimerScheduler
+	Notifier        Notifier       // delivers the messages of the alerts that fire
+	DryRun          bool           // don't write anything to the database, eg, when replaying events
+	Firings         *FiringHistory // if nil, firings aren't recorded
+	Health          *Health        // whether the alerts are loaded and the changes feed is followed
+	Metrics         *AppMetrics
+	ShutdownTimeout time.Duration // how long in-flight changes get to finish once the feed is stopped
+	FeedMode        string        // how the changes feed is requested, longpoll or normal
+	FeedTimeout     time.Duration // longpoll requests return empty-handed after this
+	PollInterval    time.Duration // how long to wait between requests in normal mode
+	PushTimeout     time.Duration // how long each request to uniqush gets
+	QuietHours      *QuietHours   // pushes are suppressed during these, if set
 }
 
 type OfficeRadarDoc struct {
@@ -30,123 +51,198 @@ type stringmap map[string]interface{}
 
 const (
 	UNIQUSH_OFFICERADAR_SERVICE = "officeradar"
+	DEFAULT_SHUTDOWN_TIMEOUT    = 30 * time.Second
+	DEFAULT_FEED_TIMEOUT        = 5 * time.Minute
+	DEFAULT_POLL_INTERVAL       = 10 * time.Second
+	RETRIEVE_ATTEMPTS           = 5               // tries to retrieve a changed doc, before giving up on the change
+	RETRIEVE_RETRY_DELAY        = time.Second     // doubled after each failed try
+	RETRIEVE_MAX_RETRY_DELAY    = 5 * time.Second // up to this
+)
+
+// Changes feed modes
+const (
+	FEED_MODE_LONGPOLL = "longpoll" // each request waits for new changes
+	FEED_MODE_NORMAL   = "normal"   // each request returns right away, and is repeated every PollInterval
 )
 
 func NewOfficeRadarApp(databaseURL string, uniqushURL string) *OfficeRadarApp {
 	return &OfficeRadarApp{
 		DatabaseURL: databaseURL,
 		UniqushURL:  uniqushURL,
+		AlertIndex:  NewAlertIndex(),
+		Presence:    NewPresenceHistory(SystemClock),
+		Clock:       SystemClock,
+		Debouncer:   NewDebouncer(0, 0),
+		Notifier:    UniqushNotifier{UniqushURL: uniqushURL},
+		Health:      NewHealth(),
+		Metrics:     NewAppMetrics(),
+
+		ShutdownTimeout: DEFAULT_SHUTDOWN_TIMEOUT,
+		FeedMode:        FEED_MODE_LONGPOLL,
+		FeedTimeout:     DEFAULT_FEED_TIMEOUT,
+		PollInterval:    DEFAULT_POLL_INTERVAL,
+		PushTimeout:     UNIQUSH_TIMEOUT,
+	}
+}
+
+// Use the given clock instead of the SystemClock.  Must be called before
+// any changes are processed.
+func (o *OfficeRadarApp) SetClock(clock Clock) {
+	o.Clock = clock
+	o.Presence.clock = clock
+	if o.Validator != nil {
+		o.Validator.Clock = clock
 	}
 }
 
 func (o *OfficeRadarApp) InitApp() error {
+	if o.SyncGatewayAuth != nil {
+		if err := InstallSyncGatewayAuth(o.DatabaseURL, *o.SyncGatewayAuth); err != nil {
+			return fmt.Errorf("Unable to set up sync gateway auth: %v", err)
+		}
+	}
 	db, err := couch.Connect(o.DatabaseURL)
 	if err != nil {
-		logg.LogPanic("Error connecting to db: %v", err)
+		Log.Panic("Error connecting to db", LogFields{"error": err})
 		return err
 	}
 	o.Database = db
+	if o.Validator == nil {
+		o.Validator = NewGeofenceEventValidator(db, o.Clock)
+	}
+	if o.Timers == nil && o.DryRun {
+		o.Timers = NewTimerScheduler(discardTimerStore{})
+	}
+	if o.Timers == nil {
+		o.Timers = NewTimerScheduler(NewCouchTimerStore(db))
+	}
+	if o.Firings == nil && !o.DryRun {
+		o.Firings = NewFiringHistory(NewCouchFixtureStore(db))
+	}
 	return nil
 }
 
-func (o *OfficeRadarApp) InitHardcodedAlerts() error {
-
-	db := o.Database
+// Load all of the alerts in the database into the alert index, restore any
+// pending alert timers, and rebuild the presence history from the stored
+// geofence events, by reading the changes feed from the beginning.  After
+// this, they are kept up to date by the changes that come through
+// FollowChangesFeed.
+func (o OfficeRadarApp) LoadAlerts() error {
 
-	alert := NewAnyUsersPresentAlert()
+	var loadErr error
 
-	// it's necessary to set an id, because otherwise it will default to
-	// empty string id (as opposed to not including id in json), which
-	// causes sync gateway to return an error (technically a 301)
-	alert.Id = "hardcoded_alert_1"
+	handleChanges := func(reader io.Reader) interface{} {
+		changes, err := decodeChanges(reader)
+		if err != nil {
+			loadErr = err
+			return nil // stop
+		}
+		for _, change := range changes.Results {
+			if change.Deleted {
+				continue
+			}
+			doc := OfficeRadarDoc{}
+			if err := o.Database.Retrieve(change.Id, &doc); err != nil {
+				Log.Error("Didn't retrieve doc", LogFields{"doc": change.Id, "error": err})
+				continue
+			}
+			switch {
+			case isAlertDocType(doc.Type):
+				o.indexAlert(change.Id)
+			case o.DryRun:
+				// a dry run builds up its own timers and presence
+			case doc.Type == DOC_TYPE_ALERT_TIMER:
+				o.restoreTimer(change.Id)
+			case doc.Type == DOC_TYPE_GEOFENCE_EVENT:
+				o.restorePresence(change.Id)
+			}
+		}
+		return nil // a normal (non-continuous) feed only needs one callback
+	}
 
-	retrievedAlert := &AnyUsersPresentAlert{}
-	err := db.Retrieve(alert.Id, retrievedAlert)
-	if err == nil {
-		logg.LogTo("OFFICERADAR", "already have alert, skip adding alert")
-		return nil
+	options := map[string]interface{}{
+		"since": 0,
+		"feed":  "normal",
 	}
+	o.ChangesFilter.addOptions(options)
+	o.Database.Changes(handleChanges, options)
 
-	sfBeaconId := "df7172f4e29b4d10881229810b9af710"
-	mvBeaconId := "4a83813db6ce76e9618793cf483cfa10"
-	macBeaconId := "b18b572cb8a4ea6d5ce12b4620c7b90f"
-	jensId := "242941625916974"
-	traunsId := "727846993927551"
+	Log.Info("Loaded alerts", LogFields{"alerts": o.AlertIndex.Len(), "timers": o.Timers.Len()})
 
-	sfBeacon := Beacon{}
-	err = db.Retrieve(sfBeaconId, &sfBeacon)
-	if err != nil {
-		logg.LogPanic("Could not find beacon: %v", err)
-	}
+	// now that the timers are restored, make sure every scheduled alert
+	// has its next timer
+	o.scheduleAlerts()
 
-	mvBeacon := Beacon{}
-	err = db.Retrieve(mvBeaconId, &mvBeacon)
-	if err != nil {
-		logg.LogPanic("Could not find beacon: %v", err)
+	if loadErr == nil {
+		o.Health.setAlertsLoaded()
 	}
-	logg.LogTo("OFFICERADAR", "mvBeacon: %v", mvBeacon)
+	return loadErr
 
-	macBeacon := Beacon{}
-	err = db.Retrieve(macBeaconId, &macBeacon)
-	if err != nil {
-		logg.LogPanic("Could not find beacon: %v", err)
-	}
-	logg.LogTo("OFFICERADAR", "macBeacon: %+v", macBeacon)
+}
 
-	jensProfile := OfficeRadarProfile{}
-	err = db.Retrieve(jensId, &jensProfile)
-	if err != nil {
-		logg.LogPanic("Could not find profile: %v", err)
-	}
+// Follow the changes feed and process the changes until the context is done.
+// Then stop reading the feed, give the changes that were already read up to
+// the ShutdownTimeout to finish, and save the checkpoint before returning.
+func (o OfficeRadarApp) FollowChangesFeed(ctx context.Context, startingSince string) {
 
-	traunsProfile := OfficeRadarProfile{}
-	err = db.Retrieve(traunsId, &traunsProfile)
-	if err != nil {
-		logg.LogPanic("Could not find profile: %v", err)
-	}
+	var since interface{}
 
-	alert.Users = []OfficeRadarProfile{jensProfile, traunsProfile}
-	alert.Beacon = sfBeacon
+	// if this returns, the status server needs to know that nothing is
+	// following the changes feed anymore
+	defer o.Health.feedExited()
 
-	action := AlertAction{
-		Recipient: "727846993927551",
-		Message:   "Jens or Traun passed by a beacon",
-	}
-	alert.Actions = []AlertAction{action}
-	alert.Sticky = true
-	alert.ReactivateAfter = time.Second * 30
+	// in-flight changes aren't aborted as soon as ctx is done, but only
+	// once they've had the shutdown timeout to finish
+	workCtx, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
+
+	pipeline := newChangePipeline(workCtx, o.NumWorkers, o.QueueSize)
+	stopTimers := o.runTimers(pipeline)
 
-	id, rev, err := db.Insert(alert)
+	checkpoint, err := LoadCheckpoint(o.Database)
 	if err != nil {
-		logg.LogPanic("Could not create alert: %v", err)
+		Log.Panic("Error loading checkpoint", LogFields{"error": err})
+		return
 	}
 
-	logg.LogTo("OFFICERADAR", "created alert id: %v rev: %v", id, rev)
-	return nil
-
-}
+	// held while a batch of changes is dispatched, so that the pipeline
+	// isn't closed underneath it
+	var mutex sync.Mutex
+	stopped := false
 
-func (o OfficeRadarApp) FollowChangesFeed(startingSince string) {
+	handleChange := func(reader io.Reader) interface{} {
 
-	var since interface{}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if stopped || ctx.Err() != nil {
+			return nil // stop
+		}
 
-	handleChange := func(reader io.Reader) interface{} {
-		logg.LogTo("OFFICERADAR", "handleChange() callback called")
-		changes, err := decodeChanges(reader)
+		changes, err := decodeFeedChanges(reader)
 		if err != nil {
 			// it's very common for this to timeout while waiting for new changes.
-			// since we want to follow the changes feed forever, just log an error
-			// TODO: don't even log an error if its an io.Timeout, just noise
-			logg.LogTo("OFFICERADAR", "%T decoding changes: %v.", err, err)
+			// since we want to follow the changes feed forever, just log it
+			Log.Debug("Error decoding changes", LogFields{"error": err, "since": since})
+			o.Health.feedFailed(err, o.Clock.Now())
 			return since
 		}
 
-		logg.LogTo("OFFICERADAR", "changes: %v", changes)
+		Log.Debug("Received changes", LogFields{"changes": len(changes.Results), "last_sequence": changes.LastSequence})
 
-		o.processChanges(changes)
+		o.processChanges(ctx, pipeline, changes)
+
+		// only persist the sequences that have been completely processed,
+		// which may lag behind what has been read from the feed
+		if err := checkpoint.Save(o.Database, pipeline.tracker.Checkpoint()); err != nil {
+			Log.Error("Unable to save checkpoint", LogFields{"error": err})
+		}
+
+		if ctx.Err() != nil {
+			return nil // stop, without waiting for another batch
+		}
 
 		since = changes.LastSequence
-		logg.LogTo("OFFICERADAR", "returning since: %v", since)
+		o.Health.feedReceived(since, o.Clock.Now())
 
 		return since
 
@@ -154,176 +250,780 @@ func (o OfficeRadarApp) FollowChangesFeed(startingSince string) {
 
 	options := map[string]interface{}{}
 	if startingSince != "" {
-		logg.LogTo("OFFICERADAR", "startingSince not empty: %v", startingSince)
 		since = startingSince
+	} else if checkpoint.Since != nil {
+		Log.Info("Resuming from checkpoint", LogFields{"since": checkpoint.Since})
+		since = checkpoint.Since
 	} else {
 		// find the sequence of most recent change
 		lastSequence, err := o.Database.LastSequence()
 		if err != nil {
-			logg.LogPanic("Error getting LastSequence: %v", err)
+			Log.Panic("Error getting LastSequence", LogFields{"error": err})
 			return
 		}
 		since = lastSequence
 	}
 
 	options["since"] = since
-	options["feed"] = "longpoll"
-	logg.LogTo("OFFICERADAR", "Following changes feed: %+v", options)
-	o.Database.Changes(handleChange, options)
+	options["feed"] = o.FeedMode
+	options["include_docs"] = true // to partition the changes without retrieving the docs
+	if o.FeedMode == FEED_MODE_LONGPOLL {
+		options["timeout"] = int(o.FeedTimeout / time.Millisecond)
+	}
+	o.ChangesFilter.addOptions(options)
+
+	// in normal mode, go-couch would request the feed again right away
+	handle := handleChange
+	if o.FeedMode == FEED_MODE_NORMAL {
+		handle = func(reader io.Reader) interface{} {
+			next := handleChange(reader)
+			if next == nil {
+				return nil
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(o.PollInterval):
+				return next
+			}
+		}
+	}
+
+	Log.Info("Following changes feed", LogFields{"options": options})
+	o.Health.feedStarted(since)
+
+	// go-couch can't cancel a longpoll request that's in progress, so the
+	// feed is followed in the background.  if it's still waiting when ctx
+	// is done, it's abandoned, and stops the next time it hears back.
+	feedDone := make(chan struct{})
+	go func() {
+		defer close(feedDone)
+		o.Database.Changes(handle, options)
+	}()
+
+	select {
+	case <-feedDone:
+		Log.Warn("Stopped following changes feed", LogFields{"since": since})
+	case <-ctx.Done():
+		Log.Info("Stopping changes feed follower")
+	}
+
+	mutex.Lock()
+	stopped = true
+	mutex.Unlock()
+
+	stopTimers()
+	o.drainPipeline(pipeline, cancelWork)
+
+	if err := checkpoint.Save(o.Database, pipeline.tracker.Checkpoint()); err != nil {
+		Log.Error("Unable to save checkpoint", LogFields{"error": err})
+		return
+	}
+	Log.Info("Saved checkpoint", LogFields{"since": checkpoint.Since, "pending": pipeline.tracker.NumPending()})
+
+}
+
+// Wait for the changes that were dispatched to finish processing, giving up
+// on them once the shutdown timeout has passed.  The ones given up on will
+// be processed again after a restart, since the checkpoint won't include them.
+func (o OfficeRadarApp) drainPipeline(pipeline *changePipeline, cancelWork context.CancelFunc) {
+
+	timeout := time.AfterFunc(o.ShutdownTimeout, func() {
+		Log.Warn("Timed out waiting for in-flight changes", LogFields{"timeout": o.ShutdownTimeout})
+		cancelWork()
+	})
+	defer timeout.Stop()
+
+	pipeline.close()
+
+	if skipped := pipeline.numSkipped(); skipped > 0 {
+		Log.Warn("Gave up on changes that were still queued or in flight", LogFields{"skipped": skipped})
+	}
+
+}
+
+// A change from the changes feed, which includes the doc since the feed is
+// requested with include_docs
+type feedChange struct {
+	couch.Change
+	Doc json.RawMessage `json:"doc"`
+}
+
+type feedChanges struct {
+	Results      []feedChange `json:"results"`
+	LastSequence interface{}  `json:"last_seq"`
+}
+
+// The fields needed to decide how a changed doc should be processed
+type changedDoc struct {
+	OfficeRadarDoc
+	ProfileId string `json:"profile"` // only set for geofence events
+}
+
+// The key used to decide which worker processes the change.  All changes
+// related to the same profile share a key, so they are processed in order.
+func (d changedDoc) partitionKey() string {
+	if d.ProfileId != "" {
+		return d.ProfileId
+	}
+	return d.Id
+}
+
+// The doc included with the change, as far as it's needed to dispatch it.
+// If the feed didn't include it, only the id is known.
+func (c feedChange) changedDoc() changedDoc {
+	doc := changedDoc{}
+	if len(c.Doc) > 0 {
+		if err := json.Unmarshal(c.Doc, &doc); err != nil {
+			Log.Warn("Unable to decode doc included with change", LogFields{"doc": c.Id, "error": err})
+		}
+	}
+	doc.Id = c.Id
+	return doc
+}
 
+// Is this a doc type that the changes feed follower does something with?
+func isProcessedDocType(docType string) bool {
+	return docType == DOC_TYPE_PROFILE || docType == DOC_TYPE_GEOFENCE_EVENT || isAlertDocType(docType)
 }
 
-func (o OfficeRadarApp) processChanges(changes couch.Changes) {
+// Dispatch the changes to the pipeline's workers, based on the docs included
+// with the changes.  The docs are retrieved by the workers, so that a slow
+// or failing retrieve doesn't stall the feed.  This blocks if the workers
+// have too many changes queued up.
+func (o OfficeRadarApp) processChanges(ctx context.Context, pipeline *changePipeline, changes feedChanges) {
+
+	tracker := pipeline.tracker
 
 	for _, change := range changes.Results {
-		logg.LogTo("OFFICERADAR", "change: %v", change)
+		change := change
+
+		// the rest will be read again after a restart, since they aren't
+		// tracked and so can't become part of the checkpoint
+		if ctx.Err() != nil {
+			return
+		}
+
+		// follows the change through to any pushes it results in
+		correlationId := newCorrelationId()
+		log := Log.WithCorrelationId(correlationId)
+		log.Debug("Processing change", LogFields{"doc": change.Id, "sequence": change.Sequence, "deleted": change.Deleted})
+
+		sequence := tracker.track(change.Sequence)
 
 		if change.Deleted {
-			logg.LogTo("OFFICERADAR", "change was deleted, skipping")
+			o.AlertIndex.Remove(change.Id) // in case it was an alert
+			tracker.complete(sequence)
 			continue
 		}
 
-		doc := OfficeRadarDoc{}
-		err := o.Database.Retrieve(change.Id, &doc)
-		if err != nil {
-			errMsg := fmt.Errorf("Didn't retrieve: %v - %v", change.Id, err)
-			logg.LogError(errMsg)
+		// if the doc wasn't included, its type is only known once the
+		// worker has retrieved it
+		doc := change.changedDoc()
+		if doc.Type != "" && (!o.ChangesFilter.acceptsDocType(doc.Type) || !isProcessedDocType(doc.Type)) {
+			log.Debug("Doc type filtered out", LogFields{"doc": change.Id, "type": doc.Type})
+			tracker.complete(sequence)
 			continue
 		}
 
-		logg.LogTo("OFFICERADAR", "doc: %+v", doc)
+		pipeline.dispatch(doc.partitionKey(), sequence, func(ctx context.Context) {
+			o.processChange(ctx, change, tracker, sequence, correlationId)
+		})
+
+	}
+
+	// the last sequence can be past the last change (eg, if changes were
+	// filtered out), so track it as well.  it only becomes the checkpoint
+	// once all the changes above have completed.
+	tracker.complete(tracker.track(changes.LastSequence))
 
-		switch doc.Type {
-		case "profile":
-			o.processChangedProfile(change)
-		case "geofence_event":
-			o.processChangedGeofenceEvent(change)
+}
+
+// Retrieve the changed doc and process it according to its type.  Runs on
+// the pipeline's worker, which completes the sequence once this returns.
+func (o OfficeRadarApp) processChange(ctx context.Context, change feedChange, tracker *sequenceTracker, sequence *trackedSequence, correlationId string) {
+
+	log := Log.WithCorrelationId(correlationId)
+
+	docJson := json.RawMessage{}
+	err := o.retrieveChangedDoc(ctx, change.Id, &docJson)
+	if isNotFound(err) {
+		// deleted since, which comes through as a change of its own
+		return
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return // not completed, so it's processed again after a restart
 		}
+		// rather than holding back the checkpoint forever, give up on it
+		log.Error("Didn't retrieve doc, giving up on the change", LogFields{"doc": change.Id, "sequence": change.Sequence, "error": err})
+		o.Health.deadLettered(DeadLetter{DocId: change.Id, Sequence: change.Sequence, Error: err.Error(), At: o.Clock.Now()})
+		return
+	}
+
+	doc := changedDoc{}
+	if err := json.Unmarshal(docJson, &doc); err != nil {
+		log.Error("Unable to decode changed doc", LogFields{"doc": change.Id, "error": err})
+		return
+	}
+	if !o.ChangesFilter.acceptsDocType(doc.Type) {
+		log.Debug("Doc type filtered out", LogFields{"doc": change.Id, "type": doc.Type})
+		return
+	}
 
+	switch {
+	case doc.Type == DOC_TYPE_PROFILE:
+		o.processChangedProfile(ctx, docJson, log)
+	case doc.Type == DOC_TYPE_GEOFENCE_EVENT:
+		o.processChangedGeofenceEvent(ctx, docJson, correlationId, tracker.hold(sequence))
+	case isAlertDocType(doc.Type):
+		o.processChangedAlert(change.Id, docJson, log)
+	default:
+		return
 	}
+	o.Metrics.ChangesProcessed.Inc(doc.Type)
 
 }
 
-func (o OfficeRadarApp) processChangedProfile(change couch.Change) {
+func (o OfficeRadarApp) processChangedProfile(ctx context.Context, docJson []byte, log *Logger) {
 
 	profileDoc := OfficeRadarProfile{}
-	err := o.Database.Retrieve(change.Id, &profileDoc)
-	if err != nil {
-		errMsg := fmt.Errorf("Load fail: %v - %v", change.Id, err)
-		logg.LogError(errMsg)
+	if err := json.Unmarshal(docJson, &profileDoc); err != nil {
+		log.Error("Unable to decode profile", LogFields{"error": err})
 		return
 	}
-	logg.LogTo("OFFICERADAR", "profileDoc: %+v", profileDoc)
+	log.Debug("Changed profile", LogFields{"profile": profileDoc})
 
-	o.registerDeviceTokens(profileDoc)
+	o.registerDeviceTokens(ctx, profileDoc, log)
 
 }
 
-func (o OfficeRadarApp) processChangedGeofenceEvent(change couch.Change) {
+// The change's sequence is held back from the checkpoint until settle is
+// called, which is once the event has been processed or filtered out, since
+// it may sit in the debouncer for a while.
+func (o OfficeRadarApp) processChangedGeofenceEvent(ctx context.Context, docJson []byte, correlationId string, settle func()) {
 
 	geofenceDoc := GeofenceEvent{}
-	err := o.Database.Retrieve(change.Id, &geofenceDoc)
-	if err != nil {
-		errMsg := fmt.Errorf("Load fail: %v - %v", change.Id, err)
-		logg.LogError(errMsg)
+	if err := json.Unmarshal(docJson, &geofenceDoc); err != nil {
+		Log.WithCorrelationId(correlationId).Error("Unable to decode event", LogFields{"error": err})
+		settle()
 		return
 	}
+	geofenceDoc.correlationId = correlationId
+	geofenceDoc.settle = settle
+	defer geofenceDoc.settleOnPanic()
 
 	// o.noisyTempAlert(geofenceDoc)
 
-	o.triggerAlerts(geofenceDoc)
+	o.processGeofenceEvent(ctx, geofenceDoc)
 
 }
 
-func (o OfficeRadarApp) triggerAlerts(geofenceEvent GeofenceEvent) {
+// Validate and debounce a geofence event, and then process it if it counts
+func (o OfficeRadarApp) processGeofenceEvent(ctx context.Context, geofenceEvent GeofenceEvent) {
+
+	// rejected events are counted w/o their beacon and action, which could be
+	// anything, so they don't blow up the number of label values
+	if !o.validateGeofenceEvent(geofenceEvent) {
+		o.Metrics.GeofenceEvents.Inc(METRIC_LABEL_INVALID, METRIC_LABEL_INVALID)
+		geofenceEvent.settled()
+		return
+	}
+	o.Metrics.GeofenceEvents.Inc(geofenceEvent.BeaconId, geofenceEvent.Action)
+
+	// the event only counts once the debouncer has decided it isn't flapping,
+	// which may release an earlier pending event for the same beacon as well
+	eventTime := geofenceEvent.EventTime(o.Clock)
+	for _, confirmedEvent := range o.Debouncer.Add(geofenceEvent, eventTime) {
+		o.processConfirmedGeofenceEvent(ctx, confirmedEvent)
+	}
+
+}
 
-	activeAlerts, err := o.findActiveAlerts()
+// Process a geofence event that made it through validation and debouncing
+func (o OfficeRadarApp) processConfirmedGeofenceEvent(ctx context.Context, geofenceEvent GeofenceEvent) {
+
+	defer geofenceEvent.settleOnPanic()
+
+	o.triggerAlerts(ctx, geofenceEvent)
+
+	// record the presence after triggering alerts, so that alerts see
+	// when the user was last seen _before_ this event
+	o.Presence.Record(geofenceEvent)
+
+	// if it was cancelled partway through, it's processed again after a restart
+	if ctx.Err() == nil {
+		geofenceEvent.settled()
+	}
+
+}
+
+// Periodically release the debounced events whose dwell time has passed and
+// fire the alert timers that have come due.  They are processed on the worker
+// for their profile, so they stay in order with that profile's other events.
+// Returns a func which stops the timers.
+func (o OfficeRadarApp) runTimers(pipeline *changePipeline) func() {
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(TIMER_TICK_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				o.releaseDue(o.Clock.Now(), pipeline.dispatchUntracked)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+
+}
+
+// Hand the debounced events whose dwell time has passed and the alert timers
+// that have come due to the dispatch func, keyed by the profile they belong
+// to.  They're handed over in the order they happened, so the timers that
+// came due before an event go first, eg, when replaying.  Returns how many
+// there were.
+func (o OfficeRadarApp) releaseDue(now time.Time, dispatch func(partitionKey string, job func(ctx context.Context))) int {
+
+	released := 0
+	for _, confirmedEvent := range o.Debouncer.Release(now) {
+		confirmedEvent := confirmedEvent
+		released += o.releaseTimers(confirmedEvent.EventTime(o.Clock), dispatch)
+		dispatch(confirmedEvent.ProfileId, func(ctx context.Context) {
+			o.processConfirmedGeofenceEvent(ctx, confirmedEvent)
+		})
+		released += 1
+	}
+	return released + o.releaseTimers(now, dispatch)
+
+}
+
+// Hand the alert timers that have come due to the dispatch func, earliest first
+func (o OfficeRadarApp) releaseTimers(now time.Time, dispatch func(partitionKey string, job func(ctx context.Context))) int {
+
+	due := o.Timers.Due(now)
+	for _, timer := range due {
+		timer := timer
+		partitionKey := timer.ProfileId
+		if partitionKey == "" {
+			partitionKey = timer.AlertId
+		}
+		dispatch(partitionKey, func(ctx context.Context) {
+			o.fireTimer(ctx, timer, newCorrelationId())
+		})
+	}
+	return len(due)
+
+}
+
+// Restore a timer that was saved before the app server was restarted
+func (o OfficeRadarApp) restoreTimer(timerId string) {
+
+	timer := &AlertTimer{}
+	err := o.Database.Retrieve(timerId, timer)
 	if err != nil {
-		errMsg := fmt.Errorf("Failed to find active alerts: %v", err)
-		logg.LogError(errMsg)
+		Log.Error("Unable to load timer", LogFields{"timer": timerId, "error": err})
 		return
 	}
+	o.Timers.Restore(timer)
 
-	for _, alert := range activeAlerts {
+}
 
-		shouldFire, err := alert.Process(geofenceEvent)
-		if err != nil {
-			errMsg := fmt.Errorf("Alert failed to process event: %v", err)
-			logg.LogError(errMsg)
-			continue
+// Rebuild the presence history from a stored geofence event
+func (o OfficeRadarApp) restorePresence(eventId string) {
+
+	geofenceEvent := GeofenceEvent{}
+	err := o.Database.Retrieve(eventId, &geofenceEvent)
+	if err != nil {
+		Log.Error("Unable to load event", LogFields{"event": eventId, "error": err})
+		return
+	}
+	o.Presence.Record(geofenceEvent)
+
+}
+
+// Schedule the next timer of the scheduled alerts in the index that don't
+// have one.  A restored timer is left alone even if it's overdue, so that a
+// deadline that passed while the app server was down is still evaluated, and
+// the alert's next timer is scheduled once it has been.
+func (o OfficeRadarApp) scheduleAlerts() {
+	for _, alert := range o.AlertIndex.All() {
+		scheduledAlert, ok := alert.(ScheduledAlerter)
+		if ok && !o.Timers.HasTimers(alert.AlertId()) {
+			o.scheduleNext(scheduledAlert, o.Clock.Now())
 		}
+	}
+}
 
-		logg.LogTo("OFFICERADAR", "alert.Process(): shouldFire = %v", shouldFire)
+func (o OfficeRadarApp) scheduleNext(alert ScheduledAlerter, after time.Time) {
+	err := alert.ScheduleNext(after)
+	if err != nil {
+		Log.Error("Unable to schedule alert", LogFields{"alert": alert.AlertId(), "error": err})
+	}
+}
 
-		if !shouldFire {
-			continue
+// Evaluate the alert that a due timer belongs to, and fire it if needed
+func (o OfficeRadarApp) fireTimer(ctx context.Context, timer AlertTimer, correlationId string) {
+
+	log := Log.WithCorrelationId(correlationId).With(LogFields{"alert": timer.AlertId, "timer": timer.Id})
+
+	alert, ok := o.AlertIndex.Get(timer.AlertId)
+	if !ok {
+		log.Debug("Alert for timer no longer exists")
+		o.Timers.Take(timer) // discard it
+		return
+	}
+	timedAlert, ok := alert.(TimedAlerter)
+	if !ok {
+		log.Warn("Alert does not support timers")
+		o.Timers.Take(timer) // discard it
+		return
+	}
+
+	timedAlert.lock()
+	defer timedAlert.unlock()
+
+	// it may have been cancelled, eg, by an exit event, since it came due
+	if !o.Timers.Take(timer) {
+		return
+	}
+
+	// scheduled alerts need their next timer whether or not they fire now.
+	// if the timer is overdue, eg, it was missed while the app server was
+	// down, the deadlines that were missed after it are skipped.
+	if scheduledAlert, ok := timedAlert.(ScheduledAlerter); ok {
+		after := timer.FireAt
+		if now := o.Clock.Now(); now.After(after) {
+			after = now
 		}
+		defer func() {
+			if _, stillExists := o.AlertIndex.Get(timer.AlertId); stillExists {
+				o.scheduleNext(scheduledAlert, after)
+			}
+		}()
+	}
 
-		// invoke actions associated with alert
-		o.invokeActions(alert, geofenceEvent)
+	if !timedAlert.IsActive(timer.FireAt) {
+		if _, scheduled := timedAlert.(ScheduledAlerter); !scheduled {
+			o.postponeTimer(timedAlert, timer)
+		}
+		return
+	}
 
-		err = alert.RescheduleOrDelete()
-		if err != nil {
-			errMsg := fmt.Errorf("Unable to reschedule or delete alert %+v: err: %v", alert, err)
-			logg.LogError(errMsg)
+	start := time.Now()
+	shouldFire, err := timedAlert.ProcessTimer(timer)
+	o.recordEvaluation(timedAlert, start, shouldFire, err)
+	if err != nil {
+		log.Error("Alert failed to process timer", LogFields{"error": err})
+		return
+	}
+
+	log.Debug("Alert processed timer", LogFields{"should_fire": shouldFire})
+
+	if shouldFire {
+		firing := AlertFiring{
+			FiredAt:       timer.FireAt,
+			TimerId:       timer.Id,
+			ProfileId:     timer.ProfileId,
+			BeaconId:      timer.BeaconId,
+			CorrelationId: correlationId,
 		}
+		o.fireAlert(ctx, timedAlert, firing)
+	}
 
+}
+
+// A timer that comes due while its alert is waiting to reactivate fires once
+// it has, eg, if the user is still dwelling by then and so hasn't cancelled
+// it.  A paused alert's timers are dropped.
+func (o OfficeRadarApp) postponeTimer(alert TimedAlerter, timer AlertTimer) {
+	activeOn, reactivates := alert.reactivatesAt()
+	if !reactivates {
+		return
 	}
+	postponed := NewAlertTimer(timer.AlertId, timer.ProfileId, timer.BeaconId, activeOn)
+	if err := o.Timers.Schedule(postponed); err != nil {
+		Log.Error("Unable to postpone timer", LogFields{"timer": timer.Id, "error": err})
+	}
+}
+
+// Returns whether the event is valid.  Invalid events get a rejection doc
+// so the mobile client can see why they were ignored.
+func (o OfficeRadarApp) validateGeofenceEvent(geofenceEvent GeofenceEvent) bool {
+
+	log := geofenceEvent.logger()
+
+	reasons, err := o.Validator.Validate(geofenceEvent)
+	if err != nil {
+		// can't tell whether it's valid, so give it the benefit of the doubt
+		log.Error("Unable to validate event", LogFields{"event": geofenceEvent.Id, "error": err})
+		return true
+	}
+	if len(reasons) == 0 {
+		return true
+	}
+
+	log.Info("Rejecting event", LogFields{"event": geofenceEvent.Id, "reasons": reasons})
+	if o.DryRun {
+		return false
+	}
+	rejection := NewGeofenceEventRejection(geofenceEvent, reasons, o.Clock.Now())
+	err = rejection.Save(o.Database)
+	if err != nil {
+		log.Error("Unable to save rejection for event", LogFields{"event": geofenceEvent.Id, "error": err})
+	}
+	return false
 
 }
 
-func (o OfficeRadarApp) invokeActions(alert Alerter, geofenceEvent GeofenceEvent) {
+// Load the alert with the given id, along with its state, and add it to the
+// alert index
+func (o OfficeRadarApp) indexAlert(alertId string) {
 
-	defaultActionFunc := func(action AlertAction) error {
-		logg.LogTo("OFFICERADAR", "invoke action on: %+v", action)
-		o.sendPushToSubscriber(action.Recipient, action.Message)
-		return nil
+	alert, err := LoadAlert(o.Database, alertId, o.alertServices())
+	if err != nil {
+		Log.Error("Unable to load alert", LogFields{"alert": alertId, "error": err})
+		return
 	}
-	logg.LogTo("OFFICERADAR", "perform action: %v", defaultActionFunc)
-	err := alert.PerformActions(defaultActionFunc)
-	logg.LogTo("OFFICERADAR", "performed action: %v", defaultActionFunc)
+	if statefulAlert, ok := alert.(StatefulAlerter); ok {
+		if err := statefulAlert.LoadState(); err != nil {
+			Log.Warn("Unable to load alert state", LogFields{"alert": alertId, "error": err})
+		}
+	}
+	o.AlertIndex.Upsert(alert)
+
+}
+
+// Index a changed alert in place of its previous version, whose state it
+// carries on from
+func (o OfficeRadarApp) reindexAlert(alert Alerter) {
+	if statefulAlert, ok := alert.(StatefulAlerter); ok {
+		if previous, ok := o.AlertIndex.Get(alert.AlertId()); ok {
+			statefulAlert.keepState(previous)
+		}
+	}
+	o.AlertIndex.Upsert(alert)
+}
+
+// A new or changed alert, which may need its next timer scheduled
+func (o OfficeRadarApp) processChangedAlert(alertId string, alertJson []byte, log *Logger) {
+
+	log.Debug("Changed alert", LogFields{"alert": alertId})
+
+	// the app's own edits, eg, reactivating a sticky alert, are already in memory
+	doc := OfficeRadarDoc{}
+	if err := json.Unmarshal(alertJson, &doc); err == nil && o.isIndexedRevision(alertId, doc.Revision) {
+		log.Debug("Alert revision already indexed", LogFields{"alert": alertId, "revision": doc.Revision})
+		return
+	}
+
+	alert, err := DecodeAlert(o.Database, alertJson, o.alertServices())
 	if err != nil {
-		errMsg := fmt.Errorf("Alert failed to perform actions: %v", err)
-		logg.LogError(errMsg)
+		log.Error("Unable to load alert", LogFields{"alert": alertId, "error": err})
 		return
 	}
+	o.reindexAlert(alert)
+
+	if scheduledAlert, ok := alert.(ScheduledAlerter); ok {
+		o.scheduleNext(scheduledAlert, o.Clock.Now())
+	}
 
 }
 
-// Use a view query to find all active alerts
-func (o OfficeRadarApp) findActiveAlerts() ([]Alerter, error) {
+func (o OfficeRadarApp) isIndexedRevision(alertId, revision string) bool {
+	alert, ok := o.AlertIndex.Get(alertId)
+	if !ok || revision == "" {
+		return false
+	}
+	alert.lock()
+	defer alert.unlock()
+	return alert.AlertRevision() == revision
+}
 
-	db := o.Database
+func (o OfficeRadarApp) alertServices() AlertServices {
+	return AlertServices{
+		LastSeenFunc:  o.Presence.LastSeen,
+		PresentFunc:   o.Presence.IsPresent,
+		FirstSeenFunc: o.Presence.FirstSeenSince,
+		Timers:        o.Timers,
+		Clock:         o.Clock,
+	}
 
-	alerters := []Alerter{}
-	alertIds := []string{"hardcoded_alert_1"}
-	for _, alertId := range alertIds {
-		retrievedAlert := &BaseAlert{}
-		err := db.Retrieve(alertId, retrievedAlert)
-		if err != nil {
-			return []Alerter{}, err
-		}
-		switch retrievedAlert.Type {
-		case DOC_TYPE_ANY_USERS_PRESENT_ALERT:
-			alert := &AnyUsersPresentAlert{}
-			alert.database = db
-			err := db.Retrieve(alertId, alert)
-			if err != nil {
-				return []Alerter{}, err
-			}
-			alerters = append(alerters, alert)
+}
+
+func (o OfficeRadarApp) triggerAlerts(ctx context.Context, geofenceEvent GeofenceEvent) {
+
+	// the alerts share the event's docs, rather than each fetching them
+	geofenceEvent.docs = newEventDocs()
+
+	candidateAlerts := o.AlertIndex.Candidates(geofenceEvent)
+	geofenceEvent.logger().Debug("Triggering alerts", LogFields{"event": geofenceEvent.Id, "candidates": len(candidateAlerts)})
+
+	for _, alert := range candidateAlerts {
+		o.triggerAlert(ctx, alert, geofenceEvent)
+	}
+
+}
+
+func (o OfficeRadarApp) triggerAlert(ctx context.Context, alert Alerter, geofenceEvent GeofenceEvent) {
+
+	log := geofenceEvent.logger().With(LogFields{"alert": alert.AlertId(), "event": geofenceEvent.Id})
+
+	// prevent the same alert from being fired concurrently by another worker
+	alert.lock()
+	defer alert.unlock()
+
+	// evaluate the alert as of the time the event happened
+	eventTime := geofenceEvent.EventTime(o.Clock)
+
+	// timed alerts keep their timers up to date while they're inactive, eg,
+	// so that an exit during a sticky alert's reactivation delay still
+	// cancels the dwell timer.  only the firing waits for the alert to be active.
+	active := alert.IsActive(eventTime)
+	if _, timed := alert.(TimedAlerter); !timed && !active {
+		return
+	}
+
+	start := time.Now()
+	shouldFire, err := alert.Process(geofenceEvent)
+	o.recordEvaluation(alert, start, shouldFire, err)
+	if err != nil {
+		log.Error("Alert failed to process event", LogFields{"error": err})
+		return
+	}
+
+	if statefulAlert, ok := alert.(StatefulAlerter); ok && !o.DryRun {
+		if err := statefulAlert.SaveState(); err != nil {
+			log.Warn("Unable to save alert state", LogFields{"error": err})
+		}
+	}
+	if rearmingAlert, ok := alert.(RearmingAlerter); ok && !o.DryRun {
+		if err := rearmingAlert.SaveRearmed(); err != nil {
+			log.Warn("Unable to save re-armed alert", LogFields{"error": err})
+		}
+	}
+
+	log.Debug("Alert processed event", LogFields{"should_fire": shouldFire})
+
+	if shouldFire && active {
+		firing := AlertFiring{
+			FiredAt:       eventTime,
+			EventId:       geofenceEvent.Id,
+			ProfileId:     geofenceEvent.ProfileId,
+			BeaconId:      geofenceEvent.BeaconId,
+			CorrelationId: geofenceEvent.correlationId,
+		}
+		o.fireAlert(ctx, alert, firing)
+	}
+
+}
+
+func (o OfficeRadarApp) recordEvaluation(alert Alerter, start time.Time, shouldFire bool, err error) {
+	result := "no_fire"
+	switch {
+	case err != nil:
+		result = "error"
+	case shouldFire:
+		result = "fire"
+	}
+	o.Metrics.ProcessLatency.ObserveSince(start, alert.AlertType())
+	o.Metrics.AlertEvaluations.Inc(alert.AlertType(), result)
+}
+
+// Perform the alert's actions, record the firing in the alert's history, and
+// then reschedule or delete it.  The caller must hold the alert's lock.
+// Returns the firing, along with the actions that were performed.
+func (o OfficeRadarApp) fireAlert(ctx context.Context, alert Alerter, firing AlertFiring) AlertFiring {
+
+	firedAt := firing.FiredAt
+	o.Metrics.AlertFirings.Inc(alert.AlertType())
+
+	log := Log.WithCorrelationId(firing.CorrelationId).With(LogFields{"alert": alert.AlertId()})
+	log.Info("Alert fired", LogFields{"type": alert.AlertType(), "event": firing.EventId, "timer": firing.TimerId, "manual": firing.Manual})
+
+	// invoke actions associated with alert
+	firing.Actions = o.invokeActions(ctx, alert, firedAt, log)
+
+	if o.Firings != nil {
+		if err := o.Firings.Record(alert.AlertId(), firing); err != nil {
+			log.Error("Unable to record firing of alert", LogFields{"error": err})
 		}
 	}
 
-	// TODO: query view via go-couchdb
+	// leave the alert doc alone, but make sure the alert behaves as if it
+	// had been rescheduled or deleted
+	if o.DryRun {
+		if alert.IsSticky() {
+			alert.reactivate(firedAt)
+		} else {
+			o.AlertIndex.Remove(alert.AlertId())
+		}
+		return firing
+	}
+
+	err := alert.RescheduleOrDelete(firedAt)
+	if err != nil {
+		log.Error("Unable to reschedule or delete alert", LogFields{"error": err})
+		return firing
+	}
+
+	// don't wait for the deletion to come through the changes feed, or the
+	// alert could fire again in the meantime
+	if !alert.IsSticky() {
+		o.AlertIndex.Remove(alert.AlertId())
+	}
+
+	return firing
+
+}
 
-	return alerters, nil
+// Returns the actions that were performed, which are none during quiet hours
+func (o OfficeRadarApp) invokeActions(ctx context.Context, alert Alerter, firedAt time.Time, log *Logger) []AlertAction {
+
+	performed := []AlertAction{}
+	defaultActionFunc := func(action AlertAction) error {
+		if o.QuietHours.Contains(firedAt) {
+			o.Metrics.PushSends.Inc("suppressed")
+			log.Info("Push suppressed during quiet hours", LogFields{"recipient": action.Recipient})
+			return nil
+		}
+		performed = append(performed, action)
+		start := time.Now()
+		pushCtx, cancel := o.pushContext(ctx)
+		err := o.Notifier.Notify(pushCtx, alert.AlertId(), action)
+		cancel()
+		o.Metrics.PushLatency.ObserveSince(start, outcome(err))
+		o.Metrics.PushSends.Inc(outcome(err))
+		fields := LogFields{"recipient": action.Recipient, "duration": time.Since(start)}
+		if err != nil {
+			fields["error"] = err
+			log.Error("Push failed", fields)
+		} else {
+			log.Info("Push sent", fields)
+		}
+		return nil
+	}
+	err := alert.PerformActions(defaultActionFunc)
+	if err != nil {
+		log.Error("Alert failed to perform actions", LogFields{"error": err})
+	}
+	return performed
 
 }
 
 // This was added temporarily to test alerts.  This will get removed once
 // the real alerts system is in place.
-func (o OfficeRadarApp) noisyTempAlert(geofenceEvent GeofenceEvent) {
+func (o OfficeRadarApp) noisyTempAlert(ctx context.Context, geofenceEvent GeofenceEvent) {
 
 	// create the message for the alert
 	msg := o.createAlertMessage(geofenceEvent)
@@ -331,7 +1031,10 @@ func (o OfficeRadarApp) noisyTempAlert(geofenceEvent GeofenceEvent) {
 	// send the alert to a hardcoded list of user id's (for now)
 	recipients := []string{"727846993927551"}
 	for _, recipient := range recipients {
-		o.sendPushToSubscriber(recipient, msg)
+		action := AlertAction{Recipient: recipient, Message: msg}
+		if err := o.Notifier.Notify(ctx, "", action); err != nil {
+			geofenceEvent.logger().Error("Push failed", LogFields{"recipient": recipient, "error": err})
+		}
 	}
 
 }
@@ -343,16 +1046,14 @@ func (o OfficeRadarApp) createAlertMessage(geofenceEvent GeofenceEvent) string {
 	// find the name
 	profileDoc, err := FetchOfficeRadarProfile(o.Database, geofenceEvent.ProfileId)
 	if err != nil {
-		errMsg := fmt.Errorf("Error loading profile from %+v: %v", geofenceEvent, err)
-		logg.LogError(errMsg)
+		geofenceEvent.logger().Error("Error loading profile", LogFields{"event": geofenceEvent, "error": err})
 		return "Sorry, an error occurred"
 	}
 
 	// find the beacon
 	beaconDoc, err := FetchBeacon(o.Database, geofenceEvent.BeaconId)
 	if err != nil {
-		errMsg := fmt.Errorf("Error loading beacon from %+v: %v", geofenceEvent, err)
-		logg.LogError(errMsg)
+		geofenceEvent.logger().Error("Error loading beacon", LogFields{"event": geofenceEvent, "error": err})
 		return "Sorry, an error occurred"
 	}
 
@@ -365,9 +1066,15 @@ func (o OfficeRadarApp) createAlertMessage(geofenceEvent GeofenceEvent) string {
 
 }
 
-func (o OfficeRadarApp) registerDeviceTokens(profileDoc OfficeRadarProfile) {
+func (o OfficeRadarApp) registerDeviceTokens(ctx context.Context, profileDoc OfficeRadarProfile, log *Logger) {
+
+	// eg, only logging the pushes
+	if o.UniqushURL == "" {
+		return
+	}
 
 	endpointUrl := fmt.Sprintf("%s/subscribe", o.UniqushURL)
+	log = log.With(LogFields{"profile": profileDoc.Id})
 
 	for _, deviceToken := range profileDoc.DeviceTokens {
 
@@ -377,61 +1084,74 @@ func (o OfficeRadarApp) registerDeviceTokens(profileDoc OfficeRadarProfile) {
 			"pushservicetype": {"apns"},
 			"devtoken":        {deviceToken},
 		}
-		logg.LogTo("OFFICERADAR", "post to %v with vals: %v", endpointUrl, formValues)
+		log.Debug("Registering device token", LogFields{"url": endpointUrl, "form": formValues})
 
-		resp, err := http.PostForm(endpointUrl, formValues)
+		pushCtx, cancel := o.pushContext(ctx)
+		body, err := postUniqush(pushCtx, endpointUrl, formValues)
+		cancel()
+		o.Metrics.TokenRegistrations.Inc(outcome(err))
 		if err != nil {
-			errMsg := fmt.Errorf("Failed to add uniqush subscriber: %v - %v", profileDoc, err)
-			logg.LogError(errMsg)
-			continue
-		}
-		defer resp.Body.Close()
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			errMsg := fmt.Errorf("Failed to read body: %v - %v", profileDoc, err)
-			logg.LogError(errMsg)
+			log.Error("Failed to add uniqush subscriber", LogFields{"error": err})
 			continue
 		}
 
-		logg.LogTo("OFFICERADAR", "uniqush response body: %v", string(body))
+		log.Info("Registered device token", LogFields{"response": string(body)})
 
 	}
 
 }
 
-func (o OfficeRadarApp) sendPushToSubscriber(profileId string, msg string) {
-
-	endpointUrl := fmt.Sprintf("%s/push", o.UniqushURL)
-	formValues := url.Values{
-		"service":    {UNIQUSH_OFFICERADAR_SERVICE},
-		"subscriber": {profileId},
-		"msg":        {msg},
+// Limit a request to uniqush to the push timeout
+func (o OfficeRadarApp) pushContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if o.PushTimeout <= 0 {
+		return context.WithCancel(ctx)
 	}
-	logg.LogTo("OFFICERADAR", "post to %v with vals: %v", endpointUrl, formValues)
+	return context.WithTimeout(ctx, o.PushTimeout)
+}
 
-	resp, err := http.PostForm(endpointUrl, formValues)
-	if err != nil {
-		errMsg := fmt.Errorf("Failed to send push to: %v - %v", profileId, err)
-		logg.LogError(errMsg)
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		errMsg := fmt.Errorf("Failed to read body: %v - %v", profileId, err)
-		logg.LogError(errMsg)
+// Retrieve a changed doc, trying again a few times in case sync gateway is
+// briefly unavailable.  Gives up right away if the doc isn't found.
+func (o OfficeRadarApp) retrieveChangedDoc(ctx context.Context, docId string, doc interface{}) error {
+
+	delay := RETRIEVE_RETRY_DELAY
+	for attempt := 1; ; attempt++ {
+		err := o.Database.Retrieve(docId, doc)
+		if err == nil || isNotFound(err) || attempt == RETRIEVE_ATTEMPTS {
+			return err
+		}
+		Log.Warn("Didn't retrieve doc, trying again", LogFields{"doc": docId, "attempt": attempt, "error": err})
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > RETRIEVE_MAX_RETRY_DELAY {
+			delay = RETRIEVE_MAX_RETRY_DELAY
+		}
 	}
-	logg.LogTo("OFFICERADAR", "uniqush response body: %v", string(body))
 
 }
 
+// Does the error returned by go-couch indicate that the doc doesn't exist?
+func isNotFound(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "404")
+}
+
 func decodeChanges(reader io.Reader) (couch.Changes, error) {
 
 	changes := couch.Changes{}
 	decoder := json.NewDecoder(reader)
 	err := decoder.Decode(&changes)
-	if err != nil {
-		logg.LogTo("OFFICERADAR", "Err decoding changes: %v", err)
-	}
+	return changes, err
+
+}
+
+func decodeFeedChanges(reader io.Reader) (feedChanges, error) {
+
+	changes := feedChanges{}
+	decoder := json.NewDecoder(reader)
+	err := decoder.Decode(&changes)
 	return changes, err
 
 }
@@ -0,0 +1,208 @@
+package officeradar
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	DEFAULT_NUM_WORKERS       = 8
+	DEFAULT_WORKER_QUEUE_SIZE = 16
+)
+
+// Processes changes concurrently on a fixed pool of workers.  Every change is
+// dispatched with a partition key (eg, the profile id of a geofence event) and
+// changes with the same key always go to the same worker, so they are processed
+// in the order they came off of the changes feed.  This guarantees that a user's
+// entry and exit events are never reordered, while one slow push notification
+// only stalls the users that happen to share its worker.
+//
+// Each worker has a bounded queue, and dispatch blocks when it is full, which
+// in turn stops the changes feed from being read any further (backpressure).
+//
+// Once the context is done, the queued jobs are skipped rather than processed,
+// and their sequences never complete, so they'll be processed again after a
+// restart.  The context is also passed to the jobs, to abort what they're doing,
+// and the sequences of the jobs that were aborted don't complete either.
+type changePipeline struct {
+	ctx       context.Context
+	workers   []chan pipelineJob
+	tracker   *sequenceTracker
+	waitGroup sync.WaitGroup
+	skipped   int64 // jobs skipped or aborted because the context was done
+}
+
+type pipelineJob struct {
+	sequence *trackedSequence
+	process  func(ctx context.Context)
+}
+
+func newChangePipeline(ctx context.Context, numWorkers, queueSize int) *changePipeline {
+
+	if numWorkers <= 0 {
+		numWorkers = DEFAULT_NUM_WORKERS
+	}
+	if queueSize <= 0 {
+		queueSize = DEFAULT_WORKER_QUEUE_SIZE
+	}
+
+	pipeline := &changePipeline{
+		ctx:     ctx,
+		workers: make([]chan pipelineJob, numWorkers),
+		tracker: newSequenceTracker(),
+	}
+	for i := range pipeline.workers {
+		jobs := make(chan pipelineJob, queueSize)
+		pipeline.workers[i] = jobs
+		pipeline.waitGroup.Add(1)
+		go pipeline.work(jobs)
+	}
+	return pipeline
+
+}
+
+// Queue the process func on the worker that owns the partition key.  Once
+// the func returns, the sequence is marked as completed.
+func (p *changePipeline) dispatch(partitionKey string, sequence *trackedSequence, process func(ctx context.Context)) {
+	jobs := p.workers[p.workerIndex(partitionKey)]
+	jobs <- pipelineJob{sequence: sequence, process: process}
+}
+
+// Queue the process func on the worker that owns the partition key, for
+// work that doesn't correspond to a change on the feed (so it doesn't hold
+// back the checkpoint).
+func (p *changePipeline) dispatchUntracked(partitionKey string, process func(ctx context.Context)) {
+	p.dispatch(partitionKey, nil, process)
+}
+
+// Stop accepting changes and wait for all queued changes to finish processing
+func (p *changePipeline) close() {
+	for _, jobs := range p.workers {
+		close(jobs)
+	}
+	p.waitGroup.Wait()
+}
+
+// The number of jobs that were skipped or aborted because the context was done
+func (p *changePipeline) numSkipped() int {
+	return int(atomic.LoadInt64(&p.skipped))
+}
+
+func (p *changePipeline) workerIndex(partitionKey string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(partitionKey))
+	return int(hash.Sum32() % uint32(len(p.workers)))
+}
+
+func (p *changePipeline) work(jobs chan pipelineJob) {
+	defer p.waitGroup.Done()
+	for job := range jobs {
+		if p.ctx.Err() != nil {
+			atomic.AddInt64(&p.skipped, 1)
+			continue
+		}
+		p.runJob(job)
+	}
+}
+
+func (p *changePipeline) runJob(job pipelineJob) {
+
+	// a panic while processing one change shouldn't take down the worker,
+	// or the sequence would never complete and the checkpoint would be stuck.
+	// a job that was cancelled partway through (eg, mid-push) doesn't complete
+	// either, so that it's processed again after a restart.
+	defer func() {
+		if r := recover(); r != nil {
+			Log.Error("Recovered from panic processing change", LogFields{"panic": fmt.Sprintf("%v", r)})
+		}
+		if p.ctx.Err() != nil {
+			atomic.AddInt64(&p.skipped, 1)
+			return
+		}
+		if job.sequence != nil {
+			p.tracker.complete(job.sequence)
+		}
+	}()
+
+	job.process(p.ctx)
+
+}
+
+// Keeps track of the sequences that have been read from the changes feed, in
+// feed order, and computes the checkpoint: the latest sequence such that it
+// and every sequence before it have been completely processed.
+type sequenceTracker struct {
+	mutex      sync.Mutex
+	pending    []*trackedSequence
+	checkpoint interface{}
+}
+
+type trackedSequence struct {
+	sequence  interface{}
+	completed bool
+	holds     int // the sequence isn't done until it's been completed and has no holds
+}
+
+func newSequenceTracker() *sequenceTracker {
+	return &sequenceTracker{}
+}
+
+// Start tracking a sequence.  Sequences must be tracked in feed order.
+func (t *sequenceTracker) track(sequence interface{}) *trackedSequence {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	tracked := &trackedSequence{sequence: sequence}
+	t.pending = append(t.pending, tracked)
+	return tracked
+}
+
+// Mark a sequence as completed, and advance the checkpoint past all
+// completed sequences at the front of the pending list.
+func (t *sequenceTracker) complete(tracked *trackedSequence) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	tracked.completed = true
+	t.advance()
+}
+
+// Hold the sequence back from the checkpoint even once it's completed, eg,
+// while its geofence event is pending in the debouncer.  Returns the func
+// which lets go of it, which can safely be called more than once.
+func (t *sequenceTracker) hold(tracked *trackedSequence) func() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	tracked.holds += 1
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			tracked.holds -= 1
+			t.advance()
+		})
+	}
+}
+
+func (t *sequenceTracker) advance() {
+	for len(t.pending) > 0 && t.pending[0].completed && t.pending[0].holds == 0 {
+		t.checkpoint = t.pending[0].sequence
+		t.pending = t.pending[1:]
+	}
+}
+
+// The latest fully processed sequence, or nil if nothing has completed yet
+func (t *sequenceTracker) Checkpoint() interface{} {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.checkpoint
+}
+
+// The number of sequences that have been tracked but are not yet part of the checkpoint
+func (t *sequenceTracker) NumPending() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.pending)
+}
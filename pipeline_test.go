@@ -0,0 +1,204 @@
+package officeradar
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestPipelinePreservesOrderPerKey(t *testing.T) {
+
+	pipeline := newChangePipeline(context.Background(), 4, 2)
+
+	mutex := sync.Mutex{}
+	processed := map[string][]int{}
+
+	profiles := []string{"foo", "bar", "baz", "qux", "quux"}
+	for i := 0; i < 100; i++ {
+		i := i
+		profile := profiles[i%len(profiles)]
+		sequence := pipeline.tracker.track(i)
+		pipeline.dispatch(profile, sequence, func(ctx context.Context) {
+			time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+			mutex.Lock()
+			defer mutex.Unlock()
+			processed[profile] = append(processed[profile], i)
+		})
+	}
+	pipeline.close()
+
+	for _, profile := range profiles {
+		sequences := processed[profile]
+		assert.Equals(t, len(sequences), 20)
+		for j := 1; j < len(sequences); j++ {
+			assert.True(t, sequences[j-1] < sequences[j])
+		}
+	}
+	assert.Equals(t, pipeline.tracker.Checkpoint(), 99)
+	assert.Equals(t, pipeline.tracker.NumPending(), 0)
+
+}
+
+func TestPipelinePanicCompletesSequence(t *testing.T) {
+
+	pipeline := newChangePipeline(context.Background(), 1, 1)
+	sequence := pipeline.tracker.track("1")
+	pipeline.dispatch("foo", sequence, func(ctx context.Context) { panic("boom") })
+	pipeline.close()
+	assert.Equals(t, pipeline.tracker.Checkpoint(), "1")
+
+}
+
+func TestPipelinePanicSettlesEvent(t *testing.T) {
+
+	pipeline := newChangePipeline(context.Background(), 1, 1)
+	sequence := pipeline.tracker.track("1")
+	pipeline.dispatch("foo", sequence, func(ctx context.Context) {
+		event := GeofenceEvent{settle: pipeline.tracker.hold(sequence)}
+		defer event.settleOnPanic()
+		panic("boom")
+	})
+	pipeline.close()
+	assert.Equals(t, pipeline.tracker.Checkpoint(), "1")
+
+}
+
+func TestSequenceTrackerCheckpoint(t *testing.T) {
+
+	tracker := newSequenceTracker()
+	assert.True(t, tracker.Checkpoint() == nil)
+
+	sequences := []*trackedSequence{}
+	for i := 1; i <= 3; i++ {
+		sequences = append(sequences, tracker.track(fmt.Sprintf("%d", i)))
+	}
+
+	// completing a later sequence doesn't move the checkpoint past an
+	// earlier one that's still in flight
+	tracker.complete(sequences[1])
+	assert.True(t, tracker.Checkpoint() == nil)
+
+	tracker.complete(sequences[0])
+	assert.Equals(t, tracker.Checkpoint(), "2")
+
+	tracker.complete(sequences[2])
+	assert.Equals(t, tracker.Checkpoint(), "3")
+	assert.Equals(t, tracker.NumPending(), 0)
+
+}
+
+func TestSequenceTrackerHold(t *testing.T) {
+
+	tracker := newSequenceTracker()
+	first := tracker.track("1")
+	second := tracker.track("2")
+
+	// eg, the first change's event is pending in the debouncer
+	settle := tracker.hold(first)
+	tracker.complete(first)
+	tracker.complete(second)
+	assert.Equals(t, tracker.Checkpoint(), nil)
+	assert.Equals(t, tracker.NumPending(), 2)
+
+	settle()
+	settle()
+	assert.Equals(t, tracker.Checkpoint(), "2")
+	assert.Equals(t, tracker.NumPending(), 0)
+
+}
+
+func TestPipelineSkipsJobsOnceCancelled(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pipeline := newChangePipeline(ctx, 1, 4)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	first := pipeline.tracker.track("1")
+	pipeline.dispatch("foo", first, func(ctx context.Context) {
+		close(started)
+		<-release
+	})
+	<-started
+
+	// queued behind the first job, which is still in flight
+	processed := false
+	second := pipeline.tracker.track("2")
+	pipeline.dispatch("foo", second, func(ctx context.Context) { processed = true })
+
+	cancel()
+	close(release)
+	pipeline.close()
+
+	// the queued job is left for next time, and so is the in-flight one, since
+	// there's no telling how far it got once it was cancelled
+	assert.False(t, processed)
+	assert.Equals(t, pipeline.numSkipped(), 2)
+	assert.Equals(t, pipeline.tracker.Checkpoint(), nil)
+	assert.Equals(t, pipeline.tracker.NumPending(), 2)
+
+}
+
+func TestPipelineDoesNotCompleteJobCancelledInFlight(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pipeline := newChangePipeline(ctx, 1, 4)
+
+	done := make(chan struct{})
+	first := pipeline.tracker.track("1")
+	pipeline.dispatch("foo", first, func(ctx context.Context) { close(done) })
+	<-done
+
+	// eg, a push that's aborted by the drain timeout
+	started := make(chan struct{})
+	pushed := false
+	second := pipeline.tracker.track("2")
+	pipeline.dispatch("foo", second, func(ctx context.Context) {
+		close(started)
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Minute):
+			pushed = true
+		}
+	})
+	<-started
+
+	cancel()
+	pipeline.close()
+
+	assert.False(t, pushed)
+	assert.Equals(t, pipeline.numSkipped(), 1)
+	assert.Equals(t, pipeline.tracker.Checkpoint(), "1")
+	assert.Equals(t, pipeline.tracker.NumPending(), 1)
+
+}
+
+func TestFeedChangesPartitionedByIncludedDoc(t *testing.T) {
+
+	feed := `{"results": [
+		{"seq": 10, "id": "event1", "changes": [{"rev": "1-a"}], "doc": {"_id": "event1", "type": "geofence_event", "profile": "profile_jens"}},
+		{"seq": 11, "id": "profile_jens", "changes": [{"rev": "2-b"}], "doc": {"_id": "profile_jens", "type": "profile"}},
+		{"seq": 12, "id": "event2", "changes": [{"rev": "1-c"}]}
+	], "last_seq": 12}`
+
+	changes, err := decodeFeedChanges(strings.NewReader(feed))
+	assert.True(t, err == nil)
+	assert.Equals(t, len(changes.Results), 3)
+	assert.Equals(t, changes.Results[0].Id, "event1")
+
+	// an event and its profile go to the same worker
+	assert.Equals(t, changes.Results[0].changedDoc().partitionKey(), "profile_jens")
+	assert.Equals(t, changes.Results[1].changedDoc().partitionKey(), "profile_jens")
+
+	// without the doc, only the id is known
+	doc := changes.Results[2].changedDoc()
+	assert.Equals(t, doc.Type, "")
+	assert.Equals(t, doc.partitionKey(), "event2")
+
+}
@@ -0,0 +1,151 @@
+package officeradar
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// An in-memory record of when each profile was last seen at each beacon,
+// built up from the geofence events processed by the app server.  Its
+// LastSeen method is used as the LastSeenFunc of the alerts that need one,
+// IsPresent as the PresentFunc and FirstSeenSince as the FirstSeenFunc.
+type PresenceHistory struct {
+	mutex     sync.RWMutex
+	lastSeen  map[presenceKey]time.Time
+	present   map[presenceKey]bool
+	sightings map[presenceKey][]time.Time // the recent times seen, oldest first
+	clock     Clock
+}
+
+// How long sightings are kept for FirstSeenSince, which is enough to cover
+// the day of a deadline in any time zone
+const PRESENCE_SIGHTINGS_RETENTION = 48 * time.Hour
+
+// callback function to determine whether this user is currently in range
+// of this beacon, ie, entered and hasn't exited since
+type PresentFunc func(profileId, beaconId string) bool
+
+// callback function to determine when this user was first seen at this
+// beacon at or after the given time
+type FirstSeenFunc func(profileId, beaconId string, since time.Time) (bool, time.Time)
+
+// Where a profile was last seen at a beacon
+type PresenceEntry struct {
+	ProfileId string    `json:"profile"`
+	BeaconId  string    `json:"beacon"`
+	Present   bool      `json:"present"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+type presenceKey struct {
+	profileId string
+	beaconId  string
+}
+
+func NewPresenceHistory(clock Clock) *PresenceHistory {
+	return &PresenceHistory{
+		lastSeen:  map[presenceKey]time.Time{},
+		present:   map[presenceKey]bool{},
+		sightings: map[presenceKey][]time.Time{},
+		clock:     clock,
+	}
+}
+
+// Record that the profile in the geofence event was seen at its beacon, as
+// of the time of the event.
+func (h *PresenceHistory) Record(e GeofenceEvent) {
+
+	seenAt := e.EventTime(h.clock)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	key := presenceKey{profileId: e.ProfileId, beaconId: e.BeaconId}
+	h.recordSighting(key, seenAt)
+
+	// otherwise, an event older than the latest one doesn't change anything
+	if seenAt.Before(h.lastSeen[key]) {
+		return
+	}
+	h.lastSeen[key] = seenAt
+	h.present[key] = e.Action == ACTION_ENTRY
+
+}
+
+// Add the time to the key's sightings, in order, and drop the ones that are
+// too old to be needed anymore
+func (h *PresenceHistory) recordSighting(key presenceKey, seenAt time.Time) {
+
+	sightings := h.sightings[key]
+	i := sort.Search(len(sightings), func(i int) bool { return sightings[i].After(seenAt) })
+	sightings = append(sightings, time.Time{})
+	copy(sightings[i+1:], sightings[i:])
+	sightings[i] = seenAt
+
+	cutoff := sightings[len(sightings)-1].Add(-PRESENCE_SIGHTINGS_RETENTION)
+	for len(sightings) > 0 && sightings[0].Before(cutoff) {
+		sightings = sightings[1:]
+	}
+	h.sightings[key] = sightings
+
+}
+
+// When was the profile first seen at the beacon at or after since?  Returns
+// false if it hasn't been since then, as far as the recent sightings go.
+func (h *PresenceHistory) FirstSeenSince(profileId, beaconId string, since time.Time) (bool, time.Time) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	sightings := h.sightings[presenceKey{profileId: profileId, beaconId: beaconId}]
+	i := sort.Search(len(sightings), func(i int) bool { return !sightings[i].Before(since) })
+	if i == len(sightings) {
+		return false, time.Time{}
+	}
+	return true, sightings[i]
+}
+
+// When was the profile last seen at the beacon?  Returns false if never.
+func (h *PresenceHistory) LastSeen(profileId, beaconId string) (bool, time.Time) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	lastSeenAt, haveSeen := h.lastSeen[presenceKey{profileId: profileId, beaconId: beaconId}]
+	return haveSeen, lastSeenAt
+}
+
+// Is the profile in range of the beacon, as of the latest event?
+func (h *PresenceHistory) IsPresent(profileId, beaconId string) bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.present[presenceKey{profileId: profileId, beaconId: beaconId}]
+}
+
+// Everything in the history, sorted by profile and then beacon
+func (h *PresenceHistory) Entries() []PresenceEntry {
+
+	h.mutex.RLock()
+	entries := []PresenceEntry{}
+	for key, lastSeenAt := range h.lastSeen {
+		entries = append(entries, PresenceEntry{
+			ProfileId: key.profileId,
+			BeaconId:  key.beaconId,
+			Present:   h.present[key],
+			LastSeen:  lastSeenAt,
+		})
+	}
+	h.mutex.RUnlock()
+
+	sort.Sort(presenceEntries(entries))
+	return entries
+
+}
+
+type presenceEntries []PresenceEntry
+
+func (p presenceEntries) Len() int      { return len(p) }
+func (p presenceEntries) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p presenceEntries) Less(i, j int) bool {
+	if p[i].ProfileId != p[j].ProfileId {
+		return p[i].ProfileId < p[j].ProfileId
+	}
+	return p[i].BeaconId < p[j].BeaconId
+}
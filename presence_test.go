@@ -0,0 +1,63 @@
+package officeradar
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestPresenceHistoryEntries(t *testing.T) {
+
+	morning := time.Date(2014, 9, 2, 9, 0, 0, 0, time.UTC)
+	presence := NewPresenceHistory(NewManualClock(morning))
+	record := func(action, profileId, beaconId string, at time.Time) {
+		presence.Record(GeofenceEvent{
+			Action:    action,
+			BeaconId:  beaconId,
+			ProfileId: profileId,
+			CreatedAt: at.Format(time.RFC3339),
+		})
+	}
+	record(ACTION_ENTRY, "traunsId", "sfBeaconId", morning)
+	record(ACTION_ENTRY, "jensId", "sfBeaconId", morning)
+	record(ACTION_EXIT, "jensId", "sfBeaconId", morning.Add(time.Hour))
+	record(ACTION_ENTRY, "jensId", "mvBeaconId", morning.Add(2*time.Hour))
+
+	assert.DeepEquals(t, presence.Entries(), []PresenceEntry{
+		{ProfileId: "jensId", BeaconId: "mvBeaconId", Present: true, LastSeen: morning.Add(2 * time.Hour)},
+		{ProfileId: "jensId", BeaconId: "sfBeaconId", Present: false, LastSeen: morning.Add(time.Hour)},
+		{ProfileId: "traunsId", BeaconId: "sfBeaconId", Present: true, LastSeen: morning},
+	})
+
+}
+
+func TestPresenceHistoryFirstSeenSince(t *testing.T) {
+
+	morning := time.Date(2014, 9, 2, 9, 0, 0, 0, time.UTC)
+	presence := NewPresenceHistory(NewManualClock(morning))
+	record := func(at time.Time) {
+		presence.Record(GeofenceEvent{
+			Action:    ACTION_ENTRY,
+			BeaconId:  "sfBeaconId",
+			ProfileId: "jensId",
+			CreatedAt: at.Format(time.RFC3339),
+		})
+	}
+	record(morning.Add(-72 * time.Hour))
+	record(morning.Add(time.Hour))
+	record(morning) // out of order
+
+	haveSeen, firstSeenAt := presence.FirstSeenSince("jensId", "sfBeaconId", morning.Add(-time.Hour))
+	assert.True(t, haveSeen)
+	assert.Equals(t, firstSeenAt, morning)
+
+	haveSeen, _ = presence.FirstSeenSince("jensId", "sfBeaconId", morning.Add(2*time.Hour))
+	assert.False(t, haveSeen)
+
+	// the sighting from three days ago is too old to be kept
+	haveSeen, firstSeenAt = presence.FirstSeenSince("jensId", "sfBeaconId", time.Time{})
+	assert.True(t, haveSeen)
+	assert.Equals(t, firstSeenAt, morning)
+
+}
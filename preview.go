@@ -0,0 +1,332 @@
+package officeradar
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// The result of replaying the geofence event history through an alert,
+// without performing any of its actions.
+type AlertPreview struct {
+	Since          time.Time       `json:"since"`
+	Until          time.Time       `json:"until"`
+	EventsReplayed int             `json:"events_replayed"` // the number of valid events within the time range
+	Firings        []PreviewFiring `json:"firings"`         // the times the alert would have fired
+}
+
+// A time the alert would have fired, and the notifications it would have sent
+type PreviewFiring struct {
+	FiredAt time.Time      `json:"fired_at"`
+	Event   *GeofenceEvent `json:"event,omitempty"` // the event that fired the alert, if any
+	Timer   *AlertTimer    `json:"timer,omitempty"` // or the timer that fired it
+	Actions []AlertAction  `json:"actions"`
+}
+
+// Dry-run an alert definition against the stored geofence events between
+// since and until, to see how often it would have fired.  The events go
+// through the app's validation and debouncing first, the same as when they
+// came in.  The events before since are only used to build up the presence
+// history that LastSeenFunc is backed by, and the ones after until are
+// dropped as they're loaded.  Nothing is saved and no notifications are sent.
+func (o OfficeRadarApp) PreviewAlert(store FixtureStore, alertJson []byte, since, until time.Time) (*AlertPreview, error) {
+
+	events, err := storedEventsUntil(store, until)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load geofence events: %v", err)
+	}
+	return o.previewAlert(alertJson, events, since, until)
+
+}
+
+// The geofence events in the store that happened at or before until
+func storedEventsUntil(store FixtureStore, until time.Time) ([]GeofenceEvent, error) {
+
+	docs, err := store.AllDocs()
+	if err != nil {
+		return nil, err
+	}
+
+	events := []GeofenceEvent{}
+	for _, doc := range docs {
+		if doc.Type() != DOC_TYPE_GEOFENCE_EVENT {
+			continue
+		}
+		docJson, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		geofenceEvent := GeofenceEvent{}
+		if err := json.Unmarshal(docJson, &geofenceEvent); err != nil {
+			return nil, fmt.Errorf("Invalid event %v: %v", doc.Id(), err)
+		}
+		eventTime, err := geofenceEvent.CreatedAtTime()
+		if err == nil && !eventTime.After(until) {
+			events = append(events, geofenceEvent)
+		}
+	}
+	return events, nil
+
+}
+
+func (o OfficeRadarApp) previewAlert(alertJson []byte, events []GeofenceEvent, since, until time.Time) (*AlertPreview, error) {
+
+	replay := &alertReplay{
+		clock:     NewManualClock(since),
+		timers:    NewTimerScheduler(discardTimerStore{}),
+		debouncer: NewDebouncer(o.Debouncer.EntryDwell, o.Debouncer.ExitDwell),
+		preview:   &AlertPreview{Since: since, Until: until, Firings: []PreviewFiring{}},
+		events:    historyOrder(events),
+	}
+	replay.presence = NewPresenceHistory(replay.clock)
+
+	// the validator checks the events as of when they happened
+	if o.Validator != nil {
+		validator := *o.Validator
+		validator.Clock = replay.clock
+		replay.validator = &validator
+	}
+
+	services := AlertServices{
+		LastSeenFunc:  replay.presence.LastSeen,
+		PresentFunc:   replay.presence.IsPresent,
+		FirstSeenFunc: replay.presence.FirstSeenSince,
+		Timers:        replay.timers,
+		Clock:         replay.clock,
+	}
+	alert, err := DecodeAlert(o.Database, alertJson, services)
+	if err != nil {
+		return nil, err
+	}
+	replay.alert = alert
+
+	if err := replay.run(); err != nil {
+		return nil, err
+	}
+	return replay.preview, nil
+
+}
+
+// The state of an alert preview while the events are replayed
+type alertReplay struct {
+	alert     Alerter
+	clock     *ManualClock
+	presence  *PresenceHistory
+	timers    *TimerScheduler
+	validator *GeofenceEventValidator // if nil, every event is valid
+	debouncer *Debouncer
+	preview   *AlertPreview
+	events    []GeofenceEvent // the events in the order they happened
+	deleted   bool            // a non-sticky alert is deleted after it fires
+}
+
+func (r *alertReplay) run() error {
+
+	since, until := r.preview.Since, r.preview.Until
+
+	if scheduledAlert, ok := r.alert.(ScheduledAlerter); ok {
+		if err := scheduledAlert.ScheduleNext(since); err != nil {
+			return err
+		}
+	}
+
+	for _, geofenceEvent := range r.events {
+
+		// the event history was sorted by event time, which is known to be valid
+		eventTime, _ := geofenceEvent.CreatedAtTime()
+		if eventTime.After(until) {
+			break
+		}
+
+		if err := r.releaseDue(eventTime); err != nil {
+			return err
+		}
+
+		r.clock.Set(eventTime)
+		if !r.isValid(geofenceEvent) {
+			continue
+		}
+		if !eventTime.Before(since) {
+			r.preview.EventsReplayed += 1
+		}
+
+		for _, confirmedEvent := range r.debouncer.Add(geofenceEvent, eventTime) {
+			if err := r.processConfirmedEvent(confirmedEvent); err != nil {
+				return err
+			}
+		}
+
+		if r.deleted {
+			return nil
+		}
+
+	}
+
+	return r.releaseDue(until)
+
+}
+
+// Does the event pass validation?  As in the app, an event that can't be
+// validated gets the benefit of the doubt.
+func (r *alertReplay) isValid(geofenceEvent GeofenceEvent) bool {
+	if r.validator == nil {
+		return true
+	}
+	reasons, err := r.validator.Validate(geofenceEvent)
+	return err != nil || len(reasons) == 0
+}
+
+// Process the debounced events and the timers that are due by the given time,
+// in the order they happened
+func (r *alertReplay) releaseDue(now time.Time) error {
+	for _, confirmedEvent := range r.debouncer.Release(now) {
+		eventTime, _ := confirmedEvent.CreatedAtTime()
+		if err := r.releaseTimers(eventTime); err != nil {
+			return err
+		}
+		if err := r.processConfirmedEvent(confirmedEvent); err != nil {
+			return err
+		}
+	}
+	return r.releaseTimers(now)
+}
+
+// An event that made it through validation and debouncing.  The ones before
+// since only count towards the presence history.
+func (r *alertReplay) processConfirmedEvent(geofenceEvent GeofenceEvent) error {
+
+	eventTime, _ := geofenceEvent.CreatedAtTime()
+	if !eventTime.Before(r.preview.Since) {
+		if err := r.processEvent(geofenceEvent, eventTime); err != nil {
+			return err
+		}
+	}
+	r.presence.Record(geofenceEvent)
+	return nil
+
+}
+
+func (r *alertReplay) processEvent(geofenceEvent GeofenceEvent, eventTime time.Time) error {
+
+	if r.deleted {
+		return nil
+	}
+
+	r.clock.Set(eventTime)
+	if !r.alert.IsActive(eventTime) {
+		return nil
+	}
+
+	shouldFire, err := r.alert.Process(geofenceEvent)
+	if err != nil {
+		return fmt.Errorf("Alert failed to process event %v: %v", geofenceEvent.Id, err)
+	}
+	if shouldFire {
+		r.fire(PreviewFiring{FiredAt: eventTime, Event: &geofenceEvent})
+	}
+	return nil
+
+}
+
+// Process the timers that are due by the given time, earliest first,
+// including any that are scheduled along the way
+func (r *alertReplay) releaseTimers(now time.Time) error {
+
+	timedAlert, ok := r.alert.(TimedAlerter)
+	if !ok {
+		return nil
+	}
+
+	for {
+		due := r.timers.Due(now)
+		if len(due) == 0 || r.deleted {
+			return nil
+		}
+		for _, timer := range due {
+			if err := r.processTimer(timedAlert, timer); err != nil {
+				return err
+			}
+		}
+	}
+
+}
+
+func (r *alertReplay) processTimer(timedAlert TimedAlerter, timer AlertTimer) error {
+
+	if r.deleted || !r.timers.Take(timer) {
+		return nil
+	}
+	r.clock.Set(timer.FireAt)
+
+	if scheduledAlert, ok := timedAlert.(ScheduledAlerter); ok {
+		defer scheduledAlert.ScheduleNext(timer.FireAt)
+	}
+
+	if !timedAlert.IsActive(timer.FireAt) {
+		return nil
+	}
+
+	shouldFire, err := timedAlert.ProcessTimer(timer)
+	if err != nil {
+		return fmt.Errorf("Alert failed to process timer %v: %v", timer.Id, err)
+	}
+	if shouldFire {
+		r.fire(PreviewFiring{FiredAt: timer.FireAt, Timer: &timer})
+	}
+	return nil
+
+}
+
+// Record the notifications the alert would send, rather than sending them,
+// and then reactivate it in memory, or consider it deleted.
+func (r *alertReplay) fire(firing PreviewFiring) {
+
+	firing.Actions = []AlertAction{}
+	r.alert.PerformActions(func(action AlertAction) error {
+		firing.Actions = append(firing.Actions, action)
+		return nil
+	})
+	r.preview.Firings = append(r.preview.Firings, firing)
+
+	if r.alert.IsSticky() {
+		r.alert.reactivate(firing.FiredAt)
+	} else {
+		r.deleted = true
+	}
+
+}
+
+// The events with a valid timestamp, in the order they happened.  Events
+// without one can't be placed in the history, so are left out.
+func historyOrder(events []GeofenceEvent) []GeofenceEvent {
+	sorted := []GeofenceEvent{}
+	for _, geofenceEvent := range events {
+		if _, err := geofenceEvent.CreatedAtTime(); err == nil {
+			sorted = append(sorted, geofenceEvent)
+		}
+	}
+	sort.Stable(eventsByTime(sorted))
+	return sorted
+}
+
+type eventsByTime []GeofenceEvent
+
+func (e eventsByTime) Len() int      { return len(e) }
+func (e eventsByTime) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e eventsByTime) Less(i, j int) bool {
+	iTime, _ := e[i].CreatedAtTime()
+	jTime, _ := e[j].CreatedAtTime()
+	return iTime.Before(jTime)
+}
+
+// Timers in a preview only live in memory
+type discardTimerStore struct{}
+
+func (s discardTimerStore) SaveTimer(timer *AlertTimer) error {
+	return nil
+}
+
+func (s discardTimerStore) DeleteTimer(timer *AlertTimer) error {
+	return nil
+}
@@ -0,0 +1,190 @@
+package officeradar
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestPreviewAlert(t *testing.T) {
+
+	day := time.Date(2014, 9, 1, 9, 0, 0, 0, time.UTC)
+	event := func(id, profileId string, at time.Time) GeofenceEvent {
+		geofenceEvent := GeofenceEvent{
+			Action:    ACTION_ENTRY,
+			BeaconId:  "sf",
+			ProfileId: profileId,
+			CreatedAt: at.Format(time.RFC3339),
+		}
+		geofenceEvent.Id = id
+		geofenceEvent.Type = DOC_TYPE_GEOFENCE_EVENT
+		return geofenceEvent
+	}
+
+	// stored in a different order than they happened
+	events := []GeofenceEvent{
+		event("e3", "foo", day.Add(20*24*time.Hour)),
+		event("e1", "foo", day),
+		event("e2", "foo", day.Add(2*24*time.Hour)),
+		event("e4", "foo", day.Add(21*24*time.Hour)),
+		event("e5", "foo", day.Add(40*24*time.Hour)),
+		event("e6", "bar", day.Add(41*24*time.Hour)),
+		event("e7", "foo", day.Add(90*24*time.Hour)),
+	}
+	events = append(events, GeofenceEvent{Action: ACTION_ENTRY, BeaconId: "sf", ProfileId: "foo"})
+
+	alertJson := []byte(`{
+		"type": "surprise_appearance_alert",
+		"Users": [{"_id": "foo"}, {"_id": "bar"}],
+		"Beacons": [{"_id": "sf"}],
+		"MinLastSeenAgo": 1209600000000000,
+		"Sticky": true,
+		"Actions": [{"Recipient": "me", "Message": "long time no see"}]
+	}`)
+
+	app := NewOfficeRadarApp("", "")
+
+	// the events before since only count towards the presence history, so
+	// foo on day 2 isn't a surprise, but is on day 20, and then on day 40.
+	// bar has never been seen before day 41.
+	since := day.Add(time.Hour)
+	until := day.Add(60 * 24 * time.Hour)
+	preview, err := app.previewAlert(alertJson, events, since, until)
+	assert.True(t, err == nil)
+	assert.Equals(t, preview.EventsReplayed, 5)
+	assert.Equals(t, len(preview.Firings), 3)
+	assert.Equals(t, preview.Firings[0].Event.Id, "e3")
+	assert.Equals(t, preview.Firings[1].Event.Id, "e5")
+	assert.Equals(t, preview.Firings[2].Event.Id, "e6")
+	assert.Equals(t, len(preview.Firings[0].Actions), 1)
+	assert.Equals(t, preview.Firings[0].Actions[0].Message, "long time no see")
+
+	// a sticky alert that reactivates after a week misses day 41
+	alertJson = []byte(`{
+		"type": "surprise_appearance_alert",
+		"Users": [{"_id": "foo"}, {"_id": "bar"}],
+		"Beacons": [{"_id": "sf"}],
+		"MinLastSeenAgo": 1209600000000000,
+		"Sticky": true,
+		"ReactivateAfter": 604800000000000
+	}`)
+	preview, err = app.previewAlert(alertJson, events, since, until)
+	assert.True(t, err == nil)
+	assert.Equals(t, len(preview.Firings), 2)
+
+	// a non-sticky alert is deleted after it fires the first time
+	alertJson = []byte(`{
+		"type": "surprise_appearance_alert",
+		"Users": [{"_id": "foo"}, {"_id": "bar"}],
+		"Beacons": [{"_id": "sf"}],
+		"MinLastSeenAgo": 1209600000000000
+	}`)
+	preview, err = app.previewAlert(alertJson, events, since, until)
+	assert.True(t, err == nil)
+	assert.Equals(t, len(preview.Firings), 1)
+	assert.Equals(t, preview.Firings[0].Event.Id, "e3")
+
+	// invalid alert definitions are rejected
+	_, err = app.previewAlert([]byte(`{"type": "bogus_alert"}`), events, since, until)
+	assert.True(t, err != nil)
+
+}
+
+func TestPreviewDwellAlert(t *testing.T) {
+
+	arrival := time.Date(2014, 9, 2, 9, 0, 0, 0, time.UTC)
+	entry := GeofenceEvent{Action: ACTION_ENTRY, BeaconId: "desk", ProfileId: "foo", CreatedAt: arrival.Format(time.RFC3339)}
+	exit := GeofenceEvent{Action: ACTION_EXIT, BeaconId: "desk", ProfileId: "foo", CreatedAt: arrival.Add(3 * time.Hour).Format(time.RFC3339)}
+
+	alertJson := []byte(`{
+		"_id": "dwell_alert_1",
+		"type": "dwell_alert",
+		"Users": [{"_id": "foo"}],
+		"Beacons": [{"_id": "desk"}],
+		"Duration": 7200000000000
+	}`)
+
+	// the dwell timer comes due between the entry and the exit
+	app := NewOfficeRadarApp("", "")
+	preview, err := app.previewAlert(alertJson, []GeofenceEvent{entry, exit}, arrival, arrival.Add(24*time.Hour))
+	assert.True(t, err == nil)
+	assert.Equals(t, len(preview.Firings), 1)
+	assert.True(t, preview.Firings[0].Event == nil)
+	assert.Equals(t, preview.Firings[0].Timer.ProfileId, "foo")
+	assert.Equals(t, preview.Firings[0].FiredAt, arrival.Add(2*time.Hour))
+
+}
+
+func TestPreviewAlertValidatesAndDebounces(t *testing.T) {
+
+	start := time.Date(2014, 9, 2, 9, 0, 0, 0, time.UTC)
+	event := func(id, profileId, action string, at time.Time) GeofenceEvent {
+		geofenceEvent := GeofenceEvent{Action: action, BeaconId: "beacon_sf", ProfileId: profileId, CreatedAt: at.Format(time.RFC3339)}
+		geofenceEvent.Id = id
+		return geofenceEvent
+	}
+
+	app := NewOfficeRadarApp("", "")
+	app.Debouncer = NewDebouncer(5*time.Minute, 0)
+	app.Validator = &GeofenceEventValidator{
+		MaxClockSkew: DEFAULT_MAX_CLOCK_SKEW,
+		DocTypeFunc: func(docId string) (string, error) {
+			if docId == "beacon_sf" {
+				return DOC_TYPE_BEACON, nil
+			}
+			if docId == "profile_foo" {
+				return DOC_TYPE_PROFILE, nil
+			}
+			return "", nil
+		},
+	}
+
+	// foo flaps in and out, and then stays.  nobody has no profile.
+	events := []GeofenceEvent{
+		event("e1", "profile_foo", ACTION_ENTRY, start),
+		event("e2", "profile_foo", ACTION_EXIT, start.Add(time.Minute)),
+		event("e3", "profile_foo", ACTION_ENTRY, start.Add(time.Hour)),
+		event("e4", "nobody", ACTION_ENTRY, start.Add(2*time.Hour)),
+	}
+
+	alertJson := []byte(`{
+		"type": "any_users_present_alert",
+		"Users": [{"_id": "profile_foo"}, {"_id": "nobody"}],
+		"Beacon": {"_id": "beacon_sf"},
+		"Sticky": true
+	}`)
+
+	preview, err := app.previewAlert(alertJson, events, start, start.Add(24*time.Hour))
+	assert.True(t, err == nil)
+	assert.Equals(t, preview.EventsReplayed, 3)
+	assert.Equals(t, len(preview.Firings), 1)
+	assert.Equals(t, preview.Firings[0].Event.Id, "e3")
+	assert.Equals(t, preview.Firings[0].FiredAt, start.Add(time.Hour))
+
+}
+
+func TestPreviewTimersBeforeReleasedEvents(t *testing.T) {
+
+	arrival := time.Date(2014, 9, 2, 9, 0, 0, 0, time.UTC)
+	entry := GeofenceEvent{Action: ACTION_ENTRY, BeaconId: "desk", ProfileId: "foo", CreatedAt: arrival.Format(time.RFC3339)}
+	exit := GeofenceEvent{Action: ACTION_EXIT, BeaconId: "desk", ProfileId: "foo", CreatedAt: arrival.Add(150 * time.Minute).Format(time.RFC3339)}
+
+	alertJson := []byte(`{
+		"_id": "dwell_alert_1",
+		"type": "dwell_alert",
+		"Users": [{"_id": "foo"}],
+		"Beacons": [{"_id": "desk"}],
+		"Duration": 7200000000000
+	}`)
+
+	// the exit is only released after the dwell timer came due, but it
+	// happened after it, so it doesn't cancel it
+	app := NewOfficeRadarApp("", "")
+	app.Debouncer = NewDebouncer(0, 3*time.Hour)
+	preview, err := app.previewAlert(alertJson, []GeofenceEvent{entry, exit}, arrival, arrival.Add(24*time.Hour))
+	assert.True(t, err == nil)
+	assert.Equals(t, len(preview.Firings), 1)
+	assert.Equals(t, preview.Firings[0].FiredAt, arrival.Add(2*time.Hour))
+
+}
@@ -2,6 +2,10 @@ package officeradar
 
 import "github.com/tleyden/go-couch"
 
+const (
+	DOC_TYPE_PROFILE = "profile"
+)
+
 type OfficeRadarProfile struct {
 	OfficeRadarDoc
 	DeviceTokens []string `json:"deviceTokens"`
@@ -0,0 +1,274 @@
+package officeradar
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	DOC_TYPE_PROXIMITY_ALERT = "proximity_alert"
+)
+
+// A geofence alert triggered when any two of the users are in range of the
+// same beacon, whichever beacon that is, at the same time or within the window
+// of eachother.  Both users are notified with a message naming the location.
+// Each pair only triggers once per meeting, and is re-armed after they part.
+// Eg, "Next time Jens and I are in the same office, remind us to talk about the release"
+type ProximityAlert struct {
+	BaseAlert
+	Users        []OfficeRadarProfile                                // users who should be told when they meet
+	Window       time.Duration                                       // max time between the users' appearances
+	Message      string                                              // optional note added to the notifications
+	Meetings     []Meeting                                           // pairs of users who met and haven't parted yet
+	LastSeenFunc LastSeenFunc                                        `json:"-"` // determine when last seen user at beacon
+	PresentFunc  PresentFunc                                         `json:"-"` // determine whether user is still at beacon
+	BeaconFunc   func(beaconId string) (*Beacon, error)              `json:"-"` // if nil, beacons are fetched from the db
+	ProfileFunc  func(profileId string) (*OfficeRadarProfile, error) `json:"-"` // if nil, profiles are fetched from the db
+	pending      []AlertAction                                       // notifications for the meetings found by Process
+	rearmed      bool                                                // pairs parted since it was last saved
+}
+
+// A pair of users who met at a beacon
+type Meeting struct {
+	BeaconId   string
+	ProfileIds []string // sorted
+}
+
+func NewProximityAlert() *ProximityAlert {
+	alert := &ProximityAlert{}
+	alert.Type = DOC_TYPE_PROXIMITY_ALERT
+	return alert
+}
+
+func (a *ProximityAlert) Validate() error {
+	if len(a.Users) < 2 {
+		return fmt.Errorf("Proximity alert %v needs at least two users", a.Id)
+	}
+	return nil
+}
+
+func (a *ProximityAlert) Process(e GeofenceEvent) (bool, error) {
+
+	if a.LastSeenFunc == nil {
+		Log.Panic("no LastSeenFunc defined.")
+	}
+
+	if !hasProfileOverlap(a.Users, e) {
+		return false, nil
+	}
+
+	eventTime := e.EventTime(a.clock())
+
+	// re-arm the pairs that have parted since they met here, judging by the
+	// presence before this event is taken into account
+	seenHere := seenWithin(a.PresentFunc, a.LastSeenFunc, e.ProfileId, e.BeaconId, eventTime, a.Window)
+	for _, user := range a.Users {
+		if user.Id == e.ProfileId || !a.haveMet(e.BeaconId, e.ProfileId, user.Id) {
+			continue
+		}
+		if !seenHere || !seenWithin(a.PresentFunc, a.LastSeenFunc, user.Id, e.BeaconId, eventTime, a.Window) {
+			e.logger().Debug("Users parted, re-arming", LogFields{"alert": a.Id, "profile": e.ProfileId, "other_profile": user.Id, "beacon": e.BeaconId})
+			a.setMet(e.BeaconId, e.ProfileId, user.Id, false)
+			a.rearmed = true
+		}
+	}
+
+	// only an arrival can bring a pair together
+	if e.Action != ACTION_ENTRY {
+		return false, nil
+	}
+
+	met := []OfficeRadarProfile{}
+	for _, user := range a.Users {
+		if user.Id == e.ProfileId || a.haveMet(e.BeaconId, e.ProfileId, user.Id) {
+			continue
+		}
+		if seenWithin(a.PresentFunc, a.LastSeenFunc, user.Id, e.BeaconId, eventTime, a.Window) {
+			met = append(met, user)
+		}
+	}
+	if len(met) == 0 {
+		return false, nil
+	}
+
+	location := a.locationName(e.BeaconId)
+	arrivedName := a.userName(e.ProfileId)
+	for _, user := range met {
+		a.setMet(e.BeaconId, e.ProfileId, user.Id, true)
+		a.pending = append(
+			a.pending,
+			AlertAction{Recipient: e.ProfileId, Message: a.message(a.userName(user.Id), location)},
+			AlertAction{Recipient: user.Id, Message: a.message(arrivedName, location)},
+		)
+	}
+
+	// the meetings are saved when it fires, along with any pairs that parted
+	a.rearmed = false
+	return true, nil
+
+}
+
+// Notify both users of each pair that met, along with any other actions
+func (a *ProximityAlert) PerformActions(actionFunc ActionFunc) error {
+
+	actions := append([]AlertAction{}, a.Actions...)
+	actions = append(actions, a.pending...)
+	a.pending = nil
+
+	for _, action := range actions {
+		err := actionFunc(action)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+
+}
+
+// Save the alert if pairs parted w/o it firing, so they're still re-armed
+// after a restart
+func (a *ProximityAlert) SaveRearmed() error {
+	if !a.rearmed {
+		return nil
+	}
+	rev, err := a.database.Edit(a)
+	if err != nil {
+		// try again after the next event
+		return err
+	}
+	a.Revision = rev
+	a.rearmed = false
+	return nil
+}
+
+func (a *ProximityAlert) message(name string, location string) string {
+	msg := fmt.Sprintf("You and %v are both at %v", name, location)
+	if a.Message != "" {
+		msg = fmt.Sprintf("%v: %v", msg, a.Message)
+	}
+	return msg
+}
+
+// The most readable name for the beacon, falling back to its id if it can't
+// be found, since that shouldn't stop the users from being told
+func (a *ProximityAlert) locationName(beaconId string) string {
+
+	fetchBeacon := a.BeaconFunc
+	if fetchBeacon == nil {
+		fetchBeacon = a.fetchBeacon
+	}
+
+	beacon, err := fetchBeacon(beaconId)
+	if err != nil {
+		Log.Error("Unable to fetch beacon", LogFields{"beacon": beaconId, "alert": a.Id, "error": err})
+		return beaconId
+	}
+
+	switch {
+	case beacon.Location != "":
+		return beacon.Location
+	case beacon.Desc != "":
+		return beacon.Desc
+	}
+	return beaconId
+
+}
+
+func (a *ProximityAlert) fetchBeacon(beaconId string) (*Beacon, error) {
+	return FetchBeacon(a.database, beaconId)
+}
+
+func (a *ProximityAlert) fetchProfile(profileId string) (*OfficeRadarProfile, error) {
+	return FetchOfficeRadarProfile(a.database, profileId)
+}
+
+// The name on the user's profile, since the users of the alert are usually
+// just their ids.  Falls back to the name in the alert, or the id, if the
+// profile can't be found.
+func (a *ProximityAlert) userName(profileId string) string {
+
+	fetchProfile := a.ProfileFunc
+	if fetchProfile == nil {
+		fetchProfile = a.fetchProfile
+	}
+
+	profile, err := fetchProfile(profileId)
+	if err != nil {
+		Log.Error("Unable to fetch profile", LogFields{"profile": profileId, "alert": a.Id, "error": err})
+	} else if profile.Name != "" {
+		return profile.Name
+	}
+
+	for _, user := range a.Users {
+		if user.Id == profileId && user.Name != "" {
+			return user.Name
+		}
+	}
+	return profileId
+
+}
+
+func (a *ProximityAlert) haveMet(beaconId, profileId, otherProfileId string) bool {
+	meeting := newMeeting(beaconId, profileId, otherProfileId)
+	for _, existing := range a.Meetings {
+		if existing.equals(meeting) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *ProximityAlert) setMet(beaconId, profileId, otherProfileId string, met bool) {
+	meeting := newMeeting(beaconId, profileId, otherProfileId)
+	remaining := []Meeting{}
+	for _, existing := range a.Meetings {
+		if !existing.equals(meeting) {
+			remaining = append(remaining, existing)
+		}
+	}
+	if met {
+		remaining = append(remaining, meeting)
+	}
+	a.Meetings = remaining
+}
+
+func newMeeting(beaconId, profileId, otherProfileId string) Meeting {
+	profileIds := []string{profileId, otherProfileId}
+	sort.Strings(profileIds)
+	return Meeting{BeaconId: beaconId, ProfileIds: profileIds}
+}
+
+func (m Meeting) equals(other Meeting) bool {
+	return m.BeaconId == other.BeaconId &&
+		len(m.ProfileIds) == 2 && len(other.ProfileIds) == 2 &&
+		m.ProfileIds[0] == other.ProfileIds[0] &&
+		m.ProfileIds[1] == other.ProfileIds[1]
+}
+
+// The users can meet at any beacon
+func (a *ProximityAlert) BeaconIds() []string {
+	return []string{}
+}
+
+func (a *ProximityAlert) ProfileIds() []string {
+	return profileIds(a.Users)
+}
+
+func (a *ProximityAlert) RescheduleOrDelete(firedAt time.Time) error {
+
+	// if it's sticky, then update the alert's activeOn time
+	if a.Sticky {
+		a.ActiveOn = firedAt.Add(a.ReactivateAfter)
+		rev, err := a.database.Edit(a)
+		if err == nil {
+			a.Revision = rev
+		}
+		return err
+	}
+
+	// otherwise, delete the alert
+	err := a.database.Delete(a.Id, a.Revision)
+	return err
+
+}
@@ -0,0 +1,132 @@
+package officeradar
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func newTestProximityAlert(presence *PresenceHistory) *ProximityAlert {
+
+	alert := NewProximityAlert()
+	alert.Window = 15 * time.Minute
+	alert.Message = "talk about the release"
+	alert.Users = []OfficeRadarProfile{
+		{OfficeRadarDoc: OfficeRadarDoc{Id: "traun"}},
+		{OfficeRadarDoc: OfficeRadarDoc{Id: "jens"}},
+		{OfficeRadarDoc: OfficeRadarDoc{Id: "marty"}, Name: "Marty"},
+	}
+	alert.LastSeenFunc = presence.LastSeen
+	alert.PresentFunc = presence.IsPresent
+	alert.BeaconFunc = func(beaconId string) (*Beacon, error) {
+		switch beaconId {
+		case "sf":
+			return &Beacon{Location: "SF office"}, nil
+		case "mv":
+			return &Beacon{Desc: "MV lobby"}, nil
+		}
+		return nil, fmt.Errorf("404 Not Found")
+	}
+	alert.ProfileFunc = func(profileId string) (*OfficeRadarProfile, error) {
+		switch profileId {
+		case "traun":
+			return &OfficeRadarProfile{Name: "Traun"}, nil
+		case "jens":
+			return &OfficeRadarProfile{Name: "Jens"}, nil
+		}
+		return nil, fmt.Errorf("404 Not Found")
+	}
+	return alert
+
+}
+
+func TestProximityAlert(t *testing.T) {
+
+	presence := NewPresenceHistory(SystemClock)
+	alert := newTestProximityAlert(presence)
+	assert.True(t, alert.Validate() == nil)
+
+	startTime := time.Date(2014, 9, 2, 9, 0, 0, 0, time.UTC)
+	process := func(profileId, beaconId, action string, minutes int) bool {
+		geofenceEvent := GeofenceEvent{
+			Action:    action,
+			BeaconId:  beaconId,
+			ProfileId: profileId,
+			CreatedAt: startTime.Add(time.Duration(minutes) * time.Minute).Format(time.RFC3339),
+		}
+		fired, err := alert.Process(geofenceEvent)
+		assert.True(t, err == nil)
+		presence.Record(geofenceEvent)
+		return fired
+	}
+	performActions := func() []AlertAction {
+		actions := []AlertAction{}
+		alert.PerformActions(func(action AlertAction) error {
+			actions = append(actions, action)
+			return nil
+		})
+		return actions
+	}
+
+	// traun and jens at different beacons
+	assert.False(t, process("traun", "sf", ACTION_ENTRY, 0))
+	assert.False(t, process("jens", "mv", ACTION_ENTRY, 5))
+	assert.False(t, process("jens", "mv", ACTION_EXIT, 8))
+
+	// jens shows up at the sf office, so both of them are told
+	assert.True(t, process("jens", "sf", ACTION_ENTRY, 10))
+	actions := performActions()
+	assert.Equals(t, len(actions), 2)
+	assert.Equals(t, actions[0].Recipient, "jens")
+	assert.Equals(t, actions[0].Message, "You and Traun are both at SF office: talk about the release")
+	assert.Equals(t, actions[1].Recipient, "traun")
+	assert.Equals(t, actions[1].Message, "You and Jens are both at SF office: talk about the release")
+	assert.Equals(t, len(performActions()), 0)
+
+	// marty joins them, which is a new meeting for both pairs with marty
+	assert.True(t, process("marty", "sf", ACTION_ENTRY, 12))
+
+	actions = performActions()
+	assert.Equals(t, len(actions), 4)
+	assert.Equals(t, actions[0].Message, "You and Traun are both at SF office: talk about the release")
+	assert.Equals(t, actions[1].Message, "You and Marty are both at SF office: talk about the release") // from the alert, w/o a profile
+
+	// jens stepping out and back in doesn't count as a new meeting
+	assert.False(t, process("jens", "sf", ACTION_EXIT, 20))
+	assert.False(t, process("jens", "sf", ACTION_ENTRY, 25))
+	assert.False(t, alert.rearmed)
+
+	// but it does once they've been apart for longer than the window.  traun
+	// leaving re-arms traun and jens, which has to be saved.
+	assert.False(t, process("jens", "sf", ACTION_EXIT, 30))
+	assert.False(t, process("traun", "sf", ACTION_EXIT, 55))
+	assert.True(t, alert.rearmed)
+	assert.True(t, process("jens", "sf", ACTION_ENTRY, 60))
+	assert.False(t, alert.rearmed)
+	assert.Equals(t, len(performActions()), 4)
+
+	// at the mv lobby, which has no location, long after jens left it
+	assert.False(t, process("traun", "mv", ACTION_ENTRY, 70))
+	assert.True(t, process("jens", "mv", ACTION_ENTRY, 71))
+	actions = performActions()
+	assert.Equals(t, len(actions), 2)
+	assert.Equals(t, actions[0].Message, "You and Traun are both at MV lobby: talk about the release")
+
+	// an unknown beacon is named by its id
+	assert.False(t, process("traun", "attic", ACTION_ENTRY, 80))
+	assert.True(t, process("marty", "attic", ACTION_ENTRY, 81))
+	actions = performActions()
+	assert.Equals(t, actions[0].Message, "You and Traun are both at attic: talk about the release")
+
+	// not one of the users
+	assert.False(t, process("stranger", "sf", ACTION_ENTRY, 90))
+
+}
+
+func TestProximityAlertValidate(t *testing.T) {
+	alert := newTestProximityAlert(NewPresenceHistory(SystemClock))
+	alert.Users = alert.Users[:1]
+	assert.True(t, alert.Validate() != nil)
+}
@@ -0,0 +1,56 @@
+package officeradar
+
+import (
+	"fmt"
+	"time"
+)
+
+// A time of day range, eg, overnight, during which the alerts still fire and
+// are recorded, but their pushes are suppressed so that nobody gets woken up.
+// The suppressed pushes are dropped, not sent once quiet hours are over.
+type QuietHours struct {
+	Start    string // 24h "15:04" format
+	End      string
+	TimeZone string // empty means UTC
+	start    int    // minutes since midnight
+	end      int
+	location *time.Location
+}
+
+func NewQuietHours(start, end, timeZone string) (*QuietHours, error) {
+
+	quietHours := &QuietHours{Start: start, End: end, TimeZone: timeZone, location: time.UTC}
+
+	var err error
+	if quietHours.start, err = minuteOfDay(start); err != nil {
+		return nil, fmt.Errorf("Invalid start of quiet hours: %v", err)
+	}
+	if quietHours.end, err = minuteOfDay(end); err != nil {
+		return nil, fmt.Errorf("Invalid end of quiet hours: %v", err)
+	}
+	if timeZone != "" {
+		if quietHours.location, err = time.LoadLocation(timeZone); err != nil {
+			return nil, fmt.Errorf("Invalid time zone %q for quiet hours: %v", timeZone, err)
+		}
+	}
+	return quietHours, nil
+
+}
+
+// Is the time within quiet hours?  Always false for nil quiet hours.
+func (q *QuietHours) Contains(t time.Time) bool {
+
+	if q == nil {
+		return false
+	}
+
+	local := t.In(q.location)
+	minute := local.Hour()*60 + local.Minute()
+
+	if q.start <= q.end {
+		return minute >= q.start && minute < q.end
+	}
+	// the range wraps around midnight, eg, 22:00 - 07:00
+	return minute >= q.start || minute < q.end
+
+}
@@ -0,0 +1,46 @@
+package officeradar
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestQuietHoursContains(t *testing.T) {
+
+	overnight, err := NewQuietHours("22:00", "07:00", "")
+	assert.True(t, err == nil)
+	assert.True(t, overnight.Contains(time.Date(2014, 9, 2, 23, 30, 0, 0, time.UTC)))
+	assert.True(t, overnight.Contains(time.Date(2014, 9, 2, 6, 59, 0, 0, time.UTC)))
+	assert.False(t, overnight.Contains(time.Date(2014, 9, 2, 7, 0, 0, 0, time.UTC)))
+
+	var none *QuietHours
+	assert.False(t, none.Contains(time.Date(2014, 9, 2, 23, 30, 0, 0, time.UTC)))
+
+	_, err = NewQuietHours("22:00", "7am", "")
+	assert.True(t, err != nil)
+	_, err = NewQuietHours("22:00", "07:00", "Mars/Olympus_Mons")
+	assert.True(t, err != nil)
+
+}
+
+func TestQuietHoursSuppressPushes(t *testing.T) {
+
+	api, notifier := newTestAdminAPI()
+	app := api.App
+	app.QuietHours, _ = NewQuietHours("08:00", "10:00", "")
+	adminRequest(api, "POST", "/alerts", testAdminAlert)
+
+	event := GeofenceEvent{Action: ACTION_ENTRY, BeaconId: "sfBeaconId", ProfileId: "jensId", CreatedAt: "2014-09-02T09:00:00Z"}
+	app.processGeofenceEvent(context.Background(), event)
+
+	// the alert fires, but nobody hears about it
+	assert.Equals(t, len(notifier.Notifications()), 0)
+	firings, err := app.Firings.Firings("sf_alert")
+	assert.True(t, err == nil)
+	assert.Equals(t, len(firings), 1)
+	assert.Equals(t, len(firings[0].Actions), 0)
+
+}
@@ -0,0 +1,139 @@
+package officeradar
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Which of the events to replay, and how fast
+type ReplayOptions struct {
+	From    time.Time // only replay events at or after this time, if set
+	To      time.Time // only replay events at or before this time, if set
+	Speedup float64   // 1 replays in real time, 60 a minute per second, 0 as fast as possible
+}
+
+// Push geofence events through the same processing as the changes feed, in
+// the order they happened, eg, to find out why an alert did or didn't fire.
+// The app's clock must be a ManualClock, which follows the time of the events
+// so that the debouncer and alert timers behave as they would have at the
+// time.  The history events from before the first replayed event are only
+// used to build up the presence history.  Returns how many events were
+// replayed, which is fewer than expected if the context is done first.
+func (o OfficeRadarApp) ReplayEvents(ctx context.Context, history, events []GeofenceEvent, options ReplayOptions) (int, error) {
+
+	clock, ok := o.Clock.(*ManualClock)
+	if !ok {
+		return 0, fmt.Errorf("Replaying events needs a ManualClock, not %T", o.Clock)
+	}
+
+	events = eventsBetween(historyOrder(events), options.From, options.To)
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	start, _ := events[0].CreatedAtTime()
+	for _, geofenceEvent := range historyOrder(history) {
+		eventTime, _ := geofenceEvent.CreatedAtTime()
+		if !eventTime.Before(start) {
+			break
+		}
+		o.Presence.Record(geofenceEvent)
+	}
+
+	// everything happens inline, in order, rather than on the workers
+	inline := func(partitionKey string, job func(ctx context.Context)) {
+		job(ctx)
+	}
+
+	previous := start
+	for i, geofenceEvent := range events {
+
+		if ctx.Err() != nil {
+			return i, ctx.Err()
+		}
+
+		eventTime, _ := geofenceEvent.CreatedAtTime()
+		if options.Speedup > 0 {
+			select {
+			case <-ctx.Done():
+				return i, ctx.Err()
+			case <-time.After(time.Duration(float64(eventTime.Sub(previous)) / options.Speedup)):
+			}
+		}
+		previous = eventTime
+
+		o.releaseUntil(eventTime, inline)
+
+		Log.Info("Replaying event", LogFields{"event": geofenceEvent.Id, "at": eventTime})
+		clock.Set(eventTime)
+		o.processGeofenceEvent(ctx, geofenceEvent)
+
+	}
+
+	// let the last of the pending events and timers play out
+	until := previous
+	if !options.To.IsZero() {
+		until = options.To
+	}
+	o.releaseUntil(until, inline)
+
+	return len(events), nil
+
+}
+
+// Index the alerts to replay events through, eg, the alerts of a fixture or
+// an export.  They're loaded w/o their runtime state, eg, ActiveOn or Paused,
+// which is as of now rather than as of the replayed events.  Alerts that
+// can't be decoded are skipped, the same as when loading them from the
+// database.
+func (o OfficeRadarApp) LoadReplayAlerts(docs []FixtureDoc) {
+
+	for _, doc := range docs {
+		alert, err := o.decodeReplayAlert(doc)
+		if err != nil {
+			Log.Error("Unable to load alert", LogFields{"alert": doc.Id(), "error": err})
+			continue
+		}
+		o.AlertIndex.Upsert(alert)
+	}
+
+	Log.Info("Loaded alerts", LogFields{"alerts": o.AlertIndex.Len()})
+	o.scheduleAlerts()
+
+}
+
+func (o OfficeRadarApp) decodeReplayAlert(doc FixtureDoc) (Alerter, error) {
+	alertJson, err := json.Marshal(withoutAlertState(doc))
+	if err != nil {
+		return nil, err
+	}
+	return DecodeAlert(o.Database, alertJson, o.alertServices())
+}
+
+// Release everything that comes due up to the given time, including timers
+// that are scheduled along the way, eg, by scheduled alerts that fire daily
+func (o OfficeRadarApp) releaseUntil(until time.Time, dispatch func(string, func(context.Context))) {
+	for o.releaseDue(until, dispatch) > 0 {
+	}
+}
+
+// The events between from and to, either of which may be zero for no limit
+func eventsBetween(events []GeofenceEvent, from, to time.Time) []GeofenceEvent {
+	between := []GeofenceEvent{}
+	for _, geofenceEvent := range events {
+		eventTime, err := geofenceEvent.CreatedAtTime()
+		if err != nil {
+			continue
+		}
+		if !from.IsZero() && eventTime.Before(from) {
+			continue
+		}
+		if !to.IsZero() && eventTime.After(to) {
+			continue
+		}
+		between = append(between, geofenceEvent)
+	}
+	return between
+}
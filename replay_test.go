@@ -0,0 +1,155 @@
+package officeradar
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestReplayEvents(t *testing.T) {
+
+	start := time.Date(2014, 9, 2, 9, 0, 0, 0, time.UTC)
+
+	app := NewOfficeRadarApp("", "")
+	app.DryRun = true
+	clock := NewManualClock(start)
+	app.SetClock(clock)
+	app.Validator = &GeofenceEventValidator{
+		MaxClockSkew: DEFAULT_MAX_CLOCK_SKEW,
+		Clock:        clock,
+		DocTypeFunc: func(docId string) (string, error) {
+			if strings.HasPrefix(docId, "beacon") {
+				return DOC_TYPE_BEACON, nil
+			}
+			return DOC_TYPE_PROFILE, nil
+		},
+	}
+	app.Timers = NewTimerScheduler(discardTimerStore{})
+	notifier := NewRecordingNotifier(clock)
+	app.Notifier = notifier
+
+	foo := OfficeRadarProfile{OfficeRadarDoc: OfficeRadarDoc{Id: "profile_foo"}}
+	desk := Beacon{OfficeRadarDoc: OfficeRadarDoc{Id: "beacon_desk"}}
+
+	dwellAlert := NewDwellAlert()
+	dwellAlert.Id = "dwell_alert"
+	dwellAlert.Users = []OfficeRadarProfile{foo}
+	dwellAlert.Beacons = []Beacon{desk}
+	dwellAlert.Duration = 2 * time.Hour
+	dwellAlert.Sticky = true
+	dwellAlert.Timers = app.Timers
+	dwellAlert.Actions = []AlertAction{{Recipient: foo.Id, Message: "stand up"}}
+	app.AlertIndex.Upsert(dwellAlert)
+
+	surpriseAlert := NewSurpriseAppearanceAlert()
+	surpriseAlert.Id = "surprise_alert"
+	surpriseAlert.Users = []OfficeRadarProfile{foo}
+	surpriseAlert.Beacons = []Beacon{desk}
+	surpriseAlert.MinLastSeenAgo = 7 * 24 * time.Hour
+	surpriseAlert.LastSeenFunc = app.Presence.LastSeen
+	surpriseAlert.Actions = []AlertAction{{Recipient: "boss", Message: "foo is back"}}
+	app.AlertIndex.Upsert(surpriseAlert)
+
+	event := func(id, action string, at time.Time) GeofenceEvent {
+		geofenceEvent := GeofenceEvent{
+			Action:    action,
+			BeaconId:  desk.Id,
+			ProfileId: foo.Id,
+			CreatedAt: at.Format(time.RFC3339),
+		}
+		geofenceEvent.Id = id
+		return geofenceEvent
+	}
+
+	// foo was at their desk ten days ago
+	history := []GeofenceEvent{event("old", ACTION_ENTRY, start.Add(-10*24*time.Hour))}
+
+	// out of order, and the second visit is too short for the dwell alert
+	events := []GeofenceEvent{
+		event("e4", ACTION_EXIT, start.Add(26*time.Hour)),
+		event("e1", ACTION_ENTRY, start),
+		event("e2", ACTION_EXIT, start.Add(3*time.Hour)),
+		event("e3", ACTION_ENTRY, start.Add(25*time.Hour)),
+		event("e5", ACTION_ENTRY, start.Add(72*time.Hour)),
+	}
+
+	replayed, err := app.ReplayEvents(context.Background(), history, events, ReplayOptions{To: start.Add(30 * time.Hour)})
+	assert.True(t, err == nil)
+	assert.Equals(t, replayed, 4)
+
+	notifications := notifier.Notifications()
+	assert.Equals(t, len(notifications), 2)
+	assert.Equals(t, notifications[0].AlertId, "surprise_alert")
+	assert.Equals(t, notifications[0].SentAt, start)
+	assert.Equals(t, notifications[1].AlertId, "dwell_alert")
+	assert.Equals(t, notifications[1].Message, "stand up")
+
+	// the non-sticky alert was only removed in memory
+	_, stillIndexed := app.AlertIndex.Get("surprise_alert")
+	assert.False(t, stillIndexed)
+	_, stillIndexed = app.AlertIndex.Get("dwell_alert")
+	assert.True(t, stillIndexed)
+
+	// a real time replay stops waiting for the next event once cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	replayed, err = app.ReplayEvents(ctx, history, events, ReplayOptions{Speedup: 1})
+	assert.Equals(t, err, context.DeadlineExceeded)
+	assert.Equals(t, replayed, 1)
+
+	// replaying needs a clock it can control
+	app.SetClock(SystemClock)
+	_, err = app.ReplayEvents(context.Background(), history, events, ReplayOptions{})
+	assert.True(t, err != nil)
+
+}
+
+func TestLoadReplayAlerts(t *testing.T) {
+
+	api, notifier := newTestAdminAPI()
+	app := api.App
+
+	// the alert is paused now, but that shouldn't affect the replay
+	fixture, err := ReadFixture(strings.NewReader(`
+alerts:
+  - _id: sf_alert
+    type: any_users_present_alert
+    Beacon: {_id: sfBeaconId}
+    Users: [{_id: jensId}]
+    Actions: [{Recipient: traunsId, Message: jens is here}]
+    Paused: true
+    ActiveOn: "2014-09-03T09:00:00Z"
+  - _id: bogus_alert
+    type: bogus
+`))
+	assert.True(t, err == nil)
+	app.LoadReplayAlerts(fixture.Alerts)
+	assert.Equals(t, app.AlertIndex.Len(), 1)
+
+	events := []GeofenceEvent{{Action: ACTION_ENTRY, BeaconId: "sfBeaconId", ProfileId: "jensId", CreatedAt: "2014-09-02T09:00:00Z"}}
+	replayed, err := app.ReplayEvents(context.Background(), nil, events, ReplayOptions{})
+	assert.True(t, err == nil)
+	assert.Equals(t, replayed, 1)
+	assert.Equals(t, len(notifier.Notifications()), 1)
+
+}
+
+func TestReadGeofenceEvents(t *testing.T) {
+
+	jsonl := `{"_id": "e1", "type": "geofence_event", "action": "entry", "beacon": "b", "profile": "p", "created_at": "2014-09-02T09:00:00Z"}
+
+{"_id": "e2", "type": "geofence_event", "action": "exit", "beacon": "b", "profile": "p", "created_at": "2014-09-02T10:00:00Z"}
+`
+	events, err := ReadGeofenceEvents(strings.NewReader(jsonl))
+	assert.True(t, err == nil)
+	assert.Equals(t, len(events), 2)
+	assert.Equals(t, events[1].Action, ACTION_EXIT)
+
+	_, err = ReadGeofenceEvents(strings.NewReader("{\"_id\": \"e1\"}\nnot json\n"))
+	assert.True(t, err != nil)
+	assert.True(t, strings.Contains(err.Error(), "line 2"))
+
+}
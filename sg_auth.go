@@ -0,0 +1,256 @@
+package officeradar
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// How to authenticate with sync gateway
+const (
+	SG_AUTH_BASIC   = "basic"   // send the username and password with every request
+	SG_AUTH_SESSION = "session" // send a session cookie, logging in with the username and password for one if needed
+
+	SG_SESSION_COOKIE = "SyncGatewaySession"
+)
+
+// The credentials and certificates needed to use a secured sync gateway port,
+// rather than the admin port, eg, as a dedicated service user
+type SyncGatewayAuth struct {
+	Mode      string // basic or session, empty means basic if there's a username
+	Username  string
+	Password  string
+	SessionId string // an existing session to use, eg, one created via the admin api
+	CAFile    string // PEM file with the CA certificate(s) for sync gateway's certificate
+	CertFile  string // PEM files with a client certificate and its key, if sync gateway wants one
+	KeyFile   string
+}
+
+func (a SyncGatewayAuth) mode() string {
+	switch {
+	case a.Mode != "":
+		return a.Mode
+	case a.SessionId != "":
+		return SG_AUTH_SESSION
+	case a.Username != "":
+		return SG_AUTH_BASIC
+	}
+	return ""
+}
+
+// Check that the auth can be used, including loading the certificates
+func (a SyncGatewayAuth) Validate() error {
+	switch a.mode() {
+	case "":
+	case SG_AUTH_BASIC:
+		if a.Username == "" {
+			return fmt.Errorf("basic auth needs a username")
+		}
+	case SG_AUTH_SESSION:
+		if a.SessionId == "" && a.Username == "" {
+			return fmt.Errorf("session auth needs a session id, or a username to log in with")
+		}
+	default:
+		return fmt.Errorf("auth must be %v or %v, not %q", SG_AUTH_BASIC, SG_AUTH_SESSION, a.Mode)
+	}
+	_, err := a.tlsConfig()
+	return err
+}
+
+// The tls config for sync gateway, or nil if the defaults will do
+func (a SyncGatewayAuth) tlsConfig() (*tls.Config, error) {
+
+	if a.CAFile == "" && a.CertFile == "" && a.KeyFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{}
+
+	if a.CAFile != "" {
+		pem, err := ioutil.ReadFile(a.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read CA file: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in CA file: %v", a.CAFile)
+		}
+	}
+
+	if a.CertFile != "" || a.KeyFile != "" {
+		if a.CertFile == "" || a.KeyFile == "" {
+			return nil, fmt.Errorf("A client certificate needs both a cert file and a key file")
+		}
+		cert, err := tls.LoadX509KeyPair(a.CertFile, a.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+
+}
+
+// Authenticates the requests to sync gateway, and passes all other requests
+// (eg, to uniqush) on as they are
+type syncGatewayTransport struct {
+	host        string // only requests to this host are authenticated
+	sessionURL  string
+	auth        SyncGatewayAuth
+	sgTransport http.RoundTripper // with sync gateway's tls config
+	next        http.RoundTripper // for everything else
+	mutex       sync.Mutex
+	sessionId   string
+}
+
+func newSyncGatewayTransport(databaseURL string, auth SyncGatewayAuth, next http.RoundTripper) (*syncGatewayTransport, error) {
+
+	parsed, err := url.Parse(databaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid sync gateway url: %v", err)
+	}
+	parsed.User = nil
+	tlsConfig, err := auth.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	sgTransport := next
+	if tlsConfig != nil {
+		base, ok := next.(*http.Transport)
+		if !ok {
+			return nil, fmt.Errorf("Unable to use sync gateway tls settings with a %T", next)
+		}
+		clone := base.Clone()
+		clone.TLSClientConfig = tlsConfig
+		sgTransport = clone
+	}
+
+	return &syncGatewayTransport{
+		host:        parsed.Host,
+		sessionURL:  strings.TrimRight(parsed.String(), "/") + "/_session",
+		auth:        auth,
+		sgTransport: sgTransport,
+		next:        next,
+		sessionId:   auth.SessionId,
+	}, nil
+
+}
+
+// go-couch makes its requests with the default http client, so this is how it
+// gets to authenticate with sync gateway.  Other requests aren't affected.
+func InstallSyncGatewayAuth(databaseURL string, auth SyncGatewayAuth) error {
+	next := http.DefaultTransport
+	if installed, ok := next.(*syncGatewayTransport); ok {
+		next = installed.next
+	}
+	transport, err := newSyncGatewayTransport(databaseURL, auth, next)
+	if err != nil {
+		return err
+	}
+	http.DefaultTransport = transport
+	return nil
+}
+
+func (t *syncGatewayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	if req.URL.Host != t.host {
+		return t.next.RoundTrip(req)
+	}
+
+	switch t.auth.mode() {
+	case SG_AUTH_BASIC:
+		authenticated := req.Clone(req.Context())
+		authenticated.SetBasicAuth(t.auth.Username, t.auth.Password)
+		return t.sgTransport.RoundTrip(authenticated)
+	case SG_AUTH_SESSION:
+		return t.roundTripWithSession(req)
+	}
+	return t.sgTransport.RoundTrip(req)
+
+}
+
+func (t *syncGatewayTransport) roundTripWithSession(req *http.Request) (*http.Response, error) {
+
+	sessionId, err := t.session("")
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.sgTransport.RoundTrip(withSessionCookie(req, sessionId))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// the session expired, so log in again, as long as the request can be
+	// sent again
+	if t.auth.Username == "" || (req.Body != nil && req.GetBody == nil) {
+		return resp, nil
+	}
+	resp.Body.Close()
+	Log.Info("Sync gateway session expired, logging in again", LogFields{"username": t.auth.Username})
+
+	if sessionId, err = t.session(sessionId); err != nil {
+		return nil, err
+	}
+	retry := withSessionCookie(req, sessionId)
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return t.sgTransport.RoundTrip(retry)
+
+}
+
+func withSessionCookie(req *http.Request, sessionId string) *http.Request {
+	authenticated := req.Clone(req.Context())
+	authenticated.AddCookie(&http.Cookie{Name: SG_SESSION_COOKIE, Value: sessionId})
+	return authenticated
+}
+
+// The current session id, logging in for a new one if there isn't one yet or
+// the current one is the expired one
+func (t *syncGatewayTransport) session(expiredId string) (string, error) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.sessionId != "" && t.sessionId != expiredId {
+		return t.sessionId, nil
+	}
+	if t.auth.Username == "" {
+		return "", fmt.Errorf("Sync gateway session expired, and there's no username to log in with")
+	}
+
+	credentials, _ := json.Marshal(map[string]string{"name": t.auth.Username, "password": t.auth.Password})
+	req, err := http.NewRequest("POST", t.sessionURL, bytes.NewReader(credentials))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.sgTransport.RoundTrip(req)
+	if err != nil {
+		return "", fmt.Errorf("Unable to log in to sync gateway: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Unable to log in to sync gateway as %v: %v", t.auth.Username, resp.Status)
+	}
+
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == SG_SESSION_COOKIE {
+			t.sessionId = cookie.Value
+			return t.sessionId, nil
+		}
+	}
+	return "", fmt.Errorf("Sync gateway didn't return a %v cookie", SG_SESSION_COOKIE)
+
+}
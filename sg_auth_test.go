@@ -0,0 +1,114 @@
+package officeradar
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestSyncGatewayBasicAuth(t *testing.T) {
+
+	var sgAuth, otherAuth string
+	sg := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sgAuth = r.Header.Get("Authorization")
+	}))
+	defer sg.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		otherAuth = r.Header.Get("Authorization")
+	}))
+	defer other.Close()
+
+	auth := SyncGatewayAuth{Username: "officeradar", Password: "secret"}
+	transport, err := newSyncGatewayTransport(sg.URL+"/officeradar", auth, http.DefaultTransport)
+	assert.True(t, err == nil)
+	client := &http.Client{Transport: transport}
+
+	_, err = client.Get(sg.URL + "/officeradar/_changes")
+	assert.True(t, err == nil)
+	assert.True(t, strings.HasPrefix(sgAuth, "Basic "))
+
+	// eg, uniqush doesn't get the sync gateway credentials
+	_, err = client.Get(other.URL + "/push")
+	assert.True(t, err == nil)
+	assert.Equals(t, otherAuth, "")
+
+}
+
+func TestSyncGatewaySessionLogsInAgainWhenExpired(t *testing.T) {
+
+	logins := 0
+	validSession := ""
+	var bodies []string
+	sg := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/officeradar/_session" {
+			logins++
+			validSession = fmt.Sprintf("session%v", logins)
+			http.SetCookie(w, &http.Cookie{Name: SG_SESSION_COOKIE, Value: validSession})
+			return
+		}
+		cookie, err := r.Cookie(SG_SESSION_COOKIE)
+		if err != nil || cookie.Value != validSession {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+	}))
+	defer sg.Close()
+
+	auth := SyncGatewayAuth{Mode: SG_AUTH_SESSION, Username: "officeradar", Password: "secret"}
+	transport, err := newSyncGatewayTransport(sg.URL+"/officeradar", auth, http.DefaultTransport)
+	assert.True(t, err == nil)
+	client := &http.Client{Transport: transport}
+
+	resp, err := client.Post(sg.URL+"/officeradar/doc", "application/json", strings.NewReader("{}"))
+	assert.True(t, err == nil)
+	assert.Equals(t, resp.StatusCode, http.StatusOK)
+	assert.Equals(t, logins, 1)
+
+	// the session expires, so it logs in again and resends the request
+	validSession = "expired"
+	resp, err = client.Post(sg.URL+"/officeradar/doc", "application/json", strings.NewReader(`{"a":1}`))
+	assert.True(t, err == nil)
+	assert.Equals(t, resp.StatusCode, http.StatusOK)
+	assert.Equals(t, logins, 2)
+	assert.DeepEquals(t, bodies, []string{"{}", `{"a":1}`})
+
+}
+
+func TestSyncGatewayCustomCA(t *testing.T) {
+
+	sg := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer sg.Close()
+
+	// without the CA, the self signed certificate isn't trusted
+	transport, err := newSyncGatewayTransport(sg.URL+"/officeradar", SyncGatewayAuth{}, http.DefaultTransport)
+	assert.True(t, err == nil)
+	_, err = (&http.Client{Transport: transport}).Get(sg.URL + "/officeradar/")
+	assert.True(t, err != nil)
+
+	caFile, err := ioutil.TempFile("", "sg_ca")
+	assert.True(t, err == nil)
+	defer os.Remove(caFile.Name())
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: sg.Certificate().Raw})
+	caFile.Close()
+
+	auth := SyncGatewayAuth{CAFile: caFile.Name()}
+	assert.True(t, auth.Validate() == nil)
+	transport, err = newSyncGatewayTransport(sg.URL+"/officeradar", auth, http.DefaultTransport)
+	assert.True(t, err == nil)
+	resp, err := (&http.Client{Transport: transport}).Get(sg.URL + "/officeradar/")
+	assert.True(t, err == nil)
+	assert.Equals(t, resp.StatusCode, http.StatusOK)
+
+	assert.True(t, SyncGatewayAuth{CAFile: "missing.pem"}.Validate() != nil)
+	assert.True(t, SyncGatewayAuth{Mode: "digest", Username: "officeradar"}.Validate() != nil)
+
+}
@@ -0,0 +1,316 @@
+package officeradar
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	SIMULATION_ORGANIZATION = "Simulated Inc"
+	SIMULATION_UUID         = "f7826da6-4fa2-4e98-8024-bc5b71e0893e"
+	BEACONS_PER_OFFICE      = 5
+)
+
+var simulationNames = []string{
+	"Alice", "Bob", "Carol", "Dave", "Erin", "Frank", "Grace", "Heidi",
+	"Ivan", "Judy", "Mallory", "Niaj", "Olivia", "Peggy", "Rupert", "Sybil",
+	"Trent", "Victor", "Walter", "Yolanda",
+}
+
+// Settings for a simulated organization and its day of geofence events
+type SimulationConfig struct {
+	NumUsers        int
+	NumBeacons      int
+	Seed            int64   // the same seed always simulates the same day
+	FlapProbability float64 // chance that an entry or exit flaps, eg, 0.05
+}
+
+// A simulated organization of users spread across offices, each of which has
+// a lobby beacon, desk area beacons and meeting room beacons.  Used to
+// generate realistic traffic for load testing and demos.
+type Simulation struct {
+	Config   SimulationConfig
+	Beacons  []Beacon
+	Profiles []OfficeRadarProfile
+	offices  []simulatedOffice
+	homes    map[string]int // the office index of each profile
+	random   *rand.Rand
+}
+
+type simulatedOffice struct {
+	lobby Beacon
+	desks []Beacon
+	rooms []Beacon
+}
+
+// A stay within range of a beacon
+type simulatedVisit struct {
+	profileId string
+	beaconId  string
+	start     time.Time
+	end       time.Time
+}
+
+func NewSimulation(config SimulationConfig) *Simulation {
+
+	if config.NumUsers < 1 {
+		config.NumUsers = 1
+	}
+	if config.NumBeacons < 1 {
+		config.NumBeacons = 1
+	}
+
+	s := &Simulation{
+		Config: config,
+		homes:  map[string]int{},
+		random: rand.New(rand.NewSource(config.Seed)),
+	}
+	s.createBeacons()
+	s.createProfiles()
+	return s
+
+}
+
+func (s *Simulation) createBeacons() {
+
+	numOffices := (s.Config.NumBeacons + BEACONS_PER_OFFICE - 1) / BEACONS_PER_OFFICE
+	s.offices = make([]simulatedOffice, numOffices)
+
+	for i := 0; i < s.Config.NumBeacons; i++ {
+
+		officeIndex := i / BEACONS_PER_OFFICE
+		office := &s.offices[officeIndex]
+		location := fmt.Sprintf("Office %d", officeIndex+1)
+
+		beacon := Beacon{
+			OfficeRadarDoc: OfficeRadarDoc{Id: fmt.Sprintf("sim_beacon_%d", i), Type: DOC_TYPE_BEACON},
+			Location:       location,
+			Uuid:           SIMULATION_UUID,
+			Major:          officeIndex + 1,
+			Minor:          i + 1,
+			Organization:   SIMULATION_ORGANIZATION,
+		}
+
+		// the first beacon in each office is the lobby, the rest alternate
+		// between desk areas and meeting rooms
+		switch position := i % BEACONS_PER_OFFICE; {
+		case position == 0:
+			beacon.Desc = fmt.Sprintf("%v lobby", location)
+			office.lobby = beacon
+		case position%2 == 1:
+			beacon.Desc = fmt.Sprintf("%v desks %d", location, len(office.desks)+1)
+			office.desks = append(office.desks, beacon)
+		default:
+			beacon.Desc = fmt.Sprintf("%v meeting room %d", location, len(office.rooms)+1)
+			office.rooms = append(office.rooms, beacon)
+		}
+
+		s.Beacons = append(s.Beacons, beacon)
+
+	}
+
+	// small offices make do with what they have
+	for i := range s.offices {
+		office := &s.offices[i]
+		if len(office.desks) == 0 {
+			office.desks = []Beacon{office.lobby}
+		}
+		if len(office.rooms) == 0 {
+			office.rooms = office.desks
+		}
+	}
+
+}
+
+func (s *Simulation) createProfiles() {
+	for i := 0; i < s.Config.NumUsers; i++ {
+		name := simulationNames[i%len(simulationNames)]
+		if i >= len(simulationNames) {
+			name = fmt.Sprintf("%v %d", name, i/len(simulationNames)+1)
+		}
+		profile := OfficeRadarProfile{
+			OfficeRadarDoc: OfficeRadarDoc{Id: fmt.Sprintf("sim_profile_%d", i), Type: DOC_TYPE_PROFILE},
+			Name:           name,
+		}
+		s.homes[profile.Id] = i % len(s.offices)
+		s.Profiles = append(s.Profiles, profile)
+	}
+}
+
+// Simulate a working day starting at the given midnight: everyone commutes
+// in through the lobby, works at a desk, goes to meetings and lunch, and then
+// leaves through the lobby.  Some of the entries and exits flap.  The events
+// are returned in the order they happened.
+func (s *Simulation) Day(midnight time.Time) []GeofenceEvent {
+
+	at := func(hours, minutes int) time.Time {
+		return midnight.Add(time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute)
+	}
+
+	// commutes and lunches first, since meetings have to fit around them.
+	// the time spent outside the office counts as busy.
+	arrivals := map[string]time.Time{}
+	departures := map[string]time.Time{}
+	lobbyTimes := map[string]time.Duration{}
+	busy := map[string][]simulatedVisit{}
+	for _, profile := range s.Profiles {
+		arrival := s.around(at(9, 0), 45*time.Minute, at(7, 30), at(9, 50))
+		departure := s.around(at(17, 30), 60*time.Minute, at(17, 0), at(19, 30))
+		lobbyTime := time.Duration(1+s.random.Intn(3)) * time.Minute
+		lunch := at(12, s.random.Intn(30))
+		arrivals[profile.Id], departures[profile.Id], lobbyTimes[profile.Id] = arrival, departure, lobbyTime
+		busy[profile.Id] = []simulatedVisit{
+			{start: midnight, end: arrival.Add(lobbyTime)},
+			{start: lunch, end: lunch.Add(time.Duration(45+s.random.Intn(15)) * time.Minute)},
+			{start: departure.Add(-lobbyTime), end: at(24, 0)},
+		}
+	}
+
+	visits := []simulatedVisit{}
+
+	// meetings of a few people from the same office, on the hour
+	for _, hour := range []int{10, 11, 13, 14, 15, 16} {
+		for officeIndex, office := range s.offices {
+			attendees := s.available(officeIndex, busy, at(hour, 0), at(hour, 59))
+			for _, room := range office.rooms {
+				if len(attendees) < 2 || s.random.Float64() < 0.5 {
+					break
+				}
+				size := 2 + s.random.Intn(4)
+				if size > len(attendees) {
+					size = len(attendees)
+				}
+				length := time.Duration(30*(1+s.random.Intn(2))) * time.Minute
+				for _, profileId := range attendees[:size] {
+					visit := simulatedVisit{
+						profileId: profileId,
+						beaconId:  room.Id,
+						start:     s.jitter(at(hour, 0), 3*time.Minute),
+						end:       s.jitter(at(hour, 0).Add(length), 3*time.Minute),
+					}
+					visits = append(visits, visit)
+					busy[profileId] = append(busy[profileId], visit)
+				}
+				attendees = attendees[size:]
+			}
+		}
+	}
+
+	// the lobby on the way in and out, and the desk the rest of the time
+	for _, profile := range s.Profiles {
+
+		office := s.offices[s.homes[profile.Id]]
+		desk := office.desks[s.random.Intn(len(office.desks))]
+		arrival, departure, lobbyTime := arrivals[profile.Id], departures[profile.Id], lobbyTimes[profile.Id]
+
+		visits = append(
+			visits,
+			simulatedVisit{profileId: profile.Id, beaconId: office.lobby.Id, start: arrival, end: arrival.Add(lobbyTime)},
+			simulatedVisit{profileId: profile.Id, beaconId: office.lobby.Id, start: departure.Add(-lobbyTime), end: departure},
+		)
+
+		away := busy[profile.Id]
+		sort.Sort(visitsByStart(away))
+		deskStart := away[0].end.Add(time.Minute)
+		for _, awayVisit := range away[1:] {
+			deskEnd := awayVisit.start.Add(-time.Minute)
+			if deskEnd.After(deskStart) {
+				visits = append(visits, simulatedVisit{profileId: profile.Id, beaconId: desk.Id, start: deskStart, end: deskEnd})
+			}
+			deskStart = awayVisit.end.Add(time.Minute)
+		}
+
+	}
+
+	events := []GeofenceEvent{}
+	for _, visit := range visits {
+		events = append(events, s.visitEvents(visit)...)
+	}
+	sort.Stable(eventsByTime(events))
+	for i := range events {
+		events[i].Id = fmt.Sprintf("sim_event_%v_%d", midnight.Format("20060102"), i)
+	}
+	return events
+
+}
+
+// The entry and exit events for a visit, including any flapping at either end
+func (s *Simulation) visitEvents(visit simulatedVisit) []GeofenceEvent {
+
+	event := func(action string, at time.Time) GeofenceEvent {
+		return GeofenceEvent{
+			OfficeRadarDoc: OfficeRadarDoc{Type: DOC_TYPE_GEOFENCE_EVENT},
+			Action:         action,
+			BeaconId:       visit.beaconId,
+			ProfileId:      visit.profileId,
+			CreatedAt:      at.UTC().Format(time.RFC3339),
+		}
+	}
+
+	events := []GeofenceEvent{event(ACTION_ENTRY, visit.start)}
+
+	// on the edge of the region, the phone briefly loses and regains it
+	flaps := func() bool {
+		return s.random.Float64() < s.Config.FlapProbability && visit.end.Sub(visit.start) > 2*time.Minute
+	}
+	if flaps() {
+		lost := visit.start.Add(time.Duration(5+s.random.Intn(20)) * time.Second)
+		events = append(events, event(ACTION_EXIT, lost), event(ACTION_ENTRY, lost.Add(time.Duration(5+s.random.Intn(20))*time.Second)))
+	}
+	if flaps() {
+		lost := visit.end.Add(-time.Duration(30+s.random.Intn(30)) * time.Second)
+		events = append(events, event(ACTION_EXIT, lost), event(ACTION_ENTRY, lost.Add(time.Duration(5+s.random.Intn(20))*time.Second)))
+	}
+
+	return append(events, event(ACTION_EXIT, visit.end))
+
+}
+
+// The profiles of the office that aren't busy during the given time, in a
+// random order
+func (s *Simulation) available(officeIndex int, busy map[string][]simulatedVisit, start, end time.Time) []string {
+	available := []string{}
+	for _, profile := range s.Profiles {
+		if s.homes[profile.Id] != officeIndex {
+			continue
+		}
+		free := true
+		for _, visit := range busy[profile.Id] {
+			if visit.start.Before(end.Add(5*time.Minute)) && visit.end.After(start.Add(-5*time.Minute)) {
+				free = false
+			}
+		}
+		if free {
+			available = append(available, profile.Id)
+		}
+	}
+	for i := range available {
+		j := s.random.Intn(i + 1)
+		available[i], available[j] = available[j], available[i]
+	}
+	return available
+}
+
+// A normally distributed time around the mean, clamped to the given range
+func (s *Simulation) around(mean time.Time, stdDev time.Duration, earliest, latest time.Time) time.Time {
+	t := mean.Add(time.Duration(s.random.NormFloat64() * float64(stdDev))).Truncate(time.Second)
+	if t.Before(earliest) {
+		return earliest
+	}
+	if t.After(latest) {
+		return latest
+	}
+	return t
+}
+
+func (s *Simulation) jitter(t time.Time, max time.Duration) time.Time {
+	return t.Add(time.Duration(s.random.Int63n(int64(2*max))) - max).Truncate(time.Second)
+}
+
+type visitsByStart []simulatedVisit
+
+func (v visitsByStart) Len() int           { return len(v) }
+func (v visitsByStart) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+func (v visitsByStart) Less(i, j int) bool { return v[i].start.Before(v[j].start) }
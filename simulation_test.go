@@ -0,0 +1,63 @@
+package officeradar
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestSimulationDay(t *testing.T) {
+
+	config := SimulationConfig{NumUsers: 25, NumBeacons: 12, Seed: 42, FlapProbability: 0.1}
+	simulation := NewSimulation(config)
+	assert.Equals(t, len(simulation.Profiles), 25)
+	assert.Equals(t, len(simulation.Beacons), 12)
+
+	midnight := time.Date(2014, 9, 2, 0, 0, 0, 0, time.UTC)
+	events := simulation.Day(midnight)
+	assert.True(t, len(events) > 25*6)
+
+	// the same seed always simulates the same day
+	again := NewSimulation(config).Day(midnight)
+	assert.DeepEquals(t, again, events)
+
+	// in order, and each user is in range of at most one beacon at a time,
+	// entering before exiting
+	present := map[string]string{}
+	meetingRooms := map[string]bool{}
+	var previous time.Time
+	for _, geofenceEvent := range events {
+		eventTime, err := geofenceEvent.CreatedAtTime()
+		assert.True(t, err == nil)
+		assert.False(t, eventTime.Before(previous))
+		previous = eventTime
+		assert.True(t, eventTime.After(midnight.Add(7*time.Hour)))
+		assert.True(t, eventTime.Before(midnight.Add(20*time.Hour)))
+
+		switch geofenceEvent.Action {
+		case ACTION_ENTRY:
+			if present[geofenceEvent.ProfileId] != "" {
+				t.Fatalf("%v entered %v while still at %v", geofenceEvent.ProfileId, geofenceEvent.BeaconId, present[geofenceEvent.ProfileId])
+			}
+			present[geofenceEvent.ProfileId] = geofenceEvent.BeaconId
+		case ACTION_EXIT:
+			assert.Equals(t, present[geofenceEvent.ProfileId], geofenceEvent.BeaconId)
+			present[geofenceEvent.ProfileId] = ""
+		}
+
+		for _, beacon := range simulation.Beacons {
+			if beacon.Id == geofenceEvent.BeaconId && beacon.Minor%BEACONS_PER_OFFICE == 3 {
+				meetingRooms[beacon.Id] = true
+			}
+		}
+	}
+
+	// everyone went home, and some meetings happened
+	for profileId, beaconId := range present {
+		assert.Equals(t, beaconId, "")
+		assert.True(t, profileId != "")
+	}
+	assert.True(t, len(meetingRooms) > 0)
+
+}
@@ -0,0 +1,249 @@
+package officeradar
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tleyden/go-couch"
+)
+
+const (
+	DOC_TYPE_ALERT_TIMER = "alert_timer"
+	TIMER_TICK_INTERVAL  = time.Second
+)
+
+// A point in time at which an alert should be evaluated, regardless of
+// whether any geofence events arrive in the meantime.  Timers are saved as
+// docs so that they survive restarts of the app server.
+type AlertTimer struct {
+	OfficeRadarDoc
+	AlertId   string    `json:"alert"`
+	ProfileId string    `json:"profile,omitempty"` // the profile the timer concerns, if any
+	BeaconId  string    `json:"beacon,omitempty"`  // the beacon the timer concerns, if any
+	FireAt    time.Time `json:"fire_at"`
+}
+
+// Alerts that are evaluated when one of their timers comes due, in addition
+// to when geofence events arrive.
+type TimedAlerter interface {
+	Alerter
+
+	// Given a timer belonging to this alert that has come due, return
+	// whether the alert should fire or not.
+	ProcessTimer(timer AlertTimer) (bool, error)
+}
+
+// Alerts that are evaluated on a schedule rather than in response to events,
+// eg, every weekday at 10:30.
+type ScheduledAlerter interface {
+	TimedAlerter
+
+	// Schedule a timer for the next time the alert should be evaluated
+	// after the given time.
+	ScheduleNext(after time.Time) error
+}
+
+func NewAlertTimer(alertId, profileId, beaconId string, fireAt time.Time) *AlertTimer {
+	timer := &AlertTimer{
+		AlertId:   alertId,
+		ProfileId: profileId,
+		BeaconId:  beaconId,
+		FireAt:    fireAt,
+	}
+	timer.Id = alertTimerId(alertId, profileId, beaconId)
+	timer.Type = DOC_TYPE_ALERT_TIMER
+	return timer
+}
+
+// There's at most one timer per alert, profile and beacon, so scheduling
+// the same timer again replaces it rather than adding another one.
+func alertTimerId(alertId, profileId, beaconId string) string {
+	return fmt.Sprintf("%v:%v:%v:%v", DOC_TYPE_ALERT_TIMER, alertId, profileId, beaconId)
+}
+
+// Persists timers
+type TimerStore interface {
+	SaveTimer(timer *AlertTimer) error
+	DeleteTimer(timer *AlertTimer) error
+}
+
+// Keeps track of the pending alert timers, both in memory and in the store
+type TimerScheduler struct {
+	mutex  sync.Mutex
+	store  TimerStore
+	timers map[string]*scheduledTimer
+}
+
+type scheduledTimer struct {
+	timer      *AlertTimer
+	dispatched bool // has been handed out by Due, and is waiting to be taken
+}
+
+func NewTimerScheduler(store TimerStore) *TimerScheduler {
+	return &TimerScheduler{
+		store:  store,
+		timers: map[string]*scheduledTimer{},
+	}
+}
+
+// Schedule a timer, replacing any existing timer with the same id
+func (s *TimerScheduler) Schedule(timer *AlertTimer) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if existing, ok := s.timers[timer.Id]; ok {
+		if existing.timer.FireAt.Equal(timer.FireAt) {
+			return nil
+		}
+		timer.Revision = existing.timer.Revision
+	}
+
+	if err := s.store.SaveTimer(timer); err != nil {
+		return err
+	}
+	s.timers[timer.Id] = &scheduledTimer{timer: timer}
+	return nil
+
+}
+
+// Cancel the timer with the given id, if there is one
+func (s *TimerScheduler) Cancel(timerId string) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	existing, ok := s.timers[timerId]
+	if !ok {
+		return nil
+	}
+	delete(s.timers, timerId)
+	return s.store.DeleteTimer(existing.timer)
+
+}
+
+// Cancel all of the alert's timers, eg, when it's deleted
+func (s *TimerScheduler) CancelAlert(alertId string) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for timerId, scheduled := range s.timers {
+		if scheduled.timer.AlertId != alertId {
+			continue
+		}
+		if err := s.store.DeleteTimer(scheduled.timer); err != nil {
+			return err
+		}
+		delete(s.timers, timerId)
+	}
+	return nil
+
+}
+
+// Add a timer that was previously saved to the store, eg, after a restart
+func (s *TimerScheduler) Restore(timer *AlertTimer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.timers[timer.Id] = &scheduledTimer{timer: timer}
+}
+
+// The timers that are due as of now, earliest first.  Each timer is only
+// returned once, and should be passed to Take when it is about to fire.
+func (s *TimerScheduler) Due(now time.Time) []AlertTimer {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	due := []AlertTimer{}
+	for _, scheduled := range s.timers {
+		if scheduled.dispatched || scheduled.timer.FireAt.After(now) {
+			continue
+		}
+		scheduled.dispatched = true
+		due = append(due, *scheduled.timer)
+	}
+	sort.Sort(timersByFireAt(due))
+	return due
+
+}
+
+// Remove a due timer so that it can fire.  Returns false if the timer was
+// cancelled or rescheduled since it came due, in which case it must not fire.
+func (s *TimerScheduler) Take(timer AlertTimer) bool {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	scheduled, ok := s.timers[timer.Id]
+	if !ok || !scheduled.timer.FireAt.Equal(timer.FireAt) {
+		return false
+	}
+	delete(s.timers, timer.Id)
+	if err := s.store.DeleteTimer(scheduled.timer); err != nil {
+		Log.Error("Unable to delete timer", LogFields{"timer": timer.Id, "error": err})
+	}
+	return true
+
+}
+
+// Does the alert have any pending timers?
+func (s *TimerScheduler) HasTimers(alertId string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, scheduled := range s.timers {
+		if scheduled.timer.AlertId == alertId {
+			return true
+		}
+	}
+	return false
+}
+
+// The number of pending timers
+func (s *TimerScheduler) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.timers)
+}
+
+type timersByFireAt []AlertTimer
+
+func (t timersByFireAt) Len() int           { return len(t) }
+func (t timersByFireAt) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t timersByFireAt) Less(i, j int) bool { return t[i].FireAt.Before(t[j].FireAt) }
+
+// Stores timers as docs in the database
+type couchTimerStore struct {
+	database couch.Database
+}
+
+func NewCouchTimerStore(db couch.Database) TimerStore {
+	return couchTimerStore{database: db}
+}
+
+func (s couchTimerStore) SaveTimer(timer *AlertTimer) error {
+	if timer.Revision == "" {
+		_, rev, err := s.database.Insert(timer)
+		if err != nil {
+			return err
+		}
+		timer.Revision = rev
+		return nil
+	}
+	rev, err := s.database.Edit(timer)
+	if err != nil {
+		return err
+	}
+	timer.Revision = rev
+	return nil
+}
+
+func (s couchTimerStore) DeleteTimer(timer *AlertTimer) error {
+	err := s.database.Delete(timer.Id, timer.Revision)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
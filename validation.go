@@ -0,0 +1,148 @@
+package officeradar
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tleyden/go-couch"
+)
+
+const (
+	DOC_TYPE_GEOFENCE_EVENT_REJECTION = "geofence_event_rejection"
+	DEFAULT_MAX_CLOCK_SKEW            = 5 * time.Minute
+)
+
+// Returns the type of the doc with the given id, or the empty string if
+// there is no such doc.
+type DocTypeFunc func(docId string) (string, error)
+
+// Checks geofence events before they are used to trigger alerts
+type GeofenceEventValidator struct {
+	MaxClockSkew time.Duration // how far in the future an event can be
+	MaxEventAge  time.Duration // how far in the past an event can be, zero means no limit
+	Clock        Clock
+	DocTypeFunc  DocTypeFunc // used to check the referenced beacon and profile
+}
+
+// Written when an event fails validation, so that the mobile client can see
+// why the event was ignored.
+type GeofenceEventRejection struct {
+	OfficeRadarDoc
+	EventId    string    `json:"event"`
+	ProfileId  string    `json:"profile"`
+	Reasons    []string  `json:"reasons"`
+	RejectedAt time.Time `json:"rejected_at"`
+}
+
+func NewGeofenceEventValidator(db couch.Database, clock Clock) *GeofenceEventValidator {
+	return &GeofenceEventValidator{
+		MaxClockSkew: DEFAULT_MAX_CLOCK_SKEW,
+		Clock:        clock,
+		DocTypeFunc: func(docId string) (string, error) {
+			doc := OfficeRadarDoc{}
+			err := db.Retrieve(docId, &doc)
+			if isNotFound(err) {
+				return "", nil
+			}
+			return doc.Type, err
+		},
+	}
+}
+
+// Returns the reasons the event is invalid, or an empty list if it is valid.
+// An error is only returned if the validation itself failed, eg, because
+// the database couldn't be reached.
+func (v GeofenceEventValidator) Validate(e GeofenceEvent) ([]string, error) {
+
+	reasons := []string{}
+
+	switch e.Action {
+	case ACTION_ENTRY, ACTION_EXIT:
+	default:
+		reasons = append(reasons, fmt.Sprintf("invalid action: %q, expected %q or %q", e.Action, ACTION_ENTRY, ACTION_EXIT))
+	}
+
+	reasons = append(reasons, v.validateCreatedAt(e)...)
+
+	beaconReasons, err := v.validateReference("beacon", e.BeaconId, DOC_TYPE_BEACON)
+	if err != nil {
+		return nil, err
+	}
+	reasons = append(reasons, beaconReasons...)
+
+	profileReasons, err := v.validateReference("profile", e.ProfileId, DOC_TYPE_PROFILE)
+	if err != nil {
+		return nil, err
+	}
+	reasons = append(reasons, profileReasons...)
+
+	return reasons, nil
+
+}
+
+func (v GeofenceEventValidator) validateCreatedAt(e GeofenceEvent) []string {
+
+	if e.CreatedAt == "" {
+		return []string{"missing created_at"}
+	}
+
+	createdAt, err := e.CreatedAtTime()
+	if err != nil {
+		return []string{fmt.Sprintf("invalid created_at: %q is not an RFC3339 timestamp", e.CreatedAt)}
+	}
+
+	now := v.Clock.Now()
+	if createdAt.After(now.Add(v.MaxClockSkew)) {
+		return []string{fmt.Sprintf("created_at %v is more than %v in the future", e.CreatedAt, v.MaxClockSkew)}
+	}
+	if v.MaxEventAge > 0 && createdAt.Before(now.Add(-v.MaxEventAge)) {
+		return []string{fmt.Sprintf("created_at %v is more than %v in the past", e.CreatedAt, v.MaxEventAge)}
+	}
+	return []string{}
+
+}
+
+func (v GeofenceEventValidator) validateReference(field, docId, expectedType string) ([]string, error) {
+
+	if docId == "" {
+		return []string{fmt.Sprintf("missing %v", field)}, nil
+	}
+
+	docType, err := v.DocTypeFunc(docId)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to look up %v %v: %v", field, docId, err)
+	}
+
+	switch docType {
+	case "":
+		return []string{fmt.Sprintf("%v %v does not exist", field, docId)}, nil
+	case expectedType:
+		return []string{}, nil
+	}
+	return []string{fmt.Sprintf("%v %v is a %v, not a %v", field, docId, docType, expectedType)}, nil
+
+}
+
+func NewGeofenceEventRejection(e GeofenceEvent, reasons []string, rejectedAt time.Time) *GeofenceEventRejection {
+	rejection := &GeofenceEventRejection{
+		EventId:    e.Id,
+		ProfileId:  e.ProfileId,
+		Reasons:    reasons,
+		RejectedAt: rejectedAt,
+	}
+	// one rejection per event, so reprocessing an event doesn't pile them up
+	rejection.Id = fmt.Sprintf("%v:%v", DOC_TYPE_GEOFENCE_EVENT_REJECTION, e.Id)
+	rejection.Type = DOC_TYPE_GEOFENCE_EVENT_REJECTION
+	return rejection
+}
+
+// Save the rejection, unless one was already saved for this event
+func (r *GeofenceEventRejection) Save(db couch.Database) error {
+	_, _, err := db.Insert(r)
+	if err != nil && strings.Contains(err.Error(), "409") {
+		Log.Debug("Rejection for event already exists", LogFields{"event": r.EventId})
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+package officeradar
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func newTestValidator(now time.Time) *GeofenceEventValidator {
+	docTypes := map[string]string{
+		"beacon1": DOC_TYPE_BEACON,
+		"foo":     DOC_TYPE_PROFILE,
+	}
+	return &GeofenceEventValidator{
+		MaxClockSkew: DEFAULT_MAX_CLOCK_SKEW,
+		MaxEventAge:  24 * time.Hour,
+		Clock:        NewManualClock(now),
+		DocTypeFunc: func(docId string) (string, error) {
+			if docId == "unreachable" {
+				return "", fmt.Errorf("connection refused")
+			}
+			return docTypes[docId], nil
+		},
+	}
+}
+
+func TestValidateGeofenceEvent(t *testing.T) {
+
+	now := time.Date(2014, 9, 2, 9, 0, 0, 0, time.UTC)
+	validator := newTestValidator(now)
+
+	valid := GeofenceEvent{
+		Action:    ACTION_ENTRY,
+		BeaconId:  "beacon1",
+		ProfileId: "foo",
+		CreatedAt: now.Add(-time.Minute).Format(time.RFC3339),
+	}
+
+	tests := []struct {
+		name   string
+		modify func(e *GeofenceEvent)
+		reason string // substring of the expected reason, empty if valid
+	}{
+		{"valid", func(e *GeofenceEvent) {}, ""},
+		{"exit", func(e *GeofenceEvent) { e.Action = ACTION_EXIT }, ""},
+		{"bad action", func(e *GeofenceEvent) { e.Action = "entered" }, "invalid action"},
+		{"missing created_at", func(e *GeofenceEvent) { e.CreatedAt = "" }, "missing created_at"},
+		{"bad created_at", func(e *GeofenceEvent) { e.CreatedAt = "yesterday" }, "not an RFC3339"},
+		{"small skew", func(e *GeofenceEvent) { e.CreatedAt = now.Add(time.Minute).Format(time.RFC3339) }, ""},
+		{"future", func(e *GeofenceEvent) { e.CreatedAt = now.Add(time.Hour).Format(time.RFC3339) }, "in the future"},
+		{"too old", func(e *GeofenceEvent) { e.CreatedAt = now.Add(-48 * time.Hour).Format(time.RFC3339) }, "in the past"},
+		{"missing beacon", func(e *GeofenceEvent) { e.BeaconId = "" }, "missing beacon"},
+		{"unknown beacon", func(e *GeofenceEvent) { e.BeaconId = "beacon2" }, "beacon beacon2 does not exist"},
+		{"beacon is a profile", func(e *GeofenceEvent) { e.BeaconId = "foo" }, "not a beacon"},
+		{"unknown profile", func(e *GeofenceEvent) { e.ProfileId = "bar" }, "profile bar does not exist"},
+	}
+
+	for _, test := range tests {
+		e := valid
+		test.modify(&e)
+		reasons, err := validator.Validate(e)
+		assert.True(t, err == nil)
+		if test.reason == "" {
+			assert.Equals(t, len(reasons), 0)
+			continue
+		}
+		if len(reasons) != 1 || !strings.Contains(reasons[0], test.reason) {
+			t.Errorf("%v: expected reason containing %q, got %v", test.name, test.reason, reasons)
+		}
+	}
+
+	// lookup failures are errors, not rejections
+	e := valid
+	e.ProfileId = "unreachable"
+	_, err := validator.Validate(e)
+	assert.True(t, err != nil)
+
+}
+
+func TestGeofenceEventRejection(t *testing.T) {
+
+	e := GeofenceEvent{ProfileId: "foo"}
+	e.Id = "event1"
+	rejection := NewGeofenceEventRejection(e, []string{"missing beacon"}, time.Now())
+	assert.Equals(t, rejection.Id, "geofence_event_rejection:event1")
+	assert.Equals(t, rejection.Type, DOC_TYPE_GEOFENCE_EVENT_REJECTION)
+	assert.Equals(t, rejection.ProfileId, "foo")
+
+}